@@ -28,7 +28,8 @@ def emit_go_asm_action(ctx, source, hdrs, out_obj):
   includes += [f.dirname for f in hdrs]
   includes += [f.dirname for f in go_toolchain.headers.cc.transitive_headers]
   inputs = hdrs + list(go_toolchain.headers.cc.transitive_headers) + go_toolchain.tools + [source]
-  asm_args = [go_toolchain.go.path, source.path, "--", "-o", out_obj.path]
+  asm_args = [go_toolchain.go.path] + go_toolchain.subarch_args
+  asm_args += [source.path, "--", "-o", out_obj.path]
   for inc in includes:
     asm_args += ["-I", inc]
   ctx.action(
@@ -12,7 +12,7 @@
 # See the License for the specific language governing permissions and
 # limitations under the License.
 
-load("@io_bazel_rules_go//go/private:common.bzl", "get_go_toolchain", "go_filetype")
+load("@io_bazel_rules_go//go/private:common.bzl", "get_go_toolchain", "emit_sdk_files_action", "emit_builder_params_action", "worker_execution_requirements", "go_filetype")
 load("@io_bazel_rules_go//go/private:library.bzl", "emit_library_actions")
 
 def _go_binary_impl(ctx):
@@ -23,6 +23,10 @@ def _go_binary_impl(ctx):
       cgo_object = None,
       library = ctx.attr.library,
   )
+  # A JSON record of the -X definitions, archives, and flags used to link
+  # the binary. It is only built when the link_manifest output group is
+  # requested.
+  link_manifest = ctx.new_file(ctx.label.name + ".link.json")
   emit_go_link_action(
     ctx,
     transitive_go_libraries=lib_result.transitive_go_libraries,
@@ -31,12 +35,14 @@ def _go_binary_impl(ctx):
     libs=lib_result.files,
     executable=ctx.outputs.executable,
     gc_linkopts=gc_linkopts(ctx),
-    x_defs=ctx.attr.x_defs)
+    x_defs=ctx.attr.x_defs,
+    link_manifest=link_manifest)
 
   return struct(
       files = depset([ctx.outputs.executable]),
       runfiles = lib_result.runfiles,
       cgo_object = lib_result.cgo_object,
+      output_groups = {"link_manifest": depset([link_manifest])},
   )
 
 go_binary = rule(
@@ -66,6 +72,10 @@ go_binary = rule(
         ),
         "gc_goopts": attr.string_list(),
         "gc_linkopts": attr.string_list(),
+        "duplicate_symbols": attr.string(
+            default = "explain",
+            values = ["explain", "allow"],
+        ),
         "linkstamp": attr.string(),
         "x_defs": attr.string_dict(),
         #TODO(toolchains): Remove _toolchain attribute when real toolchains arrive
@@ -133,20 +143,32 @@ def _extract_extldflags(gc_linkopts, extldflags):
   return filtered_gc_linkopts, extldflags
 
 def emit_go_link_action(ctx, transitive_go_library_paths, transitive_go_libraries, cgo_deps, libs,
-                         executable, gc_linkopts, x_defs):
-  """Sets up a symlink tree to libraries to link together."""
+                         executable, gc_linkopts, x_defs, link_manifest=None):
+  """Sets up a symlink tree to libraries to link together.
+
+  If link_manifest is given, a separate action runs the link wrapper to
+  write a JSON file there listing the -X definitions, archives with their
+  hashes, build mode, and linker flags used to produce the executable. The
+  link itself does no extra work, and the manifest is only computed when
+  it's requested.
+  """
   go_toolchain = get_go_toolchain(ctx)
   config_strip = len(ctx.configuration.bin_dir.path) + 1
   pkg_depth = executable.dirname[config_strip:].count('/') + 1
 
   ld = "%s" % ctx.fragments.cpp.compiler_executable
-  extldflags = c_linker_options(ctx) + [
-      "-Wl,-rpath,$ORIGIN/" + ("../" * pkg_depth),
+  extldflags = c_linker_options(ctx)
+  # The link wrapper computes platform-specific search paths for shared
+  # libraries: the output root, and the directories of shared cgo_deps, both
+  # in the output tree and in the runfiles tree.
+  rpath_args = [
+      "-rpath_depth", str(pkg_depth),
+      "-workspace", ctx.workspace_name,
   ]
   for d in cgo_deps:
-    if d.basename.endswith('.so'):
+    if d.basename.endswith('.so') or d.basename.endswith('.dylib'):
       short_dir = d.dirname[len(d.root.path):]
-      extldflags += ["-Wl,-rpath,$ORIGIN/" + ("../" * pkg_depth) + short_dir]
+      rpath_args += ["-rpath", short_dir]
 
   gc_linkopts, extldflags = _extract_extldflags(gc_linkopts, extldflags)
 
@@ -173,7 +195,13 @@ def emit_go_link_action(ctx, transitive_go_library_paths, transitive_go_librarie
       "-extldflags", " ".join(extldflags),
   ] + [lib.path for lib in libs]
 
-  link_args = [go_toolchain.go.path]
+  sdk_args, sdk_inputs = emit_sdk_files_action(ctx, go_toolchain, executable)
+  link_args = [go_toolchain.go.path] + rpath_args + sdk_args + go_toolchain.subarch_args
+  # Duplicate symbol support: the link wrapper names the targets that
+  # produced conflicting cgo dependencies when the external linker fails.
+  link_args += ["-duplicate_symbols", ctx.attr.duplicate_symbols]
+  for d in cgo_deps:
+    link_args += ["-archive_label", "%s=%s" % (d.path, d.owner)]
   # Stamping support
   stamp_inputs = []
   if stamp_x_defs or ctx.attr.linkstamp:
@@ -188,14 +216,33 @@ def emit_go_link_action(ctx, transitive_go_library_paths, transitive_go_librarie
     if ctx.attr.linkstamp:
       link_args += ["-linkstamp", ctx.attr.linkstamp]
 
-  link_args += ["--"] + link_opts
+  inputs = list(transitive_go_libraries + [lib] + cgo_deps +
+                sdk_inputs + go_toolchain.crosstool + stamp_inputs)
+  params = emit_builder_params_action(ctx, executable, link_args + ["--"] + link_opts)
 
   ctx.action(
-      inputs = list(transitive_go_libraries + [lib] + cgo_deps +
-                go_toolchain.tools + go_toolchain.crosstool + stamp_inputs),
+      inputs = inputs + [params],
       outputs = [executable],
       mnemonic = "GoLink",
       executable = go_toolchain.link,
-      arguments = link_args,
+      arguments = ["@" + params.path],
       env = go_toolchain.env,
-  )
\ No newline at end of file
+      execution_requirements = worker_execution_requirements,
+  )
+
+  # Link manifest support: with -manifest, the link wrapper computes the
+  # -X definitions and hashes the archives, but doesn't run the linker.
+  if link_manifest:
+    manifest_args = link_args + ["-manifest", link_manifest.path]
+    for a in list(libs) + list(transitive_go_libraries) + list(cgo_deps):
+      manifest_args += ["-manifest_archive", a.path]
+    manifest_params = emit_builder_params_action(ctx, link_manifest, manifest_args + ["--"] + link_opts)
+    ctx.action(
+        inputs = inputs + [manifest_params],
+        outputs = [link_manifest],
+        mnemonic = "GoLinkManifest",
+        executable = go_toolchain.link,
+        arguments = ["@" + manifest_params.path],
+        env = go_toolchain.env,
+        execution_requirements = worker_execution_requirements,
+    )
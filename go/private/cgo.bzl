@@ -22,6 +22,7 @@ def _cgo_genrule_impl(ctx):
     go_sources = ctx.files.srcs,
     asm_sources = [],
     asm_headers = [],
+    syso_sources = [],
     cgo_object = ctx.attr.cgo_object,
     direct_deps = ctx.attr.deps,
     gc_goopts = [],
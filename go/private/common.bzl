@@ -21,6 +21,7 @@ go_filetype = FileType([
     ".s",
     ".S",
     ".h",  # may be included by .s
+    ".syso",  # prebuilt objects packed into the archive
 ])
 
 # be consistent to cc_library.
@@ -53,6 +54,55 @@ cgo_filetype = FileType([
 def get_go_toolchain(ctx):
     return ctx.attr._go_toolchain #TODO(toolchains): ctx.toolchains[go_toolchain_type]
 
+def emit_sdk_files_action(ctx, go_toolchain, out):
+  """Writes a list of the Go SDK files used by the compile and link builders.
+
+  The builders assemble a GOROOT out of the listed files, so the actions
+  don't depend on the layout of the SDK outside of their declared inputs.
+
+  Args:
+    ctx: The skylark Context.
+    go_toolchain: The Go toolchain that provides the SDK.
+    out: The output of the action. The list is written next to it.
+
+  Returns:
+    A tuple of the builder arguments and the SDK files (including the list)
+    that must be declared as inputs.
+  """
+  sdk_files = depset([go_toolchain.go]) + go_toolchain.tools + go_toolchain.stdlib
+  sdk_list = ctx.new_file(out, out.basename + ".sdk_files")
+  ctx.file_action(
+      output = sdk_list,
+      content = "\n".join([f.path for f in sdk_files]) + "\n",
+  )
+  sdk_root = go_toolchain.go.dirname.rpartition("/")[0]
+  args = ["-sdk_root", sdk_root, "-sdk_files", sdk_list.path]
+  return args, list(sdk_files) + [sdk_list]
+
+# Execution requirements for actions run by builders that support Bazel's
+# persistent worker protocol. Workers are only used when requested, for
+# example, with --strategy=GoCompile=worker.
+worker_execution_requirements = {"supports-workers": "1"}
+
+def emit_builder_params_action(ctx, out, args):
+  """Writes the arguments of a builder action to a params file.
+
+  Persistent workers receive their arguments from a params file named by
+  the last argument of the action, so builders that support workers are
+  invoked with "@" and the path of the file written here.
+
+  Args:
+    ctx: The skylark Context.
+    out: The output of the action. The params file is written next to it.
+    args: The arguments to write, one per line.
+
+  Returns:
+    The params file, which must be declared as an input.
+  """
+  params = ctx.new_file(out, out.basename + ".params")
+  ctx.file_action(output = params, content = "\n".join(args) + "\n")
+  return params
+
 def emit_generate_params_action(cmds, ctx, fn):
   cmds_all = [
       # Use bash explicitly. /bin/sh is default, and it may be linked to a
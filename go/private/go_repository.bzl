@@ -73,6 +73,8 @@ def _go_repository_impl(ctx):
             "--build_tags", ",".join(ctx.attr.build_tags)]
     if ctx.attr.build_file_name:
         cmds += ["--build_file_name", ctx.attr.build_file_name]
+    if ctx.attr.testonly:
+        cmds += ["--testonly"]
     cmds += [ctx.path('')]
     result = env_execute(ctx, cmds)
     if result.return_code:
@@ -102,6 +104,9 @@ go_repository = repository_rule(
         # Attributes for a repository that needs automatic build file generation
         "build_file_name": attr.string(default="BUILD.bazel,BUILD"),
         "build_file_generation": attr.string(default="auto", values=["on", "auto", "off"]),
+        # Marks generated rules other than tests testonly. Use this for
+        # repositories that are only needed by tests.
+        "testonly": attr.bool(default=False),
 
         # Hidden attributes for tool dependancies
         "_fetch_repo": attr.label(
@@ -48,6 +48,12 @@ def constraint_value(name, setting):
 go_toolchain_type = toolchain_type()
 
 def _go_toolchain_impl(ctx):
+  # Architecture variants are passed to the builders as flags, so they
+  # don't depend on GOARM and similar variables in the host environment.
+  subarch_args = []
+  for flag, value in [("-goarm", ctx.attr.goarm), ("-gomips", ctx.attr.gomips), ("-go386", ctx.attr.go386)]:
+    if value:
+      subarch_args += [flag, value]
   return go_toolchain_type(
       exec_compatible_with = ctx.attr.exec_compatible_with,
       target_compatible_with = ctx.attr.target_compatible_with,
@@ -68,6 +74,7 @@ def _go_toolchain_impl(ctx):
       extract_package = ctx.executable.extract_package,
       link_flags = ctx.attr.link_flags,
       cgo_link_flags = ctx.attr.cgo_link_flags,
+      subarch_args = subarch_args,
       crosstool = ctx.files.crosstool,
   )
 
@@ -85,6 +92,9 @@ go_toolchain_attrs = go_toolchain_core_attrs + {
     "is_cross": attr.bool(),
     "goos": attr.string(),
     "goarch": attr.string(),
+    "goarm": attr.string(values = ["", "5", "6", "7"]),
+    "gomips": attr.string(values = ["", "hardfloat", "softfloat"]),
+    "go386": attr.string(values = ["", "387", "sse2"]),
     "filter_tags": attr.label(allow_files = True, single_file = True, executable = True, cfg = "host", default=Label("//go/tools/builders:filter_tags")),
     "asm": attr.label(allow_files = True, single_file = True, executable = True, cfg = "host", default=Label("//go/tools/builders:asm")),
     "compile": attr.label(allow_files = True, single_file = True, executable = True, cfg = "host", default=Label("//go/tools/builders:compile")),
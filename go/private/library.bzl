@@ -12,7 +12,7 @@
 # See the License for the specific language governing permissions and
 # limitations under the License.
 
-load("@io_bazel_rules_go//go/private:common.bzl", "get_go_toolchain", "DEFAULT_LIB", "VENDOR_PREFIX", "go_filetype")
+load("@io_bazel_rules_go//go/private:common.bzl", "get_go_toolchain", "emit_sdk_files_action", "emit_builder_params_action", "worker_execution_requirements", "DEFAULT_LIB", "VENDOR_PREFIX", "go_filetype")
 load("@io_bazel_rules_go//go/private:asm.bzl", "emit_go_asm_action")
 
 def emit_library_actions(ctx, sources, deps, cgo_object, library):
@@ -21,12 +21,14 @@ def emit_library_actions(ctx, sources, deps, cgo_object, library):
   go_srcs = depset([s for s in sources if s.basename.endswith('.go')])
   asm_srcs = [s for s in sources if s.basename.endswith('.s') or s.basename.endswith('.S')]
   asm_hdrs = [s for s in sources if s.basename.endswith('.h')]
+  syso_srcs = [s for s in sources if s.basename.endswith('.syso')]
   dep_runfiles = [d.data_runfiles for d in deps]
 
   if library:
     go_srcs += library.go_sources
     asm_srcs += library.asm_sources
     asm_hdrs += library.asm_headers
+    syso_srcs += library.syso_sources
     deps += library.direct_deps
     dep_runfiles += [library.data_runfiles]
     if library.cgo_object:
@@ -48,6 +50,7 @@ def emit_library_actions(ctx, sources, deps, cgo_object, library):
     obj = ctx.new_file(src, "%s.dir/%s.o" % (ctx.label.name, src.basename[:-2]))
     emit_go_asm_action(ctx, src, asm_hdrs, obj)
     extra_objects += [obj]
+  extra_objects += syso_srcs
 
   lib_name = go_importpath(ctx) + ".a"
   out_lib = ctx.new_file(lib_name)
@@ -85,6 +88,7 @@ def emit_library_actions(ctx, sources, deps, cgo_object, library):
     go_sources = go_srcs,
     asm_sources = asm_srcs,
     asm_headers = asm_hdrs,
+    syso_sources = syso_srcs,
     cgo_object = cgo_object,
     transitive_cgo_deps = transitive_cgo_deps,
     transitive_go_libraries = transitive_go_library_deps + [out_lib],
@@ -111,6 +115,7 @@ def _go_library_impl(ctx):
     go_sources = lib_result.go_sources,
     asm_sources = lib_result.asm_sources,
     asm_headers = lib_result.asm_headers,
+    syso_sources = lib_result.syso_sources,
     cgo_object = lib_result.cgo_object,
     direct_deps = ctx.attr.deps,
     transitive_cgo_deps = lib_result.transitive_cgo_deps,
@@ -186,6 +191,11 @@ def get_gc_goopts(ctx):
     gc_goopts += ctx.attr.library.gc_goopts
   return gc_goopts
 
+def get_gotags(ctx):
+  """Returns the build tags used to filter sources, from the gotags attribute
+  of rules that have one."""
+  return getattr(ctx.attr, "gotags", [])
+
 def emit_go_compile_action(ctx, sources, libs, libpaths, out_object, gc_goopts):
   """Construct the command line for compiling Go code.
 
@@ -201,21 +211,28 @@ def emit_go_compile_action(ctx, sources, libs, libpaths, out_object, gc_goopts):
   if ctx.coverage_instrumented():
     sources = _emit_go_cover_action(ctx, sources)
   gc_goopts = [ctx.expand_make_variables("gc_goopts", f, {}) for f in gc_goopts]
-  inputs = depset([go_toolchain.go]) + sources + libs
+  sdk_args, sdk_inputs = emit_sdk_files_action(ctx, go_toolchain, out_object)
+  inputs = depset(sdk_inputs) + sources + libs
   go_sources = [s.path for s in sources if not s.basename.startswith("_cgo")]
   cgo_sources = [s.path for s in sources if s.basename.startswith("_cgo")]
-  args = [go_toolchain.go.path] + go_sources + ["--"]
+  args = [go_toolchain.go.path] + sdk_args + go_toolchain.subarch_args
+  gotags = get_gotags(ctx)
+  if gotags:
+    args += ["-tags", ",".join(gotags)]
+  args += go_sources + ["--"]
   args += ["-o", out_object.path, "-trimpath", ".", "-I", "."]
   for path in libpaths:
     args += ["-I", path]
   args += gc_goopts + cgo_sources
+  params = emit_builder_params_action(ctx, out_object, args)
   ctx.action(
-      inputs = list(inputs),
+      inputs = list(inputs) + [params],
       outputs = [out_object],
       mnemonic = "GoCompile",
       executable = go_toolchain.compile,
-      arguments = args,
+      arguments = ["@" + params.path],
       env = go_toolchain.env,
+      execution_requirements = worker_execution_requirements,
   )
 
   return sources
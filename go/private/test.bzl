@@ -13,7 +13,7 @@
 # limitations under the License.
 
 load("@io_bazel_rules_go//go/private:common.bzl", "get_go_toolchain", "go_filetype")
-load("@io_bazel_rules_go//go/private:library.bzl", "emit_library_actions", "go_importpath", "emit_go_compile_action", "get_gc_goopts", "emit_go_pack_action")
+load("@io_bazel_rules_go//go/private:library.bzl", "emit_library_actions", "go_importpath", "emit_go_compile_action", "get_gc_goopts", "get_gotags", "emit_go_pack_action")
 load("@io_bazel_rules_go//go/private:binary.bzl", "emit_go_link_action", "gc_linkopts")
 
 def _go_test_impl(ctx):
@@ -34,6 +34,22 @@ def _go_test_impl(ctx):
   main_lib = ctx.new_file(ctx.label.name + "_main_test.a")
   go_import = go_importpath(ctx)
 
+  profile_args = []
+  if ctx.attr.profiles:
+    profile_args = ['--profile', ",".join(ctx.attr.profiles)]
+  tag_args = []
+  gotags = get_gotags(ctx)
+  if gotags:
+    tag_args = ['--tags', ",".join(gotags)]
+  test_flag_args = []
+  short = ctx.attr.short
+  if short == "auto":
+    short = "true" if ctx.attr.size == "small" else ""
+  if short:
+    test_flag_args += ['--short', short]
+  if ctx.attr.test_timeout:
+    test_flag_args += ['--timeout', ctx.attr.test_timeout]
+
   ctx.action(
       inputs = list(lib_result.go_sources),
       outputs = [main_go],
@@ -44,7 +60,7 @@ def _go_test_impl(ctx):
           go_import,
           '--output',
           main_go.path,
-      ] + [src.path for src in lib_result.go_sources],
+      ] + profile_args + tag_args + test_flag_args + [src.path for src in lib_result.go_sources],
       env = dict(go_toolchain.env, RUNDIR=ctx.label.package)
   )
 
@@ -104,7 +120,18 @@ go_test = rule(
         ),
         "gc_goopts": attr.string_list(),
         "gc_linkopts": attr.string_list(),
+        "duplicate_symbols": attr.string(
+            default = "explain",
+            values = ["explain", "allow"],
+        ),
+        "gotags": attr.string_list(),
         "linkstamp": attr.string(),
+        "profiles": attr.string_list(),
+        "short": attr.string(
+            default = "auto",
+            values = ["auto", "true", "false"],
+        ),
+        "test_timeout": attr.string(),
         "x_defs": attr.string_dict(),
         #TODO(toolchains): Remove _toolchain attribute when real toolchains arrive
         "_go_toolchain": attr.label(default = Label("@io_bazel_rules_go_toolchain//:go_toolchain")),
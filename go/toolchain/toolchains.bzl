@@ -180,6 +180,10 @@ def generate_toolchains():
       toolchain["cgo_link_flags"] += ["-shared", "-Wl,-all_load"]
     if toolchain["goos"] == os_linux.goos:
       toolchain["cgo_link_flags"] += ["-Wl,-whole-archive"]
+    if toolchain["goarch"] == arch_arm.goarch:
+      # The go command defaults to GOARM=7 when cross compiling but detects
+      # the host's version otherwise. Set it so builds don't depend on the host.
+      toolchain["goarm"] = "7"
 
   # Use the final dictionaries to actually generate all the toolchains
   for toolchain in toolchains:
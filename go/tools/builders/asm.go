@@ -17,6 +17,7 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"go/build"
 	"log"
@@ -26,11 +27,21 @@ import (
 
 func run(args []string) error {
 	// process the args
-	if len(args) < 3 || args[2] != "--" {
-		return fmt.Errorf("Usage: asm gotool source.s -- <extra options>")
+	usage := fmt.Errorf("Usage: asm gotool [asm flags] source.s -- <extra options>")
+	if len(args) < 1 {
+		return usage
 	}
 	gotool := args[0]
-	source := args[1]
+	flags := flag.NewFlagSet("asm", flag.ExitOnError)
+	subarch := registerSubarchFlags(flags)
+	if err := flags.Parse(args[1:]); err != nil {
+		return err
+	}
+	args = flags.Args()
+	if len(args) < 2 || args[1] != "--" {
+		return usage
+	}
+	source := args[0]
 	// filter our input file list
 	bctx := build.Default
 	bctx.CgoEnabled = true
@@ -42,9 +53,14 @@ func run(args []string) error {
 		source = os.DevNull
 	}
 	goargs := []string{"tool", "asm"}
-	goargs = append(goargs, args[3:]...)
+	goargs = append(goargs, args[2:]...)
 	goargs = append(goargs, source)
+	env, err := subarch.env(bctx.GOARCH, os.Environ())
+	if err != nil {
+		return err
+	}
 	cmd := exec.Command(gotool, goargs...)
+	cmd.Env = env
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
 	if err := cmd.Run(); err != nil {
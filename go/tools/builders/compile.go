@@ -17,25 +17,43 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"go/build"
+	"io"
 	"log"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strings"
 )
 
-func run(args []string) error {
+func run(args []string, stdout, stderr io.Writer) error {
 	// process the args
 	if len(args) < 2 {
-		return fmt.Errorf("Usage: compile gotool [sources] -- <extra options>")
+		return fmt.Errorf("Usage: compile gotool [compile flags] [sources] -- <extra options>")
 	}
 	gotool := args[0]
 	args = args[1:]
+	// Errors are returned rather than exiting, so that a persistent worker
+	// can report them in a work response.
+	flags := flag.NewFlagSet("compile", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	sdkRoot := flags.String("sdk_root", "", "The directory containing the files listed in -sdk_files.")
+	sdkFiles := flags.String("sdk_files", "", "A file listing the Go SDK files needed by the compiler, one per line.")
+	tags := flags.String("tags", "", "Comma-separated list of build tags to satisfy when filtering sources.")
+	subarch := registerSubarchFlags(flags)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	args = flags.Args()
 	sources := []string{}
 	goopts := []string{}
 	bctx := build.Default
 	bctx.CgoEnabled = true
+	if *tags != "" {
+		bctx.BuildTags = strings.Split(*tags, ",")
+	}
 	for i, s := range args {
 		if s == "--" {
 			goopts = args[i+1:]
@@ -70,11 +88,25 @@ func run(args []string) error {
 		}
 	}
 
+	goroot, gotool, cleanup, err := hermeticGoroot(*sdkRoot, *sdkFiles, gotool)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
 	goargs := append([]string{"tool", "compile"}, goopts...)
 	goargs = append(goargs, sources...)
+	env, err := subarch.env(bctx.GOARCH, os.Environ())
+	if err != nil {
+		return err
+	}
+	if goroot != "" {
+		env = setEnv(env, "GOROOT", goroot)
+	}
 	cmd := exec.Command(gotool, goargs...)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
+	cmd.Env = env
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
 	if err := cmd.Run(); err != nil {
 		return fmt.Errorf("error running compiler: %v", err)
 	}
@@ -82,7 +114,7 @@ func run(args []string) error {
 }
 
 func main() {
-	if err := run(os.Args[1:]); err != nil {
+	if err := builderMain(os.Args[1:], run); err != nil {
 		log.Fatal(err)
 	}
 }
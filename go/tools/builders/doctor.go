@@ -0,0 +1,221 @@
+// Copyright 2017 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// doctor checks that a Go SDK and C toolchain can build programs the way
+// the other builders do. It compiles, links, and runs a small program with
+// the plain toolchain, with cgo, and in race mode, and reports which step
+// failed. It is meant to be run by hand when toolchain setup is in doubt.
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+const helloGo = `package main
+
+func main() {
+	println("hello from go")
+}
+`
+
+const helloCgo = `package main
+
+/*
+#include <stdio.h>
+
+static void hello() {
+	printf("hello from cgo\n");
+	fflush(stdout);
+}
+*/
+import "C"
+
+func main() {
+	C.hello()
+}
+`
+
+const helloC = `int hello(void) { return 0; }
+`
+
+// doctor holds the configuration shared by all checks.
+type doctor struct {
+	gotool, goroot, cc, dir string
+	stdout                  io.Writer
+}
+
+// step is one command in a check. If want is not empty, the command's
+// combined output must contain it.
+type step struct {
+	name string
+	cmd  *exec.Cmd
+	want string
+}
+
+func run(args []string, stdout, stderr io.Writer) error {
+	if len(args) < 1 {
+		return fmt.Errorf("Usage: doctor gotool [-cc compiler] [-cgo=false] [-race=false]")
+	}
+	gotool := args[0]
+	args = args[1:]
+	flags := flag.NewFlagSet("doctor", flag.ExitOnError)
+	cc := flags.String("cc", "", "The C compiler to check. Defaults to $CC, or cc.")
+	cgo := flags.Bool("cgo", true, "Whether to check building with cgo.")
+	race := flags.Bool("race", true, "Whether to check building in race mode.")
+	sdkRoot := flags.String("sdk_root", "", "The directory containing the files listed in -sdk_files.")
+	sdkFiles := flags.String("sdk_files", "", "A file listing the Go SDK files needed by the compiler and linker, one per line.")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *cc == "" {
+		*cc = os.Getenv("CC")
+	}
+	if *cc == "" {
+		*cc = "cc"
+	}
+
+	goroot, gotool, cleanup, err := hermeticGoroot(*sdkRoot, *sdkFiles, gotool)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	dir, err := ioutil.TempDir("", "doctor")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	d := &doctor{gotool: gotool, goroot: goroot, cc: *cc, dir: dir, stdout: stdout}
+	var failed []string
+	check := func(name string, steps func() ([]step, error)) {
+		if err := d.check(name, steps); err != nil {
+			fmt.Fprintf(stderr, "%s: %v\n", name, err)
+			failed = append(failed, name)
+		}
+	}
+	check("go", d.goSteps)
+	if *cgo {
+		check("cgo", d.cgoSteps)
+	}
+	if *race {
+		check("race", d.raceSteps)
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("checks failed: %s", strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// check runs the steps of one check in order, stopping at the first
+// failure. Each step is reported on d.stdout.
+func (d *doctor) check(name string, steps func() ([]step, error)) error {
+	ss, err := steps()
+	if err != nil {
+		fmt.Fprintf(d.stdout, "FAIL %s: setup\n", name)
+		return err
+	}
+	for _, s := range ss {
+		out, err := s.cmd.CombinedOutput()
+		if err == nil && s.want != "" && !bytes.Contains(out, []byte(s.want)) {
+			err = fmt.Errorf("output does not contain %q", s.want)
+		}
+		if err != nil {
+			fmt.Fprintf(d.stdout, "FAIL %s: %s\n", name, s.name)
+			return fmt.Errorf("%s failed: %v\n$ %s\n%s", s.name, err, strings.Join(s.cmd.Args, " "), out)
+		}
+		fmt.Fprintf(d.stdout, "ok   %s: %s\n", name, s.name)
+	}
+	return nil
+}
+
+// goSteps compiles and links a program with "go tool compile" and
+// "go tool link", as the compile and link builders do, then runs it.
+func (d *doctor) goSteps() ([]step, error) {
+	return d.toolSteps("go", nil, "hello from go")
+}
+
+// raceSteps is like goSteps, but builds in race mode. This needs the race
+// runtime and a version of the standard library built for it.
+func (d *doctor) raceSteps() ([]step, error) {
+	return d.toolSteps("race", []string{"-race", "-installsuffix", "race"}, "hello from go")
+}
+
+func (d *doctor) toolSteps(name string, opts []string, want string) ([]step, error) {
+	src := filepath.Join(d.dir, name+".go")
+	if err := ioutil.WriteFile(src, []byte(helloGo), 0666); err != nil {
+		return nil, err
+	}
+	archive := filepath.Join(d.dir, name+".a")
+	exe := filepath.Join(d.dir, name+".exe")
+	compileArgs := append([]string{"tool", "compile", "-o", archive}, opts...)
+	linkArgs := append([]string{"tool", "link", "-o", exe}, opts...)
+	return []step{
+		{name: "compile", cmd: d.command(d.gotool, append(compileArgs, src)...)},
+		{name: "link", cmd: d.command(d.gotool, append(linkArgs, archive)...)},
+		{name: "run", cmd: d.command(exe), want: want},
+	}, nil
+}
+
+// cgoSteps checks that the C compiler works on its own, then builds and
+// runs a cgo program with it.
+func (d *doctor) cgoSteps() ([]step, error) {
+	csrc := filepath.Join(d.dir, "hello.c")
+	if err := ioutil.WriteFile(csrc, []byte(helloC), 0666); err != nil {
+		return nil, err
+	}
+	pkg := filepath.Join(d.dir, "cgo")
+	if err := os.Mkdir(pkg, 0777); err != nil {
+		return nil, err
+	}
+	if err := ioutil.WriteFile(filepath.Join(pkg, "hello.go"), []byte(helloCgo), 0666); err != nil {
+		return nil, err
+	}
+	exe := filepath.Join(d.dir, "cgo.exe")
+	build := d.command(d.gotool, "build", "-o", exe, "hello.go")
+	build.Dir = pkg
+	build.Env = append(build.Env, "CGO_ENABLED=1", "CC="+d.cc)
+	return []step{
+		{name: "cc", cmd: d.command(d.cc, "-c", "-o", filepath.Join(d.dir, "hello.o"), csrc)},
+		{name: "build", cmd: build},
+		{name: "run", cmd: d.command(exe), want: "hello from cgo"},
+	}, nil
+}
+
+// command returns a command that runs in d.dir with GOROOT set to the
+// hermetic GOROOT, if there is one.
+func (d *doctor) command(name string, args ...string) *exec.Cmd {
+	cmd := exec.Command(name, args...)
+	cmd.Dir = d.dir
+	cmd.Env = os.Environ()
+	if d.goroot != "" {
+		cmd.Env = setEnv(cmd.Env, "GOROOT", d.goroot)
+	}
+	return cmd
+}
+
+func main() {
+	if err := run(os.Args[1:], os.Stdout, os.Stderr); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,168 @@
+// Copyright 2017 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+)
+
+// Values of the -duplicate_symbols flag.
+const (
+	// explainDuplicateSymbols makes duplicate symbols an error, explaining
+	// which libraries define them when the external linker reports them.
+	explainDuplicateSymbols = "explain"
+
+	// allowDuplicateSymbols asks the external linker to keep the first
+	// definition of each duplicate symbol. This is only supported by GNU
+	// style linkers.
+	allowDuplicateSymbols = "allow"
+)
+
+var (
+	// duplicateSymbolRes match lines reporting a duplicate symbol. The first
+	// group is the symbol name. GNU ld and gold report "multiple definition
+	// of `sym'"; lld reports "duplicate symbol: sym"; ld64 reports
+	// "duplicate symbol _sym in:" or "duplicate symbol '_sym' in:".
+	duplicateSymbolRes = []*regexp.Regexp{
+		regexp.MustCompile("multiple definition of [`'‘\"]([^'’\"]+)['’\"]"),
+		regexp.MustCompile(`(?:^|: )duplicate symbol:? '?([^'\s]+)'?`),
+	}
+
+	// linkedFileRe matches archives and objects named in linker output. An
+	// archive may be followed by the member that defines a symbol, as in
+	// "libfoo.a(foo.o)"; the member is not matched separately.
+	linkedFileRe = regexp.MustCompile(`[^\s:'"()]+\.(?:a|lo|o)(?:\(|:|$)`)
+
+	// lldArchiveRe matches the archives lld names on ">>>" lines.
+	lldArchiveRe = regexp.MustCompile(`in archive (\S+)`)
+)
+
+// duplicateSymbols describes duplicate symbol errors found in the output of
+// an external linker.
+type duplicateSymbols struct {
+	// symbols is the list of symbols defined more than once, in the order
+	// they were reported.
+	symbols []string
+
+	// files is the list of archives and objects named in the errors, in the
+	// order they were reported.
+	files []string
+}
+
+// findDuplicateSymbols looks for duplicate symbol errors in "output", the
+// standard error of "go tool link". It returns nil if there are none.
+func findDuplicateSymbols(output []byte) *duplicateSymbols {
+	d := &duplicateSymbols{}
+	seenSymbols := make(map[string]bool)
+	seenFiles := make(map[string]bool)
+	addFile := func(f string) {
+		if !seenFiles[f] {
+			seenFiles[f] = true
+			d.files = append(d.files, f)
+		}
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for scanner.Scan() {
+		line := scanner.Text()
+		for _, re := range duplicateSymbolRes {
+			for _, m := range re.FindAllStringSubmatch(line, -1) {
+				if !seenSymbols[m[1]] {
+					seenSymbols[m[1]] = true
+					d.symbols = append(d.symbols, m[1])
+				}
+			}
+		}
+		if m := lldArchiveRe.FindStringSubmatch(line); m != nil {
+			// The object on this line is a member of the archive.
+			addFile(m[1])
+			continue
+		}
+		for _, f := range linkedFileRe.FindAllString(line, -1) {
+			addFile(strings.TrimRight(f, "(:"))
+		}
+	}
+	if len(d.symbols) == 0 {
+		return nil
+	}
+	return d
+}
+
+// explain writes a description of the duplicate symbols to "w", with advice
+// on how to fix them. "labels" maps paths of cgo dependencies to the labels
+// of the targets that produced them. Files the linker names are matched
+// against these paths by suffix, since linkers may print absolute paths.
+func (d *duplicateSymbols) explain(w io.Writer, labels map[string]string) {
+	fmt.Fprintf(w, "\nThe external linker found symbols defined more than once:\n")
+	for _, sym := range d.symbols {
+		fmt.Fprintf(w, "  %s\n", sym)
+	}
+	if len(d.files) > 0 {
+		fmt.Fprintf(w, "They are defined in:\n")
+		for _, f := range d.files {
+			if label := labelForFile(f, labels); label != "" {
+				fmt.Fprintf(w, "  %s (%s)\n", label, f)
+			} else {
+				fmt.Fprintf(w, "  %s\n", f)
+			}
+		}
+	}
+	fmt.Fprintf(w, `Each symbol may only be defined by one library in a binary. To fix this:
+  * Remove one of the definitions, or move it into a library that the
+    others depend on.
+  * If the same sources are compiled into more than one cc_library, or a
+    library is reachable through both cdeps and the deps of another library,
+    depend on it in one place only.
+  * Libraries with alwayslink = 1, including those generated by cgo_library,
+    are linked in full, so their symbols can't be overridden by an earlier
+    library. Drop alwayslink if the library doesn't need it.
+  * Otherwise, the first library that defines a symbol wins. Reorder cdeps
+    so the library you want comes first. With GNU style linkers, you can
+    also set duplicate_symbols = "allow" on the go_binary or go_test to
+    let the linker keep the first definition.
+`)
+}
+
+// labelForFile returns the label of the target that produced "file", or ""
+// if it is not known.
+func labelForFile(file string, labels map[string]string) string {
+	if label, ok := labels[file]; ok {
+		return label
+	}
+	for path, label := range labels {
+		if strings.HasSuffix(file, "/"+path) {
+			return label
+		}
+	}
+	return ""
+}
+
+// parseArchiveLabels parses the values of -archive_label flags, which have
+// the form "path=label".
+func parseArchiveLabels(args []string) (map[string]string, error) {
+	labels := make(map[string]string)
+	for _, arg := range args {
+		i := strings.Index(arg, "=")
+		if i < 0 {
+			return nil, fmt.Errorf("-archive_label %q: want path=label", arg)
+		}
+		labels[arg[:i]] = arg[i+1:]
+	}
+	return labels, nil
+}
@@ -0,0 +1,114 @@
+// Copyright 2017 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestFindDuplicateSymbols(t *testing.T) {
+	for _, tc := range []struct {
+		desc, output string
+		want         *duplicateSymbols
+	}{
+		{
+			desc:   "none",
+			output: "/usr/bin/ld: cannot find -lfoo\ncollect2: error: ld returned 1 exit status\n",
+		}, {
+			desc: "gnu",
+			output: `/usr/bin/ld: bazel-out/local-fastbuild/bin/b/libb.a(b.o): in function ` + "`" + `hello':
+b.c:(.text+0x0): multiple definition of ` + "`" + `hello'; bazel-out/local-fastbuild/bin/a/liba.a(a.o):a.c:(.text+0x0): first defined here
+collect2: error: ld returned 1 exit status
+`,
+			want: &duplicateSymbols{
+				symbols: []string{"hello"},
+				files:   []string{"bazel-out/local-fastbuild/bin/b/libb.a", "bazel-out/local-fastbuild/bin/a/liba.a"},
+			},
+		}, {
+			desc: "lld",
+			output: `ld.lld: error: duplicate symbol: hello
+>>> defined at a.c
+>>>            a.o:(hello) in archive bazel-out/k8-fastbuild/bin/a/liba.a
+>>> defined at b.c
+>>>            b.o:(hello) in archive bazel-out/k8-fastbuild/bin/b/libb.a
+`,
+			want: &duplicateSymbols{
+				symbols: []string{"hello"},
+				files:   []string{"bazel-out/k8-fastbuild/bin/a/liba.a", "bazel-out/k8-fastbuild/bin/b/libb.a"},
+			},
+		}, {
+			desc: "darwin",
+			output: `duplicate symbol '_hello' in:
+    /private/var/tmp/execroot/bazel-out/darwin_x86_64-fastbuild/bin/a/liba.a(a.o)
+    /private/var/tmp/execroot/bazel-out/darwin_x86_64-fastbuild/bin/b/b.o
+ld: 1 duplicate symbol for architecture x86_64
+`,
+			want: &duplicateSymbols{
+				symbols: []string{"_hello"},
+				files: []string{
+					"/private/var/tmp/execroot/bazel-out/darwin_x86_64-fastbuild/bin/a/liba.a",
+					"/private/var/tmp/execroot/bazel-out/darwin_x86_64-fastbuild/bin/b/b.o",
+				},
+			},
+		},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			got := findDuplicateSymbols([]byte(tc.output))
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("got %#v; want %#v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestExplainDuplicateSymbols(t *testing.T) {
+	d := &duplicateSymbols{
+		symbols: []string{"hello"},
+		files:   []string{"/abs/bazel-out/local-fastbuild/bin/a/liba.a", "b/b.o"},
+	}
+	labels := map[string]string{
+		"bazel-out/local-fastbuild/bin/a/liba.a": "//a:a",
+	}
+	var buf bytes.Buffer
+	d.explain(&buf, labels)
+	out := buf.String()
+	for _, want := range []string{
+		"  hello\n",
+		"  //a:a (/abs/bazel-out/local-fastbuild/bin/a/liba.a)\n",
+		"  b/b.o\n",
+		"alwayslink",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("explanation does not contain %q:\n%s", want, out)
+		}
+	}
+}
+
+func TestParseArchiveLabels(t *testing.T) {
+	got, err := parseArchiveLabels([]string{"a/liba.a=//a:a", "external/x/libx.a=@x//:x"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"a/liba.a": "//a:a", "external/x/libx.a": "@x//:x"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v; want %v", got, want)
+	}
+	if _, err := parseArchiveLabels([]string{"a/liba.a"}); err == nil {
+		t.Error("got success for argument without a label; want error")
+	}
+}
@@ -31,6 +31,7 @@ import (
 	"strconv"
 	"strings"
 	"text/template"
+	"time"
 )
 
 var (
@@ -52,6 +53,21 @@ type coverInfo struct {
 	Vars map[string]*CoverVar
 }
 
+// Profile describes a profile collected by the test binary. Profiles are
+// written to TEST_UNDECLARED_OUTPUTS_DIR, so Bazel collects them as
+// undeclared test outputs.
+type Profile struct {
+	Flag string // name of the testing flag, for example, "test.cpuprofile"
+	File string // base name of the output file
+}
+
+// profileKinds maps values of the -profile flag to testing flags.
+var profileKinds = map[string]Profile{
+	"cpu":   {Flag: "test.cpuprofile", File: "cpu.prof"},
+	"mem":   {Flag: "test.memprofile", File: "mem.prof"},
+	"trace": {Flag: "test.trace", File: "trace.out"},
+}
+
 // Cases holds template data.
 type Cases struct {
 	Package          string
@@ -62,8 +78,23 @@ type Cases struct {
 	Version17        bool
 	Version18OrNewer bool
 	Cover            []coverInfo
+	Profiles         []Profile
+
+	// Short is the default value of -test.short: "true", "false", or "" to
+	// leave the testing package's default.
+	Short string
+
+	// Timeout is the default value of -test.timeout. If it is empty, the
+	// timeout is derived from TEST_TIMEOUT, which Bazel sets from the size
+	// or timeout of the test.
+	Timeout string
 }
 
+// timeoutGrace is the number of seconds before Bazel's TEST_TIMEOUT that
+// -test.timeout expires by default, so the test binary can print the stacks
+// of running tests before Bazel terminates it.
+const timeoutGrace = 5
+
 func (c *Cases) CoverMode() string {
 	if testCoverMode == "" {
 		return "set"
@@ -71,6 +102,10 @@ func (c *Cases) CoverMode() string {
 	return testCoverMode
 }
 
+func (c *Cases) TimeoutGrace() int {
+	return timeoutGrace
+}
+
 func (c *Cases) CoverEnabled() bool {
 	return testCover
 }
@@ -89,15 +124,29 @@ func (c *Cases) Covered() string {
 var codeTpl = `
 package main
 import (
+	"bytes"
+	"encoding/xml"
 	"flag"
+	"fmt"
 	"os"
+	"os/signal"
+{{if .Profiles}}
+	"path/filepath"
+{{end}}
 {{if .Version17}}
 	"regexp"
 {{end}}
+{{if not .Timeout}}
+	"strconv"
+{{end}}
+	"strings"
+	"sync"
+	"syscall"
 	"testing"
 {{if .Version18OrNewer}}
 	"testing/internal/testdeps"
 {{end}}
+	"time"
 
 {{if .TestNames}}
 	undertest "{{.Package}}"
@@ -115,7 +164,7 @@ import (
 
 var tests = []testing.InternalTest{
 {{range .TestNames}}
-	{"{{.}}", undertest.{{.}} },
+	{"{{.}}", wrapTest("{{.}}", undertest.{{.}}) },
 {{end}}
 }
 
@@ -125,6 +174,175 @@ var benchmarks = []testing.InternalBenchmark{
 {{end}}
 }
 
+// testTiming records the wall time of a top-level test function. Subtests
+// run inside their parent function, so their time is included in it, and
+// they are not tracked separately: a timeout names the top-level function
+// that was running.
+type testTiming struct {
+	name            string
+	start           time.Time
+	elapsed         time.Duration
+	done            bool
+	failed, skipped bool
+}
+
+var (
+	timingMu sync.Mutex
+	timings  []*testTiming
+)
+
+// wrapTest records the wall time and result of a test function. The XML
+// report is rewritten after each test, since TestMain and testing.Main may
+// exit without returning control to us.
+func wrapTest(name string, f func(*testing.T)) func(*testing.T) {
+	return func(t *testing.T) {
+		tt := &testTiming{name: name, start: time.Now()}
+		timingMu.Lock()
+		timings = append(timings, tt)
+		timingMu.Unlock()
+		completed := false
+		defer func() {
+			timingMu.Lock()
+			defer timingMu.Unlock()
+			tt.elapsed = time.Since(tt.start)
+			tt.done = true
+			tt.skipped = t.Skipped()
+			// A test that neither returned nor called FailNow or SkipNow panicked.
+			tt.failed = t.Failed() || (!completed && !tt.skipped)
+			writeTestXML(false)
+		}()
+		f(t)
+		completed = true
+	}
+}
+
+// writeTestXML writes a report of finished tests to XML_OUTPUT_FILE, where
+// Bazel looks for test results. If timedOut is true, tests that are still
+// running are reported as errors. timingMu must be held.
+func writeTestXML(timedOut bool) {
+	path := os.Getenv("XML_OUTPUT_FILE")
+	if path == "" || len(timings) == 0 {
+		return
+	}
+	now := time.Now()
+	var cases bytes.Buffer
+	tests, failures, errors, skipped := 0, 0, 0, 0
+	for _, tt := range timings {
+		elapsed := tt.elapsed
+		if !tt.done {
+			if !timedOut {
+				continue
+			}
+			elapsed = now.Sub(tt.start)
+		}
+		tests++
+		fmt.Fprintf(&cases, "    <testcase name=\"%s\" classname=\"%s\" time=\"%.3f\">", xmlEscape(tt.name), xmlEscape({{printf "%q" .Package}}), elapsed.Seconds())
+		switch {
+		case !tt.done:
+			errors++
+			cases.WriteString("<error message=\"timed out\"></error>")
+		case tt.failed:
+			failures++
+			cases.WriteString("<failure message=\"failed\"></failure>")
+		case tt.skipped:
+			skipped++
+			cases.WriteString("<skipped></skipped>")
+		}
+		cases.WriteString("</testcase>\n")
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString(xml.Header)
+	buf.WriteString("<testsuites>\n")
+	fmt.Fprintf(&buf, "  <testsuite name=\"%s\" tests=\"%d\" failures=\"%d\" errors=\"%d\" skipped=\"%d\" time=\"%.3f\">\n", xmlEscape({{printf "%q" .Package}}), tests, failures, errors, skipped, now.Sub(timings[0].start).Seconds())
+	buf.Write(cases.Bytes())
+	buf.WriteString("  </testsuite>\n</testsuites>\n")
+	if f, err := os.Create(path); err == nil {
+		f.Write(buf.Bytes())
+		f.Close()
+	}
+}
+
+func xmlEscape(s string) string {
+	var buf bytes.Buffer
+	xml.EscapeText(&buf, []byte(s))
+	return buf.String()
+}
+
+// reportTimeout names the test functions that are running when the test
+// times out, in the test log and as errors in the XML report. The testing
+// package panics when -test.timeout expires, without running deferred
+// calls, so a timer reports the running tests just before that. If Bazel's
+// timeout comes first, Bazel terminates the test binary with SIGTERM, and
+// the running tests are reported then.
+func reportTimeout() {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGTERM)
+	go func() {
+		<-c
+		reportRunning("test terminated, probably by a timeout,")
+		os.Exit(1)
+	}()
+	if d := testTimeout(); d > 0 {
+		margin := time.Second
+		if d < 10*time.Second {
+			margin = d / 10
+		}
+		time.AfterFunc(d-margin, func() {
+			reportRunning("test timed out")
+		})
+	}
+}
+
+// reportRunning writes the XML report with running tests as errors and
+// prints "what" followed by the names of the running tests.
+func reportRunning(what string) {
+	timingMu.Lock()
+	defer timingMu.Unlock()
+	var running []string
+	for _, tt := range timings {
+		if !tt.done {
+			running = append(running, fmt.Sprintf("%s (running for %v)", tt.name, time.Since(tt.start)))
+		}
+	}
+	writeTestXML(true)
+	if len(running) == 0 {
+		fmt.Fprintf(os.Stderr, "%s while no test function was running\n", what)
+	} else {
+		fmt.Fprintf(os.Stderr, "%s while running %s\n", what, strings.Join(running, ", "))
+	}
+}
+
+// testTimeout returns the value of -test.timeout: the last value given on
+// the command line, or the default set by setTestFlags. The flags are only
+// parsed later, by the testing package or by TestMain, which may define
+// flags of its own.
+func testTimeout() time.Duration {
+	f := flag.Lookup("test.timeout")
+	if f == nil {
+		return 0
+	}
+	value := f.Value.String()
+	args := os.Args[1:]
+	for i, arg := range args {
+		if arg == "--" {
+			break
+		}
+		name := strings.TrimPrefix(strings.TrimPrefix(arg, "-"), "-")
+		switch {
+		case strings.HasPrefix(name, "test.timeout="):
+			value = strings.TrimPrefix(name, "test.timeout=")
+		case name == "test.timeout" && i+1 < len(args):
+			value = args[i+1]
+		}
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return 0
+	}
+	return d
+}
+
 {{if .CoverEnabled}}
 
 // Only updated by init functions, so no need for atomicity.
@@ -164,6 +382,44 @@ func coverRegisterFile(fileName string, counter []uint32, pos []uint32, numStmts
 }
 {{end}}
 
+{{if .Profiles}}
+// setProfileFlags points profiling flags at TEST_UNDECLARED_OUTPUTS_DIR.
+// Flags given on the command line take precedence, since they are parsed
+// later.
+func setProfileFlags() {
+	dir := os.Getenv("TEST_UNDECLARED_OUTPUTS_DIR")
+	if dir == "" {
+		return
+	}
+{{range .Profiles}}
+	if f := flag.Lookup({{printf "%q" .Flag}}); f != nil {
+		f.Value.Set(filepath.Join(dir, {{printf "%q" .File}}))
+	}
+{{end}}
+}
+{{end}}
+
+// setTestFlags sets defaults for -test.short and -test.timeout. Flags given
+// on the command line take precedence, since they are parsed later.
+func setTestFlags() {
+{{if .Short}}
+	if f := flag.Lookup("test.short"); f != nil {
+		f.Value.Set({{printf "%q" .Short}})
+	}
+{{end}}
+{{if .Timeout}}
+	timeout := {{printf "%q" .Timeout}}
+{{else}}
+	timeout := ""
+	if secs, err := strconv.Atoi(os.Getenv("TEST_TIMEOUT")); err == nil && secs > 2*{{.TimeoutGrace}} {
+		timeout = fmt.Sprintf("%ds", secs-{{.TimeoutGrace}})
+	}
+{{end}}
+	if f := flag.Lookup("test.timeout"); f != nil && timeout != "" {
+		f.Value.Set(timeout)
+	}
+}
+
 func main() {
 	os.Chdir("{{.RunDir}}")
 	if filter := os.Getenv("TESTBRIDGE_TEST_ONLY"); filter != "" {
@@ -183,12 +439,22 @@ func main() {
 
 {{if .Version18OrNewer}}
 	m := testing.MainStart(testdeps.TestDeps{}, tests, benchmarks, nil)
+	setTestFlags()
+	{{if .Profiles}}
+	setProfileFlags()
+	{{end}}
+	reportTimeout()
 	{{if not .HasTestMain}}
 	os.Exit(m.Run())
 	{{else}}
 	undertest.TestMain(m)
 	{{end}}
 {{else if .Version17}}
+	setTestFlags()
+	{{if .Profiles}}
+	setProfileFlags()
+	{{end}}
+	reportTimeout()
 	{{if not .HasTestMain}}
 	testing.Main(regexp.MatchString, tests, benchmarks, nil)
 	{{else}}
@@ -205,12 +471,33 @@ func run(args []string) error {
 	pkg := flags.String("package", "", "package from which to import test methods.")
 	out := flags.String("output", "", "output file to write. Defaults to stdout.")
 	tags := flags.String("tags", "", "Only pass through files that match these tags.")
+	profiles := flags.String("profile", "", "Comma-separated list of profiles to write to TEST_UNDECLARED_OUTPUTS_DIR: cpu, mem, or trace.")
+	short := flags.String("short", "", "Default value of -test.short: true or false. If empty, the testing package's default is used.")
+	timeout := flags.String("timeout", "", "Default value of -test.timeout. If empty, it is derived from TEST_TIMEOUT at run time.")
 	if err := flags.Parse(args); err != nil {
 		return err
 	}
 	if *pkg == "" {
 		return fmt.Errorf("must set --package.")
 	}
+	var profileList []Profile
+	if *profiles != "" {
+		for _, kind := range strings.Split(*profiles, ",") {
+			p, ok := profileKinds[kind]
+			if !ok {
+				return fmt.Errorf("unknown profile %q", kind)
+			}
+			profileList = append(profileList, p)
+		}
+	}
+	if *short != "" && *short != "true" && *short != "false" {
+		return fmt.Errorf("invalid --short %q: want true or false", *short)
+	}
+	if *timeout != "" {
+		if _, err := time.ParseDuration(*timeout); err != nil {
+			return fmt.Errorf("invalid --timeout: %v", err)
+		}
+	}
 	// filter our input file list
 	bctx := build.Default
 	bctx.CgoEnabled = true
@@ -234,9 +521,12 @@ func run(args []string) error {
 		Vars: map[string]*CoverVar{},
 	}
 	cases := Cases{
-		Package: *pkg,
-		RunDir:  os.Getenv("RUNDIR"),
-		Cover:   []coverInfo{ci},
+		Package:  *pkg,
+		RunDir:   os.Getenv("RUNDIR"),
+		Cover:    []coverInfo{ci},
+		Profiles: profileList,
+		Short:    *short,
+		Timeout:  *timeout,
 	}
 	testFileSet := token.NewFileSet()
 	for _, f := range filenames {
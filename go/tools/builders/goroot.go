@@ -0,0 +1,115 @@
+// Copyright 2017 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// hermeticGoroot assembles a GOROOT in a temporary directory containing
+// symbolic links to the SDK files listed in the file "sdkFiles". Each listed
+// file must be under "sdkRoot". This lets actions run on remote executors
+// that only fetch declared inputs, since the go tool does not need to find
+// anything else in the SDK's layout.
+//
+// The path of the new GOROOT is returned, along with the path of "gotool"
+// inside it (if "gotool" is in the SDK) and a function that removes the
+// directory. If "sdkFiles" is empty, no directory is created, and an empty
+// GOROOT is returned with "gotool" unchanged.
+func hermeticGoroot(sdkRoot, sdkFiles, gotool string) (goroot, newGotool string, cleanup func(), err error) {
+	if sdkFiles == "" {
+		return "", gotool, func() {}, nil
+	}
+	files, err := readFileList(sdkFiles)
+	if err != nil {
+		return "", "", nil, err
+	}
+	dir, err := ioutil.TempDir("", "goroot")
+	if err != nil {
+		return "", "", nil, err
+	}
+	cleanup = func() { os.RemoveAll(dir) }
+	if err := assembleGoroot(dir, sdkRoot, files); err != nil {
+		cleanup()
+		return "", "", nil, err
+	}
+	newGotool = gotool
+	if rel, err := filepath.Rel(sdkRoot, gotool); err == nil && !strings.HasPrefix(rel, "..") {
+		newGotool = filepath.Join(dir, rel)
+	}
+	return dir, newGotool, cleanup, nil
+}
+
+// assembleGoroot creates a symbolic link in "dir" for each file in "files",
+// at the same path relative to "dir" that the file has relative to
+// "sdkRoot". Links point to absolute paths, so they may be followed from
+// any working directory.
+func assembleGoroot(dir, sdkRoot string, files []string) error {
+	for _, f := range files {
+		rel, err := filepath.Rel(sdkRoot, f)
+		if err != nil {
+			return err
+		}
+		if rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return fmt.Errorf("SDK file %s is not in %s", f, sdkRoot)
+		}
+		target, err := filepath.Abs(f)
+		if err != nil {
+			return err
+		}
+		link := filepath.Join(dir, rel)
+		if _, err := os.Lstat(link); err == nil {
+			// Files may be listed more than once.
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(link), 0777); err != nil {
+			return err
+		}
+		if err := os.Symlink(target, link); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readFileList returns the non-empty lines in the file at "path".
+func readFileList(path string) ([]string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for _, line := range strings.Split(string(data), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			files = append(files, line)
+		}
+	}
+	return files, nil
+}
+
+// setEnv returns a copy of "env" with "key" set to "value".
+func setEnv(env []string, key, value string) []string {
+	var result []string
+	for _, e := range env {
+		if !strings.HasPrefix(e, key+"=") {
+			result = append(result, e)
+		}
+	}
+	return append(result, key+"="+value)
+}
@@ -0,0 +1,81 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestHermeticGoroot(t *testing.T) {
+	tmp, err := ioutil.TempDir(os.Getenv("TEST_TMPDIR"), "sdk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	sdkRoot := filepath.Join(tmp, "go_sdk")
+	gotool := filepath.Join(sdkRoot, "bin", "go")
+	stdlibFile := filepath.Join(sdkRoot, "src", "fmt", "print.go")
+	for _, f := range []string{gotool, stdlibFile, filepath.Join(sdkRoot, "undeclared")} {
+		if err := os.MkdirAll(filepath.Dir(f), 0777); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(f, []byte(f), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	list := filepath.Join(tmp, "sdk_files")
+	if err := ioutil.WriteFile(list, []byte(gotool+"\n"+stdlibFile+"\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	goroot, newGotool, cleanup, err := hermeticGoroot(sdkRoot, list, gotool)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+
+	if want := filepath.Join(goroot, "bin", "go"); newGotool != want {
+		t.Errorf("got gotool %q; want %q", newGotool, want)
+	}
+	if data, err := ioutil.ReadFile(filepath.Join(goroot, "src", "fmt", "print.go")); err != nil {
+		t.Error(err)
+	} else if string(data) != stdlibFile {
+		t.Errorf("got contents %q; want %q", data, stdlibFile)
+	}
+	if _, err := os.Lstat(filepath.Join(goroot, "undeclared")); !os.IsNotExist(err) {
+		t.Errorf("undeclared file was linked: %v", err)
+	}
+
+	cleanup()
+	if _, err := os.Stat(goroot); !os.IsNotExist(err) {
+		t.Errorf("GOROOT was not removed: %v", err)
+	}
+}
+
+func TestAssembleGorootOutsideRoot(t *testing.T) {
+	tmp, err := ioutil.TempDir(os.Getenv("TEST_TMPDIR"), "goroot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	if err := assembleGoroot(tmp, "sdk", []string{"other/bin/go"}); err == nil {
+		t.Error("got success; want error for file outside SDK root")
+	}
+}
@@ -22,14 +22,16 @@ import (
 	"flag"
 	"fmt"
 	"go/build"
+	"io"
 	"io/ioutil"
 	"log"
 	"os"
 	"os/exec"
+	"sort"
 	"strings"
 )
 
-func run(args []string) error {
+func run(args []string, stdout, stderr io.Writer) error {
 	// process the args
 	if len(args) < 2 {
 		return fmt.Errorf("Usage: link gotool [link args] -- <go link args>")
@@ -51,13 +53,33 @@ func run(args []string) error {
 	xdefs := multiFlag{}
 	stamps := multiFlag{}
 	linkstamps := multiFlag{}
-	flags := flag.NewFlagSet("link", flag.ExitOnError)
+	rpaths := multiFlag{}
+	archiveLabels := multiFlag{}
+	manifestArchives := multiFlag{}
+	// Errors are returned rather than exiting, so that a persistent worker
+	// can report them in a work response.
+	flags := flag.NewFlagSet("link", flag.ContinueOnError)
+	flags.SetOutput(stderr)
 	flags.Var(&xdefs, "X", "A link xdef that may need stamping.")
 	flags.Var(&stamps, "stamp", "The name of a file with stamping values.")
 	flags.Var(&linkstamps, "linkstamp", "A package that requires link stamping.")
+	flags.Var(&rpaths, "rpath", "A runfiles-relative directory containing a shared library needed at run time.")
+	rpathDepth := flags.Int("rpath_depth", -1, "The number of directories between the executable and the output root. If set, the output root and the -rpath directories are added to the run-time search path.")
+	workspace := flags.String("workspace", "", "The name of the workspace, used to locate shared libraries in the runfiles tree.")
+	sdkRoot := flags.String("sdk_root", "", "The directory containing the files listed in -sdk_files.")
+	sdkFiles := flags.String("sdk_files", "", "A file listing the Go SDK files needed by the linker, one per line.")
+	flags.Var(&archiveLabels, "archive_label", "A cgo dependency and the label that produced it, as path=label. Used to explain duplicate symbol errors.")
+	manifest := flags.String("manifest", "", "If set, a JSON file describing the link is written to this path instead of running the linker.")
+	flags.Var(&manifestArchives, "manifest_archive", "An archive available to the linker, listed with its hash in the -manifest file.")
+	subarch := registerSubarchFlags(flags)
+	duplicateSymbols := flags.String("duplicate_symbols", explainDuplicateSymbols, "How to handle symbols defined by more than one cgo dependency: explain or allow.")
 	if err := flags.Parse(args); err != nil {
 		return err
 	}
+	labels, err := parseArchiveLabels(archiveLabels)
+	if err != nil {
+		return err
+	}
 	goargs := []string{"tool", "link"}
 	// If we were given any stamp value files, read and parse them
 	stampmap := map[string]string{}
@@ -81,37 +103,98 @@ func run(args []string) error {
 			}
 		}
 	}
-	// generate any additional link options we need
-	for _, xdef := range xdefs {
-		split := strings.SplitN(xdef, "=", 2)
+	// generate any additional link options we need. If a variable is defined
+	// more than once, the last definition wins: stamped -X definitions are
+	// overridden by -linkstamp expansion, which is overridden by -X options
+	// passed through to the linker.
+	var defs []xdef
+	for _, x := range xdefs {
+		split := strings.SplitN(x, "=", 2)
 		if len(split) != 2 {
 			continue
 		}
 		name := split[0]
 		key := split[1]
 		if value, found := stampmap[key]; found {
-			goargs = append(goargs, "-X", fmt.Sprintf("%s=%s", name, value))
+			defs = append(defs, xdef{name: name, value: value, source: "-X " + x})
 		}
 	}
+	stampkeys := make([]string, 0, len(stampmap))
+	for key := range stampmap {
+		stampkeys = append(stampkeys, key)
+	}
+	sort.Strings(stampkeys)
 	for _, linkstamp := range linkstamps {
-		for key, value := range stampmap {
-			goargs = append(goargs, "-X", fmt.Sprintf("%s.%s=%s", linkstamp, key, value))
+		for _, key := range stampkeys {
+			defs = append(defs, xdef{name: linkstamp + "." + key, value: stampmap[key], source: "-linkstamp " + linkstamp})
+		}
+	}
+	goopts, optdefs := extractXdefs(goopts)
+	defs = append(defs, optdefs...)
+	defs = mergeXdefs(defs, stderr)
+	for _, d := range defs {
+		goargs = append(goargs, "-X", fmt.Sprintf("%s=%s", d.name, d.value))
+	}
+
+	if *rpathDepth >= 0 {
+		goopts = addExtldflags(goopts, rpathFlags(bctx.GOOS, *rpathDepth, *workspace, outputName(goopts), rpaths)...)
+	}
+	switch *duplicateSymbols {
+	case explainDuplicateSymbols:
+	case allowDuplicateSymbols:
+		if bctx.GOOS == "darwin" {
+			fmt.Fprintf(stderr, "warning: duplicate_symbols = %q is not supported by the darwin linker\n", allowDuplicateSymbols)
+		} else {
+			goopts = addExtldflags(goopts, "-Wl,--allow-multiple-definition")
+		}
+	default:
+		return fmt.Errorf("-duplicate_symbols %q: want %s or %s", *duplicateSymbols, explainDuplicateSymbols, allowDuplicateSymbols)
+	}
+
+	if *manifest != "" {
+		m, err := newLinkManifest(outputName(goopts), append(goargs[2:], goopts...), defs, manifestArchives)
+		if err != nil {
+			return fmt.Errorf("error writing link manifest: %v", err)
+		}
+		if err := writeLinkManifest(*manifest, m); err != nil {
+			return fmt.Errorf("error writing link manifest: %v", err)
 		}
+		return nil
+	}
+
+	goroot, gotool, cleanup, err := hermeticGoroot(*sdkRoot, *sdkFiles, gotool)
+	if err != nil {
+		return err
 	}
+	defer cleanup()
 
 	// add in the unprocess pass through options
 	goargs = append(goargs, goopts...)
+	env, err := subarch.env(bctx.GOARCH, os.Environ())
+	if err != nil {
+		return err
+	}
+	if goroot != "" {
+		env = setEnv(env, "GOROOT", goroot)
+	}
 	cmd := exec.Command(gotool, goargs...)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
+	cmd.Env = env
+	// Keep a copy of the linker's output so duplicate symbol errors from the
+	// external linker can be explained.
+	linkerr := &bytes.Buffer{}
+	cmd.Stdout = stdout
+	cmd.Stderr = io.MultiWriter(stderr, linkerr)
 	if err := cmd.Run(); err != nil {
+		if d := findDuplicateSymbols(linkerr.Bytes()); d != nil {
+			d.explain(stderr, labels)
+		}
 		return fmt.Errorf("error running linker: %v", err)
 	}
 	return nil
 }
 
 func main() {
-	if err := run(os.Args[1:]); err != nil {
+	if err := builderMain(os.Args[1:], run); err != nil {
 		log.Fatal(err)
 	}
 }
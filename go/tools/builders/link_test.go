@@ -0,0 +1,92 @@
+// Copyright 2017 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestRpathFlags(t *testing.T) {
+	for _, tc := range []struct {
+		desc, goos, workspace, executable string
+		rpaths                            []string
+		want                              []string
+	}{
+		{
+			desc:       "elf",
+			goos:       "linux",
+			workspace:  "repo",
+			executable: "bazel-out/k8-fastbuild/bin/cmd/prog",
+			rpaths:     []string{"/lib"},
+			want: []string{
+				"-Wl,-rpath,$ORIGIN/../../",
+				"-Wl,-rpath,$ORIGIN/../../lib",
+				"-Wl,-rpath,$ORIGIN/prog.runfiles/repo/lib",
+			},
+		}, {
+			desc:       "darwin",
+			goos:       "darwin",
+			workspace:  "repo",
+			executable: "bazel-out/darwin-fastbuild/bin/cmd/prog",
+			rpaths:     []string{"/lib"},
+			want: []string{
+				"-Wl,-rpath,@loader_path/../../",
+				"-Wl,-rpath,@loader_path/../../lib",
+				"-Wl,-rpath,@loader_path/prog.runfiles/repo/lib",
+			},
+		}, {
+			desc: "no shared libraries",
+			goos: "linux",
+			want: []string{"-Wl,-rpath,$ORIGIN/../../"},
+		}, {
+			desc:   "no runfiles without workspace",
+			goos:   "linux",
+			rpaths: []string{"lib"},
+			want: []string{
+				"-Wl,-rpath,$ORIGIN/../../",
+				"-Wl,-rpath,$ORIGIN/../../lib",
+			},
+		},
+	} {
+		if got := rpathFlags(tc.goos, 2, tc.workspace, tc.executable, tc.rpaths); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: got %q; want %q", tc.desc, got, tc.want)
+		}
+	}
+}
+
+func TestAddExtldflags(t *testing.T) {
+	got := addExtldflags([]string{"-o", "prog", "-extldflags", "-lm"}, "-Wl,-rpath,$ORIGIN/", "-Wl,-z,now")
+	if want := []string{"-o", "prog", "-extldflags", "-lm -Wl,-rpath,$ORIGIN/ -Wl,-z,now"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("merging into -extldflags: got %q; want %q", got, want)
+	}
+	got = addExtldflags([]string{"-o", "prog", "-extldflags", ""}, "-lm")
+	if want := []string{"-o", "prog", "-extldflags", "-lm"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("merging into empty -extldflags: got %q; want %q", got, want)
+	}
+	got = addExtldflags([]string{"-o", "prog"}, "-lm")
+	if want := []string{"-o", "prog", "-extldflags", "-lm"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("adding -extldflags: got %q; want %q", got, want)
+	}
+}
+
+func TestOutputName(t *testing.T) {
+	if got, want := outputName([]string{"-s", "-o", "bin/prog"}), "bin/prog"; got != want {
+		t.Errorf("got %q; want %q", got, want)
+	}
+	if got := outputName([]string{"-s", "-o"}); got != "" {
+		t.Errorf("without a value for -o: got %q; want \"\"", got)
+	}
+}
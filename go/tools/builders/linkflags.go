@@ -0,0 +1,69 @@
+// Copyright 2017 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// rpathFlags returns external linker flags that add run-time search paths for
+// shared libraries: the output root, "depth" directories above the
+// executable, and the directories "rpaths". Each directory in "rpaths" is
+// added twice: once relative to the executable in the output tree, and once
+// relative to the executable's runfiles tree. On darwin, paths are relative
+// to @loader_path; elsewhere, $ORIGIN is used.
+func rpathFlags(goos string, depth int, workspace, executable string, rpaths []string) []string {
+	origin := "$ORIGIN"
+	if goos == "darwin" {
+		origin = "@loader_path"
+	}
+	up := strings.Repeat("../", depth)
+	flags := []string{fmt.Sprintf("-Wl,-rpath,%s/%s", origin, up)}
+	for _, dir := range rpaths {
+		dir = strings.TrimPrefix(dir, "/")
+		flags = append(flags, fmt.Sprintf("-Wl,-rpath,%s/%s%s", origin, up, dir))
+		if executable != "" && workspace != "" {
+			runfiles := path.Join(path.Base(executable)+".runfiles", workspace, dir)
+			flags = append(flags, fmt.Sprintf("-Wl,-rpath,%s/%s", origin, runfiles))
+		}
+	}
+	return flags
+}
+
+// addExtldflags appends "flags" to the value of the -extldflags option in
+// "goopts", adding the option if it is not already present.
+func addExtldflags(goopts []string, flags ...string) []string {
+	for i := 0; i < len(goopts)-1; i++ {
+		if goopts[i] == "-extldflags" {
+			goopts[i+1] = strings.TrimSpace(goopts[i+1] + " " + strings.Join(flags, " "))
+			return goopts
+		}
+	}
+	return append(goopts, "-extldflags", strings.Join(flags, " "))
+}
+
+// outputName returns the path of the file named by the -o option in "goopts",
+// or "" if there is none.
+func outputName(goopts []string) string {
+	for i := 0; i < len(goopts)-1; i++ {
+		if goopts[i] == "-o" {
+			return filepath.ToSlash(goopts[i+1])
+		}
+	}
+	return ""
+}
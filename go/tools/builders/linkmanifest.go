@@ -0,0 +1,127 @@
+// Copyright 2017 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// linkManifest is a record of what goes into a linked binary. It is written
+// as JSON when the link wrapper is given -manifest, in an action separate
+// from the link.
+type linkManifest struct {
+	// Output is the path of the linked binary.
+	Output string `json:"output"`
+
+	// BuildMode is the value of the linker's -buildmode option, or "exe" if
+	// it was not set.
+	BuildMode string `json:"buildmode"`
+
+	// XDefs lists the -X definitions applied by the linker after stamping
+	// and merging, in the order they were passed.
+	XDefs []manifestXdef `json:"x_defs"`
+
+	// Archives lists the archives available to the linker, with the SHA-256
+	// hashes of their contents.
+	Archives []manifestArchive `json:"archives"`
+
+	// LinkFlags lists the arguments passed to "go tool link", other than -X
+	// definitions, which are listed in XDefs.
+	LinkFlags []string `json:"link_flags"`
+}
+
+type manifestXdef struct {
+	Name   string `json:"name"`
+	Value  string `json:"value"`
+	Source string `json:"source"`
+}
+
+type manifestArchive struct {
+	Path   string `json:"path"`
+	SHA256 string `json:"sha256"`
+}
+
+// newLinkManifest returns a manifest for the binary "output", linked with
+// the arguments "linkargs" to "go tool link" after the -X definitions "defs"
+// were applied. Each file in "archives" is read to compute its hash.
+func newLinkManifest(output string, linkargs []string, defs []xdef, archives []string) (*linkManifest, error) {
+	flags, _ := extractXdefs(linkargs)
+	m := &linkManifest{
+		Output:    output,
+		BuildMode: buildMode(flags),
+		XDefs:     []manifestXdef{},
+		Archives:  []manifestArchive{},
+		LinkFlags: flags,
+	}
+	for _, d := range defs {
+		m.XDefs = append(m.XDefs, manifestXdef{Name: d.name, Value: d.value, Source: d.source})
+	}
+	seen := make(map[string]bool)
+	for _, a := range archives {
+		if seen[a] {
+			continue
+		}
+		seen[a] = true
+		sum, err := fileSHA256(a)
+		if err != nil {
+			return nil, err
+		}
+		m.Archives = append(m.Archives, manifestArchive{Path: a, SHA256: sum})
+	}
+	return m, nil
+}
+
+// buildMode returns the value of the -buildmode option in "linkargs", or
+// "exe", the linker's default, if there is none.
+func buildMode(linkargs []string) string {
+	mode := "exe"
+	for i, arg := range linkargs {
+		switch {
+		case arg == "-buildmode" && i+1 < len(linkargs):
+			mode = linkargs[i+1]
+		case strings.HasPrefix(arg, "-buildmode="):
+			mode = strings.TrimPrefix(arg, "-buildmode=")
+		}
+	}
+	return mode
+}
+
+func fileSHA256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// writeLinkManifest writes "m" as indented JSON to the file "path".
+func writeLinkManifest(path string, m *linkManifest) error {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, append(data, '\n'), 0666)
+}
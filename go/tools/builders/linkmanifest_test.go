@@ -0,0 +1,93 @@
+// Copyright 2017 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestBuildMode(t *testing.T) {
+	for _, tc := range []struct {
+		args []string
+		want string
+	}{
+		{[]string{"-o", "out", "main.a"}, "exe"},
+		{[]string{"-buildmode", "pie", "main.a"}, "pie"},
+		{[]string{"-buildmode=c-shared", "main.a"}, "c-shared"},
+	} {
+		if got := buildMode(tc.args); got != tc.want {
+			t.Errorf("%q: got %q; want %q", tc.args, got, tc.want)
+		}
+	}
+}
+
+func TestLinkManifest(t *testing.T) {
+	dir, err := ioutil.TempDir(os.Getenv("TEST_TMPDIR"), "linkmanifest_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	lib := filepath.Join(dir, "lib.a")
+	if err := ioutil.WriteFile(lib, []byte("hello"), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	linkargs := []string{"-X", "p.Version=1.0", "-L", dir, "-o", "bin/out", "-s", lib}
+	defs := []xdef{{name: "p.Version", value: "1.0", source: "link option -X p.Version=1.0"}}
+	m, err := newLinkManifest("bin/out", linkargs, defs, []string{lib, lib})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &linkManifest{
+		Output:    "bin/out",
+		BuildMode: "exe",
+		XDefs:     []manifestXdef{{Name: "p.Version", Value: "1.0", Source: "link option -X p.Version=1.0"}},
+		Archives: []manifestArchive{{
+			Path:   lib,
+			SHA256: "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824",
+		}},
+		LinkFlags: []string{"-L", dir, "-o", "bin/out", "-s", lib},
+	}
+	if !reflect.DeepEqual(m, want) {
+		t.Errorf("got %#v; want %#v", m, want)
+	}
+
+	path := filepath.Join(dir, "out.link.json")
+	if err := writeLinkManifest(path, m); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got linkManifest
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(&got, want) {
+		t.Errorf("read back %#v; want %#v", &got, want)
+	}
+}
+
+func TestLinkManifestMissingArchive(t *testing.T) {
+	if _, err := newLinkManifest("out", nil, nil, []string{"does/not/exist.a"}); err == nil {
+		t.Error("got success; want error for missing archive")
+	}
+}
@@ -0,0 +1,102 @@
+// Copyright 2017 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+)
+
+// subarchVar describes an environment variable that selects a variant of
+// an architecture, like GOARM.
+type subarchVar struct {
+	// env is the name of the variable, and flag is the name of the builder
+	// flag that sets it.
+	env, flag string
+
+	// goarchs lists the values of GOARCH the variable applies to.
+	goarchs []string
+
+	// values lists the values the variable accepts.
+	values []string
+}
+
+var subarchVars = []subarchVar{
+	{env: "GOARM", flag: "goarm", goarchs: []string{"arm"}, values: []string{"5", "6", "7"}},
+	{env: "GOMIPS", flag: "gomips", goarchs: []string{"mips", "mipsle"}, values: []string{"hardfloat", "softfloat"}},
+	{env: "GO386", flag: "go386", goarchs: []string{"386"}, values: []string{"387", "sse2"}},
+}
+
+// subarchFlags maps names of variables in subarchVars to the values of the
+// flags that set them.
+type subarchFlags map[string]*string
+
+// registerSubarchFlags adds a flag for each variable in subarchVars to
+// "flags".
+func registerSubarchFlags(flags *flag.FlagSet) subarchFlags {
+	s := make(subarchFlags)
+	for _, v := range subarchVars {
+		s[v.env] = flags.String(v.flag, "", fmt.Sprintf("The value of %s. Must be one of %s, and only for GOARCH %s.", v.env, strings.Join(v.values, ", "), strings.Join(v.goarchs, ", ")))
+	}
+	return s
+}
+
+// env returns a copy of "env" with the variables in subarchVars set to the
+// values of their flags. Variables whose flags are not set are removed, so
+// the go tool uses its defaults instead of values from the host
+// environment. An error is returned if a value is not valid or doesn't
+// apply to "goarch".
+func (s subarchFlags) env(goarch string, env []string) ([]string, error) {
+	var result []string
+	for _, e := range env {
+		keep := true
+		for _, v := range subarchVars {
+			if strings.HasPrefix(e, v.env+"=") {
+				keep = false
+				break
+			}
+		}
+		if keep {
+			result = append(result, e)
+		}
+	}
+	for _, v := range subarchVars {
+		value := ""
+		if p := s[v.env]; p != nil {
+			value = *p
+		}
+		if value == "" {
+			continue
+		}
+		if !containsString(v.goarchs, goarch) {
+			return nil, fmt.Errorf("-%s is set, but %s only applies to GOARCH %s, not %s", v.flag, v.env, strings.Join(v.goarchs, ", "), goarch)
+		}
+		if !containsString(v.values, value) {
+			return nil, fmt.Errorf("-%s %q: must be one of %s", v.flag, value, strings.Join(v.values, ", "))
+		}
+		result = append(result, v.env+"="+value)
+	}
+	return result, nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, x := range list {
+		if x == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,79 @@
+// Copyright 2017 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"flag"
+	"reflect"
+	"testing"
+)
+
+func TestSubarchEnv(t *testing.T) {
+	for _, tc := range []struct {
+		desc, goarch string
+		args, env    []string
+		want         []string
+		wantErr      bool
+	}{
+		{
+			desc:   "unset removes host values",
+			goarch: "arm",
+			env:    []string{"PATH=/bin", "GOARM=5", "GO386=387"},
+			want:   []string{"PATH=/bin"},
+		}, {
+			desc:   "goarm",
+			goarch: "arm",
+			args:   []string{"-goarm", "7"},
+			env:    []string{"GOARM=5", "PATH=/bin"},
+			want:   []string{"PATH=/bin", "GOARM=7"},
+		}, {
+			desc:   "gomips",
+			goarch: "mipsle",
+			args:   []string{"-gomips", "softfloat"},
+			want:   []string{"GOMIPS=softfloat"},
+		}, {
+			desc:    "invalid value",
+			goarch:  "arm",
+			args:    []string{"-goarm", "8"},
+			wantErr: true,
+		}, {
+			desc:    "wrong architecture",
+			goarch:  "amd64",
+			args:    []string{"-go386", "sse2"},
+			wantErr: true,
+		},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			flags := flag.NewFlagSet("test", flag.ContinueOnError)
+			subarch := registerSubarchFlags(flags)
+			if err := flags.Parse(tc.args); err != nil {
+				t.Fatal(err)
+			}
+			got, err := subarch.env(tc.goarch, tc.env)
+			if tc.wantErr {
+				if err == nil {
+					t.Errorf("got %q; want error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("got %q; want %q", got, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,202 @@
+// Copyright 2017 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// persistentWorkerFlag is passed by Bazel to builders started as persistent
+// workers. See https://bazel.build/docs/persistent-workers.
+const persistentWorkerFlag = "--persistent_worker"
+
+// runFunc runs a builder once with the given arguments. Output from tools
+// invoked by the builder is written to stdout and stderr.
+type runFunc func(args []string, stdout, stderr io.Writer) error
+
+// builderMain runs a builder. If "args" contains --persistent_worker, the
+// builder reads work requests from standard input and writes responses to
+// standard output until standard input is closed. Otherwise, the builder
+// runs once with "args". In both cases, arguments of the form @file are
+// replaced with the lines of the named file.
+func builderMain(args []string, run runFunc) error {
+	for _, arg := range args {
+		if arg == persistentWorkerFlag {
+			return runWorker(os.Stdin, os.Stdout, run)
+		}
+	}
+	args, err := expandParamsFiles(args)
+	if err != nil {
+		return err
+	}
+	return run(args, os.Stdout, os.Stderr)
+}
+
+// runWorker implements the persistent worker protocol. Each request is a
+// length-delimited WorkRequest protocol buffer; each response is a
+// length-delimited WorkResponse.
+func runWorker(in io.Reader, out io.Writer, run runFunc) error {
+	r := bufio.NewReader(in)
+	for {
+		args, id, err := readWorkRequest(r)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		var output bytes.Buffer
+		exitCode := 0
+		if args, err = expandParamsFiles(args); err == nil {
+			err = run(args, &output, &output)
+		}
+		if err != nil {
+			fmt.Fprintln(&output, err)
+			exitCode = 1
+		}
+		if err := writeWorkResponse(out, exitCode, output.String(), id); err != nil {
+			return err
+		}
+	}
+}
+
+// expandParamsFiles replaces each argument of the form @file with the lines
+// of that file. Empty lines are empty arguments.
+func expandParamsFiles(args []string) ([]string, error) {
+	var expanded []string
+	for _, arg := range args {
+		if !strings.HasPrefix(arg, "@") {
+			expanded = append(expanded, arg)
+			continue
+		}
+		data, err := ioutil.ReadFile(arg[1:])
+		if err != nil {
+			return nil, err
+		}
+		if content := strings.TrimSuffix(string(data), "\n"); content != "" {
+			expanded = append(expanded, strings.Split(content, "\n")...)
+		}
+	}
+	return expanded, nil
+}
+
+// Protocol buffer wire types and field numbers used by WorkRequest and
+// WorkResponse in src/main/protobuf/worker_protocol.proto in Bazel.
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+	wireFixed32 = 5
+
+	requestArgumentsField = 1
+	requestIDField        = 3
+
+	responseExitCodeField  = 1
+	responseOutputField    = 2
+	responseRequestIDField = 3
+)
+
+var errMalformedRequest = errors.New("malformed work request")
+
+// readWorkRequest reads a WorkRequest and returns its arguments and request
+// id. Other fields are ignored. io.EOF is returned if there are no more
+// requests.
+func readWorkRequest(r *bufio.Reader) (args []string, id uint64, err error) {
+	size, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, 0, err
+	}
+	msg := make([]byte, size)
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return nil, 0, err
+	}
+	for len(msg) > 0 {
+		key, n := binary.Uvarint(msg)
+		if n <= 0 {
+			return nil, 0, errMalformedRequest
+		}
+		msg = msg[n:]
+		field, wire := key>>3, key&7
+		switch wire {
+		case wireVarint:
+			v, n := binary.Uvarint(msg)
+			if n <= 0 {
+				return nil, 0, errMalformedRequest
+			}
+			msg = msg[n:]
+			if field == requestIDField {
+				id = v
+			}
+		case wireBytes:
+			l, n := binary.Uvarint(msg)
+			if n <= 0 || uint64(len(msg)-n) < l {
+				return nil, 0, errMalformedRequest
+			}
+			if field == requestArgumentsField {
+				args = append(args, string(msg[n:n+int(l)]))
+			}
+			msg = msg[n+int(l):]
+		case wireFixed64, wireFixed32:
+			l := 8
+			if wire == wireFixed32 {
+				l = 4
+			}
+			if len(msg) < l {
+				return nil, 0, errMalformedRequest
+			}
+			msg = msg[l:]
+		default:
+			return nil, 0, errMalformedRequest
+		}
+	}
+	return args, id, nil
+}
+
+// writeWorkResponse writes a length-delimited WorkResponse.
+func writeWorkResponse(w io.Writer, exitCode int, output string, id uint64) error {
+	var msg []byte
+	if exitCode != 0 {
+		msg = appendVarintField(msg, responseExitCodeField, uint64(int64(exitCode)))
+	}
+	if output != "" {
+		msg = appendUvarint(msg, responseOutputField<<3|wireBytes)
+		msg = appendUvarint(msg, uint64(len(output)))
+		msg = append(msg, output...)
+	}
+	if id != 0 {
+		msg = appendVarintField(msg, responseRequestIDField, id)
+	}
+	buf := appendUvarint(nil, uint64(len(msg)))
+	_, err := w.Write(append(buf, msg...))
+	return err
+}
+
+func appendVarintField(b []byte, field, v uint64) []byte {
+	return appendUvarint(appendUvarint(b, field<<3|wireVarint), v)
+}
+
+func appendUvarint(b []byte, v uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buf[:], v)
+	return append(b, buf[:n]...)
+}
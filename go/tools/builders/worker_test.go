@@ -0,0 +1,130 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestRunWorker(t *testing.T) {
+	var in bytes.Buffer
+	in.Write(workRequest(1, "a", "b"))
+	in.Write(workRequest(2, "fail"))
+
+	run := func(args []string, stdout, stderr io.Writer) error {
+		if len(args) == 1 && args[0] == "fail" {
+			return errors.New("failed")
+		}
+		fmt.Fprint(stdout, strings.Join(args, " "))
+		return nil
+	}
+	var out bytes.Buffer
+	if err := runWorker(&in, &out, run); err != nil {
+		t.Fatal(err)
+	}
+
+	r := bufio.NewReader(&out)
+	for _, want := range []workResponse{
+		{exitCode: 0, output: "a b", id: 1},
+		{exitCode: 1, output: "failed\n", id: 2},
+	} {
+		got, err := readWorkResponse(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Errorf("got response %#v; want %#v", got, want)
+		}
+	}
+}
+
+func TestReadWorkRequestSkipsInputs(t *testing.T) {
+	// A request with an Input message (field 2) between the arguments.
+	var msg []byte
+	msg = appendBytesField(msg, 1, "x")
+	msg = appendBytesField(msg, 2, "\x0a\x04path\x12\x04hash")
+	msg = appendBytesField(msg, 1, "y")
+	msg = appendVarintField(msg, 3, 7)
+	r := bufio.NewReader(bytes.NewReader(append(appendUvarint(nil, uint64(len(msg))), msg...)))
+
+	args, id, err := readWorkRequest(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"x", "y"}; !reflect.DeepEqual(args, want) || id != 7 {
+		t.Errorf("got %q, %d; want %q, 7", args, id, want)
+	}
+	if _, _, err := readWorkRequest(r); err != io.EOF {
+		t.Errorf("got error %v at end of input; want io.EOF", err)
+	}
+}
+
+type workResponse struct {
+	exitCode int
+	output   string
+	id       uint64
+}
+
+func workRequest(id uint64, args ...string) []byte {
+	var msg []byte
+	for _, a := range args {
+		msg = appendBytesField(msg, requestArgumentsField, a)
+	}
+	msg = appendVarintField(msg, requestIDField, id)
+	return append(appendUvarint(nil, uint64(len(msg))), msg...)
+}
+
+func appendBytesField(b []byte, field uint64, s string) []byte {
+	b = appendUvarint(b, field<<3|wireBytes)
+	b = appendUvarint(b, uint64(len(s)))
+	return append(b, s...)
+}
+
+func readWorkResponse(r *bufio.Reader) (workResponse, error) {
+	var resp workResponse
+	size, err := binary.ReadUvarint(r)
+	if err != nil {
+		return resp, err
+	}
+	msg := make([]byte, size)
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return resp, err
+	}
+	for len(msg) > 0 {
+		key, n := binary.Uvarint(msg)
+		msg = msg[n:]
+		v, n := binary.Uvarint(msg)
+		msg = msg[n:]
+		switch key >> 3 {
+		case responseExitCodeField:
+			resp.exitCode = int(v)
+		case responseOutputField:
+			resp.output = string(msg[:v])
+			msg = msg[v:]
+		case responseRequestIDField:
+			resp.id = v
+		}
+	}
+	return resp, nil
+}
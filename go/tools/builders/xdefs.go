@@ -0,0 +1,82 @@
+// Copyright 2017 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// xdef is a string variable definition passed to the linker with -X.
+type xdef struct {
+	// name is the fully qualified name of the variable, for example,
+	// "example.com/pkg.Version".
+	name string
+
+	// value is the string the variable is set to.
+	value string
+
+	// source describes where the definition came from. It is used in
+	// warnings about conflicting definitions.
+	source string
+}
+
+// extractXdefs removes -X options from "goopts", which are passed through to
+// the linker, and returns the remaining options and the removed definitions.
+func extractXdefs(goopts []string) ([]string, []xdef) {
+	var rest []string
+	var defs []xdef
+	for i := 0; i < len(goopts); i++ {
+		if goopts[i] == "-X" && i+1 < len(goopts) {
+			if split := strings.SplitN(goopts[i+1], "=", 2); len(split) == 2 {
+				defs = append(defs, xdef{name: split[0], value: split[1], source: "link option -X " + goopts[i+1]})
+				i++
+				continue
+			}
+		}
+		rest = append(rest, goopts[i])
+	}
+	return rest, defs
+}
+
+// mergeXdefs returns "defs" with at most one definition per variable. When
+// a variable is defined more than once, the last definition wins, so
+// precedence follows the order of "defs". A warning listing the sources of
+// the definitions is written to "w" if their values differ.
+func mergeXdefs(defs []xdef, w io.Writer) []xdef {
+	last := make(map[string]int)
+	for i, d := range defs {
+		last[d.name] = i
+	}
+
+	var merged []xdef
+	for i, d := range defs {
+		if last[d.name] != i {
+			continue
+		}
+		var others []string
+		for _, o := range defs[:i] {
+			if o.name == d.name && o.value != d.value {
+				others = append(others, o.source)
+			}
+		}
+		if len(others) > 0 {
+			fmt.Fprintf(w, "warning: %s is defined more than once; using %q from %s, ignoring %s\n", d.name, d.value, d.source, strings.Join(others, ", "))
+		}
+		merged = append(merged, d)
+	}
+	return merged
+}
@@ -0,0 +1,51 @@
+// Copyright 2017 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestExtractXdefs(t *testing.T) {
+	rest, defs := extractXdefs([]string{"-o", "out", "-X", "a.b=c", "-s", "-X", "bad"})
+	if want := []string{"-o", "out", "-s", "-X", "bad"}; !reflect.DeepEqual(rest, want) {
+		t.Errorf("got options %q; want %q", rest, want)
+	}
+	if want := []xdef{{name: "a.b", value: "c", source: "link option -X a.b=c"}}; !reflect.DeepEqual(defs, want) {
+		t.Errorf("got definitions %#v; want %#v", defs, want)
+	}
+}
+
+func TestMergeXdefs(t *testing.T) {
+	defs := []xdef{
+		{name: "p.Version", value: "1.0", source: "-X p.Version=VERSION"},
+		{name: "p.Commit", value: "abc", source: "-linkstamp p"},
+		{name: "p.Version", value: "2.0", source: "-linkstamp p"},
+		{name: "p.Commit", value: "abc", source: "link option -X p.Commit=abc"},
+	}
+	var w bytes.Buffer
+	got := mergeXdefs(defs, &w)
+	want := []xdef{defs[2], defs[3]}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %#v; want %#v", got, want)
+	}
+	warnings := strings.Split(strings.TrimSpace(w.String()), "\n")
+	if len(warnings) != 1 || !strings.Contains(warnings[0], "p.Version") || !strings.Contains(warnings[0], "-X p.Version=VERSION") {
+		t.Errorf("got warnings %q; want one warning for p.Version", warnings)
+	}
+}
@@ -0,0 +1,291 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package fuzz checks that Gazelle reaches a fixed point: running it a
+// second time over a repository must not change any build file written by
+// the first run. Repositories are generated from arbitrary bytes, so the
+// check can be driven by go-fuzz as well as by ordinary tests.
+package fuzz
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	bzl "github.com/bazelbuild/buildtools/build"
+	"github.com/bazelbuild/rules_go/go/tools/gazelle/generator"
+	"github.com/bazelbuild/rules_go/go/tools/gazelle/merger"
+	"github.com/bazelbuild/rules_go/go/tools/gazelle/packages"
+	"github.com/bazelbuild/rules_go/go/tools/gazelle/rules"
+)
+
+const (
+	goPrefix      = "example.com/repo"
+	buildFileName = "BUILD"
+)
+
+// Fuzz is the entry point for go-fuzz (github.com/dvyukov/go-fuzz). "data"
+// is decoded into a repository, which is written to a temporary directory
+// and checked with roundTrip. Fuzz panics if the check fails. It returns 1
+// for repositories with Go files, so the fuzzer prefers those inputs.
+func Fuzz(data []byte) int {
+	dir, err := ioutil.TempDir("", "gazelle_fuzz")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(dir)
+
+	l := newLayout(data)
+	if err := l.write(dir); err != nil {
+		panic(err)
+	}
+	if err := roundTrip(dir); err != nil {
+		panic(fmt.Sprintf("input %q: %v", data, err))
+	}
+	if l.hasGo() {
+		return 1
+	}
+	return 0
+}
+
+// roundTrip runs Gazelle over the repository in "dir" twice, merging
+// generated rules into existing build files like "gazelle -mode=fix". It
+// returns an error if a build file written by either run can't be parsed,
+// or if the second run writes different files than the first.
+func roundTrip(dir string) error {
+	first, err := update(dir)
+	if err != nil {
+		return err
+	}
+	second, err := update(dir)
+	if err != nil {
+		return err
+	}
+	for rel, content := range first {
+		if got, ok := second[rel]; !ok {
+			return fmt.Errorf("%s: written on the first run but not the second", rel)
+		} else if got != content {
+			return fmt.Errorf("%s: changed on the second run\nfirst:\n%s\nsecond:\n%s", rel, content, got)
+		}
+	}
+	for rel := range second {
+		if _, ok := first[rel]; !ok {
+			return fmt.Errorf("%s: written on the second run but not the first", rel)
+		}
+	}
+	return nil
+}
+
+// update generates build files for the repository in "dir" and merges them
+// into existing files. It returns the contents of the files it wrote, keyed
+// by slash-separated paths relative to "dir".
+func update(dir string) (map[string]string, error) {
+	g, err := generator.New(packages.NewConfig(), dir, goPrefix, buildFileName, nil, rules.External)
+	if err != nil {
+		return nil, err
+	}
+	written := make(map[string]string)
+	for _, f := range g.Generate(dir) {
+		rel := filepath.ToSlash(f.Path)
+		f.Path = filepath.Join(dir, f.Path)
+		merged, _, err := merger.MergeWithExistingInDir(&merger.Options{}, f, []string{buildFileName}, false)
+		if os.IsNotExist(err) {
+			merged = f
+		} else if err != nil {
+			return nil, err
+		} else if merged == nil {
+			continue
+		}
+		bzl.Rewrite(merged, nil)
+		data := bzl.Format(merged)
+		if _, err := bzl.Parse(merged.Path, data); err != nil {
+			return nil, fmt.Errorf("%s: generated file can't be parsed: %v\n%s", rel, err, data)
+		}
+		if err := ioutil.WriteFile(merged.Path, data, 0666); err != nil {
+			return nil, err
+		}
+		written[rel] = string(data)
+	}
+	return written, nil
+}
+
+// source supplies choices from fuzzer input. Once the input is used up,
+// every choice is 0, so any input describes a valid repository.
+type source []byte
+
+// intn returns a choice in [0, n).
+func (s *source) intn(n int) int {
+	if len(*s) == 0 {
+		return 0
+	}
+	b := (*s)[0]
+	*s = (*s)[1:]
+	return int(b) % n
+}
+
+// layout is a repository, as a map from slash-separated file paths to
+// file contents.
+type layout map[string]string
+
+// layoutDirs are the directories a layout may have packages in.
+var layoutDirs = []string{"", "a", "a/b", "cmd/c"}
+
+// layoutImports are the imports a Go file may have, in addition to packages
+// in layoutDirs.
+var layoutImports = []string{"fmt", "github.com/ext/dep", "golang.org/x/sys/unix"}
+
+// layoutFiles are the Go files a package may have. Each name selects a
+// kind of file: platform-specific, tagged, ignored, cgo, or test.
+var layoutFiles = []string{
+	"lib.go",
+	"lib_linux.go",
+	"lib_windows_amd64.go",
+	"tagged.go",
+	"gen.go",
+	"cgo.go",
+	"lib_test.go",
+	"ext_test.go",
+}
+
+// newLayout decodes a repository from "data".
+func newLayout(data []byte) layout {
+	s := source(data)
+	l := make(layout)
+	for _, dir := range layoutDirs {
+		if dir != "" && s.intn(4) == 0 {
+			continue
+		}
+		pkg := "repo"
+		if dir != "" {
+			pkg = path.Base(dir)
+		}
+		if s.intn(3) == 0 {
+			pkg = "main"
+		}
+		for _, name := range layoutFiles {
+			if s.intn(2) == 0 {
+				continue
+			}
+			l[path.Join(dir, name)] = goFile(&s, dir, name, pkg)
+		}
+		if build := buildFile(&s, dir); build != "" {
+			l[path.Join(dir, buildFileName)] = build
+		}
+	}
+	return l
+}
+
+// goFile returns the contents of a Go file named "name" in package "pkg".
+func goFile(s *source, dir, name, pkg string) string {
+	var b bytes.Buffer
+	switch name {
+	case "tagged.go":
+		b.WriteString("// +build foo\n\n")
+	case "gen.go":
+		b.WriteString("// +build ignore\n\n")
+		pkg = "main"
+	case "ext_test.go":
+		pkg += "_test"
+	}
+	fmt.Fprintf(&b, "package %s\n\n", pkg)
+	if name == "cgo.go" {
+		b.WriteString("// #cgo LDFLAGS: -lm\nimport \"C\"\n\n")
+	}
+	var imports []string
+	for _, d := range layoutDirs {
+		if d != dir && s.intn(3) == 0 {
+			imports = append(imports, path.Join(goPrefix, d))
+		}
+	}
+	for _, imp := range layoutImports {
+		if s.intn(3) == 0 {
+			imports = append(imports, imp)
+		}
+	}
+	for _, imp := range imports {
+		fmt.Fprintf(&b, "import _ %q\n", imp)
+	}
+	return b.String()
+}
+
+// buildFile returns the contents of an existing build file for "dir", or ""
+// if there is none. Existing files may have rules Gazelle doesn't generate,
+// stale rules with # keep comments, or rules whose kinds conflict with
+// generated rules.
+func buildFile(s *source, dir string) string {
+	switch s.intn(4) {
+	case 1:
+		return `filegroup(
+    name = "data",
+    srcs = glob(["*.txt"]),
+)
+`
+	case 2:
+		return `load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+go_library(
+    name = "go_default_library",
+    srcs = ["old.go"],
+    visibility = ["//visibility:private"],
+    deps = [
+        "//extra:go_default_library",  # keep
+        "//stale:go_default_library",
+    ],
+)
+`
+	case 3:
+		name := "repo"
+		if dir != "" {
+			name = path.Base(dir)
+		}
+		return fmt.Sprintf(`load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+go_library(
+    name = %q,
+    srcs = ["lib.go"],
+)
+`, name)
+	default:
+		return ""
+	}
+}
+
+// write writes the files in the layout under "dir".
+func (l layout) write(dir string) error {
+	for p, content := range l {
+		fp := filepath.Join(dir, filepath.FromSlash(p))
+		if err := os.MkdirAll(filepath.Dir(fp), 0777); err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(fp, []byte(content), 0666); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// hasGo returns whether the layout has any Go files.
+func (l layout) hasGo() bool {
+	for p := range l {
+		if strings.HasSuffix(p, ".go") {
+			return true
+		}
+	}
+	return false
+}
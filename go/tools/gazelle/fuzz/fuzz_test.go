@@ -0,0 +1,69 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fuzz
+
+import (
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"testing"
+)
+
+// TestRoundTrip checks repositories decoded from pseudo-random inputs. The
+// seed is fixed so failures are reproducible; a failing input can be added
+// to a go-fuzz corpus to explore similar repositories.
+func TestRoundTrip(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	inputs := [][]byte{nil}
+	for i := 0; i < 50; i++ {
+		data := make([]byte, 64)
+		r.Read(data)
+		inputs = append(inputs, data)
+	}
+
+	for _, data := range inputs {
+		dir, err := ioutil.TempDir(os.Getenv("TEST_TMPDIR"), "fuzz")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := newLayout(data).write(dir); err != nil {
+			t.Fatal(err)
+		}
+		if err := roundTrip(dir); err != nil {
+			t.Errorf("input %q: %v", data, err)
+		}
+		os.RemoveAll(dir)
+	}
+}
+
+func TestNewLayout(t *testing.T) {
+	if l := newLayout(nil); len(l) != 0 {
+		t.Errorf("empty input: got %v; want an empty layout", l)
+	}
+	all := make([]byte, 256)
+	for i := range all {
+		all[i] = 1
+	}
+	l := newLayout(all)
+	if !l.hasGo() {
+		t.Errorf("got a layout without Go files: %v", l)
+	}
+	for _, p := range []string{"lib.go", "a/b/ext_test.go", "cmd/c/BUILD"} {
+		if _, ok := l[p]; !ok {
+			t.Errorf("layout is missing %s", p)
+		}
+	}
+}
@@ -0,0 +1,61 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bufio"
+	"io"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/bazelbuild/rules_go/go/tools/gazelle/packages"
+)
+
+// readChangedDirs reads a list of changed files and directories from "r",
+// one per line, relative to "repoRoot", like the output of
+// "git diff --name-only". It returns the sorted, distinct directories that
+// contain them, or the paths themselves if they are directories. Blank
+// lines are skipped. Paths whose directories no longer exist, for example,
+// in deleted directories, are ignored. Directories are looked up like Walk
+// lists them, in c.Manifest if it is set.
+func readChangedDirs(c *packages.Config, r io.Reader, repoRoot string) ([]string, error) {
+	seen := make(map[string]bool)
+	var dirs []string
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if line == "" {
+			continue
+		}
+		dir := filepath.Join(repoRoot, filepath.FromSlash(line))
+		if !packages.IsDir(c, repoRoot, dir) {
+			dir = filepath.Dir(dir)
+			if !packages.IsDir(c, repoRoot, dir) {
+				continue
+			}
+		}
+		if !seen[dir] {
+			seen[dir] = true
+			dirs = append(dirs, dir)
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	sort.Strings(dirs)
+	return dirs, nil
+}
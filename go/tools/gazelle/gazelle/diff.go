@@ -16,6 +16,7 @@ limitations under the License.
 package main
 
 import (
+	"bytes"
 	"io/ioutil"
 	"os"
 	"os/exec"
@@ -23,14 +24,25 @@ import (
 	bzl "github.com/bazelbuild/buildtools/build"
 )
 
+// filesDiffer is set by diffFile when a file would be created or changed.
+// In diff mode, gazelle exits with a non-zero status if it is set, so that
+// checks can fail when build files are out of date.
+var filesDiffer bool
+
 func diffFile(file *bzl.File) error {
+	content := bzl.Format(file)
+	if old, err := ioutil.ReadFile(file.Path); err == nil && bytes.Equal(old, content) {
+		return nil
+	}
+	filesDiffer = true
+
 	f, err := ioutil.TempFile("", getBuildFileName())
 	if err != nil {
 		return err
 	}
 	defer os.Remove(f.Name())
 	defer f.Close()
-	if _, err := f.Write(bzl.Format(file)); err != nil {
+	if _, err := f.Write(content); err != nil {
 		return err
 	}
 	if err := f.Sync(); err != nil {
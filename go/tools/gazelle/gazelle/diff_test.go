@@ -0,0 +1,72 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	bzl "github.com/bazelbuild/buildtools/build"
+)
+
+func TestDiffFile(t *testing.T) {
+	defer func() { filesDiffer = false }()
+
+	tmpdir := os.Getenv("TEST_TMPDIR")
+	dir, err := ioutil.TempDir(tmpdir, "")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir(%q, %q) failed with %v; want success", tmpdir, "", err)
+	}
+	defer os.RemoveAll(dir)
+
+	f := &bzl.File{
+		Path: filepath.Join(dir, "BUILD.bazel"),
+		Stmt: []bzl.Expr{
+			&bzl.CallExpr{
+				X: &bzl.LiteralExpr{Token: "foo_rule"},
+				List: []bzl.Expr{
+					&bzl.BinaryExpr{
+						X:  &bzl.LiteralExpr{Token: "name"},
+						Op: "=",
+						Y:  &bzl.StringExpr{Value: "bar"},
+					},
+				},
+			},
+		},
+	}
+	if err := ioutil.WriteFile(f.Path, bzl.Format(f), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if err := diffFile(f); err != nil {
+		t.Errorf("diffFile(%q) failed with %v; want success", f.Path, err)
+	}
+	if filesDiffer {
+		t.Errorf("diffFile(%q) of an up to date file: got filesDiffer true; want false", f.Path)
+	}
+
+	f.Path = filepath.Join(dir, "sub", "BUILD.bazel")
+	if err := diffFile(f); err != nil {
+		t.Errorf("diffFile(%q) failed with %v; want success", f.Path, err)
+	}
+	if !filesDiffer {
+		t.Errorf("diffFile(%q) of a missing file: got filesDiffer false; want true", f.Path)
+	}
+	if _, err := os.Stat(f.Path); !os.IsNotExist(err) {
+		t.Errorf("diffFile(%q) created the file; want it to be missing", f.Path)
+	}
+}
@@ -0,0 +1,296 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path"
+	"strings"
+
+	bzl "github.com/bazelbuild/buildtools/build"
+	"github.com/bazelbuild/rules_go/go/tools/gazelle/packages"
+	"github.com/bazelbuild/rules_go/go/tools/gazelle/rules"
+)
+
+// customKindAttrsDirective is a comment in the root build file that adds an
+// attribute to every generated rule of a kind. For example,
+//
+//	# gazelle:custom_kind_attrs go_library team = "backend"
+//
+// adds team = "backend" to new go_library rules. Since the attribute is not
+// one that gazelle merges, it is owned by the user once the rule exists.
+const customKindAttrsDirective = "# gazelle:custom_kind_attrs"
+
+// followDirective is a comment in the root build file that names a symbolic
+// link to a directory, relative to the repository root, that gazelle should
+// descend into. For example,
+//
+//	# gazelle:follow third_party/generated
+//
+// Links that are not named are only followed with -follow_symlinks.
+const followDirective = "# gazelle:follow"
+
+// skipDirDirective is a comment in the root build file that names a pattern
+// of directories gazelle should skip, in the syntax of packages.Config.SkipDirs.
+// For example,
+//
+//	# gazelle:skip_dir node_modules
+//	# gazelle:skip_dir third_party/*
+const skipDirDirective = "# gazelle:skip_dir"
+
+// testSuiteDirective is a comment in the root build file that names a build
+// tag selecting a separate suite of tests. For example,
+//
+//	# gazelle:test_suite integration
+//
+// causes test files that are only built with the integration tag to be
+// put in their own go_test rules, named with an "_integration" suffix.
+const testSuiteDirective = "# gazelle:test_suite"
+
+// localOverrideDirective is a comment in the root build file that maps an
+// import path prefix to a repository providing it, usually a
+// local_repository with a checkout of a dependency being worked on. For
+// example,
+//
+//	# gazelle:local_override github.com/foo/bar bar_fork
+//
+// resolves imports under github.com/foo/bar to labels in @bar_fork. The
+// drift command doesn't report overridden modules as missing or mismatched.
+const localOverrideDirective = "# gazelle:local_override"
+
+// pkgConfigDirective is a comment in the root build file that maps a package
+// named in "#cgo pkg-config" directives to a cc_library label. For example,
+//
+//	# gazelle:pkg_config libpng //third_party/libpng
+//
+// adds //third_party/libpng to cdeps of rules built from files that use
+// libpng.
+const pkgConfigDirective = "# gazelle:pkg_config"
+
+// loadDirectives reads directives from the root build file of the repository
+// and applies them to rules.CustomKindAttrs, the FollowedSymlinks, SkipDirs,
+// TestSuiteTags, and SrcsStyle fields of "c", rules.LocalOverrides, and
+// rules.PkgConfigLabels.
+func loadDirectives(c *packages.Config, repo string) error {
+	p, err := findBuildFile(repo)
+	if err != nil {
+		return err
+	}
+	data, err := ioutil.ReadFile(p)
+	if err != nil {
+		return err
+	}
+	f, err := bzl.Parse(p, data)
+	if err != nil {
+		return err
+	}
+	if err := parseCustomKindAttrs(f, rules.CustomKindAttrs); err != nil {
+		return err
+	}
+	if err := parseFollowDirectives(f, c.FollowedSymlinks); err != nil {
+		return err
+	}
+	skipDirs, err := parseSkipDirDirectives(f)
+	if err != nil {
+		return err
+	}
+	c.SkipDirs = append(c.SkipDirs, skipDirs...)
+	if err := parseTestSuiteDirectives(f, c.TestSuiteTags); err != nil {
+		return err
+	}
+	style, err := parseSrcsStyleDirective(f)
+	if err != nil {
+		return err
+	}
+	if style != "" {
+		c.SrcsStyle = style
+	}
+	if err := parseLocalOverrideDirectives(f, rules.LocalOverrides); err != nil {
+		return err
+	}
+	return parsePkgConfigDirectives(f, rules.PkgConfigLabels)
+}
+
+// directiveComments returns top-level comments in f.
+func directiveComments(f *bzl.File) []bzl.Comment {
+	var comments []bzl.Comment
+	for _, s := range f.Stmt {
+		comments = append(comments, s.Comment().Before...)
+		comments = append(comments, s.Comment().After...)
+	}
+	return append(comments, f.Comments.After...)
+}
+
+// parseCustomKindAttrs adds attributes from custom_kind_attrs directives in
+// top-level comments of f to "attrs", which maps kinds to attribute names to
+// values.
+func parseCustomKindAttrs(f *bzl.File, attrs map[string]map[string]bzl.Expr) error {
+	for _, c := range directiveComments(f) {
+		if !strings.HasPrefix(c.Token, customKindAttrsDirective+" ") {
+			continue
+		}
+		fields := strings.Fields(strings.TrimPrefix(c.Token, customKindAttrsDirective))
+		if len(fields) < 2 {
+			return fmt.Errorf("%s: invalid directive %q: want kind attr = value", f.Path, c.Token)
+		}
+		kind := fields[0]
+		assignment := strings.Join(fields[1:], " ")
+		af, err := bzl.Parse(f.Path, []byte(assignment))
+		if err != nil {
+			return fmt.Errorf("%s: invalid directive %q: %v", f.Path, c.Token, err)
+		}
+		var b *bzl.BinaryExpr
+		if len(af.Stmt) == 1 {
+			b, _ = af.Stmt[0].(*bzl.BinaryExpr)
+		}
+		if b == nil || b.Op != "=" {
+			return fmt.Errorf("%s: invalid directive %q: want kind attr = value", f.Path, c.Token)
+		}
+		name, ok := b.X.(*bzl.LiteralExpr)
+		if !ok {
+			return fmt.Errorf("%s: invalid directive %q: want kind attr = value", f.Path, c.Token)
+		}
+		if attrs[kind] == nil {
+			attrs[kind] = make(map[string]bzl.Expr)
+		}
+		attrs[kind][name.Token] = b.Y
+	}
+	return nil
+}
+
+// parseFollowDirectives adds paths from follow directives in top-level
+// comments of f to "followed".
+func parseFollowDirectives(f *bzl.File, followed map[string]bool) error {
+	for _, c := range directiveComments(f) {
+		if !strings.HasPrefix(c.Token, followDirective+" ") {
+			continue
+		}
+		fields := strings.Fields(strings.TrimPrefix(c.Token, followDirective))
+		if len(fields) != 1 {
+			return fmt.Errorf("%s: invalid directive %q: want one path", f.Path, c.Token)
+		}
+		rel := path.Clean(fields[0])
+		if path.IsAbs(rel) || rel == "." || rel == ".." || strings.HasPrefix(rel, "../") {
+			return fmt.Errorf("%s: invalid directive %q: path must be inside the repository", f.Path, c.Token)
+		}
+		followed[rel] = true
+	}
+	return nil
+}
+
+// parseSkipDirDirectives returns the patterns from skip_dir directives in
+// top-level comments of f.
+func parseSkipDirDirectives(f *bzl.File) ([]string, error) {
+	var patterns []string
+	for _, c := range directiveComments(f) {
+		if !strings.HasPrefix(c.Token, skipDirDirective+" ") {
+			continue
+		}
+		fields := strings.Fields(strings.TrimPrefix(c.Token, skipDirDirective))
+		if len(fields) != 1 {
+			return nil, fmt.Errorf("%s: invalid directive %q: want one pattern", f.Path, c.Token)
+		}
+		if err := checkSkipDirPattern(fields[0]); err != nil {
+			return nil, fmt.Errorf("%s: invalid directive %q: %v", f.Path, c.Token, err)
+		}
+		patterns = append(patterns, fields[0])
+	}
+	return patterns, nil
+}
+
+// checkSkipDirPattern returns an error if "pattern" is not a valid pattern
+// for packages.Config.SkipDirs.
+func checkSkipDirPattern(pattern string) error {
+	if _, err := path.Match(pattern, ""); err != nil {
+		return fmt.Errorf("invalid pattern %q: %v", pattern, err)
+	}
+	if path.IsAbs(pattern) || pattern == ".." || strings.HasPrefix(pattern, "../") {
+		return fmt.Errorf("pattern %q must be inside the repository", pattern)
+	}
+	return nil
+}
+
+// parseTestSuiteDirectives adds tags from test_suite directives in top-level
+// comments of f to "tags".
+func parseTestSuiteDirectives(f *bzl.File, tags map[string]bool) error {
+	for _, c := range directiveComments(f) {
+		if !strings.HasPrefix(c.Token, testSuiteDirective+" ") {
+			continue
+		}
+		fields := strings.Fields(strings.TrimPrefix(c.Token, testSuiteDirective))
+		if len(fields) != 1 || strings.HasPrefix(fields[0], "!") {
+			return fmt.Errorf("%s: invalid directive %q: want one tag", f.Path, c.Token)
+		}
+		tags[fields[0]] = true
+	}
+	return nil
+}
+
+// parseSrcsStyleDirective returns the argument of the last srcs_style
+// directive in top-level comments of f, or "" if there is none. In the root
+// build file, the directive sets the style for the whole repository.
+func parseSrcsStyleDirective(f *bzl.File) (string, error) {
+	style := ""
+	for _, c := range directiveComments(f) {
+		arg, ok, err := packages.ParseSrcsStyleDirective(c.Token)
+		if err != nil {
+			return "", fmt.Errorf("%s: %v", f.Path, err)
+		}
+		if ok {
+			style = arg
+		}
+	}
+	return style, nil
+}
+
+// parseLocalOverrideDirectives adds mappings from local_override directives
+// in top-level comments of f to "overrides", which maps import path
+// prefixes to repository names.
+func parseLocalOverrideDirectives(f *bzl.File, overrides map[string]string) error {
+	for _, c := range directiveComments(f) {
+		if !strings.HasPrefix(c.Token, localOverrideDirective+" ") {
+			continue
+		}
+		fields := strings.Fields(strings.TrimPrefix(c.Token, localOverrideDirective))
+		if len(fields) != 2 {
+			return fmt.Errorf("%s: invalid directive %q: want import path prefix and repository name", f.Path, c.Token)
+		}
+		prefix, repo := path.Clean(fields[0]), strings.TrimPrefix(fields[1], "@")
+		if prefix == "." || strings.HasPrefix(prefix, "/") || strings.HasPrefix(prefix, "../") || repo == "" {
+			return fmt.Errorf("%s: invalid directive %q: want import path prefix and repository name", f.Path, c.Token)
+		}
+		overrides[prefix] = repo
+	}
+	return nil
+}
+
+// parsePkgConfigDirectives adds mappings from pkg_config directives in
+// top-level comments of f to "labels", which maps pkg-config package names
+// to labels.
+func parsePkgConfigDirectives(f *bzl.File, labels map[string]string) error {
+	for _, c := range directiveComments(f) {
+		if !strings.HasPrefix(c.Token, pkgConfigDirective+" ") {
+			continue
+		}
+		fields := strings.Fields(strings.TrimPrefix(c.Token, pkgConfigDirective))
+		if len(fields) != 2 || !strings.HasPrefix(fields[1], "//") && !strings.HasPrefix(fields[1], "@") {
+			return fmt.Errorf("%s: invalid directive %q: want package name and label", f.Path, c.Token)
+		}
+		labels[fields[0]] = fields[1]
+	}
+	return nil
+}
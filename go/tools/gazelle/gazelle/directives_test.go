@@ -0,0 +1,202 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	bzl "github.com/bazelbuild/buildtools/build"
+)
+
+func TestParseCustomKindAttrs(t *testing.T) {
+	f, err := bzl.Parse("BUILD", []byte(`
+# gazelle:custom_kind_attrs go_library team = "backend"
+# gazelle:custom_kind_attrs go_test tags = ["small", "unit"]
+go_prefix("example.com/repo")
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	attrs := make(map[string]map[string]bzl.Expr)
+	if err := parseCustomKindAttrs(f, attrs); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := bzl.FormatString(attrs["go_library"]["team"]), `"backend"`; got != want {
+		t.Errorf("go_library team: got %s; want %s", got, want)
+	}
+	if got, want := bzl.FormatString(attrs["go_test"]["tags"]), `[
+    "small",
+    "unit",
+]`; got != want {
+		t.Errorf("go_test tags: got %s; want %s", got, want)
+	}
+
+	bad, err := bzl.Parse("BUILD", []byte("# gazelle:custom_kind_attrs go_library\ngo_prefix(\"x\")\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := parseCustomKindAttrs(bad, attrs); err == nil {
+		t.Error("got success for directive without attribute; want error")
+	}
+}
+
+func TestParseFollowDirectives(t *testing.T) {
+	f, err := bzl.Parse("BUILD", []byte(`
+# gazelle:follow third_party/generated
+# gazelle:follow shared/
+go_prefix("example.com/repo")
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	followed := make(map[string]bool)
+	if err := parseFollowDirectives(f, followed); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]bool{"third_party/generated": true, "shared": true}
+	if !reflect.DeepEqual(followed, want) {
+		t.Errorf("got %v; want %v", followed, want)
+	}
+
+	bad, err := bzl.Parse("BUILD", []byte("# gazelle:follow ../outside\ngo_prefix(\"x\")\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := parseFollowDirectives(bad, followed); err == nil {
+		t.Error("got success for path outside the repository; want error")
+	}
+}
+
+func TestParseSkipDirDirectives(t *testing.T) {
+	f, err := bzl.Parse("BUILD", []byte(`
+# gazelle:skip_dir node_modules
+# gazelle:skip_dir third_party/*
+go_prefix("example.com/repo")
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := parseSkipDirDirectives(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"node_modules", "third_party/*"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v; want %v", got, want)
+	}
+
+	for _, directive := range []string{"# gazelle:skip_dir [", "# gazelle:skip_dir ../outside", "# gazelle:skip_dir a b"} {
+		bad, err := bzl.Parse("BUILD", []byte(directive+"\ngo_prefix(\"x\")\n"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := parseSkipDirDirectives(bad); err == nil {
+			t.Errorf("%s: got success; want error", directive)
+		}
+	}
+}
+
+func TestParseTestSuiteDirectives(t *testing.T) {
+	f, err := bzl.Parse("BUILD", []byte(`
+# gazelle:test_suite integration
+# gazelle:test_suite e2e
+go_prefix("example.com/repo")
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tags := make(map[string]bool)
+	if err := parseTestSuiteDirectives(f, tags); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]bool{"integration": true, "e2e": true}
+	if !reflect.DeepEqual(tags, want) {
+		t.Errorf("got %v; want %v", tags, want)
+	}
+}
+
+func TestParseSrcsStyleDirective(t *testing.T) {
+	for _, tc := range []struct {
+		desc, content, want string
+		wantErr             bool
+	}{
+		{desc: "none", content: `go_prefix("example.com/repo")`},
+		{desc: "glob", content: "# gazelle:srcs_style glob\ngo_prefix(\"example.com/repo\")\n", want: "glob"},
+		{desc: "invalid", content: "# gazelle:srcs_style globs\ngo_prefix(\"example.com/repo\")\n", wantErr: true},
+	} {
+		f, err := bzl.Parse("BUILD", []byte(tc.content))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := parseSrcsStyleDirective(f)
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("%s: got success; want error", tc.desc)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tc.desc, err)
+		} else if got != tc.want {
+			t.Errorf("%s: got %q; want %q", tc.desc, got, tc.want)
+		}
+	}
+}
+
+func TestParseLocalOverrideDirectives(t *testing.T) {
+	f, err := bzl.Parse("BUILD", []byte(`
+# gazelle:local_override github.com/foo/bar bar_fork
+# gazelle:local_override example.com/baz/ @baz_local
+go_prefix("example.com/repo")
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	overrides := make(map[string]string)
+	if err := parseLocalOverrideDirectives(f, overrides); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"github.com/foo/bar": "bar_fork",
+		"example.com/baz":    "baz_local",
+	}
+	if !reflect.DeepEqual(overrides, want) {
+		t.Errorf("got %v; want %v", overrides, want)
+	}
+}
+
+func TestParsePkgConfigDirectives(t *testing.T) {
+	f, err := bzl.Parse("BUILD", []byte(`
+# gazelle:pkg_config libpng //third_party/libpng
+# gazelle:pkg_config x11 @x11//:xlib
+go_prefix("example.com/repo")
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	labels := make(map[string]string)
+	if err := parsePkgConfigDirectives(f, labels); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"libpng": "//third_party/libpng",
+		"x11":    "@x11//:xlib",
+	}
+	if !reflect.DeepEqual(labels, want) {
+		t.Errorf("got %v; want %v", labels, want)
+	}
+}
@@ -0,0 +1,277 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	bzl "github.com/bazelbuild/buildtools/build"
+	"github.com/bazelbuild/rules_go/go/tools/gazelle/packages"
+)
+
+// driftCommand is the first positional argument that selects drift mode.
+// In drift mode, gazelle compares module requirements in go.mod with
+// go_repository rules declared in WORKSPACE (and any additional files
+// listed with -repo_files) and reports differences. Nothing is modified.
+// Modules covered by local_override directives are listed separately and
+// are not compared.
+const driftCommand = "drift"
+
+// moduleRequirement is a requirement from a go.mod file.
+type moduleRequirement struct {
+	path, version string
+}
+
+// repositoryRule is a go_repository or new_go_repository rule declared
+// in WORKSPACE or in a macro file.
+type repositoryRule struct {
+	name, importpath, version string
+}
+
+// driftReport describes differences between go.mod and repository rules.
+type driftReport struct {
+	// added lists requirements in go.mod with no corresponding rule.
+	added []moduleRequirement
+
+	// removed lists rules with no corresponding requirement in go.mod.
+	removed []repositoryRule
+
+	// mismatched lists requirements whose version differs from the rule.
+	mismatched []versionMismatch
+
+	// overridden lists requirements covered by a local override. These are
+	// not compared with repository rules.
+	overridden []moduleRequirement
+}
+
+type versionMismatch struct {
+	req  moduleRequirement
+	rule repositoryRule
+}
+
+func (r driftReport) isEmpty() bool {
+	return len(r.added) == 0 && len(r.removed) == 0 && len(r.mismatched) == 0
+}
+
+// runDrift compares the go.mod file in repoRoot with repository rules in
+// WORKSPACE and in repoFiles, and writes a summary to w. "overrides" maps
+// import path prefixes to repositories, as in rules.LocalOverrides.
+func runDrift(w io.Writer, repoRoot string, repoFiles []string, overrides map[string]string) error {
+	reqs, err := readGoModRequirements(repoRoot)
+	if err != nil {
+		return err
+	}
+	repoRules, err := readRepositoryRules(repoRoot, repoFiles)
+	if err != nil {
+		return err
+	}
+
+	report := compareDependencies(reqs, repoRules, overrides)
+	printDriftReport(w, report)
+	return nil
+}
+
+// readGoModRequirements returns the requirements in the go.mod file in
+// repoRoot.
+func readGoModRequirements(repoRoot string) ([]moduleRequirement, error) {
+	goModPath := filepath.Join(repoRoot, "go.mod")
+	goModData, err := ioutil.ReadFile(goModPath)
+	if err != nil {
+		return nil, err
+	}
+	return parseGoModRequirements(goModPath, goModData)
+}
+
+// readRepositoryRules returns the repository rules declared in WORKSPACE
+// and in repoFiles. Relative paths are resolved from repoRoot.
+func readRepositoryRules(repoRoot string, repoFiles []string) ([]repositoryRule, error) {
+	var repoRules []repositoryRule
+	for _, p := range append([]string{"WORKSPACE"}, repoFiles...) {
+		if !filepath.IsAbs(p) {
+			p = filepath.Join(repoRoot, p)
+		}
+		data, err := ioutil.ReadFile(p)
+		if err != nil {
+			return nil, err
+		}
+		f, err := bzl.Parse(p, data)
+		if err != nil {
+			return nil, err
+		}
+		repoRules = append(repoRules, findRepositoryRules(f)...)
+	}
+	return repoRules, nil
+}
+
+// parseGoModRequirements returns the requirements listed in "require"
+// directives of a go.mod file. Both the single-line and block forms are
+// recognized. Other directives are ignored.
+func parseGoModRequirements(path string, data []byte) ([]moduleRequirement, error) {
+	lines, err := packages.ParseModDirective(path, data, "require")
+	if err != nil {
+		return nil, err
+	}
+	var reqs []moduleRequirement
+	for _, l := range lines {
+		if len(l.Args) != 2 {
+			return nil, fmt.Errorf("%s:%d: invalid requirement: %q", path, l.Line, strings.Join(l.Args, " "))
+		}
+		reqs = append(reqs, moduleRequirement{path: l.Args[0], version: l.Args[1]})
+	}
+	return reqs, nil
+}
+
+// findRepositoryRules returns go_repository and new_go_repository rules
+// in f that have an importpath attribute.
+func findRepositoryRules(f *bzl.File) []repositoryRule {
+	var repoRules []repositoryRule
+	for _, kind := range []string{"go_repository", "new_go_repository"} {
+		for _, r := range f.Rules(kind) {
+			importpath := r.AttrString("importpath")
+			if importpath == "" {
+				continue
+			}
+			version := r.AttrString("version")
+			if version == "" {
+				version = r.AttrString("tag")
+			}
+			if version == "" {
+				version = r.AttrString("commit")
+			}
+			repoRules = append(repoRules, repositoryRule{
+				name:       r.Name(),
+				importpath: importpath,
+				version:    version,
+			})
+		}
+	}
+	return repoRules
+}
+
+// compareDependencies matches requirements with repository rules by import
+// path and reports the differences. Requirements and rules for modules
+// covered by "overrides" are left alone. Results are sorted by import path.
+func compareDependencies(reqs []moduleRequirement, repoRules []repositoryRule, overrides map[string]string) driftReport {
+	var report driftReport
+	ruleMap := make(map[string]repositoryRule)
+	for _, r := range repoRules {
+		ruleMap[r.importpath] = r
+	}
+	reqMap := make(map[string]bool)
+	for _, req := range reqs {
+		reqMap[req.path] = true
+		if isOverridden(req.path, overrides) {
+			report.overridden = append(report.overridden, req)
+			continue
+		}
+		r, ok := ruleMap[req.path]
+		if !ok {
+			report.added = append(report.added, req)
+			continue
+		}
+		if !versionsMatch(req.version, r.version) {
+			report.mismatched = append(report.mismatched, versionMismatch{req: req, rule: r})
+		}
+	}
+	for _, r := range repoRules {
+		if !reqMap[r.importpath] && !isOverridden(r.importpath, overrides) {
+			report.removed = append(report.removed, r)
+		}
+	}
+
+	sort.Slice(report.added, func(i, j int) bool {
+		return report.added[i].path < report.added[j].path
+	})
+	sort.Slice(report.removed, func(i, j int) bool {
+		return report.removed[i].importpath < report.removed[j].importpath
+	})
+	sort.Slice(report.mismatched, func(i, j int) bool {
+		return report.mismatched[i].req.path < report.mismatched[j].req.path
+	})
+	sort.Slice(report.overridden, func(i, j int) bool {
+		return report.overridden[i].path < report.overridden[j].path
+	})
+	return report
+}
+
+// isOverridden returns whether a prefix in "overrides" covers any part of
+// the module "modPath": the module itself, or a package inside it.
+func isOverridden(modPath string, overrides map[string]string) bool {
+	for prefix := range overrides {
+		if modPath == prefix || strings.HasPrefix(modPath, prefix+"/") || strings.HasPrefix(prefix, modPath+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// versionsMatch returns whether a module version from go.mod refers to the
+// same revision as a version, tag, or commit from a repository rule.
+// Pseudo-versions (for example, "v0.0.0-20170101000000-abcdef123456") match
+// commits that start with the same abbreviated hash. Full commit hashes from
+// lock files match abbreviated commits.
+func versionsMatch(modVersion, ruleVersion string) bool {
+	modVersion = strings.TrimSuffix(modVersion, "+incompatible")
+	if modVersion == ruleVersion {
+		return true
+	}
+	if commitRe.MatchString(modVersion) && len(ruleVersion) >= 7 && strings.HasPrefix(modVersion, ruleVersion) {
+		return true
+	}
+	if i := strings.LastIndex(modVersion, "-"); i >= 0 && ruleVersion != "" {
+		hash := modVersion[i+1:]
+		if len(hash) >= 12 && (strings.HasPrefix(ruleVersion, hash) || strings.HasPrefix(hash, ruleVersion)) {
+			return true
+		}
+	}
+	return false
+}
+
+func printDriftReport(w io.Writer, report driftReport) {
+	if len(report.overridden) > 0 {
+		fmt.Fprintln(w, "overridden by local_override directives (not compared):")
+		for _, req := range report.overridden {
+			fmt.Fprintf(w, "\t%s %s\n", req.path, req.version)
+		}
+	}
+	if report.isEmpty() {
+		fmt.Fprintln(w, "go.mod and repository rules are in sync")
+		return
+	}
+	if len(report.added) > 0 {
+		fmt.Fprintln(w, "in go.mod but not declared as repositories:")
+		for _, req := range report.added {
+			fmt.Fprintf(w, "\t%s %s\n", req.path, req.version)
+		}
+	}
+	if len(report.removed) > 0 {
+		fmt.Fprintln(w, "declared as repositories but not in go.mod:")
+		for _, r := range report.removed {
+			fmt.Fprintf(w, "\t%s (%s)\n", r.importpath, r.name)
+		}
+	}
+	if len(report.mismatched) > 0 {
+		fmt.Fprintln(w, "version mismatches:")
+		for _, m := range report.mismatched {
+			fmt.Fprintf(w, "\t%s: go.mod has %s, %s has %s\n", m.req.path, m.req.version, m.rule.name, m.rule.version)
+		}
+	}
+}
@@ -0,0 +1,119 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	bzl "github.com/bazelbuild/buildtools/build"
+)
+
+func TestParseGoModRequirements(t *testing.T) {
+	data := []byte(`module example.com/repo
+
+require github.com/foo/bar v1.2.3
+
+require (
+	golang.org/x/tools v0.0.0-20170101000000-abcdef123456 // indirect
+	"github.com/quoted/mod" v0.1.0
+)
+
+replace github.com/foo/bar => ../bar
+`)
+	got, err := parseGoModRequirements("go.mod", data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []moduleRequirement{
+		{path: "github.com/foo/bar", version: "v1.2.3"},
+		{path: "golang.org/x/tools", version: "v0.0.0-20170101000000-abcdef123456"},
+		{path: "github.com/quoted/mod", version: "v0.1.0"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %#v; want %#v", got, want)
+	}
+}
+
+func TestCompareDependencies(t *testing.T) {
+	workspace := []byte(`
+go_repository(
+    name = "com_github_foo_bar",
+    importpath = "github.com/foo/bar",
+    tag = "v1.2.0",
+)
+
+go_repository(
+    name = "org_golang_x_tools",
+    commit = "abcdef1234567890",
+    importpath = "golang.org/x/tools",
+)
+
+new_go_repository(
+    name = "com_github_old_dep",
+    importpath = "github.com/old/dep",
+    tag = "v1.0.0",
+)
+`)
+	f, err := bzl.Parse("WORKSPACE", workspace)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reqs := []moduleRequirement{
+		{path: "github.com/foo/bar", version: "v1.2.3"},
+		{path: "golang.org/x/tools", version: "v0.0.0-20170101000000-abcdef123456"},
+		{path: "github.com/new/dep", version: "v0.1.0"},
+	}
+
+	got := compareDependencies(reqs, findRepositoryRules(f), nil)
+	want := driftReport{
+		added: []moduleRequirement{
+			{path: "github.com/new/dep", version: "v0.1.0"},
+		},
+		removed: []repositoryRule{
+			{name: "com_github_old_dep", importpath: "github.com/old/dep", version: "v1.0.0"},
+		},
+		mismatched: []versionMismatch{{
+			req:  moduleRequirement{path: "github.com/foo/bar", version: "v1.2.3"},
+			rule: repositoryRule{name: "com_github_foo_bar", importpath: "github.com/foo/bar", version: "v1.2.0"},
+		}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %#v; want %#v", got, want)
+	}
+}
+
+func TestCompareDependenciesOverridden(t *testing.T) {
+	reqs := []moduleRequirement{
+		{path: "github.com/foo/bar", version: "v1.2.3"},
+		{path: "github.com/foo/baz", version: "v0.1.0"},
+	}
+	repoRules := []repositoryRule{
+		{name: "com_github_foo_bar", importpath: "github.com/foo/bar", version: "v1.0.0"},
+		{name: "com_github_foo_baz", importpath: "github.com/foo/baz", version: "v0.1.0"},
+	}
+	overrides := map[string]string{"github.com/foo/bar/sub": "bar_fork"}
+
+	got := compareDependencies(reqs, repoRules, overrides)
+	want := driftReport{
+		overridden: []moduleRequirement{
+			{path: "github.com/foo/bar", version: "v1.2.3"},
+		},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %#v; want %#v", got, want)
+	}
+}
@@ -16,14 +16,43 @@ limitations under the License.
 package main
 
 import (
+	"fmt"
 	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
 
 	bzl "github.com/bazelbuild/buildtools/build"
 )
 
 func fixFile(file *bzl.File) error {
+	// The directory may not exist yet if build files are written under
+	// -build_file_out_dir.
+	if err := os.MkdirAll(filepath.Dir(file.Path), 0777); err != nil {
+		return err
+	}
 	if err := ioutil.WriteFile(file.Path, bzl.Format(file), 0644); err != nil {
 		return err
 	}
 	return nil
 }
+
+// checkBuildFileOutDir returns the absolute path of "outDir", the root of a
+// directory tree where build files are written instead of "repoRoot". The
+// tree mirrors the repository, so package paths and labels are the same in
+// both. An error is returned if outDir is inside repoRoot, since Gazelle
+// would then generate rules for its own output.
+func checkBuildFileOutDir(repoRoot, outDir string) (string, error) {
+	root, err := filepath.Abs(repoRoot)
+	if err != nil {
+		return "", err
+	}
+	dir, err := filepath.Abs(outDir)
+	if err != nil {
+		return "", err
+	}
+	if rel, err := filepath.Rel(root, dir); err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("-build_file_out_dir %s must not be inside the repository root %s", outDir, repoRoot)
+	}
+	return dir, nil
+}
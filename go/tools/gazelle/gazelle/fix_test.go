@@ -23,6 +23,8 @@ import (
 	"testing"
 
 	bzl "github.com/bazelbuild/buildtools/build"
+	"github.com/bazelbuild/rules_go/go/tools/gazelle/merger"
+	"github.com/bazelbuild/rules_go/go/tools/gazelle/packages"
 	"github.com/bazelbuild/rules_go/go/tools/gazelle/rules"
 )
 
@@ -71,6 +73,48 @@ func TestFixFile(t *testing.T) {
 	}
 }
 
+func TestFixFileOutDir(t *testing.T) {
+	tmpdir := os.Getenv("TEST_TMPDIR")
+	dir, err := ioutil.TempDir(tmpdir, "")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir(%q, %q) failed with %v; want success", tmpdir, "", err)
+	}
+	defer os.RemoveAll(dir)
+
+	f := &bzl.File{Path: filepath.Join(dir, "out", "a", "b", "BUILD.bazel")}
+	if err := fixFile(f); err != nil {
+		t.Fatalf("fixFile(%q) failed with %v; want success", f.Path, err)
+	}
+	if _, err := os.Stat(f.Path); err != nil {
+		t.Errorf("os.Stat(%q) failed with %v; want success", f.Path, err)
+	}
+}
+
+func TestCheckBuildFileOutDir(t *testing.T) {
+	for _, tc := range []struct {
+		repoRoot, outDir string
+		wantErr          bool
+	}{
+		{repoRoot: "/src/repo", outDir: "/src/out"},
+		{repoRoot: "/src/repo", outDir: "/src/repo_out"},
+		{repoRoot: "/src/repo", outDir: "/src/repo", wantErr: true},
+		{repoRoot: "/src/repo", outDir: "/src/repo/out", wantErr: true},
+	} {
+		got, err := checkBuildFileOutDir(tc.repoRoot, tc.outDir)
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("checkBuildFileOutDir(%q, %q) succeeded; want error", tc.repoRoot, tc.outDir)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("checkBuildFileOutDir(%q, %q) failed with %v; want success", tc.repoRoot, tc.outDir, err)
+		} else if want := filepath.FromSlash(tc.outDir); got != want {
+			t.Errorf("checkBuildFileOutDir(%q, %q) = %q; want %q", tc.repoRoot, tc.outDir, got, want)
+		}
+	}
+}
+
 func TestCreateFile(t *testing.T) {
 	// Create a directory with a simple .go file.
 	tmpdir := os.Getenv("TEST_TMPDIR")
@@ -86,7 +130,7 @@ func TestCreateFile(t *testing.T) {
 	}
 
 	// Check that Gazelle creates a new file named "BUILD.bazel".
-	run([]string{dir}, nil, fixFile, rules.External)
+	run([]string{dir}, nil, packages.NewConfig(), &merger.Options{}, fixFile, rules.External)
 
 	buildFile := filepath.Join(dir, "BUILD.bazel")
 	if _, err = os.Stat(buildFile); err != nil {
@@ -114,7 +158,7 @@ func TestUpdateFile(t *testing.T) {
 	}
 
 	// Check that Gazelle updates the BUILD file in place.
-	run([]string{dir}, nil, fixFile, rules.External)
+	run([]string{dir}, nil, packages.NewConfig(), &merger.Options{}, fixFile, rules.External)
 	if st, err := os.Stat(buildFile); err != nil {
 		t.Errorf("could not stat BUILD: %v", err)
 	} else if st.Size() == 0 {
@@ -0,0 +1,164 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/bazelbuild/rules_go/go/tools/gazelle/generator"
+	"github.com/bazelbuild/rules_go/go/tools/gazelle/packages"
+)
+
+// depGraph is the dependency graph of packages in a repository. Nodes are
+// import paths. Only imports of other packages in the repository are edges.
+// Directories containing only tests are not included, since they can't be
+// imported.
+type depGraph struct {
+	// nodes is the sorted list of import paths of packages.
+	nodes []string
+
+	// edges maps import paths to the sorted import paths they depend on.
+	edges map[string][]string
+}
+
+// graphWriters maps names accepted by -graph to functions that write a
+// graph in that format.
+var graphWriters = map[string]func(io.Writer, *depGraph) error{
+	"dot":  writeDotGraph,
+	"json": writeJSONGraph,
+}
+
+// runGraph walks the packages under "dirs" and writes their dependency
+// graph to "w" in the named format. Only packages with import paths under
+// "prefix" are included, if it is not empty.
+func runGraph(w io.Writer, format string, g *generator.Generator, dirs []string, prefix string) error {
+	write, ok := graphWriters[format]
+	if !ok {
+		return fmt.Errorf("unrecognized graph format %q: want dot or json", format)
+	}
+	imports := make(map[string][]string)
+	for _, d := range dirs {
+		g.Walk(d, func(rel string, pkg *packages.Package) {
+			if pkg.Extra || !pkg.HasGo() || pkg.IsTestOnly() {
+				return
+			}
+			importPath := g.ImportPath(rel)
+			imports[importPath] = append(imports[importPath], packageImports(pkg)...)
+		})
+	}
+	return write(w, buildGraph(imports, prefix))
+}
+
+// packageImports returns the imports of the library, cgo library, and
+// binary in "pkg" on all platforms. Test imports are not included.
+func packageImports(pkg *packages.Package) []string {
+	return allPlatformStrings(pkg.Imports())
+}
+
+// allPlatformStrings returns the generic strings in "ps" followed by the
+// strings for each platform.
+func allPlatformStrings(ps packages.PlatformStrings) []string {
+	ss := ps.Generic
+	for _, p := range ps.Platform {
+		ss = append(ss, p...)
+	}
+	return ss
+}
+
+// buildGraph returns the graph of packages in "imports", which maps import
+// paths of packages to the import paths they import. Imports of packages
+// not in the map are dropped, as are packages outside "prefix".
+func buildGraph(imports map[string][]string, prefix string) *depGraph {
+	g := &depGraph{edges: make(map[string][]string)}
+	for from := range imports {
+		if hasPathPrefix(from, prefix) {
+			g.nodes = append(g.nodes, from)
+		}
+	}
+	sort.Strings(g.nodes)
+	for _, from := range g.nodes {
+		seen := make(map[string]bool)
+		for _, to := range imports[from] {
+			if _, ok := imports[to]; !ok || !hasPathPrefix(to, prefix) || to == from || seen[to] {
+				continue
+			}
+			seen[to] = true
+			g.edges[from] = append(g.edges[from], to)
+		}
+		sort.Strings(g.edges[from])
+	}
+	return g
+}
+
+// hasPathPrefix returns whether "prefix" is empty, equal to "p", or a
+// parent directory of "p".
+func hasPathPrefix(p, prefix string) bool {
+	prefix = strings.TrimSuffix(prefix, "/")
+	return prefix == "" || p == prefix || strings.HasPrefix(p, prefix+"/")
+}
+
+// writeDotGraph writes "g" in the Graphviz DOT language.
+func writeDotGraph(w io.Writer, g *depGraph) error {
+	if _, err := fmt.Fprintln(w, "digraph deps {"); err != nil {
+		return err
+	}
+	for _, from := range g.nodes {
+		if _, err := fmt.Fprintf(w, "  %q;\n", from); err != nil {
+			return err
+		}
+		for _, to := range g.edges[from] {
+			if _, err := fmt.Fprintf(w, "  %q -> %q;\n", from, to); err != nil {
+				return err
+			}
+		}
+	}
+	_, err := fmt.Fprintln(w, "}")
+	return err
+}
+
+type jsonGraph struct {
+	Nodes []string   `json:"nodes"`
+	Edges []jsonEdge `json:"edges"`
+}
+
+type jsonEdge struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// writeJSONGraph writes "g" as a JSON object with a list of nodes and a
+// list of edges, each with "from" and "to" import paths.
+func writeJSONGraph(w io.Writer, g *depGraph) error {
+	jg := jsonGraph{Nodes: g.nodes, Edges: []jsonEdge{}}
+	if jg.Nodes == nil {
+		jg.Nodes = []string{}
+	}
+	for _, from := range g.nodes {
+		for _, to := range g.edges[from] {
+			jg.Edges = append(jg.Edges, jsonEdge{From: from, To: to})
+		}
+	}
+	data, err := json.MarshalIndent(jg, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "%s\n", data)
+	return err
+}
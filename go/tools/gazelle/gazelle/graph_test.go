@@ -0,0 +1,101 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestBuildGraph(t *testing.T) {
+	imports := map[string][]string{
+		"example.com/repo/a":     {"example.com/repo/b", "github.com/ext/dep", "example.com/repo/b"},
+		"example.com/repo/b":     {"example.com/repo/lib/c", "example.com/repo/b"},
+		"example.com/repo/lib/c": nil,
+		"example.com/repo/libx":  {"example.com/repo/lib/c"},
+	}
+	for _, tc := range []struct {
+		desc, prefix string
+		want         *depGraph
+	}{
+		{
+			desc: "all",
+			want: &depGraph{
+				nodes: []string{"example.com/repo/a", "example.com/repo/b", "example.com/repo/lib/c", "example.com/repo/libx"},
+				edges: map[string][]string{
+					"example.com/repo/a":    {"example.com/repo/b"},
+					"example.com/repo/b":    {"example.com/repo/lib/c"},
+					"example.com/repo/libx": {"example.com/repo/lib/c"},
+				},
+			},
+		}, {
+			desc:   "prefix",
+			prefix: "example.com/repo/lib/",
+			want: &depGraph{
+				nodes: []string{"example.com/repo/lib/c"},
+				edges: map[string][]string{},
+			},
+		},
+	} {
+		if got := buildGraph(imports, tc.prefix); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: got %#v; want %#v", tc.desc, got, tc.want)
+		}
+	}
+}
+
+func TestWriteGraph(t *testing.T) {
+	g := &depGraph{
+		nodes: []string{"example.com/a", "example.com/b"},
+		edges: map[string][]string{"example.com/a": {"example.com/b"}},
+	}
+	for _, tc := range []struct {
+		format, want string
+	}{
+		{
+			format: "dot",
+			want: `digraph deps {
+  "example.com/a";
+  "example.com/a" -> "example.com/b";
+  "example.com/b";
+}
+`,
+		}, {
+			format: "json",
+			want: `{
+  "nodes": [
+    "example.com/a",
+    "example.com/b"
+  ],
+  "edges": [
+    {
+      "from": "example.com/a",
+      "to": "example.com/b"
+    }
+  ]
+}
+`,
+		},
+	} {
+		var buf bytes.Buffer
+		if err := graphWriters[tc.format](&buf, g); err != nil {
+			t.Fatalf("%s: %v", tc.format, err)
+		}
+		if got := buf.String(); got != tc.want {
+			t.Errorf("%s: got:\n%s\nwant:\n%s", tc.format, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"io/ioutil"
+	"strings"
+
+	bzl "github.com/bazelbuild/buildtools/build"
+)
+
+// readBuildFileHeader reads a header file named by -build_file_header and
+// returns its lines as comments. An empty path yields no comments.
+func readBuildFileHeader(path string) ([]bzl.Comment, error) {
+	if path == "" {
+		return nil, nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return headerComments(string(data)), nil
+}
+
+// headerComments converts the text of a header into comments. Lines that
+// don't already start with "#" are commented out. Trailing blank lines are
+// dropped.
+func headerComments(text string) []bzl.Comment {
+	lines := strings.Split(strings.TrimRight(text, "\n"), "\n")
+	if len(lines) == 1 && strings.TrimSpace(lines[0]) == "" {
+		return nil
+	}
+	comments := make([]bzl.Comment, len(lines))
+	for i, line := range lines {
+		line = strings.TrimRight(line, " \t\r")
+		switch {
+		case strings.HasPrefix(line, "#"):
+		case line == "":
+			line = "#"
+		default:
+			line = "# " + line
+		}
+		comments[i] = bzl.Comment{Token: line}
+	}
+	return comments
+}
+
+// addBuildFileHeader inserts header comments in a block at the top of f.
+// It should only be called for newly created files; headers of existing
+// files are left alone.
+func addBuildFileHeader(f *bzl.File, header []bzl.Comment) {
+	if len(header) == 0 {
+		return
+	}
+	block := &bzl.CommentBlock{Comments: bzl.Comments{Before: header}}
+	f.Stmt = append([]bzl.Expr{block}, f.Stmt...)
+}
@@ -0,0 +1,70 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	bzl "github.com/bazelbuild/buildtools/build"
+)
+
+func TestHeaderComments(t *testing.T) {
+	for _, tc := range []struct {
+		desc, text string
+		want       []string
+	}{
+		{
+			desc: "empty",
+			text: "\n\n",
+		}, {
+			desc: "plain text",
+			text: "Copyright 2017 Example\n\nAll rights reserved.\n",
+			want: []string{"# Copyright 2017 Example", "#", "# All rights reserved."},
+		}, {
+			desc: "already commented",
+			text: "# Copyright 2017 Example\n#\n",
+			want: []string{"# Copyright 2017 Example", "#"},
+		},
+	} {
+		var got []string
+		for _, c := range headerComments(tc.text) {
+			got = append(got, c.Token)
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: got %q; want %q", tc.desc, got, tc.want)
+		}
+	}
+}
+
+func TestAddBuildFileHeader(t *testing.T) {
+	rule := &bzl.CallExpr{X: &bzl.LiteralExpr{Token: "go_library"}}
+	f := &bzl.File{Stmt: []bzl.Expr{rule}}
+	addBuildFileHeader(f, headerComments("Copyright"))
+	if len(f.Stmt) != 2 {
+		t.Fatalf("got %d statements; want 2", len(f.Stmt))
+	}
+	block, ok := f.Stmt[0].(*bzl.CommentBlock)
+	if !ok {
+		t.Fatalf("got first statement %#v; want *bzl.CommentBlock", f.Stmt[0])
+	}
+	if got, want := block.Before, []bzl.Comment{{Token: "# Copyright"}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got header %#v; want %#v", got, want)
+	}
+	if f.Stmt[1] != rule {
+		t.Errorf("got second statement %#v; want %#v", f.Stmt[1], rule)
+	}
+}
@@ -0,0 +1,98 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	bzl "github.com/bazelbuild/buildtools/build"
+	"github.com/bazelbuild/rules_go/go/tools/gazelle/merger"
+	"github.com/bazelbuild/rules_go/go/tools/gazelle/packages"
+)
+
+// conflictChoices maps answers accepted by the -interactive prompt to
+// merger decisions.
+var conflictChoices = map[string]string{
+	"k":         merger.ConflictKeep,
+	"keep":      merger.ConflictKeep,
+	"t":         merger.ConflictTakeGenerated,
+	"take":      merger.ConflictTakeGenerated,
+	"generated": merger.ConflictTakeGenerated,
+	"s":         merger.ConflictSkip,
+	"skip":      merger.ConflictSkip,
+}
+
+// newConflictPrompter returns a function for merger.Options.ResolveConflict
+// that describes each conflict on "w" and reads the user's choice from "r".
+// The question is repeated until a valid answer is given. If "r" ends, the
+// conflict is skipped.
+func newConflictPrompter(r io.Reader, w io.Writer) func(merger.Conflict) string {
+	in := bufio.NewScanner(r)
+	return func(c merger.Conflict) string {
+		what := fmt.Sprintf("//%s:%s", c.Pkg, c.Rule)
+		if c.Attr != "" {
+			what += " attribute " + c.Attr
+		}
+		fmt.Fprintf(w, "%s: %v\n", what, c.Err)
+		fmt.Fprintf(w, "existing:\n%s\n", indent(bzl.FormatString(c.Old)))
+		fmt.Fprintf(w, "generated:\n%s\n", indent(bzl.FormatString(c.Gen)))
+		for {
+			fmt.Fprint(w, "[k]eep mine, [t]ake generated, or [s]kip? ")
+			if !in.Scan() {
+				fmt.Fprintln(w)
+				return merger.ConflictSkip
+			}
+			if d, ok := conflictChoices[strings.ToLower(strings.TrimSpace(in.Text()))]; ok {
+				return d
+			}
+		}
+	}
+}
+
+// newPackagePrompter returns a function for packages.Config.ChoosePackage
+// that lists the candidate packages on "w" and reads the number of the one
+// to use from "r". An empty answer or the end of "r" selects no package.
+func newPackagePrompter(r io.Reader, w io.Writer) func(*packages.PackageNameError) *packages.Package {
+	in := bufio.NewScanner(r)
+	return func(err *packages.PackageNameError) *packages.Package {
+		fmt.Fprintf(w, "%s: no package matches the directory name\n", err.Dir)
+		for i, pkg := range err.Packages {
+			fmt.Fprintf(w, "  %d. %s\n", i+1, pkg.Name)
+		}
+		for {
+			fmt.Fprintf(w, "package to generate rules for [1-%d, or empty to skip]? ", len(err.Packages))
+			if !in.Scan() {
+				fmt.Fprintln(w)
+				return nil
+			}
+			answer := strings.TrimSpace(in.Text())
+			if answer == "" {
+				return nil
+			}
+			if n, e := strconv.Atoi(answer); e == nil && n >= 1 && n <= len(err.Packages) {
+				return err.Packages[n-1]
+			}
+		}
+	}
+}
+
+func indent(s string) string {
+	return "    " + strings.Replace(strings.TrimRight(s, "\n"), "\n", "\n    ", -1)
+}
@@ -0,0 +1,91 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+
+	bzl "github.com/bazelbuild/buildtools/build"
+	"github.com/bazelbuild/rules_go/go/tools/gazelle/merger"
+	"github.com/bazelbuild/rules_go/go/tools/gazelle/packages"
+)
+
+func TestConflictPrompter(t *testing.T) {
+	c := merger.Conflict{
+		Pkg:  "foo",
+		Rule: "go_default_library",
+		Attr: "deps",
+		Old:  &bzl.StringExpr{Value: "//bar:go_default_library"},
+		Gen:  &bzl.StringExpr{Value: "//baz:go_default_library"},
+		Err:  errors.New("could not merge expression"),
+	}
+	for _, tc := range []struct {
+		desc, input, want string
+		prompts           int
+	}{
+		{desc: "take", input: "t\n", want: merger.ConflictTakeGenerated, prompts: 1},
+		{desc: "keep", input: "Keep\n", want: merger.ConflictKeep, prompts: 1},
+		{desc: "retry", input: "x\n\ns\n", want: merger.ConflictSkip, prompts: 3},
+		{desc: "eof", input: "", want: merger.ConflictSkip, prompts: 1},
+	} {
+		var out bytes.Buffer
+		resolve := newConflictPrompter(strings.NewReader(tc.input), &out)
+		if got := resolve(c); got != tc.want {
+			t.Errorf("%s: got %q; want %q", tc.desc, got, tc.want)
+		}
+		if !strings.Contains(out.String(), "//foo:go_default_library attribute deps: could not merge expression") {
+			t.Errorf("%s: conflict not described in output:\n%s", tc.desc, out.String())
+		}
+		if got := strings.Count(out.String(), "[k]eep mine"); got != tc.prompts {
+			t.Errorf("%s: got %d prompts; want %d", tc.desc, got, tc.prompts)
+		}
+	}
+}
+
+func TestPackagePrompter(t *testing.T) {
+	err := &packages.PackageNameError{
+		Dir:      "foo",
+		Packages: []*packages.Package{{Name: "bar"}, {Name: "baz"}},
+	}
+	for _, tc := range []struct {
+		desc, input, want string
+		prompts           int
+	}{
+		{desc: "second", input: "2\n", want: "baz", prompts: 1},
+		{desc: "retry", input: "x\n3\n1\n", want: "bar", prompts: 3},
+		{desc: "skip", input: "\n", want: "", prompts: 1},
+		{desc: "eof", input: "", want: "", prompts: 1},
+	} {
+		var out bytes.Buffer
+		choose := newPackagePrompter(strings.NewReader(tc.input), &out)
+		got := ""
+		if pkg := choose(err); pkg != nil {
+			got = pkg.Name
+		}
+		if got != tc.want {
+			t.Errorf("%s: got %q; want %q", tc.desc, got, tc.want)
+		}
+		if !strings.Contains(out.String(), "2. baz") {
+			t.Errorf("%s: candidates not listed in output:\n%s", tc.desc, out.String())
+		}
+		if got := strings.Count(out.String(), "package to generate rules for"); got != tc.prompts {
+			t.Errorf("%s: got %d prompts; want %d", tc.desc, got, tc.prompts)
+		}
+	}
+}
@@ -0,0 +1,71 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+)
+
+// readKnownImports adds mappings from the file at "filename" to "known",
+// which maps import path prefixes to repositories or packages, as in
+// rules.KnownImports.
+func readKnownImports(filename string, known map[string]string) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return parseKnownImports(filename, f, known)
+}
+
+// parseKnownImports reads mappings from "r", one per line, like
+//
+//	k8s.io/api -> @io_k8s_api
+//	example.com/lib //third_party/lib
+//
+// The arrow is optional. Targets must be a repository, a package, or a
+// package in a repository, like "@repo//pkg". Blank lines and lines
+// starting with "#" are skipped.
+func parseKnownImports(filename string, r io.Reader, known map[string]string) error {
+	s := bufio.NewScanner(r)
+	for lineNum := 1; s.Scan(); lineNum++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 3 && fields[1] == "->" {
+			fields = []string{fields[0], fields[2]}
+		}
+		if len(fields) != 2 {
+			return fmt.Errorf("%s:%d: invalid mapping %q: want import path prefix and repository or package", filename, lineNum, line)
+		}
+		prefix, to := path.Clean(fields[0]), fields[1]
+		if prefix == "." || strings.HasPrefix(prefix, "/") || strings.HasPrefix(prefix, "../") {
+			return fmt.Errorf("%s:%d: invalid import path prefix %q", filename, lineNum, fields[0])
+		}
+		if !strings.HasPrefix(to, "@") && !strings.HasPrefix(to, "//") || to == "@" || strings.Contains(to, ":") {
+			return fmt.Errorf("%s:%d: invalid target %q: want a repository like @repo or a package like //pkg", filename, lineNum, to)
+		}
+		known[prefix] = to
+	}
+	return s.Err()
+}
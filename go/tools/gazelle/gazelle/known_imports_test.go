@@ -0,0 +1,75 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseKnownImports(t *testing.T) {
+	for _, tc := range []struct {
+		desc, data string
+		want       map[string]string
+		wantErr    bool
+	}{
+		{
+			desc: "valid",
+			data: `# Repositories with nonstandard names.
+k8s.io/api -> @io_k8s_api
+k8s.io/api/core @io_k8s_api//core/v1
+
+example.com/lib/ //third_party/lib
+`,
+			want: map[string]string{
+				"k8s.io/api":      "@io_k8s_api",
+				"k8s.io/api/core": "@io_k8s_api//core/v1",
+				"example.com/lib": "//third_party/lib",
+			},
+		}, {
+			desc:    "missing target",
+			data:    "k8s.io/api ->\n",
+			wantErr: true,
+		}, {
+			desc:    "bare repository name",
+			data:    "k8s.io/api io_k8s_api\n",
+			wantErr: true,
+		}, {
+			desc:    "target with name",
+			data:    "k8s.io/api @io_k8s_api//:go_default_library\n",
+			wantErr: true,
+		}, {
+			desc:    "absolute prefix",
+			data:    "/k8s.io/api @io_k8s_api\n",
+			wantErr: true,
+		},
+	} {
+		got := make(map[string]string)
+		err := parseKnownImports("known_imports.txt", strings.NewReader(tc.data), got)
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("%s: got success; want error", tc.desc)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tc.desc, err)
+		} else if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: got %v; want %v", tc.desc, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,221 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// lockFileParsers maps the base names of lock files written by older
+// dependency management tools to functions that read requirements from
+// them. Each requirement's version is a tag or a commit hash.
+var lockFileParsers = map[string]func(path string, data []byte) ([]moduleRequirement, error){
+	"Gopkg.lock":  parseGopkgLock,
+	"glide.lock":  parseGlideLock,
+	"vendor.json": parseVendorJSON,
+}
+
+// readRequirements returns the requirements in "lockFile", or in the go.mod
+// file in repoRoot if lockFile is empty. Relative paths are resolved from
+// repoRoot.
+func readRequirements(repoRoot, lockFile string) ([]moduleRequirement, error) {
+	if lockFile == "" {
+		return readGoModRequirements(repoRoot)
+	}
+	if !filepath.IsAbs(lockFile) {
+		lockFile = filepath.Join(repoRoot, lockFile)
+	}
+	parse, ok := lockFileParsers[filepath.Base(lockFile)]
+	if !ok {
+		return nil, fmt.Errorf("%s: unknown lock file; want Gopkg.lock, glide.lock, or vendor.json", lockFile)
+	}
+	data, err := ioutil.ReadFile(lockFile)
+	if err != nil {
+		return nil, err
+	}
+	return parse(lockFile, data)
+}
+
+// parseGopkgLock returns the projects in a Gopkg.lock file written by dep.
+// The version of a project is its tag if it has one, or its revision
+// otherwise. Only the parts of TOML that dep writes are understood.
+func parseGopkgLock(path string, data []byte) ([]moduleRequirement, error) {
+	var reqs []moduleRequirement
+	var name, revision, version string
+	inProject := false
+	flush := func(lineNum int) error {
+		if !inProject {
+			return nil
+		}
+		if name == "" || revision == "" && version == "" {
+			return fmt.Errorf("%s:%d: project without a name and a revision or version", path, lineNum)
+		}
+		if version == "" {
+			version = revision
+		}
+		reqs = append(reqs, moduleRequirement{path: name, version: version})
+		name, revision, version = "", "", ""
+		return nil
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	lineNum := 1
+	for ; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if strings.HasPrefix(line, "[") {
+			if err := flush(lineNum); err != nil {
+				return nil, err
+			}
+			inProject = line == "[[projects]]"
+			continue
+		}
+		if !inProject {
+			continue
+		}
+		i := strings.Index(line, "=")
+		if i < 0 {
+			continue
+		}
+		key := strings.TrimSpace(line[:i])
+		value := strings.TrimSpace(line[i+1:])
+		if key != "name" && key != "revision" && key != "version" {
+			continue
+		}
+		s, err := strconv.Unquote(value)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: invalid %s: %s", path, lineNum, key, value)
+		}
+		switch key {
+		case "name":
+			name = s
+		case "revision":
+			revision = s
+		case "version":
+			version = s
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if err := flush(lineNum); err != nil {
+		return nil, err
+	}
+	return reqs, nil
+}
+
+// parseGlideLock returns the imports and test imports in a glide.lock file.
+// The version glide records is a revision. Only the parts of YAML that
+// glide writes are understood.
+func parseGlideLock(path string, data []byte) ([]moduleRequirement, error) {
+	var reqs []moduleRequirement
+	inImports := false
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := scanner.Text()
+		if strings.TrimSpace(line) == "" || strings.HasPrefix(strings.TrimSpace(line), "#") {
+			continue
+		}
+		if !strings.HasPrefix(line, " ") && !strings.HasPrefix(line, "-") {
+			inImports = line == "imports:" || line == "testImports:"
+			continue
+		}
+		if !inImports {
+			continue
+		}
+		field := strings.TrimSpace(line)
+		item := strings.HasPrefix(field, "- ")
+		field = strings.TrimSpace(strings.TrimPrefix(field, "- "))
+		i := strings.Index(field, ":")
+		if i < 0 {
+			continue
+		}
+		key, value := field[:i], unquoteYAML(strings.TrimSpace(field[i+1:]))
+		switch {
+		case item && key == "name":
+			reqs = append(reqs, moduleRequirement{path: value})
+		case key == "version" && len(reqs) > 0 && reqs[len(reqs)-1].version == "":
+			reqs[len(reqs)-1].version = value
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	for _, req := range reqs {
+		if req.version == "" {
+			return nil, fmt.Errorf("%s: %s has no version", path, req.path)
+		}
+	}
+	return reqs, nil
+}
+
+func unquoteYAML(s string) string {
+	if len(s) >= 2 && (s[0] == '"' || s[0] == '\'') && s[len(s)-1] == s[0] {
+		return s[1 : len(s)-1]
+	}
+	return s
+}
+
+// parseVendorJSON returns the packages in a vendor/vendor.json file written
+// by govendor. govendor lists packages rather than repositories, so
+// packages under another listed package at the same revision are left out.
+// Packages whose repository root is not listed are returned as they are.
+func parseVendorJSON(path string, data []byte) ([]moduleRequirement, error) {
+	var file struct {
+		Package []struct {
+			Path, Revision string
+		}
+	}
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	var pkgs []moduleRequirement
+	for _, p := range file.Package {
+		if p.Path == "" || p.Revision == "" {
+			return nil, fmt.Errorf("%s: package without a path and a revision", path)
+		}
+		pkgs = append(pkgs, moduleRequirement{path: p.Path, version: p.Revision})
+	}
+	sortRequirements(pkgs)
+
+	var reqs []moduleRequirement
+	for _, pkg := range pkgs {
+		if !coveredByRequirement(reqs, pkg) {
+			reqs = append(reqs, pkg)
+		}
+	}
+	return reqs, nil
+}
+
+// coveredByRequirement returns whether "reqs" has a requirement for the
+// package "pkg" itself or for a directory above it at the same version.
+func coveredByRequirement(reqs []moduleRequirement, pkg moduleRequirement) bool {
+	for _, req := range reqs {
+		if req.path == pkg.path || strings.HasPrefix(pkg.path, req.path+"/") && req.version == pkg.version {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,120 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseGopkgLock(t *testing.T) {
+	data := []byte(`# This file is autogenerated, do not edit; changes may be undone by the next 'dep ensure'.
+
+
+[[projects]]
+  name = "github.com/foo/bar"
+  packages = ["."]
+  revision = "0123456789abcdef0123456789abcdef01234567"
+  version = "v1.2.0"
+
+[[projects]]
+  branch = "master"
+  name = "golang.org/x/net"
+  packages = [
+    "context",
+    "http2"
+  ]
+  revision = "abcdef0123456789abcdef0123456789abcdef01"
+
+[solve-meta]
+  analyzer-name = "dep"
+  inputs-digest = "0000"
+`)
+	got, err := parseGopkgLock("Gopkg.lock", data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []moduleRequirement{
+		{path: "github.com/foo/bar", version: "v1.2.0"},
+		{path: "golang.org/x/net", version: "abcdef0123456789abcdef0123456789abcdef01"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v; want %v", got, want)
+	}
+
+	if _, err := parseGopkgLock("Gopkg.lock", []byte("[[projects]]\n  name = \"github.com/foo/bar\"\n")); err == nil {
+		t.Error("got success for a project without a revision; want error")
+	}
+}
+
+func TestParseGlideLock(t *testing.T) {
+	data := []byte(`hash: 0000
+updated: 2017-01-01T00:00:00.000000000-05:00
+imports:
+- name: github.com/foo/bar
+  version: 0123456789abcdef0123456789abcdef01234567
+  subpackages:
+  - baz
+- name: golang.org/x/net
+  version: "abcdef0123456789abcdef0123456789abcdef01"
+  repo: https://go.googlesource.com/net
+testImports:
+- name: github.com/test/assert
+  version: 1111111111111111111111111111111111111111
+`)
+	got, err := parseGlideLock("glide.lock", data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []moduleRequirement{
+		{path: "github.com/foo/bar", version: "0123456789abcdef0123456789abcdef01234567"},
+		{path: "golang.org/x/net", version: "abcdef0123456789abcdef0123456789abcdef01"},
+		{path: "github.com/test/assert", version: "1111111111111111111111111111111111111111"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v; want %v", got, want)
+	}
+}
+
+func TestParseVendorJSON(t *testing.T) {
+	data := []byte(`{
+	"comment": "",
+	"ignore": "test",
+	"package": [
+		{"path": "github.com/foo/bar/sub", "revision": "0123456789abcdef0123456789abcdef01234567", "revisionTime": "2017-01-01T00:00:00Z"},
+		{"path": "github.com/foo/bar", "revision": "0123456789abcdef0123456789abcdef01234567", "revisionTime": "2017-01-01T00:00:00Z"},
+		{"path": "golang.org/x/net/context", "revision": "abcdef0123456789abcdef0123456789abcdef01", "revisionTime": "2017-01-01T00:00:00Z"}
+	],
+	"rootPath": "example.com/repo"
+}`)
+	got, err := parseVendorJSON("vendor.json", data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []moduleRequirement{
+		{path: "github.com/foo/bar", version: "0123456789abcdef0123456789abcdef01234567"},
+		{path: "golang.org/x/net/context", version: "abcdef0123456789abcdef0123456789abcdef01"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v; want %v", got, want)
+	}
+}
+
+func TestReadRequirementsUnknownLockFile(t *testing.T) {
+	if _, err := readRequirements("/repo", "Godeps/Godeps.json"); err == nil {
+		t.Error("got success for an unknown lock file; want error")
+	}
+}
@@ -25,22 +25,68 @@ import (
 	"log"
 	"os"
 	"path/filepath"
+	"regexp"
+	"strconv"
 	"strings"
 
 	bzl "github.com/bazelbuild/buildtools/build"
 	"github.com/bazelbuild/rules_go/go/tools/gazelle/generator"
+	"github.com/bazelbuild/rules_go/go/tools/gazelle/logging"
 	"github.com/bazelbuild/rules_go/go/tools/gazelle/merger"
+	"github.com/bazelbuild/rules_go/go/tools/gazelle/packages"
 	"github.com/bazelbuild/rules_go/go/tools/gazelle/rules"
 	"github.com/bazelbuild/rules_go/go/tools/gazelle/wspace"
 )
 
 var (
-	buildFileName = flag.String("build_file_name", "BUILD.bazel,BUILD", "comma-separated list of valid build file names.\nThe first element of the list is the name of output build files to generate.")
-	buildTags     = flag.String("build_tags", "", "comma-separated list of build tags. If not specified, Gazelle will not\n\tfilter sources with build constraints.")
-	external      = flag.String("external", "external", "external: resolve external packages with new_go_repository\n\tvendored: resolve external packages as packages in vendor/")
-	goPrefix      = flag.String("go_prefix", "", "go_prefix of the target workspace")
-	repoRoot      = flag.String("repo_root", "", "path to a directory which corresponds to go_prefix, otherwise gazelle searches for it.")
-	mode          = flag.String("mode", "fix", "print: prints all of the updated BUILD files\n\tfix: rewrites all of the BUILD files in place\n\tdiff: computes the rewrite but then just does a diff")
+	allPackages      = flag.Bool("all_packages", false, "generate rules for every package in directories with more than one package. Rules for\n\tpackages not matching the directory name are prefixed with the package name.")
+	buildFileHeader  = flag.String("build_file_header", "", "path to a file whose contents are prepended to newly created build files.\n\tLines not starting with # are commented out. Existing files are not changed.")
+	buildFileOutDir  = flag.String("build_file_out_dir", "", "directory where build files are written instead of the repository. It mirrors the\n\tsource tree; existing build files, go_prefix, and root directives are read from it.")
+	buildFileName    = flag.String("build_file_name", "BUILD.bazel,BUILD", "comma-separated list of valid build file names.\nThe first element of the list is the name of output build files to generate.")
+	buildTags        = flag.String("build_tags", "", "comma-separated list of build tags. If not specified, Gazelle will not\n\tfilter sources with build constraints.")
+	platforms        = flag.String("platforms", "", "comma-separated list of platforms that rules are generated for, like linux_amd64,darwin_amd64.\n\tOther platforms need label=os_arch with a config_setting defined elsewhere. If not\n\tspecified, Gazelle uses the platforms that rules_go defines config_settings for.")
+	external         = flag.String("external", "external", "external: resolve external packages with new_go_repository\n\tvendored: resolve external packages as packages in the innermost vendor directory that has them")
+	graph            = flag.String("graph", "", "dot: print the dependency graph of packages in the repository in Graphviz DOT format\n\tjson: print the graph as JSON. No files are modified.")
+	graphPrefix      = flag.String("graph_prefix", "", "import path prefix of packages to include in the output of -graph. If empty, all\n\tpackages are included.")
+	followSymlinks   = flag.Bool("follow_symlinks", false, "descend into symbolic links to directories. Without this flag, only links named by\n\t# gazelle:follow directives in the root build file are followed.")
+	recursive        = flag.Bool("r", true, "generate rules in subdirectories of the directories in the arguments. If false, only\n\tthose directories are visited.")
+	maxDepth         = flag.Int("depth", 0, "visit at most this many levels of subdirectories below the directories in the arguments.\n\tZero means no limit.")
+	changed          = flag.String("changed", "", "path to a file listing changed files, one per line relative to the repository root,\n\tlike the output of git diff --name-only. Use - for stdin. Only their directories are visited,\n\tinstead of walking the directories in the arguments.")
+	cacheFile        = flag.String("cache", "", "path to a file where results of parsing .go files are cached between runs. Files\n\tthat haven't changed are not parsed again.")
+	manifest         = flag.String("manifest", "", "path to a file listing the files in the repository, one per line, with an optional\n\tcontent hash. Directories are listed from it instead of the file system.")
+	maxDirFiles      = flag.Int("max_dir_files", 0, "warn about directories with more than this many files. Zero means no limit.")
+	maxDirBytes      = flag.Int64("max_dir_bytes", 0, "warn about directories whose files total more than this many bytes. Zero means no limit.")
+	skipLargeDirs    = flag.Bool("skip_large_dirs", false, "don't generate rules for directories over -max_dir_files or -max_dir_bytes.")
+	skipDirs         = flag.String("skip_dirs", "", "comma-separated list of patterns of directories to skip, like node_modules. Patterns\n\twith a slash are matched against paths from the repository root.")
+	skipGenerated    = flag.Bool("skip_generated", false, "skip .go files with a generated code comment before the package clause in every\n\tdirectory. Use this when checked in generated sources are built by other rules.")
+	generatedHeader  = flag.String("generated_header", "", "regular expression matching generated code comments, including the comment markers.\n\tThe default matches \"// Code generated ... DO NOT EDIT.\"")
+	interactive      = flag.Bool("interactive", false, "when an existing rule or attribute can't be merged with the generated one, ask\n\twhether to keep it, take the generated one, or skip it. Kept expressions are marked # keep.")
+	kindConflict     = flag.String("kind_conflict", "error", "what to do when a generated rule has the name of an existing rule of a different kind\n\terror: report an error and don't add the rule\n\trename: add the rule with its kind appended to its name\n\talias: rename the rule and replace the existing rule with an alias to it")
+	logFormat        = flag.String("log_format", logging.TextFormat, "text: print warnings and errors as plain messages\n\tjson: print one JSON object per message with level, file, rule, and message fields")
+	lang             = flag.String("lang", "go,proto", "comma-separated list of languages to generate rules for. Existing rules for other\n\tlanguages are left untouched. Valid languages are go and proto.")
+	goPrefix         = flag.String("go_prefix", "", "go_prefix of the target workspace")
+	repoRoot         = flag.String("repo_root", "", "path to a directory which corresponds to go_prefix, otherwise gazelle searches for it.")
+	multiLine        = flag.String("multiline_threshold", "", "comma-separated list of attr=N. Lists with at least N elements in merged attributes\n\tnamed attr are always formatted on multiple lines. Use * for other attributes.")
+	packageDocs      = flag.Bool("package_docs", false, "add the first sentence of each package's doc comment as a comment above new\n\tgo_library rules.")
+	packageChoice    = flag.String("package_choice", "error", "what to do in directories with .go files in several packages, none named after the\n\tdirectory or in a # gazelle:package_name directive\n\terror: report an error and don't generate rules\n\tlargest: generate rules for the package with the most .go files\n\tprompt: ask which package to generate rules for")
+	mode             = flag.String("mode", "fix", "print: prints all of the updated BUILD files to stdout, each after a --- path line\n\tfix: rewrites all of the BUILD files in place\n\tdiff: prints a diff of the rewrite and exits with a non-zero status if any file would change")
+	relocatedImports = flag.String("relocated_imports", "", "comma-separated list of old=new import path prefixes of relocated repositories,\n\tin addition to a built-in list. Imports under an old prefix cause a warning.")
+	resolveRelocated = flag.Bool("resolve_relocated", false, "resolve imports of relocated repositories to the packages that replace them.")
+	renameBuildFile  = flag.Bool("rename_build_file", false, "when an existing build file does not have the first name in -build_file_name,\n\trename it to that name in fix mode.")
+	walkNestedRepos  = flag.Bool("walk_nested_repos", false, "generate rules in subdirectories with their own WORKSPACE or WORKSPACE.bazel file.\n\tBy default these are treated as separate repositories and skipped.")
+	useImportComment = flag.Bool("use_import_comments", false, "use the path in import comments on package clauses, like // import \"example.com/foo\", as\n\tthe importpath of go_library rules. If false, a warning is printed when they don't match.")
+	fixImportPath    = flag.Bool("fix_importpath", false, "rewrite the importpath attribute of existing go_default_library rules that disagrees\n\twith the expected import path. Vendored directories and rules marked \"# keep\" are not\n\tchecked. If false, a warning is printed instead.")
+	repos            = flag.Bool("repos", false, "print go_repository rules for modules required in go.mod that are not declared in\n\tWORKSPACE or -repo_files, instead of generating files. Modules only imported by tests are listed last.")
+	knownImports     = flag.String("known_imports", "", "path to a file mapping import path prefixes to repositories or packages, one per line,\n\tlike k8s.io/api -> @io_k8s_api. Imports under a prefix outside the go_prefix are resolved there.")
+	lockFile         = flag.String("lock_file", "", "with -repos, read pinned dependencies from this file instead of go.mod. Gopkg.lock,\n\tglide.lock, and vendor/vendor.json files are understood.")
+	updateWorkspace  = flag.Bool("update_workspace", false, "with -repos, append the rules to WORKSPACE instead of printing them, and update the\n\tcommit or tag of go_repository rules in WORKSPACE that don't match go.mod or -lock_file.")
+	testOnlyRepos    = flag.Bool("testonly_repos", false, "with -repos, set testonly = True on rules for modules only imported by tests.")
+	toolSrcs         = flag.Bool("tool_srcs", false, "generate a filegroup named go_default_library_tool_srcs for .go files excluded by\n\t\"+build ignore\" comments in each package. These files are never added to srcs.")
+	testOnly         = flag.Bool("testonly", false, "mark generated rules other than tests testonly. This is used for external repositories\n\tonly needed by tests.")
+	repoFiles        = flag.String("repo_files", "", "comma-separated list of additional files declaring go_repository rules.\n\tUsed by the drift command and -repos in addition to WORKSPACE.")
+	updateGoPrefix   = flag.Bool("update_go_prefix", false, "replace the prefix in an existing go_prefix rule with -go_prefix. Import paths\n\tof all packages will change; a warning lists affected importpath attributes.")
+	strict           = flag.Bool("strict", false, "exit with a non-zero status if errors occurred while reading packages. Build files\n\tare still generated for the packages that could be read.")
+	selectAliases    = flag.String("select_aliases", "", "comma-separated list of old=new config_setting labels. Keys in existing select\n\texpressions matching an old label are renamed to the new label.")
 )
 
 var externalResolverFromName = map[string]rules.ExternalResolver{
@@ -76,8 +122,17 @@ func isValidBuildFileName(buildFileName string) bool {
 	return false
 }
 
-func run(dirs []string, buildTags map[string]bool, emit func(*bzl.File) error, external rules.ExternalResolver) {
-	g, err := generator.New(*repoRoot, *goPrefix, getBuildFileName(), buildTags, external)
+// run generates build files for the packages in "dirs", reading them as set
+// by "pkgConfig", merges them into existing files as set by "mergeOpts", and
+// passes them to "emit". It returns the status gazelle should exit with,
+// which is non-zero if errors occurred with -strict, or if build files are
+// out of date in diff mode.
+func run(dirs []string, buildTags map[string]bool, pkgConfig *packages.Config, mergeOpts *merger.Options, emit func(*bzl.File) error, external rules.ExternalResolver) int {
+	g, err := generator.New(pkgConfig, *repoRoot, *goPrefix, getBuildFileName(), buildTags, external)
+	if err != nil {
+		log.Fatal(err)
+	}
+	header, err := readBuildFileHeader(*buildFileHeader)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -85,31 +140,64 @@ func run(dirs []string, buildTags map[string]bool, emit func(*bzl.File) error, e
 	for _, d := range dirs {
 		files := g.Generate(d)
 		for _, f := range files {
-			f.Path = filepath.Join(*repoRoot, f.Path)
-			existingFilePath, err := findBuildFile(filepath.Dir(f.Path))
+			f.Path = filepath.Join(buildFileRoot(), f.Path)
+			merged, existingFilePath, err := merger.MergeWithExistingInDir(mergeOpts, f, validBuildFileNameSlice(), *renameBuildFile)
 			if os.IsNotExist(err) {
 				// No existing file, so write a new one
 				bzl.Rewrite(f, nil) // have buildifier 'format' our rules.
+				addBuildFileHeader(f, header)
 				if err := emit(f); err != nil {
-					log.Print(err)
+					logging.Errorf(logging.At{File: f.Path}, "%v", err)
 				}
 				continue
 			}
 			if err != nil {
 				// An unexpected error
-				log.Print(err)
+				logging.Errorf(logging.At{File: f.Path}, "%v", err)
 				continue
 			}
 			// Existing file, so merge and maybe remove the old one
-			if f = merger.MergeWithExisting(f, existingFilePath); f == nil {
+			if f = merged; f == nil {
 				continue
 			}
+			rel, err := filepath.Rel(buildFileRoot(), filepath.Dir(f.Path))
+			if err != nil {
+				logging.Errorf(logging.At{File: f.Path}, "%v", err)
+				continue
+			}
+			rel = filepath.ToSlash(rel)
+			if _, vendored := packages.VendoredImportPath(rel); !vendored {
+				merger.CheckImportPaths(f, g.ImportPath(rel), *fixImportPath)
+			}
 			bzl.Rewrite(f, nil) // have buildifier 'format' our rules.
 			if err := emit(f); err != nil {
-				log.Print(err)
+				logging.Errorf(logging.At{File: f.Path}, "%v", err)
+				continue
+			}
+			if f.Path != existingFilePath && *mode == "fix" {
+				// The merged file was written under the preferred name.
+				if err := os.Remove(existingFilePath); err != nil {
+					logging.Errorf(logging.At{File: existingFilePath}, "%v", err)
+				}
 			}
 		}
 	}
+
+	if excluded := g.Excluded(); len(excluded) > 0 {
+		logging.Warnf(logging.At{}, "no rules were generated in %d directories where build constraints exclude all Go files on all platforms. Use -build_tags to include them:", len(excluded))
+		for _, e := range excluded {
+			logging.Warnf(logging.At{File: e.Dir}, "%v", e)
+		}
+	}
+	if errs := g.Errors(); *strict && len(errs) > 0 {
+		log.Printf("errors occurred while reading %d directories", len(errs))
+		return 1
+	}
+	if filesDiffer {
+		log.Print("build files are out of date; run gazelle in fix mode to update them")
+		return 1
+	}
+	return 0
 }
 
 func usage() {
@@ -128,9 +216,34 @@ All the directories must be under the directory specified in -repo_root.
 [if -repo_root is not given, gazelle searches $pwd and up for the WORKSPACE file]
 
 There are several modes of gazelle.
-In print mode, gazelle prints reconciled BUILD files to stdout.
+In print mode, gazelle prints reconciled BUILD files to stdout, each preceded
+by a line with "---" and its path. No files are modified.
 In fix mode, gazelle creates BUILD files or updates existing ones.
-In diff mode, gazelle shows diff.
+In diff mode, gazelle prints unified diffs of the changes it would make and
+exits with a non-zero status if any build file is out of date. Nothing is
+modified, so this can be used to check build files in CI.
+
+With -graph, gazelle prints the dependency graph of packages in the
+repository instead of generating files. Edges are imports of other packages
+in the repository by libraries and binaries.
+
+With -repos, gazelle prints go_repository rules for modules required in
+go.mod that are not declared yet. Modules only imported by tests are listed
+separately, and are marked testonly with -testonly_repos. With
+-update_workspace, the rules are added to WORKSPACE instead, and the versions
+of rules already there are updated to match go.mod. With -lock_file, pinned
+dependencies are read from a Gopkg.lock, glide.lock, or vendor.json file
+instead of go.mod.
+
+"gazelle drift" compares module requirements in go.mod at the repository root
+with go_repository rules in WORKSPACE and reports additions, removals, and
+version mismatches. No files are modified.
+
+"gazelle fix" migrates deprecated constructs in existing build files instead
+of generating rules. Loads from old .bzl locations are changed to load from
+@io_bazel_rules_go//go:def.bzl, and go_library rules without an importpath
+attribute get the one computed from go_prefix. Files are written according
+to -mode.
 
 FLAGS:
 `)
@@ -138,32 +251,208 @@ FLAGS:
 }
 
 func main() {
+	os.Exit(runMain())
+}
+
+// runMain does the work of main and returns the exit status. Errors that
+// leave nothing to clean up are still reported with log.Fatal, but results
+// of a completed run are returned, so that deferred functions like saving
+// the -cache file run before gazelle exits.
+func runMain() int {
 	log.SetPrefix("gazelle: ")
 	log.SetFlags(0) // don't print timestamps
 
 	flag.Usage = usage
 	flag.Parse()
 
+	switch *logFormat {
+	case logging.TextFormat, logging.JSONFormat:
+		logging.Format = *logFormat
+	default:
+		log.Fatalf("unrecognized -log_format %s", *logFormat)
+	}
+
+	if flag.Arg(0) == driftCommand {
+		if *repoRoot == "" {
+			var err error
+			if *repoRoot, err = repo(nil); err != nil {
+				log.Fatal(err)
+			}
+		}
+		var files []string
+		if *repoFiles != "" {
+			files = strings.Split(*repoFiles, ",")
+		}
+		if err := loadDirectives(packages.NewConfig(), *repoRoot); err != nil && !os.IsNotExist(err) {
+			log.Fatal(err)
+		}
+		if err := runDrift(os.Stdout, *repoRoot, files, rules.LocalOverrides); err != nil {
+			log.Fatal(err)
+		}
+		return 0
+	}
+
+	if flag.Arg(0) == fixCommand {
+		dirs := flag.Args()[1:]
+		if *repoRoot == "" {
+			var err error
+			if *repoRoot, err = repo(dirs); err != nil {
+				log.Fatal(err)
+			}
+		}
+		if len(dirs) == 0 {
+			dirs = []string{"."}
+		}
+		emit := modeFromName[*mode]
+		if emit == nil {
+			log.Fatalf("unrecognized mode %s", *mode)
+		}
+		prefix := *goPrefix
+		if prefix == "" {
+			var err error
+			if prefix, err = loadGoPrefix(*repoRoot); err != nil && err != errNoGoPrefix && !os.IsNotExist(err) {
+				log.Fatal(err)
+			}
+		}
+		if err := runFix(dirs, *repoRoot, prefix, emit); err != nil {
+			log.Fatal(err)
+		}
+		if filesDiffer {
+			log.Print("build files use deprecated constructs; run gazelle fix in fix mode to update them")
+			return 1
+		}
+		return 0
+	}
+
 	if *repoRoot == "" {
 		var err error
 		if *repoRoot, err = repo(flag.Args()); err != nil {
 			log.Fatal(err)
 		}
 	}
+	if *buildFileOutDir != "" {
+		var err error
+		if *buildFileOutDir, err = checkBuildFileOutDir(*repoRoot, *buildFileOutDir); err != nil {
+			log.Fatal(err)
+		}
+	}
+	pkgConfig := packages.NewConfig()
 	if *goPrefix == "" {
 		var err error
-		if *goPrefix, err = loadGoPrefix(*repoRoot); err != nil {
-			if !os.IsNotExist(err) {
+		if *goPrefix, err = loadGoPrefix(buildFileRoot()); err != nil {
+			if err != errNoGoPrefix && !os.IsNotExist(err) {
 				log.Fatal(err)
 			}
-			log.Fatalf("-go_prefix not set and no root BUILD file found")
+			// Use the module path from go.mod, if there is one.
+			var modErr error
+			if *goPrefix, modErr = packages.ReadModulePath(pkgConfig, *repoRoot); modErr != nil {
+				if !os.IsNotExist(modErr) {
+					log.Fatal(modErr)
+				}
+				if err == errNoGoPrefix {
+					log.Fatal(err)
+				}
+				log.Fatalf("-go_prefix not set and no root BUILD file or go.mod found")
+			}
 		}
 	}
 
+	pkgConfig.BuildFileNames = validBuildFileNameSlice()
+	pkgConfig.EmitAllPackages = *allPackages
+	pkgConfig.FollowSymlinks = *followSymlinks
+	pkgConfig.SkipGenerated = *skipGenerated
+	if *manifest != "" {
+		var err error
+		if pkgConfig.Manifest, err = readManifest(*manifest); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if *cacheFile != "" {
+		c, err := packages.LoadFileInfoCache(*cacheFile)
+		if err != nil {
+			log.Fatalf("could not load -cache: %v", err)
+		}
+		pkgConfig.FileCache = c
+		defer func() {
+			if err := c.Save(*cacheFile); err != nil {
+				logging.Warnf(logging.At{File: *cacheFile}, "could not save -cache: %v", err)
+			}
+		}()
+	}
+	pkgConfig.MaxDirFiles = *maxDirFiles
+	pkgConfig.MaxDirBytes = *maxDirBytes
+	pkgConfig.SkipLargeDirs = *skipLargeDirs
+	pkgConfig.SkipNestedRepos = !*walkNestedRepos
+	switch *packageChoice {
+	case "error":
+	case "largest":
+		pkgConfig.ChoosePackage = packages.ChooseLargestPackage
+	case "prompt":
+		pkgConfig.ChoosePackage = newPackagePrompter(os.Stdin, os.Stderr)
+	default:
+		log.Fatalf("invalid -package_choice %q: want error, largest, or prompt", *packageChoice)
+	}
+	if err := parseSkipDirs(*skipDirs, &pkgConfig.SkipDirs); err != nil {
+		log.Fatal(err)
+	}
+	if *generatedHeader != "" {
+		re, err := regexp.Compile(*generatedHeader)
+		if err != nil {
+			log.Fatalf("invalid -generated_header: %v", err)
+		}
+		packages.GeneratedHeaderPattern = re
+	}
+	if err := loadDirectives(pkgConfig, buildFileRoot()); err != nil && !os.IsNotExist(err) {
+		log.Fatal(err)
+	}
+
 	genericTags, err := parseBuildTags(*buildTags)
 	if err != nil {
 		log.Fatal(err)
 	}
+	if *platforms != "" {
+		if generator.Platforms, err = packages.ParsePlatformConstraints(strings.Split(*platforms, ",")); err != nil {
+			log.Fatalf("invalid -platforms: %v", err)
+		}
+	}
+
+	mergeOpts := &merger.Options{
+		SelectKeyAliases:    make(map[string]string),
+		MultiLineThresholds: make(map[string]int),
+		UpdateGoPrefix:      *updateGoPrefix,
+		SrcsStyle:           pkgConfig.SrcsStyle,
+	}
+	if err := parseSelectAliases(*selectAliases, mergeOpts.SelectKeyAliases); err != nil {
+		log.Fatal(err)
+	}
+	if err := parseMultiLineThresholds(*multiLine, mergeOpts.MultiLineThresholds); err != nil {
+		log.Fatal(err)
+	}
+	if err := parseRelocatedImports(*relocatedImports, packages.RelocatedImports); err != nil {
+		log.Fatal(err)
+	}
+	rules.ResolveRelocatedImports = *resolveRelocated
+	if *knownImports != "" {
+		if err := readKnownImports(*knownImports, rules.KnownImports); err != nil {
+			log.Fatal(err)
+		}
+	}
+	rules.UseImportComments = *useImportComment
+	rules.PackageDocComments = *packageDocs
+	if *interactive {
+		mergeOpts.ResolveConflict = newConflictPrompter(os.Stdin, os.Stderr)
+	}
+	rules.TestOnly = *testOnly
+	rules.ToolSrcsFilegroup = *toolSrcs
+	switch *kindConflict {
+	case merger.KindConflictError, merger.KindConflictRename, merger.KindConflictAlias:
+		mergeOpts.KindConflict = *kindConflict
+	default:
+		log.Fatalf("unrecognized -kind_conflict %s", *kindConflict)
+	}
+	if rules.Languages, err = parseLanguages(*lang); err != nil {
+		log.Fatal(err)
+	}
 
 	emit := modeFromName[*mode]
 	if emit == nil {
@@ -179,25 +468,63 @@ func main() {
 	if len(args) == 0 {
 		args = append(args, ".")
 	}
+	pkgConfig.WalkSubdirs = *recursive
+	if *maxDepth < 0 {
+		log.Fatalf("-depth must not be negative: %d", *maxDepth)
+	}
+	pkgConfig.MaxDepth = *maxDepth
+	if *changed != "" {
+		if args, err = changedDirs(pkgConfig, *changed, *repoRoot); err != nil {
+			log.Fatalf("could not read -changed: %v", err)
+		}
+		pkgConfig.WalkSubdirs = false
+	}
 
-	run(args, genericTags, emit, er)
-}
+	if *repos {
+		g, err := generator.New(pkgConfig, *repoRoot, *goPrefix, getBuildFileName(), genericTags, er)
+		if err != nil {
+			log.Fatal(err)
+		}
+		var files []string
+		if *repoFiles != "" {
+			files = strings.Split(*repoFiles, ",")
+		}
+		if *updateWorkspace {
+			err = runUpdateWorkspace(g, args, *repoRoot, *lockFile, files, rules.LocalOverrides, *testOnlyRepos)
+		} else {
+			err = runRepos(os.Stdout, g, args, *repoRoot, *lockFile, files, rules.LocalOverrides, *testOnlyRepos)
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+		return 0
+	}
 
-func findBuildFile(repo string) (string, error) {
-	for _, base := range validBuildFileNameSlice() {
-		p := filepath.Join(repo, base)
-		fi, err := os.Stat(p)
-		if err == nil {
-			if fi.Mode().IsRegular() {
-				return p, nil
-			}
-			continue
+	if *graph != "" {
+		g, err := generator.New(pkgConfig, *repoRoot, *goPrefix, getBuildFileName(), genericTags, er)
+		if err != nil {
+			log.Fatal(err)
 		}
-		if !os.IsNotExist(err) {
-			return "", err
+		if err := runGraph(os.Stdout, *graph, g, args, *graphPrefix); err != nil {
+			log.Fatal(err)
 		}
+		return 0
+	}
+
+	return run(args, genericTags, pkgConfig, mergeOpts, emit, er)
+}
+
+// buildFileRoot returns the directory where build files are read and
+// written: -build_file_out_dir if set, or the repository root otherwise.
+func buildFileRoot() string {
+	if *buildFileOutDir != "" {
+		return *buildFileOutDir
 	}
-	return "", os.ErrNotExist
+	return *repoRoot
+}
+
+func findBuildFile(repo string) (string, error) {
+	return merger.FindBuildFile(repo, validBuildFileNameSlice())
 }
 
 func loadGoPrefix(repo string) (string, error) {
@@ -234,9 +561,13 @@ func loadGoPrefix(repo string) (string, error) {
 		}
 		return v.Value, nil
 	}
-	return "", errors.New("-go_prefix not set, and no go_prefix in root BUILD file")
+	return "", errNoGoPrefix
 }
 
+// errNoGoPrefix is returned by loadGoPrefix when the root build file has no
+// go_prefix rule.
+var errNoGoPrefix = errors.New("-go_prefix not set, and no go_prefix in root BUILD file or module directive in go.mod")
+
 func repo(args []string) (string, error) {
 	if len(args) == 1 {
 		return args[0], nil
@@ -262,3 +593,104 @@ func parseBuildTags(buildTags string) (map[string]bool, error) {
 	}
 	return tags, nil
 }
+
+func parseSelectAliases(selectAliases string, aliases map[string]string) error {
+	if selectAliases == "" {
+		return nil
+	}
+	for _, a := range strings.Split(selectAliases, ",") {
+		kv := strings.SplitN(a, "=", 2)
+		if len(kv) != 2 || kv[0] == "" || kv[1] == "" {
+			return fmt.Errorf("invalid select alias %q: want old=new", a)
+		}
+		aliases[kv[0]] = kv[1]
+	}
+	return nil
+}
+
+func parseRelocatedImports(relocatedImports string, relocated map[string]string) error {
+	if relocatedImports == "" {
+		return nil
+	}
+	for _, r := range strings.Split(relocatedImports, ",") {
+		kv := strings.SplitN(r, "=", 2)
+		if len(kv) != 2 || kv[0] == "" || kv[1] == "" {
+			return fmt.Errorf("invalid relocated import %q: want old=new", r)
+		}
+		relocated[kv[0]] = kv[1]
+	}
+	return nil
+}
+
+// changedDirs returns the directories of the changed files listed in the
+// file at "path", or on stdin if "path" is "-".
+func changedDirs(c *packages.Config, path, repoRoot string) ([]string, error) {
+	if path == "-" {
+		return readChangedDirs(c, os.Stdin, repoRoot)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return readChangedDirs(c, f, repoRoot)
+}
+
+func readManifest(path string) (*packages.Manifest, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	m, err := packages.ReadManifest(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return m, nil
+}
+
+func parseSkipDirs(skipDirs string, patterns *[]string) error {
+	if skipDirs == "" {
+		return nil
+	}
+	for _, p := range strings.Split(skipDirs, ",") {
+		if err := checkSkipDirPattern(p); err != nil {
+			return err
+		}
+		*patterns = append(*patterns, p)
+	}
+	return nil
+}
+
+func parseLanguages(lang string) (map[string]bool, error) {
+	known := make(map[string]bool)
+	for _, l := range rules.KnownLanguages {
+		known[l] = true
+	}
+	langs := make(map[string]bool)
+	for _, l := range strings.Split(lang, ",") {
+		if !known[l] {
+			return nil, fmt.Errorf("unknown language %q: valid languages are %s", l, strings.Join(rules.KnownLanguages, ", "))
+		}
+		langs[l] = true
+	}
+	return langs, nil
+}
+
+func parseMultiLineThresholds(multiLine string, thresholds map[string]int) error {
+	if multiLine == "" {
+		return nil
+	}
+	for _, t := range strings.Split(multiLine, ",") {
+		kv := strings.SplitN(t, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return fmt.Errorf("invalid multiline threshold %q: want attr=N", t)
+		}
+		n, err := strconv.Atoi(kv[1])
+		if err != nil || n < 0 {
+			return fmt.Errorf("invalid multiline threshold %q: want attr=N", t)
+		}
+		thresholds[kv[0]] = n
+	}
+	return nil
+}
@@ -0,0 +1,262 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	bzl "github.com/bazelbuild/buildtools/build"
+	"github.com/bazelbuild/rules_go/go/tools/gazelle/logging"
+)
+
+// fixCommand is the first positional argument that selects fix command
+// mode. In this mode, gazelle migrates deprecated constructs in existing
+// build files in the directories named by the remaining arguments and
+// their subdirectories. No rules are generated, and files are written
+// according to -mode. The following migrations are applied:
+//
+//   - load statements of rules_go symbols from old .bzl locations, like
+//     @bazel_tools//tools/build_rules/go:def.bzl or files in
+//     @io_bazel_rules_go//go/private, load from
+//     @io_bazel_rules_go//go:def.bzl instead.
+//   - go_library rules without an importpath attribute get the import path
+//     the rules would compute from go_prefix. The go_prefix rule is kept,
+//     since the rules still depend on //:go_prefix.
+//
+// The library attribute and cgo_library rules are not changed. go_library
+// has no embed attribute in this version of rules_go, and cgo_library is
+// still how cgo code is built.
+const fixCommand = "fix"
+
+// defBzl is the file that rules_go's public rules are loaded from.
+const defBzl = "@io_bazel_rules_go//go:def.bzl"
+
+// bazelToolsGoDefBzl is where the Go rules were loaded from when they were
+// part of Bazel. Every symbol it provided is now in defBzl.
+const bazelToolsGoDefBzl = "@bazel_tools//tools/build_rules/go:def.bzl"
+
+// defBzlSymbols are the symbols defBzl exports from files in go/private.
+var defBzlSymbols = map[string]bool{
+	"cgo_genrule":       true,
+	"cgo_library":       true,
+	"go_binary":         true,
+	"go_library":        true,
+	"go_prefix":         true,
+	"go_repositories":   true,
+	"go_repository":     true,
+	"go_test":           true,
+	"new_go_repository": true,
+}
+
+// runFix applies the migrations described in fixCommand to build files in
+// "dirs" and their subdirectories, and passes the changed files to "emit".
+// Package names are computed relative to "root", the directory where build
+// files are read. Import paths are computed from "goPrefix"; if it is
+// empty, importpath attributes are not added.
+func runFix(dirs []string, root, goPrefix string, emit func(*bzl.File) error) error {
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return err
+	}
+	for _, d := range dirs {
+		d, err := filepath.Abs(d)
+		if err != nil {
+			return err
+		}
+		err = filepath.Walk(d, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if info.IsDir() {
+				if path != d && strings.HasPrefix(info.Name(), ".") {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if !isValidBuildFileName(info.Name()) {
+				return nil
+			}
+			rel, err := filepath.Rel(root, filepath.Dir(path))
+			if err != nil {
+				return err
+			}
+			pkg := filepath.ToSlash(rel)
+			if pkg == "." {
+				pkg = ""
+			}
+
+			data, err := ioutil.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			f, err := bzl.Parse(path, data)
+			if err != nil {
+				logging.Errorf(logging.At{File: path}, "%v", err)
+				return nil
+			}
+			loadsChanged := fixLoads(f)
+			importPathsChanged := fixImportPaths(f, pkg, goPrefix)
+			if !loadsChanged && !importPathsChanged {
+				return nil
+			}
+			bzl.Rewrite(f, nil)
+			if err := emit(f); err != nil {
+				logging.Errorf(logging.At{File: path}, "%v", err)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fixLoads rewrites load statements in "f" that load rules_go symbols from
+// old locations to load them from defBzl. Symbols are added to an existing
+// load of defBzl if there is one; otherwise, a new load takes the place of
+// the first old one. Symbols defBzl doesn't export stay where they are.
+// fixLoads returns whether "f" was changed.
+func fixLoads(f *bzl.File) bool {
+	var def *bzl.CallExpr
+	for _, s := range f.Stmt {
+		if c, ok := s.(*bzl.CallExpr); ok && loadPath(c) == defBzl {
+			def = c
+			break
+		}
+	}
+
+	var moved []string
+	var stmts []bzl.Expr
+	var comments bzl.Comments
+	insertAt := -1
+	for _, s := range f.Stmt {
+		c, ok := s.(*bzl.CallExpr)
+		if !ok {
+			stmts = append(stmts, s)
+			continue
+		}
+		path := loadPath(c)
+		if path != bazelToolsGoDefBzl && !strings.HasPrefix(path, "@io_bazel_rules_go//go/private:") {
+			stmts = append(stmts, s)
+			continue
+		}
+		var kept []bzl.Expr
+		for _, arg := range c.List[1:] {
+			if sym, ok := arg.(*bzl.StringExpr); ok && (path == bazelToolsGoDefBzl || defBzlSymbols[sym.Value]) {
+				moved = append(moved, sym.Value)
+			} else {
+				kept = append(kept, arg)
+			}
+		}
+		if len(kept) == len(c.List)-1 {
+			stmts = append(stmts, s)
+			continue
+		}
+		if insertAt < 0 {
+			insertAt = len(stmts)
+		}
+		if len(kept) > 0 {
+			c.List = append(c.List[:1], kept...)
+			stmts = append(stmts, c)
+		} else if len(comments.Before) == 0 {
+			comments = c.Comments
+		}
+	}
+	if len(moved) == 0 {
+		return false
+	}
+
+	if def == nil {
+		def = &bzl.CallExpr{
+			Comments: comments,
+			X:        &bzl.LiteralExpr{Token: "load"},
+			List:     []bzl.Expr{&bzl.StringExpr{Value: defBzl}},
+		}
+		stmts = append(stmts[:insertAt], append([]bzl.Expr{def}, stmts[insertAt:]...)...)
+	}
+	have := make(map[string]bool)
+	for _, arg := range def.List[1:] {
+		if sym, ok := arg.(*bzl.StringExpr); ok {
+			have[sym.Value] = true
+		}
+	}
+	sort.Strings(moved)
+	for _, sym := range moved {
+		if !have[sym] {
+			have[sym] = true
+			def.List = append(def.List, &bzl.StringExpr{Value: sym})
+		}
+	}
+	f.Stmt = stmts
+	return true
+}
+
+// loadPath returns the file loaded by "c" if it's a load statement, or ""
+// otherwise.
+func loadPath(c *bzl.CallExpr) string {
+	if x, ok := c.X.(*bzl.LiteralExpr); !ok || x.Token != "load" || len(c.List) == 0 {
+		return ""
+	}
+	path, ok := c.List[0].(*bzl.StringExpr)
+	if !ok {
+		return ""
+	}
+	return path.Value
+}
+
+// fixImportPaths sets the importpath attribute of go_library rules in "f"
+// that don't have one to the import path computed from "goPrefix" for
+// rules in the package "pkg". Rules marked with "# keep" are not changed.
+// fixImportPaths returns whether "f" was changed.
+func fixImportPaths(f *bzl.File, pkg, goPrefix string) bool {
+	if goPrefix == "" {
+		return false
+	}
+	changed := false
+	for _, r := range f.Rules("go_library") {
+		if r.Attr("importpath") != nil {
+			continue
+		}
+		if c := r.Call.Comment(); len(c.Suffix) > 0 && strings.HasPrefix(c.Suffix[0].Token, "# keep") {
+			continue
+		}
+		r.SetAttr("importpath", &bzl.StringExpr{Value: prefixImportPath(goPrefix, pkg, r.Name())})
+		changed = true
+	}
+	return changed
+}
+
+// prefixImportPath returns the import path of the library "name" in the
+// package "pkg" when "goPrefix" is the go_prefix of the repository. This is
+// computed the same way as go_importpath in go/private/library.bzl.
+func prefixImportPath(goPrefix, pkg, name string) string {
+	path := strings.TrimSuffix(goPrefix, "/")
+	if pkg != "" {
+		path += "/" + pkg
+	}
+	if name != "go_default_library" {
+		path += "/" + name
+	}
+	if i := strings.LastIndex(path, "/vendor/"); i >= 0 {
+		path = path[i+len("/vendor/"):]
+	}
+	return strings.TrimPrefix(path, "/")
+}
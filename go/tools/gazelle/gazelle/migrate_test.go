@@ -0,0 +1,189 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	bzl "github.com/bazelbuild/buildtools/build"
+)
+
+func TestFixLoads(t *testing.T) {
+	for _, tc := range []struct {
+		desc, old, want string
+		changed         bool
+	}{
+		{
+			desc: "bazel_tools",
+			old: `load("@bazel_tools//tools/build_rules/go:def.bzl", "go_library", "go_prefix")
+
+go_prefix("example.com/repo")
+`,
+			want: `load("@io_bazel_rules_go//go:def.bzl", "go_library", "go_prefix")
+
+go_prefix("example.com/repo")
+`,
+			changed: true,
+		}, {
+			desc: "private merged into def.bzl",
+			old: `load("@io_bazel_rules_go//go:def.bzl", "go_test")
+load("@io_bazel_rules_go//go/private:library.bzl", "go_library", "go_importpath")
+`,
+			want: `load("@io_bazel_rules_go//go:def.bzl", "go_test", "go_library")
+load("@io_bazel_rules_go//go/private:library.bzl", "go_importpath")
+`,
+			changed: true,
+		}, {
+			desc: "several private files",
+			old: `# Go rules
+load("@io_bazel_rules_go//go/private:library.bzl", "go_library")
+load("@io_bazel_rules_go//go/private:binary.bzl", "go_binary")
+load("//:foo.bzl", "foo")
+`,
+			want: `# Go rules
+load("@io_bazel_rules_go//go:def.bzl", "go_binary", "go_library")
+load("//:foo.bzl", "foo")
+`,
+			changed: true,
+		}, {
+			desc: "private symbols only",
+			old: `load("@io_bazel_rules_go//go/private:common.bzl", "DEFAULT_LIB")
+`,
+			want: `load("@io_bazel_rules_go//go/private:common.bzl", "DEFAULT_LIB")
+`,
+		}, {
+			desc: "up to date",
+			old: `load("@io_bazel_rules_go//go:def.bzl", "go_library")
+`,
+			want: `load("@io_bazel_rules_go//go:def.bzl", "go_library")
+`,
+		},
+	} {
+		f, err := bzl.Parse(tc.desc, []byte(tc.old))
+		if err != nil {
+			t.Fatalf("%s: %v", tc.desc, err)
+		}
+		if got := fixLoads(f); got != tc.changed {
+			t.Errorf("%s: fixLoads returned %v; want %v", tc.desc, got, tc.changed)
+		}
+		if got := string(bzl.Format(f)); got != tc.want {
+			t.Errorf("%s: got\n%s\nwant\n%s", tc.desc, got, tc.want)
+		}
+	}
+}
+
+func TestFixImportPaths(t *testing.T) {
+	f, err := bzl.Parse("BUILD", []byte(`
+go_library(
+    name = "go_default_library",
+    srcs = ["a.go"],
+)
+
+go_library(
+    name = "extra",
+    srcs = ["b.go"],
+)
+
+go_library(
+    name = "set",
+    importpath = "example.com/other",
+)
+
+go_library(name = "kept")  # keep
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !fixImportPaths(f, "foo", "example.com/repo") {
+		t.Errorf("fixImportPaths returned false; want true")
+	}
+	want := map[string]string{
+		"go_default_library": "example.com/repo/foo",
+		"extra":              "example.com/repo/foo/extra",
+		"set":                "example.com/other",
+		"kept":               "",
+	}
+	for _, r := range f.Rules("go_library") {
+		if got := r.AttrString("importpath"); got != want[r.Name()] {
+			t.Errorf("%s: got importpath %q; want %q", r.Name(), got, want[r.Name()])
+		}
+	}
+
+	if fixImportPaths(f, "foo", "") {
+		t.Errorf("fixImportPaths with empty prefix returned true; want false")
+	}
+}
+
+func TestPrefixImportPath(t *testing.T) {
+	for _, tc := range []struct {
+		prefix, pkg, name, want string
+	}{
+		{"example.com/repo", "", "go_default_library", "example.com/repo"},
+		{"example.com/repo/", "foo", "go_default_library", "example.com/repo/foo"},
+		{"example.com/repo", "foo", "bar", "example.com/repo/foo/bar"},
+		{"example.com/repo", "vendor/github.com/x/y", "go_default_library", "github.com/x/y"},
+	} {
+		if got := prefixImportPath(tc.prefix, tc.pkg, tc.name); got != tc.want {
+			t.Errorf("prefixImportPath(%q, %q, %q) = %q; want %q", tc.prefix, tc.pkg, tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestRunFix(t *testing.T) {
+	dir, err := ioutil.TempDir(os.Getenv("TEST_TMPDIR"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	files := map[string]string{
+		"BUILD":         `go_prefix("example.com/repo")` + "\n",
+		"foo/BUILD":     "load(\"@io_bazel_rules_go//go/private:library.bzl\", \"go_library\")\n\ngo_library(name = \"go_default_library\")\n",
+		"bar/BUILD":     "load(\"@io_bazel_rules_go//go:def.bzl\", \"go_library\")\n\ngo_library(\n    name = \"go_default_library\",\n    importpath = \"example.com/repo/bar\",\n)\n",
+		".hidden/BUILD": "load(\"@io_bazel_rules_go//go/private:library.bzl\", \"go_library\")\n",
+	}
+	for name, content := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var got []string
+	emit := func(f *bzl.File) error {
+		rel, err := filepath.Rel(dir, f.Path)
+		if err != nil {
+			return err
+		}
+		got = append(got, filepath.ToSlash(rel))
+		if rel == filepath.Join("foo", "BUILD") && !strings.Contains(string(bzl.Format(f)), `importpath = "example.com/repo/foo"`) {
+			t.Errorf("foo/BUILD: importpath not set:\n%s", bzl.Format(f))
+		}
+		return nil
+	}
+	if err := runFix([]string{dir}, dir, "example.com/repo", emit); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 || got[0] != "foo/BUILD" {
+		t.Errorf("got changed files %q; want [foo/BUILD]", got)
+	}
+}
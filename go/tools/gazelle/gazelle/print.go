@@ -16,12 +16,29 @@ limitations under the License.
 package main
 
 import (
+	"fmt"
+	"io"
 	"os"
+	"path/filepath"
 
 	bzl "github.com/bazelbuild/buildtools/build"
 )
 
 func printFile(f *bzl.File) error {
-	_, err := os.Stdout.Write(bzl.Format(f))
+	return writeFile(os.Stdout, f)
+}
+
+// writeFile writes the content of "f" to "w", preceded by a line with
+// "---" and the path of the file relative to the root of the build file
+// tree, so that output for several files can be split apart.
+func writeFile(w io.Writer, f *bzl.File) error {
+	path := f.Path
+	if rel, err := filepath.Rel(buildFileRoot(), f.Path); err == nil {
+		path = rel
+	}
+	if _, err := fmt.Fprintf(w, "--- %s\n", filepath.ToSlash(path)); err != nil {
+		return err
+	}
+	_, err := w.Write(bzl.Format(f))
 	return err
 }
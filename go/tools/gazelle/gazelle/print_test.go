@@ -0,0 +1,50 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"path/filepath"
+	"testing"
+
+	bzl "github.com/bazelbuild/buildtools/build"
+)
+
+func TestWriteFile(t *testing.T) {
+	f := &bzl.File{
+		Path: filepath.Join(buildFileRoot(), "a", "b", "BUILD.bazel"),
+		Stmt: []bzl.Expr{
+			&bzl.CallExpr{
+				X: &bzl.LiteralExpr{Token: "foo_rule"},
+				List: []bzl.Expr{
+					&bzl.BinaryExpr{
+						X:  &bzl.LiteralExpr{Token: "name"},
+						Op: "=",
+						Y:  &bzl.StringExpr{Value: "bar"},
+					},
+				},
+			},
+		},
+	}
+
+	var buf bytes.Buffer
+	if err := writeFile(&buf, f); err != nil {
+		t.Fatalf("writeFile(%q) failed with %v; want success", f.Path, err)
+	}
+	if got, want := buf.String(), "--- a/b/BUILD.bazel\n"+string(bzl.Format(f)); got != want {
+		t.Errorf("got %q; want %q", got, want)
+	}
+}
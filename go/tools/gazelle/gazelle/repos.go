@@ -0,0 +1,281 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	bzl "github.com/bazelbuild/buildtools/build"
+	"github.com/bazelbuild/rules_go/go/tools/gazelle/generator"
+	"github.com/bazelbuild/rules_go/go/tools/gazelle/logging"
+	"github.com/bazelbuild/rules_go/go/tools/gazelle/packages"
+	"github.com/bazelbuild/rules_go/go/tools/gazelle/rules"
+)
+
+// runRepos prints go_repository rules for module requirements in the
+// go.mod file in repoRoot, or in "lockFile" if it is not empty (see
+// readRequirements), that are not declared in WORKSPACE or in repoFiles.
+// The packages under "dirs" are walked to find requirements that are only
+// imported by tests; these are printed after the others. If markTestOnly is
+// true, their rules are marked testonly, so build files generated in those
+// repositories can only be used by tests. Requirements covered by
+// "overrides" are skipped, as in drift mode.
+func runRepos(w io.Writer, g *generator.Generator, dirs []string, repoRoot, lockFile string, repoFiles []string, overrides map[string]string, markTestOnly bool) error {
+	reqs, err := readRequirements(repoRoot, lockFile)
+	if err != nil {
+		return err
+	}
+	repoRules, err := readRepositoryRules(repoRoot, repoFiles)
+	if err != nil {
+		return err
+	}
+	prodReqs, testReqs := findMissingRequirements(g, dirs, reqs, repoRules, overrides)
+	return writeRepositoryRules(w, prodReqs, testReqs, markTestOnly)
+}
+
+// runUpdateWorkspace is like runRepos, but instead of printing the rules,
+// it appends them to the WORKSPACE file in repoRoot. The commit or tag of
+// go_repository rules in WORKSPACE that don't match the requirements is
+// updated too.
+// Rules declared in repoFiles are not changed; a warning is logged for
+// those that don't match.
+func runUpdateWorkspace(g *generator.Generator, dirs []string, repoRoot, lockFile string, repoFiles []string, overrides map[string]string, markTestOnly bool) error {
+	reqs, err := readRequirements(repoRoot, lockFile)
+	if err != nil {
+		return err
+	}
+	repoRules, err := readRepositoryRules(repoRoot, repoFiles)
+	if err != nil {
+		return err
+	}
+	prodReqs, testReqs := findMissingRequirements(g, dirs, reqs, repoRules, overrides)
+
+	path := filepath.Join(repoRoot, "WORKSPACE")
+	oldData, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	f, err := bzl.Parse(path, oldData)
+	if err != nil {
+		return err
+	}
+	data := oldData
+	mismatched := compareDependencies(reqs, repoRules, overrides).mismatched
+	if updateRepositoryVersions(f, mismatched) {
+		data = bzl.Format(f)
+	}
+	if data, err = appendRepositoryRules(data, prodReqs, testReqs, markTestOnly); err != nil {
+		return err
+	}
+	if bytes.Equal(data, oldData) {
+		return nil
+	}
+	return ioutil.WriteFile(path, data, 0666)
+}
+
+// findMissingRequirements returns the requirements in "reqs" that are not
+// declared in "repoRules" or covered by "overrides". The packages under
+// "dirs" are walked to find requirements that are only imported by tests;
+// these are returned in testReqs. Both lists are sorted by path.
+func findMissingRequirements(g *generator.Generator, dirs []string, reqs []moduleRequirement, repoRules []repositoryRule, overrides map[string]string) (prodReqs, testReqs []moduleRequirement) {
+	declared := make(map[string]bool)
+	for _, r := range repoRules {
+		declared[r.importpath] = true
+	}
+
+	var prodImports, testImports []string
+	for _, d := range dirs {
+		g.Walk(d, func(rel string, pkg *packages.Package) {
+			prodImports = append(prodImports, packageImports(pkg)...)
+			testImports = append(testImports, allPlatformStrings(pkg.Test.Imports)...)
+			testImports = append(testImports, allPlatformStrings(pkg.XTest.Imports)...)
+			for _, suite := range pkg.TestSuites {
+				testImports = append(testImports, allPlatformStrings(suite.Test.Imports)...)
+				testImports = append(testImports, allPlatformStrings(suite.XTest.Imports)...)
+			}
+		})
+	}
+	testOnly := findTestOnlyRequirements(reqs, prodImports, testImports)
+
+	for _, req := range reqs {
+		if declared[req.path] || isOverridden(req.path, overrides) {
+			continue
+		}
+		if testOnly[req.path] {
+			testReqs = append(testReqs, req)
+		} else {
+			prodReqs = append(prodReqs, req)
+		}
+	}
+	sortRequirements(prodReqs)
+	sortRequirements(testReqs)
+	return prodReqs, testReqs
+}
+
+// updateRepositoryVersions sets the commit or tag of each rule in
+// "mismatched" that is declared in "f" to the version required in go.mod.
+// It returns whether any rule was changed.
+func updateRepositoryVersions(f *bzl.File, mismatched []versionMismatch) bool {
+	rulesByName := make(map[string]*bzl.Rule)
+	for _, kind := range []string{"go_repository", "new_go_repository"} {
+		for _, r := range f.Rules(kind) {
+			rulesByName[r.Name()] = r
+		}
+	}
+	changed := false
+	for _, m := range mismatched {
+		r, ok := rulesByName[m.rule.name]
+		if !ok {
+			logging.Warnf(logging.At{File: f.Path, Rule: m.rule.name}, "%s is not declared in this file; not updating it from %s to %s", m.rule.name, m.rule.version, m.req.version)
+			continue
+		}
+		r.DelAttr("commit")
+		r.DelAttr("tag")
+		attr, value := repositoryVersion(m.req.version)
+		r.SetAttr(attr, &bzl.StringExpr{Value: value})
+		changed = true
+	}
+	return changed
+}
+
+// appendRepositoryRules returns "data", the content of a WORKSPACE file,
+// followed by rules for "prodReqs" and "testReqs" as written by
+// writeRepositoryRules, separated from it by a blank line.
+func appendRepositoryRules(data []byte, prodReqs, testReqs []moduleRequirement, markTestOnly bool) ([]byte, error) {
+	if len(prodReqs) == 0 && len(testReqs) == 0 {
+		return data, nil
+	}
+	var buf bytes.Buffer
+	buf.Write(data)
+	if len(data) > 0 {
+		if !bytes.HasSuffix(data, []byte("\n")) {
+			buf.WriteByte('\n')
+		}
+		if !bytes.HasSuffix(data, []byte("\n\n")) {
+			buf.WriteByte('\n')
+		}
+	}
+	if err := writeRepositoryRules(&buf, prodReqs, testReqs, markTestOnly); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), nil
+}
+
+// findTestOnlyRequirements returns the set of module paths in "reqs" that
+// provide packages in "testImports" but none in "prodImports". Requirements
+// that provide no imported packages, for example, indirect requirements,
+// are not test-only, since production dependencies may need them.
+func findTestOnlyRequirements(reqs []moduleRequirement, prodImports, testImports []string) map[string]bool {
+	prod := make(map[string]bool)
+	for _, imp := range prodImports {
+		if m := findRequirement(reqs, imp); m != "" {
+			prod[m] = true
+		}
+	}
+	testOnly := make(map[string]bool)
+	for _, imp := range testImports {
+		if m := findRequirement(reqs, imp); m != "" && !prod[m] {
+			testOnly[m] = true
+		}
+	}
+	return testOnly
+}
+
+// findRequirement returns the path of the module in "reqs" with the longest
+// path that contains the package "importpath", or "" if none does.
+func findRequirement(reqs []moduleRequirement, importpath string) string {
+	var best string
+	for _, req := range reqs {
+		if (importpath == req.path || strings.HasPrefix(importpath, req.path+"/")) && len(req.path) > len(best) {
+			best = req.path
+		}
+	}
+	return best
+}
+
+func sortRequirements(reqs []moduleRequirement) {
+	sort.Slice(reqs, func(i, j int) bool {
+		return reqs[i].path < reqs[j].path
+	})
+}
+
+// writeRepositoryRules writes a go_repository rule for each requirement in
+// prodReqs, then for each requirement in testReqs after a comment.
+func writeRepositoryRules(w io.Writer, prodReqs, testReqs []moduleRequirement, markTestOnly bool) error {
+	for _, req := range prodReqs {
+		if err := writeRepositoryRule(w, req, false); err != nil {
+			return err
+		}
+	}
+	if len(testReqs) == 0 {
+		return nil
+	}
+	if _, err := fmt.Fprintln(w, "# Imported only by tests."); err != nil {
+		return err
+	}
+	for _, req := range testReqs {
+		if err := writeRepositoryRule(w, req, markTestOnly); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeRepositoryRule(w io.Writer, req moduleRequirement, testOnly bool) error {
+	versionAttr, version := repositoryVersion(req.version)
+	lines := []string{
+		"go_repository(",
+		fmt.Sprintf("    name = %q,", rules.ImportPathToBazelRepoName(req.path)),
+		fmt.Sprintf("    importpath = %q,", req.path),
+		fmt.Sprintf("    %s = %q,", versionAttr, version),
+	}
+	if testOnly {
+		lines = append(lines, "    testonly = True,")
+	}
+	lines = append(lines, ")", "")
+	_, err := fmt.Fprintln(w, strings.Join(lines, "\n"))
+	return err
+}
+
+// pseudoVersionRe matches the timestamp and commit hash at the end of a
+// pseudo-version like "v0.0.0-20170101000000-abcdef123456".
+var pseudoVersionRe = regexp.MustCompile(`[-.]\d{14}-([0-9a-f]{12})$`)
+
+// commitRe matches full commit hashes, which lock files record as the
+// versions of requirements without tags.
+var commitRe = regexp.MustCompile(`^[0-9a-f]{40}$`)
+
+// repositoryVersion returns the go_repository attribute and value that
+// select the revision named by a module version: "commit" with the
+// abbreviated hash of a pseudo-version or with a full commit hash, or "tag"
+// with any other version.
+func repositoryVersion(modVersion string) (attr, value string) {
+	modVersion = strings.TrimSuffix(modVersion, "+incompatible")
+	if m := pseudoVersionRe.FindStringSubmatch(modVersion); m != nil {
+		return "commit", m[1]
+	}
+	if commitRe.MatchString(modVersion) {
+		return "commit", modVersion
+	}
+	return "tag", modVersion
+}
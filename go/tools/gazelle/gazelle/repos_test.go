@@ -0,0 +1,201 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	bzl "github.com/bazelbuild/buildtools/build"
+)
+
+func TestFindTestOnlyRequirements(t *testing.T) {
+	reqs := []moduleRequirement{
+		{path: "github.com/prod/lib", version: "v1.0.0"},
+		{path: "github.com/test/assert", version: "v1.2.0"},
+		{path: "github.com/test/assert/v2", version: "v2.0.0"},
+		{path: "github.com/both/util", version: "v0.1.0"},
+		{path: "github.com/indirect/dep", version: "v0.3.0"},
+	}
+	prodImports := []string{"github.com/prod/lib/sub", "github.com/both/util", "example.com/repo/a"}
+	testImports := []string{"github.com/test/assert/v2/require", "github.com/both/util", "github.com/prod/lib"}
+	got := findTestOnlyRequirements(reqs, prodImports, testImports)
+	want := map[string]bool{"github.com/test/assert/v2": true}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v; want %v", got, want)
+	}
+}
+
+func TestRepositoryVersion(t *testing.T) {
+	for _, tc := range []struct {
+		version, attr, value string
+	}{
+		{"v1.2.3", "tag", "v1.2.3"},
+		{"v2.0.0+incompatible", "tag", "v2.0.0"},
+		{"v0.0.0-20170101000000-abcdef123456", "commit", "abcdef123456"},
+		{"v1.2.4-0.20170101000000-abcdef123456", "commit", "abcdef123456"},
+		{"v1.2.3-pre.0.20170101000000-abcdef123456", "commit", "abcdef123456"},
+		{"0123456789abcdef0123456789abcdef01234567", "commit", "0123456789abcdef0123456789abcdef01234567"},
+	} {
+		if attr, value := repositoryVersion(tc.version); attr != tc.attr || value != tc.value {
+			t.Errorf("%s: got %s = %q; want %s = %q", tc.version, attr, value, tc.attr, tc.value)
+		}
+	}
+}
+
+func TestWriteRepositoryRules(t *testing.T) {
+	prodReqs := []moduleRequirement{{path: "github.com/prod/lib", version: "v1.0.0"}}
+	testReqs := []moduleRequirement{{path: "github.com/test/assert", version: "v0.0.0-20170101000000-abcdef123456"}}
+	for _, tc := range []struct {
+		desc         string
+		markTestOnly bool
+		want         string
+	}{
+		{
+			desc: "unmarked",
+			want: `go_repository(
+    name = "com_github_prod_lib",
+    importpath = "github.com/prod/lib",
+    tag = "v1.0.0",
+)
+
+# Imported only by tests.
+go_repository(
+    name = "com_github_test_assert",
+    importpath = "github.com/test/assert",
+    commit = "abcdef123456",
+)
+
+`,
+		}, {
+			desc:         "marked",
+			markTestOnly: true,
+			want: `go_repository(
+    name = "com_github_prod_lib",
+    importpath = "github.com/prod/lib",
+    tag = "v1.0.0",
+)
+
+# Imported only by tests.
+go_repository(
+    name = "com_github_test_assert",
+    importpath = "github.com/test/assert",
+    commit = "abcdef123456",
+    testonly = True,
+)
+
+`,
+		},
+	} {
+		var buf bytes.Buffer
+		if err := writeRepositoryRules(&buf, prodReqs, testReqs, tc.markTestOnly); err != nil {
+			t.Fatal(err)
+		}
+		if got := buf.String(); got != tc.want {
+			t.Errorf("%s: got\n%s\nwant\n%s", tc.desc, got, tc.want)
+		}
+	}
+}
+
+func TestAppendRepositoryRules(t *testing.T) {
+	reqs := []moduleRequirement{{path: "github.com/prod/lib", version: "v1.0.0"}}
+	rule := `go_repository(
+    name = "com_github_prod_lib",
+    importpath = "github.com/prod/lib",
+    tag = "v1.0.0",
+)
+`
+	for _, tc := range []struct {
+		desc, data, want string
+		reqs             []moduleRequirement
+	}{
+		{
+			desc: "empty",
+			reqs: reqs,
+			want: rule,
+		}, {
+			desc: "no newline",
+			data: `workspace(name = "repo")`,
+			reqs: reqs,
+			want: "workspace(name = \"repo\")\n\n" + rule,
+		}, {
+			desc: "blank line",
+			data: "workspace(name = \"repo\")\n\n",
+			reqs: reqs,
+			want: "workspace(name = \"repo\")\n\n" + rule,
+		}, {
+			desc: "nothing to add",
+			data: "workspace(name = \"repo\")\n",
+			want: "workspace(name = \"repo\")\n",
+		},
+	} {
+		got, err := appendRepositoryRules([]byte(tc.data), tc.reqs, nil, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != tc.want {
+			t.Errorf("%s: got\n%s\nwant\n%s", tc.desc, got, tc.want)
+		}
+	}
+}
+
+func TestUpdateRepositoryVersions(t *testing.T) {
+	workspace := []byte(`
+go_repository(
+    name = "com_github_foo_bar",
+    importpath = "github.com/foo/bar",
+    tag = "v1.2.0",
+)
+
+go_repository(
+    name = "org_golang_x_tools",
+    commit = "abcdef1234567890",
+    importpath = "golang.org/x/tools",
+)
+`)
+	f, err := bzl.Parse("WORKSPACE", workspace)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mismatched := []versionMismatch{
+		{
+			req:  moduleRequirement{path: "github.com/foo/bar", version: "v0.0.0-20170101000000-123456abcdef"},
+			rule: repositoryRule{name: "com_github_foo_bar", importpath: "github.com/foo/bar", version: "v1.2.0"},
+		}, {
+			req:  moduleRequirement{path: "golang.org/x/tools", version: "v0.1.0"},
+			rule: repositoryRule{name: "org_golang_x_tools", importpath: "golang.org/x/tools", version: "abcdef1234567890"},
+		}, {
+			req:  moduleRequirement{path: "github.com/other/dep", version: "v1.0.0"},
+			rule: repositoryRule{name: "com_github_other_dep", importpath: "github.com/other/dep", version: "v0.9.0"},
+		},
+	}
+	if !updateRepositoryVersions(f, mismatched) {
+		t.Fatal("got no changes; want changes")
+	}
+
+	got := make(map[string][]string)
+	for _, r := range f.Rules("go_repository") {
+		got[r.Name()] = []string{r.AttrString("commit"), r.AttrString("tag")}
+	}
+	want := map[string][]string{
+		"com_github_foo_bar": {"123456abcdef", ""},
+		"org_golang_x_tools": {"", "v0.1.0"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q; want %q", got, want)
+	}
+}
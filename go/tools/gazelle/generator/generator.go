@@ -19,12 +19,12 @@ package generator
 
 import (
 	"fmt"
-	"log"
 	"path/filepath"
 	"sort"
 	"strings"
 
 	bzl "github.com/bazelbuild/buildtools/build"
+	"github.com/bazelbuild/rules_go/go/tools/gazelle/logging"
 	"github.com/bazelbuild/rules_go/go/tools/gazelle/packages"
 	"github.com/bazelbuild/rules_go/go/tools/gazelle/rules"
 )
@@ -34,18 +34,30 @@ const (
 	goRulesBzl = "@io_bazel_rules_go//go:def.bzl"
 )
 
+// Platforms is the set of platforms that generated rules are built for.
+// Files are classified and select expressions are generated for these
+// platforms. If nil, packages.DefaultPlatformConstraints is used.
+var Platforms packages.PlatformConstraints
+
 // Generator generates BUILD files for a Go repository.
 type Generator struct {
+	c             *packages.Config
 	repoRoot      string
 	goPrefix      string
 	buildFileName string
 	buildTags     map[string]bool
 	platforms     packages.PlatformConstraints
+	modules       []packages.ModuleRoot
+	prefixRoots   []packages.ModuleRoot
+	comments      map[string]string
 	g             rules.Generator
+	errs          []*packages.DirError
+	excluded      []*packages.ExcludedError
 }
 
 // New returns a new Generator which is responsible for a Go repository.
 //
+// "c" controls how directories and files are read.
 // "repoRoot" is a path to the root directory of the repository.
 // "goPrefix" is the go_prefix corresponding to the repository root directory.
 // See also https://github.com/bazelbuild/rules_go#go_prefix.
@@ -53,7 +65,7 @@ type Generator struct {
 // "buildTags" is set of build tags that are true on all platforms. Some
 // additional tags will be added to this. May be nil.
 // "external" is how external packages should be resolved.
-func New(repoRoot, goPrefix, buildFileName string, buildTags map[string]bool, external rules.ExternalResolver) (*Generator, error) {
+func New(c *packages.Config, repoRoot, goPrefix, buildFileName string, buildTags map[string]bool, external rules.ExternalResolver) (*Generator, error) {
 	repoRoot, err := filepath.Abs(repoRoot)
 	if err != nil {
 		return nil, err
@@ -62,19 +74,57 @@ func New(repoRoot, goPrefix, buildFileName string, buildTags map[string]bool, ex
 	if buildTags == nil {
 		buildTags = make(map[string]bool)
 	}
-	platforms := packages.DefaultPlatformConstraints
+	platforms := Platforms
+	if platforms == nil {
+		platforms = packages.DefaultPlatformConstraints
+	}
 	packages.PreprocessTags(buildTags, platforms)
 
+	modules, err := packages.FindWorkspaceModules(c, repoRoot)
+	if err != nil {
+		return nil, err
+	}
+	prefixRoots, err := packages.FindPrefixRoots(c, repoRoot)
+	if err != nil {
+		return nil, err
+	}
+
 	return &Generator{
+		c:             c,
 		repoRoot:      repoRoot,
 		goPrefix:      goPrefix,
 		buildFileName: buildFileName,
 		buildTags:     buildTags,
 		platforms:     platforms,
-		g:             rules.NewGenerator(repoRoot, goPrefix, external),
+		modules:       modules,
+		prefixRoots:   prefixRoots,
+		g:             rules.NewGenerator(c, repoRoot, goPrefix, external),
 	}, nil
 }
 
+// ImportPath returns the import path expected for a library in the
+// directory "rel", a slash-separated path from the repository root. This is
+// computed the same way Walk computes it: relative to the innermost vendor
+// directory for vendored directories, and otherwise from the innermost
+// "# gazelle:prefix" directive or module listed in go.work, or from the
+// go_prefix. With rules.UseImportComments, the path in the import comment
+// of a package visited by Generate or Walk is returned.
+func (g *Generator) ImportPath(rel string) string {
+	if rel == "." {
+		rel = ""
+	}
+	if importpath, ok := g.comments[rel]; ok {
+		return importpath
+	}
+	if importpath, ok := packages.VendoredImportPath(rel); ok {
+		return importpath
+	}
+	if root, _, ok := packages.FindPrefixRoot(g.prefixRoots, g.modules, rel); ok {
+		return root.ImportPath(rel)
+	}
+	return packages.ImportPath(nil, g.goPrefix, rel)
+}
+
 // Generate generates a BUILD file for each Go package found under
 // the given directory.
 // The directory must be the repository root directory the caller
@@ -84,35 +134,118 @@ func New(repoRoot, goPrefix, buildFileName string, buildTags map[string]bool, ex
 func (g *Generator) Generate(dir string) []*bzl.File {
 	dir, err := filepath.Abs(dir)
 	if err != nil {
-		log.Print(err)
+		logging.Errorf(logging.At{}, "%v", err)
 		return nil
 	}
 	if !isDescendingDir(dir, g.repoRoot) {
-		log.Printf("dir %s is not under the repository root %s", dir, g.repoRoot)
+		logging.Errorf(logging.At{File: dir}, "dir %s is not under the repository root %s", dir, g.repoRoot)
 		return nil
 	}
 
-	var files []*bzl.File
-	packages.Walk(g.buildTags, g.platforms, g.repoRoot, g.goPrefix, dir, func(pkg *packages.Package) {
-		rel, err := filepath.Rel(g.repoRoot, pkg.Dir)
-		if err != nil {
-			log.Print(err)
+	// Packages are read before rules are generated, so the import comments
+	// of all of them are known when imports are resolved.
+	type walkedPackage struct {
+		rel string
+		pkg *packages.Package
+	}
+	var pkgs []walkedPackage
+	g.walk(dir, func(rel string, pkg *packages.Package) {
+		if !pkg.HasGo() && !rules.ToolSrcsFilegroup {
+			// The package only has tool sources, and no filegroup is
+			// generated for them.
 			return
 		}
-		if rel == "." {
-			rel = ""
-		}
+		pkgs = append(pkgs, walkedPackage{rel, pkg})
+	})
+
+	var files []*bzl.File
+	for _, p := range pkgs {
+		rel, pkg := p.rel, p.pkg
 		if len(files) == 0 && rel != "" {
 			// "dir" was not a buildable Go package but still need a BUILD file
 			// for go_prefix.
 			files = append(files, g.emptyToplevel())
 		}
 
+		if pkg.Extra && len(files) > 0 && files[len(files)-1].Path == filepath.Join(rel, g.buildFileName) {
+			// Rules for other packages in the same directory go in the same file.
+			g.addRules(files[len(files)-1], rel, pkg)
+			continue
+		}
 		files = append(files, g.generateOne(rel, pkg))
-	})
+	}
 	return files
 }
 
+// Walk calls f for each Go package found under the given directory, with
+// the same build tags and platforms that Generate uses. "rel" is the
+// slash-separated path from the repository root to the package directory.
+// The directory must be under the repository root. Errors are logged and
+// recorded like in Generate.
+func (g *Generator) Walk(dir string, f func(rel string, pkg *packages.Package)) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		logging.Errorf(logging.At{}, "%v", err)
+		return
+	}
+	if !isDescendingDir(dir, g.repoRoot) {
+		logging.Errorf(logging.At{File: dir}, "dir %s is not under the repository root %s", dir, g.repoRoot)
+		return
+	}
+	g.walk(dir, f)
+}
+
+func (g *Generator) walk(dir string, f func(rel string, pkg *packages.Package)) {
+	packages.WalkWithErrors(g.c, g.buildTags, g.platforms, g.repoRoot, g.goPrefix, dir, func(pkg *packages.Package) {
+		rel, err := filepath.Rel(g.repoRoot, pkg.Dir)
+		if err != nil {
+			logging.Errorf(logging.At{File: pkg.Dir}, "%v", err)
+			return
+		}
+		if rel == "." {
+			rel = ""
+		}
+		rel = filepath.ToSlash(rel)
+		if rules.UseImportComments && pkg.ImportComment != "" && !pkg.Vendored && !pkg.Extra {
+			if g.comments == nil {
+				g.comments = make(map[string]string)
+			}
+			g.comments[rel] = pkg.ImportComment
+			g.g.AddImportComment(rel, pkg.ImportComment)
+		}
+		f(rel, pkg)
+	}, func(err *packages.DirError) {
+		var errs []error
+		for _, e := range err.Errs {
+			if excluded, ok := e.(*packages.ExcludedError); ok {
+				g.excluded = append(g.excluded, excluded)
+				continue
+			}
+			logging.Errorf(logging.At{File: err.Dir}, "%v", e)
+			errs = append(errs, e)
+		}
+		if len(errs) > 0 {
+			g.errs = append(g.errs, &packages.DirError{Dir: err.Dir, Errs: errs})
+		}
+	})
+}
+
+// Errors returns the errors that occurred while reading packages in calls
+// to Generate. Errors are also logged when they occur. Directories where
+// all files were excluded by build constraints are reported by Excluded
+// instead.
+func (g *Generator) Errors() []*packages.DirError {
+	return g.errs
+}
+
+// Excluded returns the directories visited by calls to Generate where
+// build constraints exclude all .go files on all platforms, so no rules
+// were generated. These are not logged when they are found, so callers can
+// report them together.
+func (g *Generator) Excluded() []*packages.ExcludedError {
+	return g.excluded
+}
+
 func (g *Generator) emptyToplevel() *bzl.File {
 	return &bzl.File{
 		Path: g.buildFileName,
@@ -129,15 +262,26 @@ func (g *Generator) emptyToplevel() *bzl.File {
 }
 
 func (g *Generator) generateOne(rel string, pkg *packages.Package) *bzl.File {
-	rs := g.g.Generate(filepath.ToSlash(rel), pkg)
 	file := &bzl.File{Path: filepath.Join(rel, g.buildFileName)}
-	for _, r := range rs {
+	g.addRules(file, rel, pkg)
+	return file
+}
+
+// addRules generates rules for "pkg" and adds them to "file", replacing the
+// load statement at the beginning of the file, if any, with one that covers
+// all rules in the file.
+func (g *Generator) addRules(file *bzl.File, rel string, pkg *packages.Package) {
+	if len(file.Stmt) > 0 {
+		if c, ok := file.Stmt[0].(*bzl.CallExpr); ok && (&bzl.Rule{Call: c}).Kind() == "load" {
+			file.Stmt = file.Stmt[1:]
+		}
+	}
+	for _, r := range g.g.Generate(filepath.ToSlash(rel), pkg) {
 		file.Stmt = append(file.Stmt, r.Call)
 	}
 	if load := g.generateLoad(file); load != nil {
 		file.Stmt = append([]bzl.Expr{load}, file.Stmt...)
 	}
-	return file
 }
 
 func (g *Generator) generateLoad(f *bzl.File) bzl.Expr {
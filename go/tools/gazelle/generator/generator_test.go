@@ -16,11 +16,15 @@ limitations under the License.
 package generator
 
 import (
+	"io/ioutil"
+	"os"
 	"path/filepath"
 	"reflect"
+	"strings"
 	"testing"
 
 	bzl "github.com/bazelbuild/buildtools/build"
+	"github.com/bazelbuild/rules_go/go/tools/gazelle/packages"
 	"github.com/bazelbuild/rules_go/go/tools/gazelle/rules"
 	"github.com/bazelbuild/rules_go/go/tools/gazelle/testdata"
 )
@@ -28,7 +32,7 @@ import (
 func TestBuildTagOverride(t *testing.T) {
 	repo := filepath.Join(testdata.Dir(), "repo")
 	buildTags := map[string]bool{"a": true, "b": true}
-	g, err := New(repo, "example.com/repo", "BUILD", buildTags, rules.External)
+	g, err := New(packages.NewConfig(), repo, "example.com/repo", "BUILD", buildTags, rules.External)
 	if err != nil {
 		t.Errorf(`New(%q, "example.com/repo") failed with %v; want success`, repo, err)
 		return
@@ -54,7 +58,7 @@ func TestGeneratedFileName(t *testing.T) {
 
 func testGeneratedFileName(t *testing.T, buildFileName string) {
 	repo := filepath.Join(testdata.Dir(), "repo")
-	g, err := New(repo, "example.com/repo", buildFileName, nil, rules.External)
+	g, err := New(packages.NewConfig(), repo, "example.com/repo", buildFileName, nil, rules.External)
 	if err != nil {
 		t.Errorf("error creating generator: %v", err)
 		return
@@ -81,3 +85,89 @@ func TestLoadExprSorted(t *testing.T) {
 		t.Errorf("loadExpr List strings: want %#v, got %#v", expected, actual)
 	}
 }
+
+func TestImportPathPrefixDirective(t *testing.T) {
+	repo, err := ioutil.TempDir(os.Getenv("TEST_TMPDIR"), "generator_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(repo)
+	for name, content := range map[string]string{
+		"other/BUILD":            "# gazelle:prefix example.com/renamed\n",
+		"other/inner/BUILD":      "# gazelle:prefix example.com/inner\n",
+		"other/inner/sub/sub.go": "package sub\n",
+		"plain/plain.go":         "package plain\n\nimport _ \"example.com/inner/sub\"\n",
+	} {
+		path := filepath.Join(repo, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	g, err := New(packages.NewConfig(), repo, "example.com/repo", "BUILD", nil, rules.External)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		rel, want string
+	}{
+		{"", "example.com/repo"},
+		{"plain", "example.com/repo/plain"},
+		{"other", "example.com/renamed"},
+		{"other/sub", "example.com/renamed/sub"},
+		{"other/inner", "example.com/inner"},
+		{"other/inner/sub", "example.com/inner/sub"},
+		{"other/inner/vendor/github.com/x/y", "github.com/x/y"},
+	} {
+		if got := g.ImportPath(tc.rel); got != tc.want {
+			t.Errorf("ImportPath(%q) = %q; want %q", tc.rel, got, tc.want)
+		}
+	}
+
+	// Imports of packages under a directive resolve before the directive's
+	// directory has been visited.
+	var content string
+	for _, f := range g.Generate(filepath.Join(repo, "plain")) {
+		content += string(bzl.Format(f))
+	}
+	if want := `"//other/inner/sub:go_default_library"`; !strings.Contains(content, want) {
+		t.Errorf("generated files don't contain %s:\n%s", want, content)
+	}
+}
+
+func TestToolSrcsOnly(t *testing.T) {
+	repo, err := ioutil.TempDir(os.Getenv("TEST_TMPDIR"), "generator_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(repo)
+	path := filepath.Join(repo, "tools", "gen.go")
+	if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, []byte("// +build ignore\n\npackage main\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	g, err := New(packages.NewConfig(), repo, "example.com/repo", "BUILD", nil, rules.External)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := filepath.Join(repo, "tools")
+	if files := g.Generate(dir); len(files) != 0 {
+		t.Errorf("got %d files without a tool_srcs filegroup; want 0", len(files))
+	}
+
+	rules.ToolSrcsFilegroup = true
+	defer func() { rules.ToolSrcsFilegroup = false }()
+	var content string
+	for _, f := range g.Generate(dir) {
+		content += string(bzl.Format(f))
+	}
+	if want := `name = "go_default_library_tool_srcs"`; !strings.Contains(content, want) {
+		t.Errorf("generated files don't contain %s:\n%s", want, content)
+	}
+}
@@ -0,0 +1,122 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package logging reports messages from gazelle with a level and the file
+// and rule they are about. Messages are written with the standard log
+// package by default, or as JSON objects, one per line, for programs that
+// run gazelle and need to parse its output.
+package logging
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+)
+
+// Level is the severity of a message.
+type Level int
+
+const (
+	// Info messages describe changes gazelle made that may be surprising.
+	Info Level = iota
+
+	// Warning messages describe problems that didn't stop gazelle from
+	// generating rules, but may make them wrong.
+	Warning
+
+	// Error messages describe problems that stopped gazelle from reading a
+	// file or directory.
+	Error
+)
+
+var levelNames = []string{"info", "warning", "error"}
+
+func (l Level) String() string {
+	if l < 0 || int(l) >= len(levelNames) {
+		return fmt.Sprintf("Level(%d)", int(l))
+	}
+	return levelNames[l]
+}
+
+// At names the file and rule a message is about. Either may be empty.
+type At struct {
+	File, Rule string
+}
+
+const (
+	// TextFormat writes messages with the standard log package, without the
+	// level or attribution. This is the default.
+	TextFormat = "text"
+
+	// JSONFormat writes each message to Output as a JSON object on its own
+	// line, with "level", "file", "rule", and "message" fields. Empty
+	// fields are omitted.
+	JSONFormat = "json"
+)
+
+var (
+	// Format is TextFormat or JSONFormat.
+	Format = TextFormat
+
+	// Output is where messages in JSONFormat are written.
+	Output = defaultOutput
+
+	defaultOutput io.Writer = os.Stderr
+
+	mu sync.Mutex
+)
+
+type jsonEntry struct {
+	Level   string `json:"level"`
+	File    string `json:"file,omitempty"`
+	Rule    string `json:"rule,omitempty"`
+	Message string `json:"message"`
+}
+
+// Logf reports a message. Messages should still name the file they are
+// about, so they are useful in TextFormat.
+func Logf(level Level, at At, format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	if Format != JSONFormat {
+		log.Print(msg)
+		return
+	}
+	data, err := json.Marshal(jsonEntry{Level: level.String(), File: at.File, Rule: at.Rule, Message: msg})
+	if err != nil {
+		log.Print(msg)
+		return
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	fmt.Fprintf(Output, "%s\n", data)
+}
+
+// Infof reports a message at the Info level.
+func Infof(at At, format string, args ...interface{}) {
+	Logf(Info, at, format, args...)
+}
+
+// Warnf reports a message at the Warning level.
+func Warnf(at At, format string, args ...interface{}) {
+	Logf(Warning, at, format, args...)
+}
+
+// Errorf reports a message at the Error level.
+func Errorf(at At, format string, args ...interface{}) {
+	Logf(Error, at, format, args...)
+}
@@ -0,0 +1,54 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package logging
+
+import (
+	"bytes"
+	"log"
+	"testing"
+)
+
+func TestLogfText(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(defaultOutput)
+	flags := log.Flags()
+	log.SetFlags(0)
+	defer log.SetFlags(flags)
+
+	Warnf(At{File: "a/BUILD"}, "a/BUILD: %s", "problem")
+	if got, want := buf.String(), "a/BUILD: problem\n"; got != want {
+		t.Errorf("got %q; want %q", got, want)
+	}
+}
+
+func TestLogfJSON(t *testing.T) {
+	var buf bytes.Buffer
+	defer func(format string) {
+		Format = format
+		Output = defaultOutput
+	}(Format)
+	Format, Output = JSONFormat, &buf
+
+	Infof(At{File: "a/BUILD", Rule: "go_default_library"}, "a/BUILD: changing importpath")
+	Errorf(At{}, "parse error")
+	want := `{"level":"info","file":"a/BUILD","rule":"go_default_library","message":"a/BUILD: changing importpath"}
+{"level":"error","message":"parse error"}
+`
+	if got := buf.String(); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
@@ -20,73 +20,392 @@ import (
 	"fmt"
 	"io/ioutil"
 	"log"
+	"os"
+	"path"
+	"path/filepath"
 	"sort"
 	"strings"
 
 	bzl "github.com/bazelbuild/buildtools/build"
+	"github.com/bazelbuild/rules_go/go/tools/gazelle/logging"
+	"github.com/bazelbuild/rules_go/go/tools/gazelle/packages"
+	"github.com/bazelbuild/rules_go/go/tools/gazelle/wspace"
 )
 
 const (
 	gazelleIgnore = "# gazelle:ignore" // marker in a BUILD file to ignore it.
 	keep          = "# keep"           // marker in srcs or deps to tell gazelle to preserve.
+	doNotSort     = "do not sort"      // buildifier marker on attributes whose lists are not sorted.
+
+	defaultLibName = "go_default_library" // name of the library of a directory's own package.
 )
 
 var (
 	mergeableFields = map[string]bool{
-		"srcs":    true,
-		"deps":    true,
-		"library": true,
+		"srcs":       true,
+		"deps":       true,
+		"library":    true,
+		"importpath": true,
+
+		// default_visibility is an attribute of package().
+		"default_visibility": true,
 	}
+
+	// nonRuleCalls is the set of functions that may be called at the top level
+	// of a build file but don't declare named rules. Each of these calls is
+	// matched by function name alone.
+	nonRuleCalls = map[string]bool{
+		"exports_files": true,
+		"licenses":      true,
+		"package":       true,
+	}
+)
+
+// Options controls how generated rules are merged into existing build
+// files. The zero value merges with the default settings.
+type Options struct {
+	// SelectKeyAliases maps old config_setting labels used as keys in select
+	// expressions to the labels that should replace them. When an existing
+	// select dict is merged, entries with an old key are moved into the
+	// entry for the new key.
+	SelectKeyAliases map[string]string
+
+	// MultiLineThresholds maps attribute names to the number of elements at
+	// which lists in merged attributes are always formatted on multiple
+	// lines. The key "*" applies to attributes that aren't listed. Lists in
+	// attributes without a threshold are formatted by buildifier's rules.
+	MultiLineThresholds map[string]int
+
+	// UpdateGoPrefix controls whether the argument of an existing go_prefix
+	// rule is replaced with the generated prefix. When false, the existing
+	// prefix is left in place.
+	UpdateGoPrefix bool
+
+	// KindConflict controls what happens when a generated rule has the same
+	// name as an existing rule of a different kind, for example, when a
+	// package becomes a command and a go_binary is generated with the name
+	// of an existing go_library. It must be one of the KindConflict
+	// constants. When empty, KindConflictError is used.
+	KindConflict string
+
+	// ResolveConflict is called when a generated rule or attribute can't be
+	// merged automatically, and returns one of the Conflict decisions. When
+	// nil, generated attributes replace existing ones that can't be merged,
+	// and rules with conflicting kinds are handled as set by KindConflict.
+	ResolveConflict func(c Conflict) string
+
+	// SrcsStyle is the style of srcs attributes in build files without a
+	// "# gazelle:srcs_style" directive, as in packages.Config.SrcsStyle.
+	SrcsStyle string
+}
+
+// Values of Options.KindConflict.
+const (
+	// KindConflictError reports an error and leaves the existing rule alone.
+	// The generated rule is not added.
+	KindConflictError = "error"
+
+	// KindConflictRename adds the generated rule with its kind appended to
+	// its name, for example, "foo_binary". The existing rule is left alone.
+	KindConflictRename = "rename"
+
+	// KindConflictAlias adds the generated rule with a new name, as with
+	// KindConflictRename, and replaces the existing rule with an alias to it,
+	// so labels referring to the old name still work.
+	KindConflictAlias = "alias"
+)
+
+// A Conflict describes a generated rule or attribute that can't be merged
+// automatically with an existing one.
+type Conflict struct {
+	// Pkg is the name of the Bazel package containing the rules, or
+	// "<unknown>" if it is not known.
+	Pkg string
+
+	// Rule is the name of the rule.
+	Rule string
+
+	// Attr is the name of the attribute that could not be merged. It is
+	// empty if the existing rule has a different kind than the generated
+	// rule with the same name. In that case, Old and Gen are the rules.
+	Attr string
+
+	// Old and Gen are the existing and generated expressions.
+	Old, Gen bzl.Expr
+
+	// Err describes why the expressions could not be merged.
+	Err error
+}
+
+// Decisions returned by Options.ResolveConflict.
+const (
+	// ConflictKeep keeps the existing expression and marks it with
+	// "# keep", so later runs leave it alone without asking again.
+	ConflictKeep = "keep"
+
+	// ConflictTakeGenerated replaces the existing expression with the
+	// generated one.
+	ConflictTakeGenerated = "generated"
+
+	// ConflictSkip leaves the existing expression alone for now. The
+	// conflict is found again on the next run.
+	ConflictSkip = "skip"
 )
 
+// FindBuildFile returns the path of the existing build file in dir. names is
+// a list of valid build file names in order of preference (for example,
+// BUILD.bazel, then BUILD). If more than one of the files exists, the
+// preferred one is returned, and a warning names the files whose rules are
+// not merged. os.ErrNotExist is returned if no build file exists.
+func FindBuildFile(dir string, names []string) (string, error) {
+	var found []string
+	for _, base := range names {
+		p := filepath.Join(dir, base)
+		fi, err := os.Stat(p)
+		if err == nil {
+			if fi.Mode().IsRegular() {
+				found = append(found, p)
+			}
+			continue
+		}
+		if !os.IsNotExist(err) {
+			return "", err
+		}
+	}
+	if len(found) == 0 {
+		return "", os.ErrNotExist
+	}
+	if len(found) > 1 {
+		logging.Warnf(logging.At{File: found[0]}, "multiple build files found; merging into %s, rules in %s are not merged", found[0], strings.Join(found[1:], ", "))
+	}
+	return found[0], nil
+}
+
+// MergeWithExistingInDir finds the existing build file in the directory of
+// genFile using FindBuildFile and merges genFile into it as set by opts. The path of the
+// existing file is returned with the merged file. If rename is true and the
+// existing file is not named names[0], the Path of the merged file is
+// changed to use names[0]; the caller should remove the old file after
+// writing the merged file. os.ErrNotExist is returned if there is no existing
+// build file. If the existing file contains "# gazelle:ignore" or cannot be
+// merged, a nil file is returned.
+func MergeWithExistingInDir(opts *Options, genFile *bzl.File, names []string, rename bool) (merged *bzl.File, oldPath string, err error) {
+	dir := filepath.Dir(genFile.Path)
+	oldPath, err = FindBuildFile(dir, names)
+	if err != nil {
+		return nil, "", err
+	}
+	merged = MergeWithExisting(opts, genFile, oldPath)
+	if merged == nil {
+		return nil, oldPath, nil
+	}
+	if rename && len(names) > 0 && filepath.Base(oldPath) != names[0] {
+		merged.Path = filepath.Join(dir, names[0])
+	}
+	return merged, oldPath, nil
+}
+
 // MergeWithExisting merges genFile with an existing build file at
-// existingFilePath and returns the merged file. If a "# gazelle:ignore" comment
+// existingFilePath as set by opts and returns the merged file. If a "# gazelle:ignore" comment
 // is found in the file, nil will be returned. If an error occurs, it will be
 // logged, and nil will be returned.
-func MergeWithExisting(genFile *bzl.File, existingFilePath string) *bzl.File {
+func MergeWithExisting(opts *Options, genFile *bzl.File, existingFilePath string) *bzl.File {
 	oldData, err := ioutil.ReadFile(existingFilePath)
 	if err != nil {
-		log.Print(err)
+		logging.Errorf(logging.At{File: existingFilePath}, "%v", err)
 		return nil
 	}
 	oldFile, err := bzl.Parse(existingFilePath, oldData)
 	if err != nil {
-		log.Print(err)
+		logging.Errorf(logging.At{File: existingFilePath}, "%v", err)
 		return nil
 	}
 	if shouldIgnore(oldFile) {
 		return nil
 	}
+	pkg := packageName(existingFilePath)
+	listSrcs := opts.srcsStyle(oldFile) == packages.SrcsStyleList
 
 	oldStmt := oldFile.Stmt
 	var newStmt []bzl.Expr
+	var pkgCalls []*bzl.CallExpr
 	for _, s := range genFile.Stmt {
 		genRule, ok := s.(*bzl.CallExpr)
 		if !ok {
 			log.Panicf("got %v expected only CallExpr in %q", s, genFile.Path)
 		}
+		if genRule = opts.resolveKindConflict(oldFile, genRule); genRule == nil {
+			continue
+		}
 		i, oldRule := match(oldFile, genRule)
 		if oldRule == nil {
-			newStmt = append(newStmt, genRule)
+			if kind(genRule) == "package" {
+				// package() must precede rules, so it can't be appended.
+				// It's inserted after the loop, since inserting it now
+				// would shift the indices returned by match.
+				pkgCalls = append(pkgCalls, genRule)
+			} else {
+				newStmt = append(newStmt, genRule)
+			}
 			continue
 		}
 
 		var mergedRule bzl.Expr
-		if kind(oldRule) == "load" {
+		switch k := kind(oldRule); {
+		case k == "load":
 			mergedRule = mergeLoad(genRule, oldRule, oldFile)
-		} else {
-			mergedRule = mergeRule(genRule, oldRule)
+		case nonRuleCalls[k]:
+			mergedRule = opts.mergeCall(genRule, oldRule, pkg)
+		case k == "go_prefix" && opts.UpdateGoPrefix:
+			mergedRule = mergeGoPrefix(genRule, oldRule, oldFile)
+		default:
+			mergedRule = opts.mergeRule(genRule, oldRule, pkg, listSrcs)
 		}
 		oldStmt[i] = mergedRule
 	}
 
+	for _, c := range pkgCalls {
+		oldStmt = insertAfterLoads(oldStmt, c)
+	}
 	oldFile.Stmt = append(oldStmt, newStmt...)
 	return oldFile
 }
 
+// resolveKindConflict checks whether "gen", a generated rule, has the same
+// name as a rule of a different kind in "f" and handles the conflict as
+// specified by KindConflict. It returns the rule to merge in place of gen,
+// which may have been renamed, or nil if gen should be dropped.
+func (opts *Options) resolveKindConflict(f *bzl.File, gen *bzl.CallExpr) *bzl.CallExpr {
+	genKind, genName := kind(gen), name(gen)
+	if genKind == "load" || nonRuleCalls[genKind] || genName == "" {
+		return gen
+	}
+	var old *bzl.CallExpr
+	for _, s := range f.Stmt {
+		c, ok := s.(*bzl.CallExpr)
+		if !ok {
+			continue
+		}
+		if k := kind(c); k != genKind && k != "load" && !nonRuleCalls[k] && name(c) == genName {
+			old = c
+			break
+		}
+	}
+	if old == nil {
+		return gen
+	}
+	if shouldKeep(old) {
+		// The user chose to keep the existing rule on an earlier run.
+		return nil
+	}
+	if opts.ResolveConflict != nil {
+		c := Conflict{
+			Pkg:  packageName(f.Path),
+			Rule: genName,
+			Old:  old,
+			Gen:  gen,
+			Err:  fmt.Errorf("existing %s has the same name as generated %s", kind(old), genKind),
+		}
+		switch opts.ResolveConflict(c) {
+		case ConflictKeep:
+			addKeepComment(old)
+			return nil
+		case ConflictTakeGenerated:
+			comments := old.Comments
+			*old = *gen
+			old.Comments = comments
+			return nil
+		case ConflictSkip:
+			return nil
+		}
+	}
+
+	at := logging.At{File: f.Path, Rule: genName}
+	newName := genName + "_" + strings.TrimPrefix(genKind, "go_")
+	switch opts.KindConflict {
+	case KindConflictRename:
+		logging.Infof(at, "%s: %s: existing %s has the same name as generated %s; adding %s as %s", f.Path, genName, kind(old), genKind, genKind, newName)
+	case KindConflictAlias:
+		if kind(old) != "alias" {
+			logging.Infof(at, "%s: %s: replacing existing %s with an alias to generated %s %s", f.Path, genName, kind(old), genKind, newName)
+		}
+		*old = bzl.CallExpr{
+			Comments: old.Comments,
+			X:        &bzl.LiteralExpr{Token: "alias"},
+			List: []bzl.Expr{
+				&bzl.BinaryExpr{X: &bzl.LiteralExpr{Token: "name"}, Op: "=", Y: &bzl.StringExpr{Value: genName}},
+				&bzl.BinaryExpr{X: &bzl.LiteralExpr{Token: "actual"}, Op: "=", Y: &bzl.StringExpr{Value: ":" + newName}},
+				&bzl.BinaryExpr{X: &bzl.LiteralExpr{Token: "visibility"}, Op: "=", Y: &bzl.ListExpr{List: []bzl.Expr{&bzl.StringExpr{Value: "//visibility:public"}}}},
+			},
+		}
+	default:
+		logging.Errorf(at, "%s: %s: generated %s has the same name as existing %s; rename or delete the existing rule, or run with -kind_conflict=rename or -kind_conflict=alias", f.Path, genName, genKind, kind(old))
+		return nil
+	}
+	(&bzl.Rule{Call: gen}).SetAttr("name", &bzl.StringExpr{Value: newName})
+	return gen
+}
+
+// noPackage is the package name used by MergeRules, where the package
+// containing the rules is not known. Since it is not a valid package name,
+// relative labels are never equal to absolute labels.
+const noPackage = "<unknown>"
+
+// MergeRules merges gen, a generated rule, into old, an existing rule, and
+// returns the merged rule. Both rules must have the same kind and name.
+// Rules are merged as set by opts, the same way as in MergeWithExisting: generated attributes
+// replace old ones, while other attributes and attributes marked with
+// "# keep" are preserved. Calls like exports_files and package() are merged
+// as well.
+//
+// Since the rest of the file is not available, load statements and go_prefix
+// rules are returned unchanged, relative labels are not considered equal
+// to absolute labels, and the style of srcs is opts.SrcsStyle.
+func MergeRules(opts *Options, gen, old *bzl.CallExpr) *bzl.CallExpr {
+	switch k := kind(old); {
+	case k == "load" || k == "go_prefix":
+		return old
+	case nonRuleCalls[k]:
+		return opts.mergeCall(gen, old, noPackage)
+	default:
+		return opts.mergeRule(gen, old, noPackage, opts.SrcsStyle == packages.SrcsStyleList)
+	}
+}
+
+// CheckImportPaths compares the importpath attribute of the default
+// go_library rule in f with "importpath", the import path expected for the
+// package in the directory. A warning is logged if they disagree. If "fix"
+// is true, the attribute is replaced with the expected import path. Other
+// libraries, like those for extra packages in the directory, and rules or
+// attributes marked with "# keep" are not checked.
+func CheckImportPaths(f *bzl.File, importpath string, fix bool) {
+	for _, r := range f.Rules("go_library") {
+		if r.Name() != defaultLibName || shouldKeep(r.Call) {
+			continue
+		}
+		attr := r.AttrDefn("importpath")
+		if attr == nil {
+			continue
+		}
+		got := stringValue(attr.Y)
+		if got == importpath || shouldKeep(attr) || shouldKeep(attr.Y) {
+			continue
+		}
+		if fix {
+			logging.Infof(logging.At{File: f.Path, Rule: r.Name()}, "%s: %s: changing importpath from %q to %q", f.Path, r.Name(), got, importpath)
+			attr.Y = &bzl.StringExpr{Value: importpath}
+		} else {
+			logging.Warnf(logging.At{File: f.Path, Rule: r.Name()}, "%s: %s: importpath %q does not match expected import path %q", f.Path, r.Name(), got, importpath)
+		}
+	}
+}
+
 // merge combines information from gen and old and returns an updated rule.
 // Both rules must be non-nil and must have the same kind and same name.
-func mergeRule(gen, old *bzl.CallExpr) *bzl.CallExpr {
+// pkg is the name of the Bazel package containing the rules. It is used
+// to compare relative labels with absolute labels. listSrcs is true if
+// srcs should be listed explicitly, replacing any glob call (see mergeSrcs).
+func (opts *Options) mergeRule(gen, old *bzl.CallExpr, pkg string, listSrcs bool) *bzl.CallExpr {
 	genRule := bzl.Rule{Call: gen}
 	oldRule := bzl.Rule{Call: old}
 	merged := *old
@@ -94,9 +413,8 @@ func mergeRule(gen, old *bzl.CallExpr) *bzl.CallExpr {
 	mergedRule := bzl.Rule{Call: &merged}
 
 	// Copy unnamed arguments from the old rule without merging. The only rule
-	// generated with unnamed arguments is go_prefix, which we currently
-	// leave in place.
-	// TODO: maybe gazelle should allow the prefix to be changed.
+	// generated with unnamed arguments is go_prefix, which is left in place
+	// unless UpdateGoPrefix is set (see mergeGoPrefix).
 	for _, a := range old.List {
 		if b, ok := a.(*bzl.BinaryExpr); ok && b.Op == "=" {
 			break
@@ -105,22 +423,45 @@ func mergeRule(gen, old *bzl.CallExpr) *bzl.CallExpr {
 	}
 
 	// Merge attributes from the old rule. Preserve comments on old attributes.
-	// Assume generated attributes have no comments.
+	// Assume generated attributes have no comments. Attributes marked with
+	// "# keep" are copied without merging, so "deps = [],  # keep" prevents
+	// gazelle from adding anything to deps.
 	for _, k := range oldRule.AttrKeys() {
 		oldAttr := oldRule.AttrDefn(k)
-		if !mergeableFields[k] {
+		if !mergeableFields[k] || shouldKeep(oldAttr) || shouldKeep(oldAttr.Y) {
 			merged.List = append(merged.List, oldAttr)
 			continue
 		}
 
 		oldExpr := oldAttr.Y
 		genExpr := genRule.Attr(k)
-		mergedExpr, err := mergeExpr(genExpr, oldExpr)
+		var mergedExpr bzl.Expr
+		var err error
+		if k == "srcs" {
+			mergedExpr, err = opts.mergeSrcs(genExpr, oldExpr, pkg, listSrcs)
+		} else {
+			mergedExpr, err = opts.mergeExpr(genExpr, oldExpr, pkg)
+		}
 		if err != nil {
+			c := Conflict{Pkg: pkg, Rule: name(old), Attr: k, Old: oldExpr, Gen: genExpr, Err: err}
+			switch opts.resolveConflict(c) {
+			case ConflictKeep:
+				keptAttr := *oldAttr
+				addKeepComment(&keptAttr)
+				merged.List = append(merged.List, &keptAttr)
+				continue
+			case ConflictSkip:
+				merged.List = append(merged.List, oldAttr)
+				continue
+			}
 			// TODO: add a verbose mode and log errors like this.
 			mergedExpr = genExpr
 		}
 		if mergedExpr != nil {
+			if hasDoNotSort(oldAttr) {
+				preserveOrder(mergedExpr, oldExpr, pkg)
+			}
+			opts.applyMultiLineThreshold(k, mergedExpr)
 			mergedAttr := *oldAttr
 			mergedAttr.Y = mergedExpr
 			merged.List = append(merged.List, &mergedAttr)
@@ -130,7 +471,9 @@ func mergeRule(gen, old *bzl.CallExpr) *bzl.CallExpr {
 	// Merge attributes from genRule that we haven't processed already.
 	for _, k := range genRule.AttrKeys() {
 		if mergedRule.Attr(k) == nil {
-			mergedRule.SetAttr(k, genRule.Attr(k))
+			genExpr := genRule.Attr(k)
+			opts.applyMultiLineThreshold(k, genExpr)
+			mergedRule.SetAttr(k, genExpr)
 		}
 	}
 
@@ -148,9 +491,16 @@ func mergeRule(gen, old *bzl.CallExpr) *bzl.CallExpr {
 //   * a list of strings combined with a select call using +. The list must
 //     be the left operand.
 //
+// If old is not in one of the above formats (for example, it is a list
+// comprehension or a function call), it is preserved, and generated strings
+// that don't appear in it or match a glob call in it are appended with +.
+// A trailing list and select are merged as usual if they only contain
+// generated strings, since gazelle appended them on a previous run.
+// Otherwise, they were written by the user and are preserved too.
+//
 // An error is returned if the expressions can't be merged, for example
-// because they are not in one of the above formats.
-func mergeExpr(gen, old bzl.Expr) (bzl.Expr, error) {
+// because gen is not in one of the above formats.
+func (opts *Options) mergeExpr(gen, old bzl.Expr, pkg string) (bzl.Expr, error) {
 	if _, ok := gen.(*bzl.StringExpr); ok {
 		if shouldKeep(old) {
 			return old, nil
@@ -162,13 +512,23 @@ func mergeExpr(gen, old bzl.Expr) (bzl.Expr, error) {
 	if err != nil {
 		return nil, err
 	}
+	var userExpr bzl.Expr
 	oldList, oldDict, err := exprListAndDict(old)
 	if err != nil {
-		return nil, err
+		var rest bzl.Expr
+		if userExpr, rest = splitUserExpr(old); rest != nil && !isGeneratedExpr(rest, gen) {
+			userExpr, rest = old, nil
+		}
+		if oldList, oldDict, err = exprListAndDict(rest); err != nil {
+			return nil, err
+		}
 	}
 
-	mergedList := mergeList(genList, oldList)
-	mergedDict, err := mergeDict(genDict, oldDict)
+	mergedList := mergeList(genList, oldList, pkg)
+	if userExpr != nil {
+		mergedList = removeUserStrings(mergedList, userExpr)
+	}
+	mergedDict, err := opts.mergeDict(genDict, oldDict, pkg)
 	if err != nil {
 		return nil, err
 	}
@@ -181,18 +541,368 @@ func mergeExpr(gen, old bzl.Expr) (bzl.Expr, error) {
 		}
 	}
 
-	if mergedList == nil {
-		return mergedSelect, nil
+	var operands []bzl.Expr
+	if userExpr != nil {
+		operands = append(operands, userExpr)
+	}
+	if mergedList != nil {
+		if mergedSelect != nil {
+			mergedList.ForceMultiLine = true
+		}
+		operands = append(operands, mergedList)
+	}
+	if mergedSelect != nil {
+		operands = append(operands, mergedSelect)
+	}
+	if len(operands) == 0 {
+		return nil, nil
+	}
+	merged := operands[0]
+	for _, e := range operands[1:] {
+		merged = &bzl.BinaryExpr{X: merged, Op: "+", Y: e}
+	}
+	return merged, nil
+}
+
+// mergeSrcs merges srcs attributes. When gen starts with a glob call (see
+// packages.SrcsStyleGlob) or listSrcs is true, a glob call at the start of
+// old is dropped, the rest is merged with mergeExpr, and the generated glob
+// call, if any, is put in front of the result. This converts between the
+// list and glob styles, and merging the result again gives the same result.
+// Otherwise, the attributes are merged with mergeExpr, which preserves glob
+// calls written by the user.
+func (opts *Options) mergeSrcs(gen, old bzl.Expr, pkg string, listSrcs bool) (bzl.Expr, error) {
+	genGlob, genRest := splitGlob(gen)
+	if genGlob == nil && !listSrcs {
+		return opts.mergeExpr(gen, old, pkg)
+	}
+	_, oldRest := splitGlob(old)
+	merged, err := opts.mergeExpr(genRest, oldRest, pkg)
+	if err != nil || genGlob == nil {
+		return merged, err
+	}
+	if merged == nil {
+		return genGlob, nil
+	}
+	return prependExpr(genGlob, merged), nil
+}
+
+// splitGlob separates a glob call at the start of a sum of expressions
+// from the rest of the sum. glob is nil if expr doesn't start with a glob
+// call. rest is nil if nothing follows the glob call.
+func splitGlob(expr bzl.Expr) (glob, rest bzl.Expr) {
+	if isGlob(expr) {
+		return expr, nil
 	}
-	if mergedSelect == nil {
-		return mergedList, nil
+	b, ok := expr.(*bzl.BinaryExpr)
+	if !ok || b.Op != "+" {
+		return nil, expr
 	}
-	mergedList.ForceMultiLine = true
-	return &bzl.BinaryExpr{
-		X:  mergedList,
-		Op: "+",
-		Y:  mergedSelect,
-	}, nil
+	glob, rest = splitGlob(b.X)
+	if glob == nil {
+		return nil, expr
+	}
+	if rest == nil {
+		return glob, b.Y
+	}
+	sum := *b
+	sum.X = rest
+	return glob, &sum
+}
+
+// prependExpr adds x to the front of expr, a sum of expressions, so that
+// the sum is still grouped to the left.
+func prependExpr(x, expr bzl.Expr) bzl.Expr {
+	if b, ok := expr.(*bzl.BinaryExpr); ok && b.Op == "+" {
+		sum := *b
+		sum.X = prependExpr(x, b.X)
+		return &sum
+	}
+	return &bzl.BinaryExpr{X: x, Op: "+", Y: expr}
+}
+
+// srcsStyle returns the argument of a "# gazelle:srcs_style" directive in
+// a comment before or after a top-level statement in oldFile. If there is no
+// directive, opts.SrcsStyle is returned. Invalid directives are logged and
+// ignored.
+func (opts *Options) srcsStyle(oldFile *bzl.File) string {
+	style := opts.SrcsStyle
+	for _, s := range oldFile.Stmt {
+		for _, comments := range [][]bzl.Comment{s.Comment().Before, s.Comment().After} {
+			for _, c := range comments {
+				arg, ok, err := packages.ParseSrcsStyleDirective(c.Token)
+				if err != nil {
+					logging.Errorf(logging.At{File: oldFile.Path}, "%s: %v", oldFile.Path, err)
+				} else if ok {
+					style = arg
+				}
+			}
+		}
+	}
+	return style
+}
+
+// applyMultiLineThreshold forces lists in the value of attribute attr
+// (including lists inside select calls) onto multiple lines if they have at
+// least as many elements as the threshold in opts.MultiLineThresholds.
+func (opts *Options) applyMultiLineThreshold(attr string, e bzl.Expr) {
+	n, ok := opts.MultiLineThresholds[attr]
+	if !ok {
+		n, ok = opts.MultiLineThresholds["*"]
+	}
+	if !ok || e == nil {
+		return
+	}
+	bzl.Walk(e, func(x bzl.Expr, _ []bzl.Expr) {
+		if l, ok := x.(*bzl.ListExpr); ok && len(l.List) >= n && len(l.List) > 0 {
+			l.ForceMultiLine = true
+		}
+	})
+}
+
+// splitUserExpr separates an expression that could not be matched by
+// exprListAndDict into a part written by the user and a trailing list and
+// select call, which gazelle may have appended with + on a previous run.
+// rest is nil if there is no trailing list or select.
+func splitUserExpr(expr bzl.Expr) (user, rest bzl.Expr) {
+	var tail []bzl.Expr
+	user = expr
+	for {
+		b, ok := user.(*bzl.BinaryExpr)
+		if !ok || b.Op != "+" {
+			break
+		}
+		_, isList := b.Y.(*bzl.ListExpr)
+		if len(tail) == 0 && isSelect(b.Y) || isList && (len(tail) == 0 || isSelect(tail[0])) {
+			tail = append([]bzl.Expr{b.Y}, tail...)
+			user = b.X
+			continue
+		}
+		break
+	}
+
+	switch len(tail) {
+	case 0:
+		return user, nil
+	case 1:
+		return user, tail[0]
+	default:
+		return user, &bzl.BinaryExpr{X: tail[0], Op: "+", Y: tail[1]}
+	}
+}
+
+// isGeneratedExpr returns whether every string in the lists of e, a list
+// and select call split from a user-written expression by splitUserExpr,
+// appears in gen or is marked with "# keep".
+func isGeneratedExpr(e, gen bzl.Expr) bool {
+	generated := make(map[string]bool)
+	for _, v := range listElems(gen) {
+		generated[stringValue(v)] = true
+	}
+	for _, v := range listElems(e) {
+		if s := stringValue(v); s == "" || !generated[s] && !shouldKeep(v) {
+			return false
+		}
+	}
+	return true
+}
+
+// listElems returns the elements of the list and of the lists in the
+// select call of e, an expression recognized by exprListAndDict.
+func listElems(e bzl.Expr) []bzl.Expr {
+	list, dict, err := exprListAndDict(e)
+	if err != nil {
+		return nil
+	}
+	var elems []bzl.Expr
+	if list != nil {
+		elems = append(elems, list.List...)
+	}
+	if dict != nil {
+		for _, kv := range dict.List {
+			if _, l, err := dictEntryKeyValue(kv); err == nil {
+				elems = append(elems, l.List...)
+			}
+		}
+	}
+	return elems
+}
+
+// removeUserStrings returns a copy of list without strings that appear in
+// the user-written expression user or match a glob call in it. nil is
+// returned if no elements remain.
+func removeUserStrings(list *bzl.ListExpr, user bzl.Expr) *bzl.ListExpr {
+	if list == nil {
+		return nil
+	}
+	userStrings := make(map[string]bool)
+	var globs []*bzl.CallExpr
+	bzl.Walk(user, func(e bzl.Expr, stack []bzl.Expr) {
+		for _, x := range stack {
+			if isGlob(x) {
+				// Patterns are matched below.
+				return
+			}
+		}
+		if isGlob(e) {
+			globs = append(globs, e.(*bzl.CallExpr))
+		} else if s, ok := e.(*bzl.StringExpr); ok {
+			userStrings[s.Value] = true
+		}
+	})
+
+	var filtered []bzl.Expr
+	for _, v := range list.List {
+		s := stringValue(v)
+		if s != "" && userStrings[s] {
+			continue
+		}
+		matched := false
+		for _, g := range globs {
+			if s != "" && globMatches(g, s) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			filtered = append(filtered, v)
+		}
+	}
+	if len(filtered) == 0 {
+		return nil
+	}
+	if len(filtered) == len(list.List) {
+		return list
+	}
+	return &bzl.ListExpr{List: filtered, ForceMultiLine: list.ForceMultiLine}
+}
+
+// globMatches returns whether the glob call g matches the file name. The
+// include and exclude patterns are matched with path.Match, which treats
+// "**" like "*", so names in subdirectories may not be recognized.
+func globMatches(g *bzl.CallExpr, name string) bool {
+	var include, exclude bzl.Expr
+	for i, arg := range g.List {
+		if b, ok := arg.(*bzl.BinaryExpr); ok && b.Op == "=" {
+			if key, ok := b.X.(*bzl.LiteralExpr); ok && key.Token == "include" {
+				include = b.Y
+			} else if ok && key.Token == "exclude" {
+				exclude = b.Y
+			}
+			continue
+		}
+		switch i {
+		case 0:
+			include = arg
+		case 1:
+			exclude = arg
+		}
+	}
+	return matchesAny(include, name) && !matchesAny(exclude, name)
+}
+
+// matchesAny returns whether name matches a pattern in patterns, a list of
+// strings.
+func matchesAny(patterns bzl.Expr, name string) bool {
+	l, ok := patterns.(*bzl.ListExpr)
+	if !ok {
+		return false
+	}
+	for _, p := range l.List {
+		if ok, _ := path.Match(stringValue(p), name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// preserveOrder reorders lists in merged, including lists in a select call,
+// to follow the order of the matching lists in old. Elements that don't
+// appear in old are moved to the end in their generated order. This is done
+// for attributes marked with buildifier's "# do not sort" comment, since
+// bzl.Rewrite won't sort them afterward.
+func preserveOrder(merged, old bzl.Expr, pkg string) {
+	mergedList, mergedDict := listAndDict(merged)
+	oldList, oldDict := listAndDict(old)
+	reorderList(mergedList, oldList, pkg)
+	if mergedDict == nil || oldDict == nil {
+		return
+	}
+	oldLists := make(map[string]*bzl.ListExpr)
+	for _, e := range oldDict.List {
+		if k, l, err := dictEntryKeyValue(e); err == nil {
+			oldLists[k] = l
+		}
+	}
+	for _, e := range mergedDict.List {
+		if k, l, err := dictEntryKeyValue(e); err == nil {
+			reorderList(l, oldLists[k], pkg)
+		}
+	}
+}
+
+// listAndDict is like exprListAndDict, but it skips an expression written
+// by the user at the start of e, and it returns nils instead of an error.
+func listAndDict(e bzl.Expr) (*bzl.ListExpr, *bzl.DictExpr) {
+	if e == nil {
+		return nil, nil
+	}
+	l, d, err := exprListAndDict(e)
+	if err != nil {
+		if _, rest := splitUserExpr(e); rest != nil {
+			l, d, _ = exprListAndDict(rest)
+		}
+	}
+	return l, d
+}
+
+// reorderList sorts the elements of list by their position in old. Elements
+// are matched by identity, since mergeList reuses old elements with comments,
+// or by label in package pkg.
+func reorderList(list, old *bzl.ListExpr, pkg string) {
+	if list == nil || old == nil {
+		return
+	}
+	exprIndex := make(map[bzl.Expr]int)
+	labelIndex := make(map[string]int)
+	for i, v := range old.List {
+		exprIndex[v] = i
+		if s := stringValue(v); s != "" {
+			labelIndex[absoluteLabel(s, pkg)] = i
+		}
+	}
+	rank := func(v bzl.Expr) int {
+		if i, ok := exprIndex[v]; ok {
+			return i
+		}
+		if s := stringValue(v); s != "" {
+			if i, ok := labelIndex[absoluteLabel(s, pkg)]; ok {
+				return i
+			}
+		}
+		return len(old.List)
+	}
+	sort.SliceStable(list.List, func(i, j int) bool {
+		return rank(list.List[i]) < rank(list.List[j])
+	})
+}
+
+func isGlob(e bzl.Expr) bool {
+	call, ok := e.(*bzl.CallExpr)
+	if !ok || len(call.List) == 0 {
+		return false
+	}
+	x, ok := call.X.(*bzl.LiteralExpr)
+	return ok && x.Token == "glob"
+}
+
+func isSelect(e bzl.Expr) bool {
+	call, ok := e.(*bzl.CallExpr)
+	if !ok || len(call.List) != 1 {
+		return false
+	}
+	x, ok := call.X.(*bzl.LiteralExpr)
+	return ok && x.Token == "select"
 }
 
 // exprListAndDict matches an expression and attempts to extract either a list
@@ -236,7 +946,7 @@ func exprListAndDict(expr bzl.Expr) (*bzl.ListExpr, *bzl.DictExpr, error) {
 	return nil, nil, fmt.Errorf("expression could not be matched")
 }
 
-func mergeList(gen, old *bzl.ListExpr) *bzl.ListExpr {
+func mergeList(gen, old *bzl.ListExpr, pkg string) *bzl.ListExpr {
 	if old == nil {
 		return gen
 	}
@@ -246,22 +956,35 @@ func mergeList(gen, old *bzl.ListExpr) *bzl.ListExpr {
 
 	// Build a list of elements from the old list with "# keep" comments. We
 	// must not duplicate these elements, since duplicate elements will be
-	// removed when we rewrite the AST.
+	// removed when we rewrite the AST. Labels are compared in absolute form,
+	// so ":foo", "//pkg:foo", and "//pkg" are the same in package "pkg".
+	//
+	// Other old elements with comments are remembered. If the same element is
+	// generated, the commented instance is used instead, so annotations like
+	// "# TODO" survive merges.
 	var merged []bzl.Expr
 	kept := make(map[string]bool)
+	commented := make(map[string]bzl.Expr)
 	for _, v := range old.List {
+		s := stringValue(v)
 		if shouldKeep(v) {
 			merged = append(merged, v)
-			if s := stringValue(v); s != "" {
-				kept[s] = true
+			if s != "" {
+				kept[absoluteLabel(s, pkg)] = true
 			}
+		} else if s != "" && hasComments(v) {
+			commented[absoluteLabel(s, pkg)] = v
 		}
 	}
 
 	for _, v := range gen.List {
-		if s := stringValue(v); kept[s] {
+		key := absoluteLabel(stringValue(v), pkg)
+		if kept[key] {
 			continue
 		}
+		if c, ok := commented[key]; ok {
+			v = c
+		}
 		merged = append(merged, v)
 	}
 
@@ -271,7 +994,7 @@ func mergeList(gen, old *bzl.ListExpr) *bzl.ListExpr {
 	return &bzl.ListExpr{List: merged}
 }
 
-func mergeDict(gen, old *bzl.DictExpr) (*bzl.DictExpr, error) {
+func (opts *Options) mergeDict(gen, old *bzl.DictExpr, pkg string) (*bzl.DictExpr, error) {
 	if old == nil {
 		return gen, nil
 	}
@@ -279,6 +1002,9 @@ func mergeDict(gen, old *bzl.DictExpr) (*bzl.DictExpr, error) {
 		gen = &bzl.DictExpr{List: []bzl.Expr{}}
 	}
 
+	// Entries are matched by canonical label, so equivalent spellings of the
+	// same condition (for example, "//foo" and "//foo:foo") are merged into
+	// one entry. The spelling from the generated dict is preferred.
 	var entries []*dictEntry
 	entryMap := make(map[string]*dictEntry)
 
@@ -287,12 +1013,22 @@ func mergeDict(gen, old *bzl.DictExpr) (*bzl.DictExpr, error) {
 		if err != nil {
 			return nil, err
 		}
-		if _, ok := entryMap[k]; ok {
-			return nil, fmt.Errorf("old dict contains more than one case named %q", k)
+		alias, isAlias := opts.SelectKeyAliases[k]
+		if isAlias {
+			k = alias
+		}
+		ck := canonicalLabel(k)
+		if e, ok := entryMap[ck]; ok {
+			if k == e.key && !isAlias && !e.aliased {
+				return nil, fmt.Errorf("old dict contains more than one case named %q", k)
+			}
+			e.oldValue = &bzl.ListExpr{List: append(append([]bzl.Expr{}, e.oldValue.List...), v.List...)}
+			e.aliased = true
+			continue
 		}
-		e := &dictEntry{key: k, oldValue: v}
+		e := &dictEntry{key: k, oldValue: v, aliased: isAlias}
 		entries = append(entries, e)
-		entryMap[k] = e
+		entryMap[ck] = e
 	}
 
 	for _, kv := range gen.List {
@@ -300,41 +1036,45 @@ func mergeDict(gen, old *bzl.DictExpr) (*bzl.DictExpr, error) {
 		if err != nil {
 			return nil, err
 		}
-		e, ok := entryMap[k]
+		ck := canonicalLabel(k)
+		e, ok := entryMap[ck]
 		if !ok {
-			e = &dictEntry{key: k}
+			e = &dictEntry{}
 			entries = append(entries, e)
-			entryMap[k] = e
+			entryMap[ck] = e
 		}
+		e.key = k
 		e.genValue = v
 	}
 
-	keys := make([]string, 0, len(entries))
-	haveDefault := false
+	var keyed []*dictEntry
+	var defaultEntry *dictEntry
 	for _, e := range entries {
-		e.mergedValue = mergeList(e.genValue, e.oldValue)
-		if e.key == "//conditions:default" {
+		e.mergedValue = mergeList(e.genValue, e.oldValue, pkg)
+		if canonicalLabel(e.key) == defaultCondition {
 			// Keep the default case, even if it's empty.
-			haveDefault = true
+			e.key = defaultCondition
+			defaultEntry = e
 			if e.mergedValue == nil {
 				e.mergedValue = &bzl.ListExpr{}
 			}
 		} else if e.mergedValue != nil {
-			keys = append(keys, e.key)
+			keyed = append(keyed, e)
 		}
 	}
-	if len(keys) == 0 && (!haveDefault || len(entryMap["//conditions:default"].mergedValue.List) == 0) {
+	if len(keyed) == 0 && (defaultEntry == nil || len(defaultEntry.mergedValue.List) == 0) {
 		return nil, nil
 	}
-	sort.Strings(keys)
+	sort.Slice(keyed, func(i, j int) bool {
+		return selectKeyLess(keyed[i].key, keyed[j].key)
+	})
 	// Always put the default case last.
-	if haveDefault {
-		keys = append(keys, "//conditions:default")
+	if defaultEntry != nil {
+		keyed = append(keyed, defaultEntry)
 	}
 
-	mergedEntries := make([]bzl.Expr, len(keys))
-	for i, k := range keys {
-		e := entryMap[k]
+	mergedEntries := make([]bzl.Expr, len(keyed))
+	for i, e := range keyed {
 		mergedEntries[i] = &bzl.KeyValueExpr{
 			Key:   &bzl.StringExpr{Value: e.key},
 			Value: e.mergedValue,
@@ -347,6 +1087,95 @@ func mergeDict(gen, old *bzl.DictExpr) (*bzl.DictExpr, error) {
 type dictEntry struct {
 	key                             string
 	oldValue, genValue, mergedValue *bzl.ListExpr
+
+	// aliased is true if the entry was renamed using SelectKeyAliases or
+	// combines old entries with equivalent labels.
+	aliased bool
+}
+
+// defaultCondition is the select key matched when no other key matches.
+const defaultCondition = "//conditions:default"
+
+// selectKeyLess orders select keys for platform config_settings by operating
+// system, then by architecture. Keys naming only an operating system precede
+// keys for the same operating system with an architecture, and keys naming
+// only an architecture follow all keys with an operating system. Keys that
+// don't name platforms follow platform keys in string order.
+func selectKeyLess(a, b string) bool {
+	aOS, aArch, aOK := platformOfKey(a)
+	bOS, bArch, bOK := platformOfKey(b)
+	switch {
+	case aOK != bOK:
+		return aOK
+	case !aOK:
+		return a < b
+	case aOS != bOS && (aOS == "" || bOS == ""):
+		return bOS == ""
+	case aOS != bOS:
+		return aOS < bOS
+	case aArch != bArch:
+		return aArch < bArch
+	default:
+		return a < b
+	}
+}
+
+// platformOfKey returns the operating system and architecture named by the
+// last component of a select key, like "linux_amd64" in
+// "@io_bazel_rules_go//go/platform:linux_amd64".
+func platformOfKey(key string) (goos, goarch string, ok bool) {
+	name := key[strings.LastIndexAny(key, ":/")+1:]
+	return packages.SplitPlatform(name)
+}
+
+// canonicalLabel returns a canonical spelling of an absolute label, for
+// example, a select key. "@//pkg:name" is converted to "//pkg:name", and "//pkg" is converted
+// to "//pkg:pkg". Strings that aren't absolute labels are returned unchanged.
+func canonicalLabel(l string) string {
+	if strings.HasPrefix(l, "@//") {
+		l = l[len("@"):]
+	}
+	i := strings.Index(l, "//")
+	if i < 0 || i > 0 && l[0] != '@' {
+		return l
+	}
+	pkg := l[i+len("//"):]
+	if pkg == "" || strings.Contains(pkg, ":") {
+		return l
+	}
+	return l + ":" + path.Base(pkg)
+}
+
+// absoluteLabel returns the canonical form of l, which may be relative to
+// the package pkg (like ":foo"). Strings that aren't labels, like source
+// file names, are returned unchanged.
+func absoluteLabel(l, pkg string) string {
+	if strings.HasPrefix(l, ":") {
+		return "//" + pkg + l
+	}
+	return canonicalLabel(l)
+}
+
+// packageName returns the name of the Bazel package containing the build
+// file at buildFilePath. If no WORKSPACE file is found, the directory path
+// is used, so that relative labels will not be equal to any absolute label.
+func packageName(buildFilePath string) string {
+	dir, err := filepath.Abs(filepath.Dir(buildFilePath))
+	if err != nil {
+		return filepath.ToSlash(filepath.Dir(buildFilePath))
+	}
+	root, err := wspace.Find(dir)
+	if err != nil {
+		return filepath.ToSlash(dir)
+	}
+	rel, err := filepath.Rel(root, dir)
+	if err != nil {
+		return filepath.ToSlash(dir)
+	}
+	if rel == "." {
+		return ""
+	}
+	return filepath.ToSlash(rel)
 }
 
 func dictEntryKeyValue(e bzl.Expr) (string, *bzl.ListExpr, error) {
@@ -365,6 +1194,160 @@ func dictEntryKeyValue(e bzl.Expr) (string, *bzl.ListExpr, error) {
 	return k.Value, v, nil
 }
 
+// mergeCall combines arguments of a call to a function that doesn't declare
+// a rule, such as exports_files. Positional arguments that are lists of
+// strings in both calls are merged by appending generated strings that
+// aren't already present. Keyword arguments in mergeableFields (like
+// default_visibility in package) are merged the same way as rule attributes.
+// Other arguments are taken from old; keyword arguments only present in gen
+// are added.
+func (opts *Options) mergeCall(gen, old *bzl.CallExpr, pkg string) *bzl.CallExpr {
+	merged := *old
+	merged.List = nil
+	oldKwargs := make(map[string]bool)
+	genKwargs := make(map[string]*bzl.BinaryExpr)
+	var genPositional []bzl.Expr
+	for _, a := range gen.List {
+		if k, ok := kwargName(a); ok {
+			genKwargs[k] = a.(*bzl.BinaryExpr)
+		} else {
+			genPositional = append(genPositional, a)
+		}
+	}
+
+	i := 0
+	for _, a := range old.List {
+		if k, ok := kwargName(a); ok {
+			oldKwargs[k] = true
+			oldArg := a.(*bzl.BinaryExpr)
+			if !mergeableFields[k] || shouldKeep(oldArg) || shouldKeep(oldArg.Y) {
+				merged.List = append(merged.List, a)
+				continue
+			}
+			var genExpr bzl.Expr
+			if genArg, ok := genKwargs[k]; ok {
+				genExpr = genArg.Y
+			}
+			mergedExpr, err := opts.mergeExpr(genExpr, oldArg.Y, pkg)
+			if err != nil {
+				mergedExpr = genExpr
+			}
+			if mergedExpr != nil {
+				mergedArg := *oldArg
+				mergedArg.Y = mergedExpr
+				merged.List = append(merged.List, &mergedArg)
+			}
+			continue
+		}
+		if i < len(genPositional) {
+			genList, genOk := genPositional[i].(*bzl.ListExpr)
+			oldList, oldOk := a.(*bzl.ListExpr)
+			if genOk && oldOk && !shouldKeep(oldList) {
+				a = unionList(genList, oldList)
+			}
+		}
+		merged.List = append(merged.List, a)
+		i++
+	}
+	for ; i < len(genPositional); i++ {
+		merged.List = append(merged.List, genPositional[i])
+	}
+	for _, a := range gen.List {
+		if k, ok := kwargName(a); ok && !oldKwargs[k] {
+			merged.List = append(merged.List, a)
+		}
+	}
+	return &merged
+}
+
+// unionList returns a list containing the elements of old followed by the
+// string elements of gen that don't appear in old.
+func unionList(gen, old *bzl.ListExpr) *bzl.ListExpr {
+	merged := *old
+	merged.List = append([]bzl.Expr{}, old.List...)
+	have := make(map[string]bool)
+	for _, v := range old.List {
+		if s := stringValue(v); s != "" {
+			have[s] = true
+		}
+	}
+	for _, v := range gen.List {
+		if s := stringValue(v); s != "" && !have[s] {
+			have[s] = true
+			merged.List = append(merged.List, v)
+		}
+	}
+	return &merged
+}
+
+// insertAfterLoads inserts c into stmts after any leading load statements
+// and comment blocks.
+func insertAfterLoads(stmts []bzl.Expr, c *bzl.CallExpr) []bzl.Expr {
+	i := 0
+	for ; i < len(stmts); i++ {
+		if _, ok := stmts[i].(*bzl.CommentBlock); ok {
+			continue
+		}
+		if l, ok := stmts[i].(*bzl.CallExpr); ok && kind(l) == "load" {
+			continue
+		}
+		break
+	}
+	stmts = append(stmts, nil)
+	copy(stmts[i+1:], stmts[i:])
+	stmts[i] = c
+	return stmts
+}
+
+// kwargName returns the name of a keyword argument in a call. false is
+// returned if e is a positional argument.
+func kwargName(e bzl.Expr) (string, bool) {
+	b, ok := e.(*bzl.BinaryExpr)
+	if !ok || b.Op != "=" {
+		return "", false
+	}
+	l, ok := b.X.(*bzl.LiteralExpr)
+	if !ok {
+		return "", false
+	}
+	return l.Token, true
+}
+
+// mergeGoPrefix replaces the prefix in an old go_prefix rule with the
+// generated prefix, unless the old prefix is marked with "# keep". Since
+// changing the prefix changes the import path of every package in the
+// repository, a warning is logged that lists the importpath attributes in
+// oldfile that are affected.
+func mergeGoPrefix(gen, old *bzl.CallExpr, oldfile *bzl.File) *bzl.CallExpr {
+	if len(gen.List) != 1 || len(old.List) != 1 || shouldKeep(old) || shouldKeep(old.List[0]) {
+		return old
+	}
+	oldPrefix, genPrefix := stringValue(old.List[0]), stringValue(gen.List[0])
+	if oldPrefix == genPrefix {
+		return old
+	}
+
+	var affected []string
+	for _, s := range oldfile.Stmt {
+		c, ok := s.(*bzl.CallExpr)
+		if !ok {
+			continue
+		}
+		r := bzl.Rule{Call: c}
+		if ip := r.AttrString("importpath"); ip == oldPrefix || strings.HasPrefix(ip, oldPrefix+"/") {
+			affected = append(affected, ip)
+		}
+	}
+	logging.Warnf(logging.At{File: oldfile.Path, Rule: "go_prefix"}, "%s: changing go_prefix from %q to %q; import paths of all packages in the repository will change", oldfile.Path, oldPrefix, genPrefix)
+	if len(affected) > 0 {
+		logging.Warnf(logging.At{File: oldfile.Path, Rule: "go_prefix"}, "%s: importpath attributes with the old prefix: %s", oldfile.Path, strings.Join(affected, ", "))
+	}
+
+	merged := *old
+	merged.List = []bzl.Expr{gen.List[0]}
+	return &merged
+}
+
 func mergeLoad(gen, old *bzl.CallExpr, oldfile *bzl.File) *bzl.CallExpr {
 	vals := make(map[string]bzl.Expr)
 	for _, v := range gen.List[1:] {
@@ -408,6 +1391,39 @@ func shouldIgnore(oldFile *bzl.File) bool {
 	return false
 }
 
+// hasComments returns whether any comments are attached to e.
+func hasComments(e bzl.Expr) bool {
+	c := e.Comment()
+	return len(c.Before) > 0 || len(c.Suffix) > 0 || len(c.After) > 0
+}
+
+// hasDoNotSort returns whether an attribute is preceded by a comment
+// containing "do not sort". Like buildifier, case is ignored.
+func hasDoNotSort(attr *bzl.BinaryExpr) bool {
+	for _, c := range attr.Comment().Before {
+		if strings.Contains(strings.ToLower(c.Token), doNotSort) {
+			return true
+		}
+	}
+	return false
+}
+
+// resolveConflict returns the decision made by opts.ResolveConflict for
+// "c", or ConflictTakeGenerated if it is nil.
+func (opts *Options) resolveConflict(c Conflict) string {
+	if opts.ResolveConflict == nil {
+		return ConflictTakeGenerated
+	}
+	return opts.ResolveConflict(c)
+}
+
+// addKeepComment adds a "# keep" comment after "e", so shouldKeep returns
+// true for it.
+func addKeepComment(e bzl.Expr) {
+	c := e.Comment()
+	c.Suffix = append([]bzl.Comment{{Token: keep}}, c.Suffix...)
+}
+
 // shouldKeep returns whether an expression from the original file should be
 // preserved. This is true if it has a trailing comment that starts with "keep".
 func shouldKeep(e bzl.Expr) bool {
@@ -423,6 +1439,7 @@ func ruleUsed(rule string, oldfile *bzl.File) bool {
 // i.e. two 'go_library(name = "foo", ...)' are considered matches
 // despite the values of the other fields.
 // exception: if c is a 'load' statement, the match is done on the first value.
+// exception: calls in nonRuleCalls, like 'exports_files', match on X alone.
 func match(f *bzl.File, c *bzl.CallExpr) (int, *bzl.CallExpr) {
 	var m matcher
 	if kind := kind(c); kind == "load" {
@@ -430,6 +1447,8 @@ func match(f *bzl.File, c *bzl.CallExpr) (int, *bzl.CallExpr) {
 			return -1, nil
 		}
 		m = &loadMatcher{stringValue(c.List[0])}
+	} else if nonRuleCalls[kind] {
+		m = &callMatcher{kind}
 	} else {
 		m = &nameMatcher{kind, name(c)}
 	}
@@ -457,6 +1476,15 @@ func (m *nameMatcher) match(c *bzl.CallExpr) bool {
 	return m.kind == kind(c) && m.name == name(c)
 }
 
+// callMatcher matches calls to a function by name, regardless of arguments.
+type callMatcher struct {
+	kind string
+}
+
+func (m *callMatcher) match(c *bzl.CallExpr) bool {
+	return m.kind == kind(c)
+}
+
 type loadMatcher struct {
 	load string
 }
@@ -4,6 +4,9 @@ import (
 	"io"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
 	"testing"
 
 	bzl "github.com/bazelbuild/buildtools/build"
@@ -72,10 +75,7 @@ go_prefix("github.com/jr_hacker/tools")
 
 go_library(
     name = "go_default_library",
-    srcs = [
-        "lex.go",
-        "print.go",
-    ],
+    srcs = glob(["*.go"]),
 )
 
 go_test(
@@ -393,17 +393,14 @@ go_library(
 )
 `,
 	}, {
-		desc: "merge comments",
+		desc: "keep empty attr",
 		previous: `
-# load
 load("@io_bazel_rules_go//go:def.bzl", "go_library")
 
-# rule
 go_library(
-    # unmerged attr
     name = "go_default_library",
-    # merged attr
     srcs = ["foo.go"],
+    deps = [],  # keep
 )
 `,
 		current: `
@@ -412,93 +409,1254 @@ load("@io_bazel_rules_go//go:def.bzl", "go_library")
 go_library(
     name = "go_default_library",
     srcs = ["foo.go"],
+    deps = ["//bar:go_default_library"],
 )
 `,
 		expected: `
-# load
 load("@io_bazel_rules_go//go:def.bzl", "go_library")
 
-# rule
 go_library(
-    # unmerged attr
     name = "go_default_library",
-    # merged attr
     srcs = ["foo.go"],
+    deps = [],  # keep
 )
 `,
-	},
-}
+	}, {
+		desc: "preserve non-literal expression",
+		previous: `
+load("@io_bazel_rules_go//go:def.bzl", "go_library")
 
-func TestMergeWithExisting(t *testing.T) {
-	tmp, err := ioutil.TempFile(os.Getenv("TEST_TMPDIR"), "")
-	if err != nil {
-		t.Fatal(err)
-	}
-	if err := tmp.Close(); err != nil {
-		t.Fatal(err)
-	}
-	defer os.Remove(tmp.Name())
-	for _, tc := range testCases {
-		if err := ioutil.WriteFile(tmp.Name(), []byte(tc.previous), 0755); err != nil {
-			t.Fatalf("%s: %v", tc.desc, err)
-		}
-		newF, err := bzl.Parse("current", []byte(tc.current))
-		if err != nil {
-			t.Fatalf("%s: %v", tc.desc, err)
-		}
-		afterF := MergeWithExisting(newF, tmp.Name())
-		if afterF == nil {
-			if !tc.ignore {
-				t.Errorf("%s: got nil; want file", tc.desc)
-			}
-			continue
-		}
-		if afterF != nil && tc.ignore {
-			t.Errorf("%s: got file; want nil", tc.desc)
-			continue
-		}
+go_library(
+    name = "go_default_library",
+    srcs = custom_srcs("foo.go"),
+)
+`,
+		current: `
+load("@io_bazel_rules_go//go:def.bzl", "go_library")
 
-		want := tc.expected
-		if len(want) > 0 && want[0] == '\n' {
-			want = want[1:]
-		}
+go_library(
+    name = "go_default_library",
+    srcs = [
+        "bar.go",
+        "foo.go",
+    ],
+)
+`,
+		expected: `
+load("@io_bazel_rules_go//go:def.bzl", "go_library")
 
-		if got := string(bzl.Format(afterF)); got != want {
-			t.Errorf("%s: got %s; want %s", tc.desc, got, want)
-		}
-	}
-}
+go_library(
+    name = "go_default_library",
+    srcs = custom_srcs("foo.go") + ["bar.go"],
+)
+`,
+	}, {
+		desc: "merge list appended to non-literal expression",
+		previous: `
+load("@io_bazel_rules_go//go:def.bzl", "go_library")
 
-func TestMergeWithExistingDifferentName(t *testing.T) {
-	oldData := testCases[0].previous
-	newData := testCases[0].current
-	expected := testCases[0].expected
-	if len(expected) > 0 && expected[0] == '\n' {
-		expected = expected[1:]
-	}
+go_library(
+    name = "go_default_library",
+    srcs = custom_srcs("foo.go") + ["bar.go"],
+)
+`,
+		current: `
+load("@io_bazel_rules_go//go:def.bzl", "go_library")
 
-	tmp, err := ioutil.TempFile(os.Getenv("TEST_TMPDIR"), "BUILD")
-	if err != nil {
-		t.Fatal(err)
-	}
-	defer os.Remove(tmp.Name())
-	if _, err := io.WriteString(tmp, oldData); err != nil {
-		t.Fatal(err)
-	}
-	if err := tmp.Close(); err != nil {
-		t.Fatal(err)
-	}
-	newTmp, err := ioutil.TempFile(os.Getenv("TEST_TMPDIR"), "BUILD.bazel")
-	if err != nil {
-		t.Fatal(err)
-	}
-	defer os.Remove(newTmp.Name())
-	newF, err := bzl.Parse(newTmp.Name(), []byte(newData))
-	if err != nil {
-		t.Fatal(err)
-	}
-	afterF := MergeWithExisting(newF, tmp.Name())
-	if s := string(bzl.Format(afterF)); s != expected {
-		t.Errorf("got %s; want %s", s, expected)
+go_library(
+    name = "go_default_library",
+    srcs = [
+        "bar.go",
+        "baz.go",
+        "foo.go",
+    ],
+)
+`,
+		expected: `
+load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+go_library(
+    name = "go_default_library",
+    srcs = custom_srcs("foo.go") + [
+        "bar.go",
+        "baz.go",
+    ],
+)
+`,
+	}, {
+		desc: "preserve user list appended to non-literal expression",
+		previous: `
+load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+go_library(
+    name = "go_default_library",
+    srcs = custom_srcs("foo.go") + ["extra.go"],
+)
+`,
+		current: `
+load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+go_library(
+    name = "go_default_library",
+    srcs = [
+        "bar.go",
+        "extra.go",
+        "foo.go",
+    ],
+)
+`,
+		expected: `
+load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+go_library(
+    name = "go_default_library",
+    srcs = custom_srcs("foo.go") + ["extra.go"] + ["bar.go"],
+)
+`,
+	}, {
+		desc: "generated strings matched by glob",
+		previous: `
+load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+go_library(
+    name = "go_default_library",
+    srcs = glob(["*.go"], exclude = ["gen.go"]),
+)
+`,
+		current: `
+load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+go_library(
+    name = "go_default_library",
+    srcs = [
+        "a.go",
+        "gen.go",
+        "sub.s",
+    ],
+)
+`,
+		expected: `
+load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+go_library(
+    name = "go_default_library",
+    srcs = glob(["*.go"], exclude = ["gen.go"]) + [
+        "gen.go",
+        "sub.s",
+    ],
+)
+`,
+	}, {
+		desc: "merge equivalent select keys",
+		previous: `
+load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+go_library(
+    name = "go_default_library",
+    srcs = select({
+        "@//config/linux": [
+            "foo_linux.go",  # keep
+        ],
+        "//conditions:default": [],
+    }),
+)
+`,
+		current: `
+load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+go_library(
+    name = "go_default_library",
+    srcs = select({
+        "//config/linux:linux": ["bar_linux.go"],
+        "//conditions:default": [],
+    }),
+)
+`,
+		expected: `
+load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+go_library(
+    name = "go_default_library",
+    srcs = select({
+        "//config/linux:linux": [
+            "foo_linux.go",  # keep
+            "bar_linux.go",
+        ],
+        "//conditions:default": [],
+    }),
+)
+`,
+	}, {
+		desc: "merge exports_files",
+		previous: `
+load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+exports_files(
+    [
+        "a.txt",
+        "b.txt",
+    ],
+    visibility = ["//visibility:public"],
+)
+
+go_library(
+    name = "go_default_library",
+    srcs = ["foo.go"],
+)
+`,
+		current: `
+load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+exports_files([
+    "b.txt",
+    "c.txt",
+])
+
+go_library(
+    name = "go_default_library",
+    srcs = ["foo.go"],
+)
+`,
+		expected: `
+load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+exports_files(
+    [
+        "a.txt",
+        "b.txt",
+        "c.txt",
+    ],
+    visibility = ["//visibility:public"],
+)
+
+go_library(
+    name = "go_default_library",
+    srcs = ["foo.go"],
+)
+`,
+	}, {
+		desc: "merge package default_visibility",
+		previous: `
+load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+package(
+    default_testonly = 1,
+    default_visibility = [
+        "//foo:__pkg__",  # keep
+        "//bar:__pkg__",
+    ],
+)
+
+go_library(
+    name = "go_default_library",
+    srcs = ["foo.go"],
+)
+`,
+		current: `
+load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+package(default_visibility = ["//visibility:public"])
+
+go_library(
+    name = "go_default_library",
+    srcs = ["foo.go"],
+)
+`,
+		expected: `
+load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+package(
+    default_testonly = 1,
+    default_visibility = [
+        "//foo:__pkg__",  # keep
+        "//visibility:public",
+    ],
+)
+
+go_library(
+    name = "go_default_library",
+    srcs = ["foo.go"],
+)
+`,
+	}, {
+		desc: "insert package before rules",
+		previous: `
+load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+go_library(
+    name = "go_default_library",
+    srcs = ["foo.go"],
+)
+`,
+		current: `
+load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+package(default_visibility = ["//visibility:public"])
+
+go_library(
+    name = "go_default_library",
+    srcs = ["foo.go"],
+)
+`,
+		expected: `
+load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+package(default_visibility = ["//visibility:public"])
+
+go_library(
+    name = "go_default_library",
+    srcs = ["foo.go"],
+)
+`,
+	}, {
+		desc: "insert package and merge several rules",
+		previous: `
+load("@io_bazel_rules_go//go:def.bzl", "go_binary", "go_library", "go_test")
+
+go_library(
+    name = "go_default_library",
+    srcs = ["old_lib.go"],
+)
+
+go_binary(
+    name = "cmd",
+    srcs = ["old_main.go"],
+    library = ":go_default_library",
+)
+
+go_test(
+    name = "go_default_test",
+    srcs = ["old_test.go"],
+    library = ":go_default_library",
+)
+`,
+		current: `
+load("@io_bazel_rules_go//go:def.bzl", "go_binary", "go_library", "go_test")
+
+package(default_visibility = ["//visibility:public"])
+
+go_library(
+    name = "go_default_library",
+    srcs = ["lib.go"],
+)
+
+go_binary(
+    name = "cmd",
+    srcs = ["main.go"],
+    library = ":go_default_library",
+)
+
+go_test(
+    name = "go_default_test",
+    srcs = ["lib_test.go"],
+    library = ":go_default_library",
+)
+`,
+		expected: `
+load("@io_bazel_rules_go//go:def.bzl", "go_binary", "go_library", "go_test")
+
+package(default_visibility = ["//visibility:public"])
+
+go_library(
+    name = "go_default_library",
+    srcs = ["lib.go"],
+)
+
+go_binary(
+    name = "cmd",
+    srcs = ["main.go"],
+    library = ":go_default_library",
+)
+
+go_test(
+    name = "go_default_test",
+    srcs = ["lib_test.go"],
+    library = ":go_default_library",
+)
+`,
+	}, {
+		desc: "preserve comments on merged elements",
+		previous: `
+load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+go_library(
+    name = "go_default_library",
+    srcs = [
+        # TODO(foo): split this file.
+        "a.go",
+        "b.go",  # TODO(bar): remove
+        "c.go",  # deleted
+    ],
+)
+`,
+		current: `
+load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+go_library(
+    name = "go_default_library",
+    srcs = [
+        "a.go",
+        "b.go",
+        "d.go",
+    ],
+)
+`,
+		expected: `
+load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+go_library(
+    name = "go_default_library",
+    srcs = [
+        # TODO(foo): split this file.
+        "a.go",
+        "b.go",  # TODO(bar): remove
+        "d.go",
+    ],
+)
+`,
+	}, {
+		desc: "merge comments",
+		previous: `
+# load
+load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+# rule
+go_library(
+    # unmerged attr
+    name = "go_default_library",
+    # merged attr
+    srcs = ["foo.go"],
+)
+`,
+		current: `
+load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+go_library(
+    name = "go_default_library",
+    srcs = ["foo.go"],
+)
+`,
+		expected: `
+# load
+load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+# rule
+go_library(
+    # unmerged attr
+    name = "go_default_library",
+    # merged attr
+    srcs = ["foo.go"],
+)
+`,
+	}, {
+		desc: "do not sort",
+		previous: `
+load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+go_library(
+    name = "go_default_library",
+    srcs = [
+        "b.go",
+        "a.go",
+    ],
+    # do not sort
+    deps = [
+        "//z:go_default_library",
+        "//y:go_default_library",
+        "//deleted:go_default_library",
+        "//x:go_default_library",
+    ],
+)
+`,
+		current: `
+load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+go_library(
+    name = "go_default_library",
+    srcs = [
+        "a.go",
+        "b.go",
+    ],
+    deps = [
+        "//new:go_default_library",
+        "//x:go_default_library",
+        "//y:go_default_library",
+        "//z:go_default_library",
+    ],
+)
+`,
+		expected: `
+load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+go_library(
+    name = "go_default_library",
+    srcs = [
+        "a.go",
+        "b.go",
+    ],
+    # do not sort
+    deps = [
+        "//z:go_default_library",
+        "//y:go_default_library",
+        "//x:go_default_library",
+        "//new:go_default_library",
+    ],
+)
+`,
+	}, {
+		desc: "srcs style list replaces glob",
+		previous: `
+load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+# gazelle:srcs_style list
+go_library(
+    name = "go_default_library",
+    srcs = glob(["*.go"], exclude = ["gen.go"]) + [
+        "extra.go",  # keep
+    ],
+)
+`,
+		current: `
+load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+go_library(
+    name = "go_default_library",
+    srcs = [
+        "a.go",
+        "b.go",
+    ],
+)
+`,
+		expected: `
+load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+# gazelle:srcs_style list
+go_library(
+    name = "go_default_library",
+    srcs = [
+        "extra.go",  # keep
+        "a.go",
+        "b.go",
+    ],
+)
+`,
+	}, {
+		desc: "srcs style glob replaces list",
+		previous: `
+load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+go_library(
+    name = "go_default_library",
+    srcs = [
+        "a.go",
+        "b.go",
+    ],
+)
+`,
+		current: `
+load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+go_library(
+    name = "go_default_library",
+    srcs = glob(["*.go"], exclude = ["*_test.go"]),
+)
+`,
+		expected: `
+load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+go_library(
+    name = "go_default_library",
+    srcs = glob(["*.go"], exclude = ["*_test.go"]),
+)
+`,
+	}, {
+		desc: "srcs style glob replaces old glob",
+		previous: `
+load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+go_library(
+    name = "go_default_library",
+    srcs = glob(["*.go"], exclude = ["old.go"]),
+)
+`,
+		current: `
+load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+go_library(
+    name = "go_default_library",
+    srcs = glob(["*.go"]),
+)
+`,
+		expected: `
+load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+go_library(
+    name = "go_default_library",
+    srcs = glob(["*.go"]),
+)
+`,
+	},
+}
+
+func TestMergeWithExisting(t *testing.T) {
+	tmp, err := ioutil.TempFile(os.Getenv("TEST_TMPDIR"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tmp.Close(); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(tmp.Name())
+	for _, tc := range testCases {
+		if err := ioutil.WriteFile(tmp.Name(), []byte(tc.previous), 0755); err != nil {
+			t.Fatalf("%s: %v", tc.desc, err)
+		}
+		newF, err := bzl.Parse("current", []byte(tc.current))
+		if err != nil {
+			t.Fatalf("%s: %v", tc.desc, err)
+		}
+		afterF := MergeWithExisting(&Options{}, newF, tmp.Name())
+		if afterF == nil {
+			if !tc.ignore {
+				t.Errorf("%s: got nil; want file", tc.desc)
+			}
+			continue
+		}
+		if afterF != nil && tc.ignore {
+			t.Errorf("%s: got file; want nil", tc.desc)
+			continue
+		}
+
+		want := tc.expected
+		if len(want) > 0 && want[0] == '\n' {
+			want = want[1:]
+		}
+
+		if got := string(bzl.Format(afterF)); got != want {
+			t.Errorf("%s: got %s; want %s", tc.desc, got, want)
+		}
+	}
+}
+
+func TestMergeWithExistingSelectAliases(t *testing.T) {
+	opts := &Options{
+		SelectKeyAliases: map[string]string{"//:linux_amd64": "@io_bazel_rules_go//go/platform:linux_amd64"},
+	}
+
+	previous := `
+load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+go_library(
+    name = "go_default_library",
+    srcs = select({
+        "//:linux_amd64": [
+            "foo_linux.go",  # keep
+        ],
+        "@io_bazel_rules_go//go/platform:linux_amd64": [
+            "bar_linux.go",  # keep
+        ],
+    }),
+)
+`
+	current := `
+load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+go_library(
+    name = "go_default_library",
+    srcs = select({
+        "@io_bazel_rules_go//go/platform:linux_amd64": ["baz_linux.go"],
+        "//conditions:default": [],
+    }),
+)
+`
+	expected := `load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+go_library(
+    name = "go_default_library",
+    srcs = select({
+        "@io_bazel_rules_go//go/platform:linux_amd64": [
+            "foo_linux.go",  # keep
+            "bar_linux.go",  # keep
+            "baz_linux.go",
+        ],
+        "//conditions:default": [],
+    }),
+)
+`
+
+	tmp, err := ioutil.TempFile(os.Getenv("TEST_TMPDIR"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := io.WriteString(tmp, previous); err != nil {
+		t.Fatal(err)
+	}
+	if err := tmp.Close(); err != nil {
+		t.Fatal(err)
+	}
+	newF, err := bzl.Parse("current", []byte(current))
+	if err != nil {
+		t.Fatal(err)
+	}
+	afterF := MergeWithExisting(opts, newF, tmp.Name())
+	if got := string(bzl.Format(afterF)); got != expected {
+		t.Errorf("got %s; want %s", got, expected)
+	}
+}
+
+func TestMergeWithExistingUpdateGoPrefix(t *testing.T) {
+	opts := &Options{UpdateGoPrefix: true}
+
+	current := `
+load("@io_bazel_rules_go//go:def.bzl", "go_library", "go_prefix")
+
+go_prefix("example.com/new")
+
+go_library(
+    name = "go_default_library",
+    srcs = ["foo.go"],
+)
+`
+	for _, tc := range []struct {
+		desc, previous, expected string
+	}{
+		{
+			desc: "update",
+			previous: `
+load("@io_bazel_rules_go//go:def.bzl", "go_library", "go_prefix")
+
+go_prefix("example.com/old")
+
+go_library(
+    name = "go_default_library",
+    srcs = ["foo.go"],
+    importpath = "example.com/old",
+)
+`,
+			expected: `load("@io_bazel_rules_go//go:def.bzl", "go_library", "go_prefix")
+
+go_prefix("example.com/new")
+
+go_library(
+    name = "go_default_library",
+    srcs = ["foo.go"],
+    importpath = "example.com/old",
+)
+`,
+		}, {
+			desc: "keep",
+			previous: `
+load("@io_bazel_rules_go//go:def.bzl", "go_library", "go_prefix")
+
+go_prefix("example.com/old")  # keep
+
+go_library(
+    name = "go_default_library",
+    srcs = ["foo.go"],
+)
+`,
+			expected: `load("@io_bazel_rules_go//go:def.bzl", "go_library", "go_prefix")
+
+go_prefix("example.com/old")  # keep
+
+go_library(
+    name = "go_default_library",
+    srcs = ["foo.go"],
+)
+`,
+		},
+	} {
+		tmp, err := ioutil.TempFile(os.Getenv("TEST_TMPDIR"), "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.Remove(tmp.Name())
+		if _, err := io.WriteString(tmp, tc.previous); err != nil {
+			t.Fatal(err)
+		}
+		if err := tmp.Close(); err != nil {
+			t.Fatal(err)
+		}
+		newF, err := bzl.Parse("current", []byte(current))
+		if err != nil {
+			t.Fatal(err)
+		}
+		afterF := MergeWithExisting(opts, newF, tmp.Name())
+		if got := string(bzl.Format(afterF)); got != tc.expected {
+			t.Errorf("%s: got %s; want %s", tc.desc, got, tc.expected)
+		}
+	}
+}
+
+func TestMergeWithExistingKindConflict(t *testing.T) {
+	current := `
+go_binary(
+    name = "foo",
+    srcs = ["main.go"],
+)
+`
+	previous := `
+go_library(
+    name = "foo",
+    srcs = ["main.go"],
+)
+`
+	for _, tc := range []struct {
+		policy, expected string
+	}{
+		{
+			policy: KindConflictError,
+			expected: `go_library(
+    name = "foo",
+    srcs = ["main.go"],
+)
+`,
+		}, {
+			policy: KindConflictRename,
+			expected: `go_library(
+    name = "foo",
+    srcs = ["main.go"],
+)
+
+go_binary(
+    name = "foo_binary",
+    srcs = ["main.go"],
+)
+`,
+		}, {
+			policy: KindConflictAlias,
+			expected: `alias(
+    name = "foo",
+    actual = ":foo_binary",
+    visibility = ["//visibility:public"],
+)
+
+go_binary(
+    name = "foo_binary",
+    srcs = ["main.go"],
+)
+`,
+		},
+	} {
+		opts := &Options{KindConflict: tc.policy}
+		tmp, err := ioutil.TempFile(os.Getenv("TEST_TMPDIR"), "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.Remove(tmp.Name())
+		if _, err := io.WriteString(tmp, previous); err != nil {
+			t.Fatal(err)
+		}
+		if err := tmp.Close(); err != nil {
+			t.Fatal(err)
+		}
+		newF, err := bzl.Parse("current", []byte(current))
+		if err != nil {
+			t.Fatal(err)
+		}
+		afterF := MergeWithExisting(opts, newF, tmp.Name())
+		if got := string(bzl.Format(afterF)); got != tc.expected {
+			t.Errorf("%s: got %s; want %s", tc.policy, got, tc.expected)
+		}
+	}
+}
+
+func TestMergeWithExistingResolveConflict(t *testing.T) {
+	current := `
+go_binary(
+    name = "foo",
+    srcs = ["main.go"],
+)
+`
+	previous := `
+go_library(
+    name = "foo",
+    srcs = ["main.go"],
+)
+`
+	for _, tc := range []struct {
+		decision, expected string
+	}{
+		{
+			decision: ConflictSkip,
+			expected: `go_library(
+    name = "foo",
+    srcs = ["main.go"],
+)
+`,
+		}, {
+			decision: ConflictTakeGenerated,
+			expected: `go_binary(
+    name = "foo",
+    srcs = ["main.go"],
+)
+`,
+		},
+	} {
+		var asked []Conflict
+		opts := &Options{
+			ResolveConflict: func(c Conflict) string {
+				asked = append(asked, c)
+				return tc.decision
+			},
+		}
+		tmp, err := ioutil.TempFile(os.Getenv("TEST_TMPDIR"), "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.Remove(tmp.Name())
+		if _, err := io.WriteString(tmp, previous); err != nil {
+			t.Fatal(err)
+		}
+		if err := tmp.Close(); err != nil {
+			t.Fatal(err)
+		}
+		newF, err := bzl.Parse("current", []byte(current))
+		if err != nil {
+			t.Fatal(err)
+		}
+		afterF := MergeWithExisting(opts, newF, tmp.Name())
+		if len(asked) != 1 || asked[0].Rule != "foo" {
+			t.Errorf("%s: got conflicts %v; want one conflict for foo", tc.decision, asked)
+		}
+		if got := string(bzl.Format(afterF)); got != tc.expected {
+			t.Errorf("%s: got %s; want %s", tc.decision, got, tc.expected)
+		}
+	}
+}
+
+func TestCanonicalLabel(t *testing.T) {
+	for _, tc := range []struct {
+		label, want string
+	}{
+		{"//conditions:default", "//conditions:default"},
+		{"@//foo:bar", "//foo:bar"},
+		{"//foo/bar", "//foo/bar:bar"},
+		{"@repo//foo", "@repo//foo:foo"},
+		{"@io_bazel_rules_go//go/platform:linux_amd64", "@io_bazel_rules_go//go/platform:linux_amd64"},
+		{"linux_amd64", "linux_amd64"},
+	} {
+		if got := canonicalLabel(tc.label); got != tc.want {
+			t.Errorf("canonicalLabel(%q) = %q; want %q", tc.label, got, tc.want)
+		}
+	}
+}
+
+func TestCheckImportPaths(t *testing.T) {
+	for _, tc := range []struct {
+		desc, old, want string
+		fix             bool
+	}{
+		{
+			desc: "match",
+			old: `go_library(
+    name = "go_default_library",
+    importpath = "example.com/repo/lib",
+)`,
+			want: `go_library(
+    name = "go_default_library",
+    importpath = "example.com/repo/lib",
+)`,
+			fix: true,
+		}, {
+			desc: "mismatch without fix",
+			old: `go_library(
+    name = "go_default_library",
+    importpath = "example.com/old/lib",
+)`,
+			want: `go_library(
+    name = "go_default_library",
+    importpath = "example.com/old/lib",
+)`,
+		}, {
+			desc: "mismatch with fix",
+			old: `go_library(
+    name = "go_default_library",
+    importpath = "example.com/old/lib",
+)`,
+			want: `go_library(
+    name = "go_default_library",
+    importpath = "example.com/repo/lib",
+)`,
+			fix: true,
+		}, {
+			desc: "mismatch with keep",
+			old: `go_library(
+    name = "go_default_library",
+    importpath = "example.com/old/lib",  # keep
+)`,
+			want: `go_library(
+    name = "go_default_library",
+    importpath = "example.com/old/lib",  # keep
+)`,
+			fix: true,
+		}, {
+			desc: "rule with keep",
+			old: `go_library(
+    name = "go_default_library",
+    importpath = "example.com/old/lib",
+)  # keep`,
+			want: `go_library(
+    name = "go_default_library",
+    importpath = "example.com/old/lib",
+)  # keep`,
+			fix: true,
+		}, {
+			desc: "other library",
+			old: `go_library(
+    name = "extra",
+    importpath = "example.com/repo/lib/extra",
+)`,
+			want: `go_library(
+    name = "extra",
+    importpath = "example.com/repo/lib/extra",
+)`,
+			fix: true,
+		},
+	} {
+		f, err := bzl.Parse(tc.desc, []byte(tc.old))
+		if err != nil {
+			t.Fatalf("%s: %v", tc.desc, err)
+		}
+		CheckImportPaths(f, "example.com/repo/lib", tc.fix)
+		if got, want := string(bzl.Format(f)), tc.want+"\n"; got != want {
+			t.Errorf("%s: got %s; want %s", tc.desc, got, want)
+		}
+	}
+}
+
+func TestMergeWithExistingDifferentName(t *testing.T) {
+	oldData := testCases[0].previous
+	newData := testCases[0].current
+	expected := testCases[0].expected
+	if len(expected) > 0 && expected[0] == '\n' {
+		expected = expected[1:]
+	}
+
+	tmp, err := ioutil.TempFile(os.Getenv("TEST_TMPDIR"), "BUILD")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := io.WriteString(tmp, oldData); err != nil {
+		t.Fatal(err)
+	}
+	if err := tmp.Close(); err != nil {
+		t.Fatal(err)
+	}
+	newTmp, err := ioutil.TempFile(os.Getenv("TEST_TMPDIR"), "BUILD.bazel")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(newTmp.Name())
+	newF, err := bzl.Parse(newTmp.Name(), []byte(newData))
+	if err != nil {
+		t.Fatal(err)
+	}
+	afterF := MergeWithExisting(&Options{}, newF, tmp.Name())
+	if s := string(bzl.Format(afterF)); s != expected {
+		t.Errorf("got %s; want %s", s, expected)
+	}
+}
+
+func TestMergeWithExistingInDirRename(t *testing.T) {
+	dir, err := ioutil.TempDir(os.Getenv("TEST_TMPDIR"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	buildPath := filepath.Join(dir, "BUILD")
+	if err := ioutil.WriteFile(buildPath, []byte(testCases[0].previous), 0644); err != nil {
+		t.Fatal(err)
+	}
+	newF, err := bzl.Parse(filepath.Join(dir, "BUILD.bazel"), []byte(testCases[0].current))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	names := []string{"BUILD.bazel", "BUILD"}
+	afterF, oldPath, err := MergeWithExistingInDir(&Options{}, newF, names, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if oldPath != buildPath {
+		t.Errorf("got old path %q; want %q", oldPath, buildPath)
+	}
+	if want := filepath.Join(dir, "BUILD.bazel"); afterF.Path != want {
+		t.Errorf("got merged path %q; want %q", afterF.Path, want)
+	}
+
+	// When both files exist, the preferred file is merged and not renamed.
+	if err := ioutil.WriteFile(filepath.Join(dir, "BUILD.bazel"), []byte(testCases[0].previous), 0644); err != nil {
+		t.Fatal(err)
+	}
+	afterF, oldPath, err = MergeWithExistingInDir(&Options{}, newF, names, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := filepath.Join(dir, "BUILD.bazel"); oldPath != want || afterF.Path != want {
+		t.Errorf("got old path %q, merged path %q; want %q for both", oldPath, afterF.Path, want)
+	}
+}
+
+func TestMergeListAbsoluteLabels(t *testing.T) {
+	old := &bzl.ListExpr{List: []bzl.Expr{
+		keepString(":foo"),
+		keepString("//pkg:bar"),
+		keepString("//other:baz"),
+	}}
+	gen := &bzl.ListExpr{List: []bzl.Expr{
+		&bzl.StringExpr{Value: "//pkg:foo"},
+		&bzl.StringExpr{Value: ":bar"},
+		&bzl.StringExpr{Value: ":baz"},
+		&bzl.StringExpr{Value: "//pkg/sub"},
+	}}
+	merged := mergeList(gen, old, "pkg")
+	var got []string
+	for _, v := range merged.List {
+		got = append(got, stringValue(v))
+	}
+	want := []string{":foo", "//pkg:bar", "//other:baz", ":baz", "//pkg/sub"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q; want %q", got, want)
+	}
+}
+
+func TestPreserveOrder(t *testing.T) {
+	strs := func(ss ...string) *bzl.ListExpr {
+		l := &bzl.ListExpr{}
+		for _, s := range ss {
+			l.List = append(l.List, &bzl.StringExpr{Value: s})
+		}
+		return l
+	}
+	values := func(l *bzl.ListExpr) []string {
+		var vs []string
+		for _, v := range l.List {
+			vs = append(vs, stringValue(v))
+		}
+		return vs
+	}
+	key := "@io_bazel_rules_go//go/platform:linux_amd64"
+	dict := func(l *bzl.ListExpr) *bzl.CallExpr {
+		return &bzl.CallExpr{
+			X: &bzl.LiteralExpr{Token: "select"},
+			List: []bzl.Expr{&bzl.DictExpr{List: []bzl.Expr{
+				&bzl.KeyValueExpr{Key: &bzl.StringExpr{Value: key}, Value: l},
+			}}},
+		}
+	}
+
+	oldList, oldPlatform := strs(":c", "//pkg:b", ":a"), strs("z.go", "y.go")
+	old := &bzl.BinaryExpr{X: oldList, Op: "+", Y: dict(oldPlatform)}
+	mergedList, mergedPlatform := strs(":a", ":b", ":c", ":d"), strs("x.go", "y.go", "z.go")
+	merged := &bzl.BinaryExpr{X: mergedList, Op: "+", Y: dict(mergedPlatform)}
+
+	preserveOrder(merged, old, "pkg")
+	if got, want := values(mergedList), []string{":c", ":b", ":a", ":d"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got list %q; want %q", got, want)
+	}
+	if got, want := values(mergedPlatform), []string{"z.go", "y.go", "x.go"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got platform list %q; want %q", got, want)
+	}
+}
+
+func keepString(s string) *bzl.StringExpr {
+	return &bzl.StringExpr{
+		Value:    s,
+		Comments: bzl.Comments{Suffix: []bzl.Comment{{Token: keep}}},
+	}
+}
+
+func TestSelectKeyLess(t *testing.T) {
+	keys := []string{
+		"//conditions:foo",
+		"@io_bazel_rules_go//go/platform:amd64",
+		"@io_bazel_rules_go//go/platform:linux_arm",
+		"@io_bazel_rules_go//go/platform:darwin_amd64",
+		"@io_bazel_rules_go//go/platform:linux",
+		"@io_bazel_rules_go//go/platform:arm",
+		"@io_bazel_rules_go//go/platform:linux_amd64",
+		"//config:debug",
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return selectKeyLess(keys[i], keys[j])
+	})
+	want := []string{
+		"@io_bazel_rules_go//go/platform:darwin_amd64",
+		"@io_bazel_rules_go//go/platform:linux",
+		"@io_bazel_rules_go//go/platform:linux_amd64",
+		"@io_bazel_rules_go//go/platform:linux_arm",
+		"@io_bazel_rules_go//go/platform:amd64",
+		"@io_bazel_rules_go//go/platform:arm",
+		"//conditions:foo",
+		"//config:debug",
+	}
+	if !reflect.DeepEqual(keys, want) {
+		t.Errorf("got %q; want %q", keys, want)
+	}
+}
+
+func TestApplyMultiLineThreshold(t *testing.T) {
+	opts := &Options{MultiLineThresholds: map[string]int{"deps": 2, "*": 3}}
+
+	strs := func(ss ...string) *bzl.ListExpr {
+		l := &bzl.ListExpr{}
+		for _, s := range ss {
+			l.List = append(l.List, &bzl.StringExpr{Value: s})
+		}
+		return l
+	}
+	for _, tc := range []struct {
+		attr string
+		list *bzl.ListExpr
+		want bool
+	}{
+		{attr: "deps", list: strs("a"), want: false},
+		{attr: "deps", list: strs("a", "b"), want: true},
+		{attr: "srcs", list: strs("a", "b"), want: false},
+		{attr: "srcs", list: strs("a", "b", "c"), want: true},
+	} {
+		opts.applyMultiLineThreshold(tc.attr, tc.list)
+		if tc.list.ForceMultiLine != tc.want {
+			t.Errorf("%s with %d elements: got ForceMultiLine %v; want %v", tc.attr, len(tc.list.List), tc.list.ForceMultiLine, tc.want)
+		}
+	}
+}
+
+func TestMergeRules(t *testing.T) {
+	genFile, err := bzl.Parse("gen", []byte(`
+go_library(
+    name = "go_default_library",
+    srcs = ["new.go"],
+    deps = ["//dep:go_default_library"],
+)
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldFile, err := bzl.Parse("old", []byte(`
+go_library(
+    name = "go_default_library",
+    srcs = ["old.go"],
+    deps = [":extra"],  # keep
+    visibility = ["//visibility:private"],
+)
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	merged := MergeRules(&Options{}, genFile.Stmt[0].(*bzl.CallExpr), oldFile.Stmt[0].(*bzl.CallExpr))
+	got := string(bzl.Format(&bzl.File{Stmt: []bzl.Expr{merged}}))
+	want := `go_library(
+    name = "go_default_library",
+    srcs = ["new.go"],
+    deps = [":extra"],  # keep
+    visibility = ["//visibility:private"],
+)
+`
+	if got != want {
+		t.Errorf("got %s; want %s", got, want)
 	}
 }
@@ -0,0 +1,151 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package packages
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// fileInfoCacheVersion is recorded in cache files. Caches with a different
+// version are discarded. It should be changed when goFileData changes or
+// when the way it is read from files changes.
+const fileInfoCacheVersion = 6
+
+// FileInfoCache maps paths of .go files to the results of parsing them.
+// It may be loaded from and saved to a file, so results can be reused by
+// later runs.
+type FileInfoCache struct {
+	entries map[string]fileCacheEntry
+	used    map[string]bool
+}
+
+// fileCacheEntry is the cached result of parsing one file, along with the
+// state of the file when it was parsed.
+type fileCacheEntry struct {
+	Size    int64  `json:",omitempty"`
+	ModTime int64  `json:",omitempty"`
+	Hash    string `json:",omitempty"`
+	Data    goFileData
+}
+
+// fileCacheFile is the format of files written by FileInfoCache.Save.
+type fileCacheFile struct {
+	Version int
+	Entries map[string]fileCacheEntry
+}
+
+// NewFileInfoCache returns an empty cache.
+func NewFileInfoCache() *FileInfoCache {
+	return &FileInfoCache{
+		entries: make(map[string]fileCacheEntry),
+		used:    make(map[string]bool),
+	}
+}
+
+// LoadFileInfoCache reads a cache saved by Save. If the file does not exist
+// or was written by a different version of the cache, an empty cache is
+// returned.
+func LoadFileInfoCache(path string) (*FileInfoCache, error) {
+	c := NewFileInfoCache()
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var f fileCacheFile
+	if err := json.Unmarshal(data, &f); err != nil {
+		return nil, err
+	}
+	if f.Version == fileInfoCacheVersion && f.Entries != nil {
+		c.entries = f.Entries
+	}
+	return c, nil
+}
+
+// Save writes the cache to "path". Only entries for files that were read
+// since the cache was loaded are saved, so files that were deleted are
+// dropped.
+func (c *FileInfoCache) Save(path string) error {
+	f := fileCacheFile{
+		Version: fileInfoCacheVersion,
+		Entries: make(map[string]fileCacheEntry),
+	}
+	for p := range c.used {
+		f.Entries[p] = c.entries[p]
+	}
+	data, err := json.Marshal(f)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+// readGoFile returns the results of parsing the .go file at "path", whose
+// slash-separated path from the repository root is "rel". Results come from
+// Config.FileCache when the file hasn't changed, and are added to it
+// otherwise.
+func (pr *packageReader) readGoFile(path, rel string) (goFileData, error) {
+	c := pr.c.FileCache
+	if c == nil {
+		return pr.c.parseGoFile(path)
+	}
+	var key fileCacheEntry
+	if pr.manifest != nil {
+		key.Hash, _ = pr.manifest.Hash(rel)
+	}
+	if key.Hash == "" {
+		fi, err := pr.c.FS.Stat(path)
+		if err != nil {
+			return goFileData{}, err
+		}
+		if fi.ModTime().IsZero() {
+			// Files in memory can't be checked for changes.
+			return pr.c.parseGoFile(path)
+		}
+		key.Size, key.ModTime = fi.Size(), fi.ModTime().UnixNano()
+	}
+	if e, ok := c.entries[path]; ok && e.Size == key.Size && e.ModTime == key.ModTime && e.Hash == key.Hash {
+		c.used[path] = true
+		return e.Data, nil
+	}
+	data, err := pr.c.parseGoFile(path)
+	if err != nil {
+		return goFileData{}, err
+	}
+	key.Data = data
+	c.entries[path] = key
+	c.used[path] = true
+	return data, nil
+}
@@ -0,0 +1,99 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package packages
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestFileInfoCache(t *testing.T) {
+	dir, err := ioutil.TempDir(os.Getenv("TEST_TMPDIR"), "cache_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	src := filepath.Join(dir, "foo.go")
+	if err := ioutil.WriteFile(src, []byte("package foo\n\nimport \"example.com/bar\"\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	c := NewConfig()
+	c.FileCache = NewFileInfoCache()
+	pr := packageReader{c: c, dir: dir, goPrefix: "example.com/repo"}
+
+	info, err := pr.goFileInfo("foo.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"example.com/bar"}; !reflect.DeepEqual(info.imports, want) {
+		t.Errorf("got imports %q; want %q", info.imports, want)
+	}
+
+	// An unchanged file is not parsed again.
+	e := c.FileCache.entries[src]
+	e.Data.Imports = []string{"example.com/cached"}
+	c.FileCache.entries[src] = e
+	if info, err = pr.goFileInfo("foo.go"); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"example.com/cached"}; !reflect.DeepEqual(info.imports, want) {
+		t.Errorf("got imports %q from unchanged file; want %q", info.imports, want)
+	}
+
+	// The cache survives being saved and loaded.
+	cachePath := filepath.Join(dir, "cache.json")
+	if err := c.FileCache.Save(cachePath); err != nil {
+		t.Fatal(err)
+	}
+	if c.FileCache, err = LoadFileInfoCache(cachePath); err != nil {
+		t.Fatal(err)
+	}
+	if info, err = pr.goFileInfo("foo.go"); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"example.com/cached"}; !reflect.DeepEqual(info.imports, want) {
+		t.Errorf("got imports %q from loaded cache; want %q", info.imports, want)
+	}
+
+	// A changed file is parsed again.
+	if err := ioutil.WriteFile(src, []byte("package foo\n\nimport \"example.com/baz\"\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	later := time.Now().Add(time.Hour)
+	if err := os.Chtimes(src, later, later); err != nil {
+		t.Fatal(err)
+	}
+	if info, err = pr.goFileInfo("foo.go"); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"example.com/baz"}; !reflect.DeepEqual(info.imports, want) {
+		t.Errorf("got imports %q from changed file; want %q", info.imports, want)
+	}
+}
+
+func TestLoadFileInfoCacheMissing(t *testing.T) {
+	c, err := LoadFileInfoCache(filepath.Join(os.Getenv("TEST_TMPDIR"), "does_not_exist.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(c.entries) != 0 {
+		t.Errorf("got %d entries; want 0", len(c.entries))
+	}
+}
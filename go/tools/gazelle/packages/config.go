@@ -0,0 +1,140 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package packages
+
+// Config controls how Walk, WalkWithErrors, FindPackage, and the functions
+// they call read a repository. Use NewConfig to get a Config with the
+// default settings.
+type Config struct {
+	// ChoosePackage is called when a directory has .go files in several
+	// packages and none matches the directory name or a package_name
+	// directive. It returns the candidate to generate rules for, or nil to
+	// report a PackageNameError. The package is not selected if
+	// ChoosePackage is nil.
+	ChoosePackage func(err *PackageNameError) *Package
+
+	// FollowSymlinks controls whether Walk descends into symbolic links to
+	// directories. When false, only links listed in FollowedSymlinks are
+	// followed.
+	FollowSymlinks bool
+
+	// FollowedSymlinks is a set of slash-separated paths, relative to the
+	// repository root, of symbolic links that Walk descends into even when
+	// FollowSymlinks is false.
+	FollowedSymlinks map[string]bool
+
+	// EmitAllPackages controls whether Walk calls its callback for every
+	// buildable package in a directory. When false, only the package whose
+	// name matches the directory is reported. Packages reported in addition
+	// to that one have Extra set.
+	EmitAllPackages bool
+
+	// WalkSubdirs controls whether Walk visits subdirectories of the
+	// directory it is called with. When false, only that directory is read.
+	// This is used to update build files in a list of changed directories
+	// without walking the whole tree.
+	WalkSubdirs bool
+
+	// MaxDepth limits how many levels of subdirectories below the directory
+	// Walk is called with are visited. For example, with a MaxDepth of 1,
+	// only that directory and its immediate subdirectories are visited. Zero
+	// means there is no limit.
+	MaxDepth int
+
+	// SkipDirs lists patterns of directories that Walk skips, in addition to
+	// directories whose names start with "." and testdata directories.
+	// Patterns use path.Match syntax. A pattern without a slash is matched
+	// against the name of each directory, like "node_modules". A pattern with
+	// a slash is matched against the slash-separated path of the directory
+	// from the repository root, like "third_party/*".
+	SkipDirs []string
+
+	// MaxDirFiles and MaxDirBytes limit the number of files and the total
+	// size of files in a directory that Walk reads packages from. Files
+	// skipped by exclude directives don't count. When a directory is over a
+	// limit, a warning is logged, and if SkipLargeDirs is set, no packages
+	// are reported for it. This protects against large dumps of generated
+	// code. Zero means no limit.
+	MaxDirFiles   int
+	MaxDirBytes   int64
+	SkipLargeDirs bool
+
+	// SkipNestedRepos controls whether Walk skips subdirectories containing
+	// a file named in WorkspaceFileNames. These are the roots of other Bazel
+	// repositories, often embedded with local_repository, and rules
+	// generated for them would have import paths from the wrong prefix.
+	SkipNestedRepos bool
+
+	// WorkspaceFileNames lists the names of files that mark the root of a
+	// Bazel repository.
+	WorkspaceFileNames []string
+
+	// BuildFileNames lists the names of build files that Walk reads
+	// directives from. In each directory, only the first file found is read.
+	BuildFileNames []string
+
+	// SrcsStyle is the style of srcs attributes for directories whose build
+	// files don't set one with SrcsStyleDirective. When empty, sources are
+	// listed explicitly, but existing glob calls are preserved when merging.
+	SrcsStyle string
+
+	// SkipGenerated controls whether Walk skips .go files with a comment
+	// matching GeneratedHeaderPattern in every directory, regardless of
+	// exclude_generated directives. This is useful in repositories that
+	// check in generated sources built by other rules.
+	SkipGenerated bool
+
+	// TestSuiteTags is a set of build tags that select separate suites of
+	// tests, for example, "integration". Test files that are only built
+	// when one of these tags is set are collected in Package.TestSuites
+	// instead of the package's Test and XTest targets.
+	TestSuiteTags map[string]bool
+
+	// FS is the file system repositories are read from.
+	FS FileSystem
+
+	// Manifest is a list of files that Walk uses instead of listing
+	// directories in FS, when it is not nil. Only files and directories in
+	// the manifest are considered, which lets Walk run on trees that aren't
+	// fully materialized, like sparse checkouts, or on lists of files from
+	// other tools, like "bazel query". The contents of build files and
+	// source files are still read from FS, and //go:embed patterns are
+	// resolved there. Sizes of files are not known, so MaxDirBytes has no
+	// effect.
+	Manifest *Manifest
+
+	// FileCache holds the results of parsing .go files, if it is not nil.
+	// Walk uses cached results for files that haven't changed since they
+	// were cached, instead of parsing them again. Files are considered
+	// unchanged if their size and modification time are the same, or, when
+	// Manifest is set and has a hash for a file, if the hash is the same.
+	FileCache *FileInfoCache
+}
+
+// NewConfig returns a Config with the default settings: subdirectories are
+// walked, nested repositories are skipped, build files are named BUILD.bazel
+// or BUILD, and files are read from the file system of the OS.
+func NewConfig() *Config {
+	return &Config{
+		FollowedSymlinks:   make(map[string]bool),
+		WalkSubdirs:        true,
+		SkipNestedRepos:    true,
+		WorkspaceFileNames: []string{"WORKSPACE", "WORKSPACE.bazel"},
+		BuildFileNames:     []string{"BUILD.bazel", "BUILD"},
+		TestSuiteTags:      make(map[string]bool),
+		FS:                 OSFileSystem{},
+	}
+}
@@ -0,0 +1,180 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package packages
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// parseGoBuild parses the expression in a "//go:build" line (without the
+// "//go:build" prefix) and returns an equivalent "+build" line, in the
+// format stored in fileInfo.tags: space-separated groups of comma-separated
+// tags, any of which may be negated with "!". The expression is converted
+// to disjunctive normal form, so each group is one way of satisfying it.
+func parseGoBuild(expr string) (string, error) {
+	p := &goBuildParser{s: expr}
+	groups, err := p.parseOr()
+	if err != nil {
+		return "", err
+	}
+	if p.next() != "" {
+		return "", fmt.Errorf("invalid //go:build expression %q: unexpected %q", expr, p.next())
+	}
+
+	lines := make([]string, len(groups))
+	for i, g := range groups {
+		lines[i] = strings.Join(g, ",")
+	}
+	return strings.Join(lines, " "), nil
+}
+
+// goBuildParser is a recursive descent parser for "//go:build" expressions.
+// Each parse method returns its expression in disjunctive normal form: a
+// list of groups of literals, where the expression is true if all the
+// literals in any group are true.
+type goBuildParser struct {
+	s string
+}
+
+// next returns the next token without consuming it. "" is returned at the
+// end of the expression.
+func (p *goBuildParser) next() string {
+	p.s = strings.TrimSpace(p.s)
+	if p.s == "" {
+		return ""
+	}
+	if strings.HasPrefix(p.s, "&&") || strings.HasPrefix(p.s, "||") {
+		return p.s[:2]
+	}
+	if c := p.s[0]; c == '!' || c == '(' || c == ')' {
+		return p.s[:1]
+	}
+	i := strings.IndexFunc(p.s, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '_' && r != '.'
+	})
+	if i < 0 {
+		return p.s
+	}
+	if i == 0 {
+		return p.s[:1]
+	}
+	return p.s[:i]
+}
+
+func (p *goBuildParser) consume(tok string) {
+	p.s = p.s[len(tok):]
+}
+
+func (p *goBuildParser) parseOr() ([][]string, error) {
+	groups, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.next() == "||" {
+		p.consume("||")
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		groups = append(groups, right...)
+	}
+	return groups, nil
+}
+
+func (p *goBuildParser) parseAnd() ([][]string, error) {
+	groups, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for p.next() == "&&" {
+		p.consume("&&")
+		right, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		groups = andGroups(groups, right)
+	}
+	return groups, nil
+}
+
+func (p *goBuildParser) parseNot() ([][]string, error) {
+	switch tok := p.next(); {
+	case tok == "!":
+		p.consume(tok)
+		groups, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return notGroups(groups), nil
+	case tok == "(":
+		p.consume(tok)
+		groups, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if p.next() != ")" {
+			return nil, fmt.Errorf("invalid //go:build expression: missing )")
+		}
+		p.consume(")")
+		return groups, nil
+	case tok == "" || tok == ")" || tok == "&&" || tok == "||" || !isTagStart(tok):
+		return nil, fmt.Errorf("invalid //go:build expression: unexpected %q", tok)
+	default:
+		p.consume(tok)
+		return [][]string{{tok}}, nil
+	}
+}
+
+func isTagStart(tok string) bool {
+	c := rune(tok[0])
+	return unicode.IsLetter(c) || unicode.IsDigit(c) || c == '_' || c == '.'
+}
+
+// andGroups returns the conjunction of two expressions in disjunctive
+// normal form.
+func andGroups(x, y [][]string) [][]string {
+	var groups [][]string
+	for _, gx := range x {
+		for _, gy := range y {
+			g := make([]string, 0, len(gx)+len(gy))
+			g = append(g, gx...)
+			g = append(g, gy...)
+			groups = append(groups, g)
+		}
+	}
+	return groups
+}
+
+// notGroups returns the negation of an expression in disjunctive normal
+// form. By De Morgan's laws, this is the conjunction, over all groups, of
+// the disjunction of the negated literals in each group.
+func notGroups(x [][]string) [][]string {
+	groups := [][]string{{}}
+	for _, g := range x {
+		var negated [][]string
+		for _, lit := range g {
+			if strings.HasPrefix(lit, "!") {
+				negated = append(negated, []string{lit[1:]})
+			} else {
+				negated = append(negated, []string{"!" + lit})
+			}
+		}
+		groups = andGroups(groups, negated)
+	}
+	return groups
+}
@@ -0,0 +1,46 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package packages
+
+import "testing"
+
+func TestParseGoBuild(t *testing.T) {
+	for _, tc := range []struct {
+		expr, want string
+	}{
+		{"linux", "linux"},
+		{"linux && amd64", "linux,amd64"},
+		{"linux || darwin", "linux darwin"},
+		{"!windows", "!windows"},
+		{"(linux || darwin) && !cgo", "linux,!cgo darwin,!cgo"},
+		{"!(linux && amd64)", "!linux !amd64"},
+		{"!!foo", "foo"},
+		{"go1.17 && foo_bar", "go1.17,foo_bar"},
+	} {
+		got, err := parseGoBuild(tc.expr)
+		if err != nil {
+			t.Errorf("%q: %v", tc.expr, err)
+		} else if got != tc.want {
+			t.Errorf("%q: got %q; want %q", tc.expr, got, tc.want)
+		}
+	}
+
+	for _, expr := range []string{"", "linux &&", "(linux", "linux darwin", "&& linux", "linux)"} {
+		if _, err := parseGoBuild(expr); err == nil {
+			t.Errorf("%q: got success; want error", expr)
+		}
+	}
+}
@@ -0,0 +1,288 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package packages
+
+import (
+	"bytes"
+	"fmt"
+	"go/parser"
+	"go/token"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const goEmbedPrefix = "//go:embed"
+
+// readEmbedPatterns returns the patterns named in //go:embed directives in
+// the .go file at "path", with content "data". Files without directives are
+// not parsed past the check for the directive text.
+func readEmbedPatterns(path string, data []byte) ([]string, error) {
+	if !bytes.Contains(data, []byte(goEmbedPrefix)) {
+		return nil, nil
+	}
+	f, err := parser.ParseFile(token.NewFileSet(), path, data, parser.ParseComments)
+	if err != nil {
+		return nil, err
+	}
+	var patterns []string
+	for _, cg := range f.Comments {
+		for _, c := range cg.List {
+			if !strings.HasPrefix(c.Text, goEmbedPrefix+" ") && !strings.HasPrefix(c.Text, goEmbedPrefix+"\t") {
+				continue
+			}
+			ps, err := parseEmbedPatterns(strings.TrimPrefix(c.Text, goEmbedPrefix))
+			if err != nil {
+				return nil, fmt.Errorf("%s: invalid //go:embed directive: %v", path, err)
+			}
+			patterns = append(patterns, ps...)
+		}
+	}
+	return patterns, nil
+}
+
+// parseEmbedPatterns splits the arguments of a //go:embed directive. Patterns
+// are separated by spaces and may be quoted with double quotes or back
+// quotes, like in go/build.
+func parseEmbedPatterns(args string) ([]string, error) {
+	var patterns []string
+	for args = strings.TrimSpace(args); args != ""; args = strings.TrimSpace(args) {
+		var p string
+		switch args[0] {
+		case '"', '`':
+			end := 1
+			for end < len(args) && args[end] != args[0] {
+				if args[0] == '"' && args[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end >= len(args) {
+				return nil, fmt.Errorf("unterminated string in %q", args)
+			}
+			var err error
+			if p, err = strconv.Unquote(args[:end+1]); err != nil {
+				return nil, fmt.Errorf("invalid quoted string %q", args[:end+1])
+			}
+			args = args[end+1:]
+			if args != "" && args[0] != ' ' && args[0] != '\t' {
+				return nil, fmt.Errorf("missing space after quoted string")
+			}
+		default:
+			end := strings.IndexAny(args, " \t")
+			if end < 0 {
+				end = len(args)
+			}
+			p, args = args[:end], args[end:]
+		}
+		patterns = append(patterns, p)
+	}
+	if len(patterns) == 0 {
+		return nil, fmt.Errorf("no patterns")
+	}
+	return patterns, nil
+}
+
+// resolveEmbedPatterns returns the files in "dir" matched by //go:embed
+// patterns, as sorted slash-separated paths relative to "dir". Like the go
+// command, directories that match are included recursively, skipping files
+// and directories whose names start with "." or "_" unless the pattern has
+// an "all:" prefix, and skipping directories in other modules. Patterns
+// that match nothing are returned in "unmatched". An error is returned if a
+// pattern is invalid.
+//
+// Files in subdirectories with their own build files belong to other Bazel
+// packages, so they can't be listed by path. Instead, the outermost of these
+// directories are returned in "dirs", also relative to "dir".
+func (c *Config) resolveEmbedPatterns(dir string, patterns []string) (files, dirs, unmatched []string, err error) {
+	seen := make(map[string]bool)
+	matched := 0
+	add := func(rel string) {
+		matched++
+		if !seen[rel] {
+			seen[rel] = true
+			files = append(files, rel)
+		}
+	}
+	seenDirs := make(map[string]bool)
+	addDir := func(rel string) {
+		matched++
+		if !seenDirs[rel] {
+			seenDirs[rel] = true
+			dirs = append(dirs, rel)
+		}
+	}
+	for _, pattern := range patterns {
+		matched = 0
+		glob, all := pattern, false
+		if strings.HasPrefix(glob, "all:") {
+			glob, all = glob[len("all:"):], true
+		}
+		if _, err := path.Match(glob, ""); err != nil || !validEmbedPattern(glob) {
+			return nil, nil, nil, fmt.Errorf("%s: invalid //go:embed pattern %q", dir, pattern)
+		}
+		for _, m := range c.globFS(dir, glob) {
+			fi, err := c.FS.Stat(m)
+			if err != nil {
+				return nil, nil, nil, err
+			}
+			rel, err := filepath.Rel(dir, m)
+			if err != nil {
+				return nil, nil, nil, err
+			}
+			if b := c.packageBoundary(dir, filepath.ToSlash(rel), fi.IsDir()); b != "" {
+				addDir(b)
+				continue
+			}
+			if !fi.IsDir() {
+				add(filepath.ToSlash(rel))
+				continue
+			}
+			err = c.walkFS(m, fi, func(p string, fi os.FileInfo) error {
+				if p != m {
+					if base := fi.Name(); !all && (strings.HasPrefix(base, ".") || strings.HasPrefix(base, "_")) {
+						if fi.IsDir() {
+							return filepath.SkipDir
+						}
+						return nil
+					}
+				}
+				rel, err := filepath.Rel(dir, p)
+				if err != nil {
+					return err
+				}
+				if fi.IsDir() {
+					if _, err := c.FS.Stat(filepath.Join(p, "go.mod")); err == nil && p != dir {
+						return filepath.SkipDir
+					}
+					if p != m && c.hasBuildFile(p) {
+						addDir(filepath.ToSlash(rel))
+						return filepath.SkipDir
+					}
+					return nil
+				}
+				add(filepath.ToSlash(rel))
+				return nil
+			})
+			if err != nil {
+				return nil, nil, nil, err
+			}
+		}
+		if matched == 0 {
+			unmatched = append(unmatched, pattern)
+		}
+	}
+	sort.Strings(files)
+	sort.Strings(dirs)
+	return files, dirs, unmatched, nil
+}
+
+// packageBoundary returns the outermost directory on the path "rel" from
+// "dir" that has a build file, or "" if there is none. Both paths are
+// slash-separated, and the result is relative to "dir". The last element of
+// "rel" is only considered if "isDir" is true.
+func (c *Config) packageBoundary(dir, rel string, isDir bool) string {
+	elems := strings.Split(rel, "/")
+	if !isDir {
+		elems = elems[:len(elems)-1]
+	}
+	for i := range elems {
+		sub := strings.Join(elems[:i+1], "/")
+		if c.hasBuildFile(filepath.Join(dir, filepath.FromSlash(sub))) {
+			return sub
+		}
+	}
+	return ""
+}
+
+// hasBuildFile returns whether the directory "dir" has a file named in
+// BuildFileNames, making it the root of a Bazel package.
+func (c *Config) hasBuildFile(dir string) bool {
+	for _, name := range c.BuildFileNames {
+		if fi, err := c.FS.Stat(filepath.Join(dir, name)); err == nil && !fi.IsDir() {
+			return true
+		}
+	}
+	return false
+}
+
+// globFS returns the paths of files in "dir" matched by "glob", a
+// slash-separated pattern relative to "dir", like filepath.Glob. Directories
+// are read from FS.
+func (c *Config) globFS(dir, glob string) []string {
+	matches := []string{dir}
+	for _, elem := range strings.Split(glob, "/") {
+		var next []string
+		for _, m := range matches {
+			infos, err := c.FS.ReadDir(m)
+			if err != nil {
+				// Like filepath.Glob, ignore errors, including for files
+				// that aren't directories.
+				continue
+			}
+			for _, fi := range infos {
+				if ok, _ := path.Match(elem, fi.Name()); ok {
+					next = append(next, filepath.Join(m, fi.Name()))
+				}
+			}
+		}
+		matches = next
+	}
+	return matches
+}
+
+// walkFS calls "f" for "root", described by "info", and for each file and
+// directory under it, like filepath.Walk. Directories are read from FS.
+// If "f" returns filepath.SkipDir for a directory, its contents are skipped.
+func (c *Config) walkFS(root string, info os.FileInfo, f func(p string, fi os.FileInfo) error) error {
+	if err := f(root, info); err != nil {
+		if err == filepath.SkipDir && info.IsDir() {
+			return nil
+		}
+		return err
+	}
+	if !info.IsDir() {
+		return nil
+	}
+	infos, err := c.FS.ReadDir(root)
+	if err != nil {
+		return err
+	}
+	for _, fi := range infos {
+		if err := c.walkFS(filepath.Join(root, fi.Name()), fi, f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validEmbedPattern returns whether "pattern" names paths inside the
+// package directory: it must not be empty or absolute, and it must not have
+// empty, "." or ".." elements.
+func validEmbedPattern(pattern string) bool {
+	if pattern == "" || strings.HasPrefix(pattern, "/") {
+		return false
+	}
+	for _, elem := range strings.Split(pattern, "/") {
+		if elem == "" || elem == "." || elem == ".." {
+			return false
+		}
+	}
+	return true
+}
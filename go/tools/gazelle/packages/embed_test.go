@@ -0,0 +1,163 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package packages
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestParseEmbedPatterns(t *testing.T) {
+	for _, tc := range []struct {
+		desc, args string
+		want       []string
+		wantErr    bool
+	}{
+		{
+			desc: "simple",
+			args: " a.txt  static/*.html\t",
+			want: []string{"a.txt", "static/*.html"},
+		}, {
+			desc: "quoted",
+			args: ` "with space.txt" ` + "`raw\\name`" + ` all:dir`,
+			want: []string{"with space.txt", `raw\name`, "all:dir"},
+		}, {
+			desc:    "empty",
+			args:    "  ",
+			wantErr: true,
+		}, {
+			desc:    "unterminated",
+			args:    `"a.txt`,
+			wantErr: true,
+		}, {
+			desc:    "no space after quote",
+			args:    `"a.txt"b.txt`,
+			wantErr: true,
+		},
+	} {
+		got, err := parseEmbedPatterns(tc.args)
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("%s: got %q; want error", tc.desc, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tc.desc, err)
+		} else if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: got %q; want %q", tc.desc, got, tc.want)
+		}
+	}
+}
+
+func TestResolveEmbedPatterns(t *testing.T) {
+	dir, err := ioutil.TempDir(os.Getenv("TEST_TMPDIR"), "embed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, f := range []string{
+		"a.txt",
+		".hidden.txt",
+		"static/index.html",
+		"static/style.css",
+		"static/.DS_Store",
+		"static/_draft/page.html",
+		"static/img/logo.png",
+		"nested/go.mod",
+		"nested/data.txt",
+		"web/index.html",
+		"web/assets/BUILD",
+		"web/assets/app.js",
+	} {
+		p := filepath.Join(dir, filepath.FromSlash(f))
+		if err := os.MkdirAll(filepath.Dir(p), 0777); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, nil, 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, tc := range []struct {
+		desc          string
+		patterns      []string
+		want          []string
+		wantDirs      []string
+		wantUnmatched []string
+		wantErr       bool
+	}{
+		{
+			desc:     "files",
+			patterns: []string{"*.txt", ".hidden.txt", "a.txt"},
+			want:     []string{".hidden.txt", "a.txt"},
+		}, {
+			desc:     "directory",
+			patterns: []string{"static"},
+			want:     []string{"static/img/logo.png", "static/index.html", "static/style.css"},
+		}, {
+			desc:     "all directory",
+			patterns: []string{"all:static"},
+			want:     []string{"static/.DS_Store", "static/_draft/page.html", "static/img/logo.png", "static/index.html", "static/style.css"},
+		}, {
+			desc:     "glob in subdirectory",
+			patterns: []string{"static/*.html"},
+			want:     []string{"static/index.html"},
+		}, {
+			desc:     "other package",
+			patterns: []string{"web"},
+			want:     []string{"web/index.html"},
+			wantDirs: []string{"web/assets"},
+		}, {
+			desc:     "file in other package",
+			patterns: []string{"web/assets/app.js"},
+			wantDirs: []string{"web/assets"},
+		}, {
+			desc:          "other module",
+			patterns:      []string{"nested"},
+			wantUnmatched: []string{"nested"},
+		}, {
+			desc:          "no match",
+			patterns:      []string{"a.txt", "missing/*"},
+			want:          []string{"a.txt"},
+			wantUnmatched: []string{"missing/*"},
+		}, {
+			desc:     "parent",
+			patterns: []string{"../a.txt"},
+			wantErr:  true,
+		}, {
+			desc:     "bad glob",
+			patterns: []string{"[a"},
+			wantErr:  true,
+		},
+	} {
+		got, gotDirs, gotUnmatched, err := NewConfig().resolveEmbedPatterns(dir, tc.patterns)
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("%s: got %q; want error", tc.desc, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tc.desc, err)
+		} else if !reflect.DeepEqual(got, tc.want) || !reflect.DeepEqual(gotDirs, tc.wantDirs) || !reflect.DeepEqual(gotUnmatched, tc.wantUnmatched) {
+			t.Errorf("%s: got %q, dirs %q, unmatched %q; want %q, dirs %q, unmatched %q", tc.desc, got, gotDirs, gotUnmatched, tc.want, tc.wantDirs, tc.wantUnmatched)
+		}
+	}
+}
@@ -21,15 +21,18 @@ import (
 	"errors"
 	"fmt"
 	"go/ast"
+	"go/doc"
 	"go/parser"
+	"go/scanner"
 	"go/token"
-	"os"
 	"path"
 	"path/filepath"
 	"strconv"
 	"strings"
 	"unicode"
 	"unicode/utf8"
+
+	"github.com/bazelbuild/rules_go/go/tools/gazelle/logging"
 )
 
 // fileInfo holds information used to decide how to build a file. This
@@ -60,17 +63,61 @@ type fileInfo struct {
 	// isCgo is true for .go files that import "C".
 	isCgo bool
 
+	// hasMain is true for .go files in package main that declare a main
+	// function.
+	hasMain bool
+
 	// goos and goarch contain the OS and architecture suffixes in the filename,
-	// if they were present.
+	// if they were present. Like go/build, only the part of the name before
+	// the first dot is considered, so suffixes like "_linux.pb.go" count.
+	// goos is "darwin" for Objective-C files without an OS suffix.
 	goos, goarch string
 
+	// embedSrcs is a list of files matched by //go:embed directives in .go
+	// files, relative to the file's directory.
+	embedSrcs []string
+
+	// embedDirs is a list of directories matched by //go:embed directives
+	// that are in other Bazel packages, relative to the file's directory.
+	embedDirs []string
+
+	// generated is the class of a generated file, based on its name or on
+	// a generated code comment in .go files. It is empty for other files.
+	generated string
+
+	// generatedHeader is true for .go files with a comment matching
+	// GeneratedHeaderPattern before the package clause.
+	generatedHeader bool
+
+	// binaryOnly is true for .go files with a "//go:binary-only-package"
+	// comment before the package clause.
+	binaryOnly bool
+
+	// importComment is the path in an import comment on the package clause
+	// of a .go file, like `package foo // import "example.com/foo"`.
+	importComment string
+
+	// synopsis is the first sentence of the package doc comment of a .go
+	// file, if it has one.
+	synopsis string
+
 	// tags is a list of build tag lines. Each entry is the trimmed text of
 	// a line after a "+build" prefix.
 	tags []string
 
-	// copts and clinkopts contain flags that are part of CFLAGS, CPPFLAGS,
-	// CXXFLAGS, and LDFLAGS directives in cgo comments.
-	copts, clinkopts []taggedOpts
+	// copts contains flags that are part of CFLAGS and CPPFLAGS directives in
+	// cgo comments, cxxopts contains flags in CXXFLAGS directives, and
+	// clinkopts contains flags in LDFLAGS directives.
+	copts, cxxopts, clinkopts []taggedOpts
+
+	// pkgConfigs contains the names of packages in pkg-config directives in
+	// cgo comments. Options for the pkg-config tool are not included.
+	pkgConfigs []taggedOpts
+
+	// protoPackage is the package declared in a .proto file, and goPackage
+	// is the value of its go_package option. Both are empty for other files
+	// and if not declared.
+	protoPackage, goPackage string
 }
 
 // taggedOpts a list of compile or link options which should only be applied
@@ -94,9 +141,18 @@ const (
 	// goExt is applied to .go files.
 	goExt
 
-	// cExt is applied to C and C++ files.
+	// cExt is applied to C files, ending with .c.
 	cExt
 
+	// cxxExt is applied to C++ files, ending with .cc, .cpp, or .cxx. These
+	// are built with cgo like C files, but need a C++ toolchain.
+	cxxExt
+
+	// objcExt is applied to Objective-C and Objective-C++ files, ending with
+	// .m and .mm, without a suffix for another operating system. These are
+	// only built on darwin, with cgo.
+	objcExt
+
 	// hExt is applied to header files. If cgo code is present, these may be
 	// C or C++ headers. If not, they are treated as Go assembly headers.
 	hExt
@@ -110,6 +166,16 @@ const (
 
 	// protoExt is applied to .proto files.
 	protoExt
+
+	// swigExt is applied to SWIG interface files, ending with .swig or
+	// .swigcxx. They can't be built yet, but they are recorded in
+	// Package.Swig.
+	swigExt
+
+	// sysoExt is applied to system object files, ending with .syso. These are
+	// prebuilt objects packed into the library archive. They are binary, so
+	// only their names are used to determine constraints.
+	sysoExt
 )
 
 // fileNameInfo returns information that can be inferred from the name of
@@ -124,6 +190,13 @@ func fileNameInfo(dir, name string) fileInfo {
 	l := strings.Split(name[:len(name)-len(ext)], "_")
 	if len(l) >= 2 && l[len(l)-1] == "test" {
 		isTest = true
+	}
+	stem := name
+	if dot := strings.Index(stem, "."); dot >= 0 {
+		stem = stem[:dot]
+	}
+	l = strings.Split(stem, "_")
+	if isTest && len(l) >= 2 && l[len(l)-1] == "test" {
 		l = l[:len(l)-1]
 	}
 	switch {
@@ -141,8 +214,12 @@ func fileNameInfo(dir, name string) fileInfo {
 	switch ext {
 	case ".go":
 		category = goExt
-	case ".c", ".cc", ".cpp", ".cxx":
+	case ".c":
 		category = cExt
+	case ".cc", ".cpp", ".cxx":
+		category = cxxExt
+	case ".m", ".mm":
+		category = objcExt
 	case ".h", ".hh", ".hpp", ".hxx":
 		category = hExt
 	case ".s":
@@ -151,41 +228,198 @@ func fileNameInfo(dir, name string) fileInfo {
 		category = csExt
 	case ".proto":
 		category = protoExt
-	case ".m", ".f", ".F", ".for", ".f90", ".swig", ".swigcxx", ".syso":
+	case ".swig", ".swigcxx":
+		category = swigExt
+	case ".syso":
+		category = sysoExt
+	case ".f", ".F", ".for", ".f90":
 		category = unsupportedExt
 	default:
 		category = ignoredExt
 	}
+	if category == objcExt {
+		// Objective-C files are only usable with Apple's frameworks, so they
+		// are treated as if they had a darwin suffix, and files for other
+		// operating systems are ignored.
+		if goos == "" {
+			goos = "darwin"
+		} else if goos != "darwin" {
+			category = ignoredExt
+		}
+	}
 
 	return fileInfo{
-		path:     filepath.Join(dir, name),
-		dir:      dir,
-		name:     name,
-		ext:      ext,
-		category: category,
-		isTest:   isTest,
-		goos:     goos,
-		goarch:   goarch,
+		path:      filepath.Join(dir, name),
+		dir:       dir,
+		name:      name,
+		ext:       ext,
+		category:  category,
+		isTest:    isTest,
+		goos:      goos,
+		goarch:    goarch,
+		generated: generatedClass(name),
 	}
 }
 
 // goFileInfo returns information about a .go file. It will parse part of the
-// file to determine the package name and imports.
+// file to determine the package name and imports, or use results from
+// Config.FileCache if the file hasn't changed.
 // This function is intended to match go/build.Context.Import.
 func (pr *packageReader) goFileInfo(name string) (fileInfo, error) {
 	info := fileNameInfo(pr.dir, name)
-	fset := token.NewFileSet()
-	pf, err := parser.ParseFile(fset, info.path, nil, parser.ImportsOnly|parser.ParseComments)
+	data, err := pr.readGoFile(info.path, path.Join(pr.rel, name))
 	if err != nil {
 		return fileInfo{}, err
 	}
 
-	info.packageName = pf.Name.Name
+	info.packageName = data.PackageName
+	info.hasMain = data.HasMain
+	info.generatedHeader = hasGeneratedHeader(data.HeaderComments)
+	info.binaryOnly = hasBinaryOnlyComment(data.HeaderComments)
+	info.importComment = data.ImportComment
+	info.synopsis = data.Synopsis
+	if info.generated == "" && info.generatedHeader {
+		info.generated = GeneratedHeaderClass
+	}
 	if info.isTest && strings.HasSuffix(info.packageName, "_test") {
 		info.isXTest = true
 		info.packageName = info.packageName[:len(info.packageName)-len("_test")]
 	}
 
+	if data.IsCgo {
+		if info.isTest {
+			return fileInfo{}, fmt.Errorf("%s: use of cgo in test not supported", info.path)
+		}
+		info.isCgo = true
+		info.copts = fromCgoOpts(data.Copts)
+		info.cxxopts = fromCgoOpts(data.Cxxopts)
+		info.clinkopts = fromCgoOpts(data.Clinkopts)
+		info.pkgConfigs = fromCgoOpts(data.PkgConfigs)
+	}
+	for _, path := range data.Imports {
+		if pr.isStandard(path) {
+			continue
+		}
+		if to, ok := RelocatedImport(path); ok {
+			logging.Warnf(logging.At{File: info.path}, "%s: import %q has moved to %q", info.path, path, to)
+		}
+		info.imports = append(info.imports, path)
+	}
+	info.tags = data.Tags
+
+	if len(data.EmbedPatterns) > 0 {
+		var unmatched []string
+		if info.embedSrcs, info.embedDirs, unmatched, err = pr.c.resolveEmbedPatterns(pr.dir, data.EmbedPatterns); err != nil {
+			return fileInfo{}, err
+		}
+		for _, pattern := range unmatched {
+			logging.Warnf(logging.At{File: info.path}, "%s: //go:embed pattern %q: no matching files found", info.path, pattern)
+		}
+	}
+
+	return info, nil
+}
+
+// goFileData holds the results of parsing a .go file that depend only on
+// its content. It is stored in Config.FileCache.
+type goFileData struct {
+	// PackageName is the declared package name, including any "_test"
+	// suffix.
+	PackageName string
+
+	// Imports lists the paths of imported packages other than "C",
+	// including standard packages.
+	Imports []string
+
+	// IsCgo is true if the file imports "C". Copts, Cxxopts, Clinkopts, and
+	// PkgConfigs hold options from cgo directives in the import's comment.
+	IsCgo                                 bool
+	Copts, Cxxopts, Clinkopts, PkgConfigs []cgoOpts `json:",omitempty"`
+
+	// Tags lists build tag lines, as in fileInfo.
+	Tags []string `json:",omitempty"`
+
+	// HeaderComments lists the text of comments before the package clause.
+	HeaderComments []string `json:",omitempty"`
+
+	// ImportComment is the path in an import comment on the package clause.
+	ImportComment string `json:",omitempty"`
+
+	// Synopsis is the first sentence of the package doc comment.
+	Synopsis string `json:",omitempty"`
+
+	// EmbedPatterns lists patterns in //go:embed directives.
+	EmbedPatterns []string `json:",omitempty"`
+
+	// HasMain is true if the file is in package main and declares a main
+	// function.
+	HasMain bool `json:",omitempty"`
+}
+
+// cgoOpts is a taggedOpts that can be encoded.
+type cgoOpts struct {
+	Tags string
+	Opts []string
+}
+
+func toCgoOpts(opts []taggedOpts) []cgoOpts {
+	var result []cgoOpts
+	for _, o := range opts {
+		result = append(result, cgoOpts{Tags: o.tags, Opts: o.opts})
+	}
+	return result
+}
+
+func fromCgoOpts(opts []cgoOpts) []taggedOpts {
+	var result []taggedOpts
+	for _, o := range opts {
+		result = append(result, taggedOpts{tags: o.Tags, opts: o.Opts})
+	}
+	return result
+}
+
+// goHeaderSize is the number of bytes of a .go file read at first by
+// parseGoFile. Most files have their package clause, build constraints,
+// and imports in this many bytes.
+const goHeaderSize = 8 << 10
+
+// parseGoFile parses the .go file at "path", read from FS. If FS is a
+// PrefixFileSystem, only the header of the file is read, unless the rest is
+// needed to find a main function or //go:embed directives.
+func (c *Config) parseGoFile(path string) (goFileData, error) {
+	var data goFileData
+	src, err := c.readFilePrefix(path, goHeaderSize)
+	if err != nil {
+		return goFileData{}, err
+	}
+	fset := token.NewFileSet()
+	var pf *ast.File
+	complete := len(src) < goHeaderSize
+	if !complete {
+		// Parse the header if it holds all the imports. Otherwise, or if it
+		// doesn't parse, read the whole file.
+		pf, err = parser.ParseFile(fset, path, src, parser.ImportsOnly|parser.ParseComments)
+		if err != nil || !importsComplete(fset, pf, src) {
+			if src, err = c.FS.ReadFile(path); err != nil {
+				return goFileData{}, err
+			}
+			fset, pf, complete = token.NewFileSet(), nil, true
+		}
+	}
+	if pf == nil {
+		pf, err = parser.ParseFile(fset, path, src, parser.ImportsOnly|parser.ParseComments)
+		if err != nil {
+			return goFileData{}, err
+		}
+	}
+
+	data.PackageName = pf.Name.Name
+	data.HeaderComments = headerComments(pf)
+	data.ImportComment = importComment(fset, pf)
+	if pf.Doc != nil {
+		data.Synopsis = doc.Synopsis(pf.Doc.Text())
+	}
+
 	for _, decl := range pf.Decls {
 		d, ok := decl.(*ast.GenDecl)
 		if !ok {
@@ -199,36 +433,157 @@ func (pr *packageReader) goFileInfo(name string) (fileInfo, error) {
 			quoted := spec.Path.Value
 			path, err := strconv.Unquote(quoted)
 			if err != nil {
-				return fileInfo{}, err
+				return goFileData{}, err
 			}
 
 			if path == "C" {
-				if info.isTest {
-					return fileInfo{}, fmt.Errorf("%s: use of cgo in test not supported", info.path)
-				}
-				info.isCgo = true
+				data.IsCgo = true
 				cg := spec.Doc
 				if cg == nil && len(d.Specs) == 1 {
 					cg = d.Doc
 				}
 				if cg != nil {
-					if err := saveCgo(&info, cg); err != nil {
-						return fileInfo{}, err
+					var cgo fileInfo
+					if err := saveCgo(&cgo, cg); err != nil {
+						return goFileData{}, err
 					}
+					data.Copts = append(data.Copts, toCgoOpts(cgo.copts)...)
+					data.Cxxopts = append(data.Cxxopts, toCgoOpts(cgo.cxxopts)...)
+					data.Clinkopts = append(data.Clinkopts, toCgoOpts(cgo.clinkopts)...)
+					data.PkgConfigs = append(data.PkgConfigs, toCgoOpts(cgo.pkgConfigs)...)
 				}
-			} else if !pr.isStandard(path) {
-				info.imports = append(info.imports, path)
+			} else {
+				data.Imports = append(data.Imports, path)
 			}
 		}
 	}
 
-	tags, err := readTags(info.path)
-	if err != nil {
-		return fileInfo{}, err
+	if data.Tags, err = readTagsData(path, src); err != nil {
+		return goFileData{}, err
+	}
+	if !complete && (data.PackageName == "main" || hasImport(data.Imports, "embed")) {
+		if src, err = c.FS.ReadFile(path); err != nil {
+			return goFileData{}, err
+		}
+		fset = token.NewFileSet()
 	}
-	info.tags = tags
+	if data.PackageName == "main" {
+		data.HasMain = hasMainFunc(fset, path, src)
+	}
+	if data.EmbedPatterns, err = readEmbedPatterns(path, src); err != nil {
+		return goFileData{}, err
+	}
+	return data, nil
+}
 
-	return info, nil
+// importsComplete returns whether "f", parsed from "src", the beginning of
+// a file, has all the file's imports: some token other than "import" must
+// follow its last import declaration in "src".
+func importsComplete(fset *token.FileSet, f *ast.File, src []byte) bool {
+	end := f.Name.End()
+	if len(f.Decls) > 0 {
+		end = f.Decls[len(f.Decls)-1].End()
+	}
+	offset := fset.Position(end).Offset
+	var s scanner.Scanner
+	s.Init(fset.AddFile("", -1, len(src)-offset), src[offset:], nil, 0)
+	for {
+		_, tok, _ := s.Scan()
+		switch tok {
+		case token.SEMICOLON:
+			continue
+		case token.EOF, token.IMPORT, token.ILLEGAL:
+			return false
+		default:
+			return true
+		}
+	}
+}
+
+func hasImport(imports []string, path string) bool {
+	for _, imp := range imports {
+		if imp == path {
+			return true
+		}
+	}
+	return false
+}
+
+// binaryOnlyComment marks files of a package distributed without source
+// code. The go command links a prebuilt archive for the package instead of
+// compiling its files, which only contain documentation.
+const binaryOnlyComment = "//go:binary-only-package"
+
+// hasBinaryOnlyComment returns whether "comments", the comments before a
+// package clause, include binaryOnlyComment on a line of its own.
+func hasBinaryOnlyComment(comments []string) bool {
+	for _, c := range comments {
+		if strings.TrimSpace(c) == binaryOnlyComment {
+			return true
+		}
+	}
+	return false
+}
+
+// importComment returns the path in an import comment on the package clause
+// of "f", like `package foo // import "example.com/foo"`, or "" if there is
+// none. Only the first comment after the package name on the same line is
+// considered. This is intended to match go/build's findImportComment.
+func importComment(fset *token.FileSet, f *ast.File) string {
+	line := fset.Position(f.Name.End()).Line
+	for _, cg := range f.Comments {
+		c := cg.List[0]
+		if c.Pos() < f.Name.End() {
+			continue
+		}
+		if fset.Position(c.Pos()).Line != line {
+			return ""
+		}
+		text := c.Text[len("//"):]
+		if strings.HasPrefix(c.Text, "/*") {
+			text = strings.TrimSuffix(text, "*/")
+		}
+		text = strings.TrimSpace(text)
+		if !strings.HasPrefix(text, "import ") && !strings.HasPrefix(text, "import\t") {
+			return ""
+		}
+		p, err := strconv.Unquote(strings.TrimSpace(text[len("import"):]))
+		if err != nil {
+			return ""
+		}
+		return p
+	}
+	return ""
+}
+
+// hasMainFunc returns whether the .go file at "path", with content "src",
+// declares a main function. The file is scanned for a top-level
+// "func main(" rather than parsed, so files with syntax errors elsewhere
+// are still recognized, like the go command does for files it can't
+// compile.
+func hasMainFunc(fset *token.FileSet, path string, src []byte) bool {
+	var s scanner.Scanner
+	s.Init(fset.AddFile(path, -1, len(src)), src, func(token.Position, string) {}, 0)
+	depth := 0
+	var prev [2]token.Token
+	var prevLit string
+	for {
+		_, tok, lit := s.Scan()
+		switch tok {
+		case token.EOF:
+			return false
+		case token.LBRACE, token.LPAREN, token.LBRACK:
+			if tok == token.LPAREN && depth == 0 && prev[0] == token.FUNC && prev[1] == token.IDENT && prevLit == "main" {
+				return true
+			}
+			depth++
+		case token.RBRACE, token.RPAREN, token.RBRACK:
+			if depth > 0 {
+				depth--
+			}
+		}
+		prev[0], prev[1], prevLit = prev[1], tok, lit
+	}
 }
 
 // saveCgo extracts CFLAGS, CPPFLAGS, CXXFLAGS, and LDFLAGS directives
@@ -278,12 +633,20 @@ func saveCgo(info *fileInfo, cg *ast.CommentGroup) error {
 
 		// Add tags to appropriate list.
 		switch verb {
-		case "CFLAGS", "CPPFLAGS", "CXXFLAGS":
+		case "CFLAGS", "CPPFLAGS":
 			info.copts = append(info.copts, taggedOpts{tags, opts})
+		case "CXXFLAGS":
+			info.cxxopts = append(info.cxxopts, taggedOpts{tags, opts})
 		case "LDFLAGS":
 			info.clinkopts = append(info.clinkopts, taggedOpts{tags, opts})
 		case "pkg-config":
-			return fmt.Errorf("%s: pkg-config not supported: %s", info.path, orig)
+			var names []string
+			for _, opt := range opts {
+				if !strings.HasPrefix(opt, "-") {
+					names = append(names, opt)
+				}
+			}
+			info.pkgConfigs = append(info.pkgConfigs, taggedOpts{tags, names})
 		default:
 			return fmt.Errorf("%s: invalid #cgo verb: %s", info.path, orig)
 		}
@@ -420,12 +783,20 @@ func (pr *packageReader) otherFileInfo(name string) (fileInfo, error) {
 	if info.category == unsupportedExt {
 		return fileInfo{}, fmt.Errorf("%s: file extension not yet supported", name)
 	}
+	if info.category == sysoExt {
+		return info, nil
+	}
 
-	if tags, err := readTags(info.path); err != nil {
+	if tags, err := pr.c.readTags(info.path); err != nil {
 		return fileInfo{}, err
 	} else {
 		info.tags = tags
 	}
+	if info.category == protoExt {
+		if err := pr.c.readProtoOptions(&info); err != nil {
+			return fileInfo{}, err
+		}
+	}
 	return info, nil
 }
 
@@ -449,25 +820,65 @@ func init() {
 // newlines and blank lines at the start of a file which is separated from the
 // rest of the file by a blank line. Each string in the returned slice is
 // the trimmed text of a line after a "+build" prefix.
+//
+// If the leading comments include a "//go:build" line, it takes precedence
+// over "+build" lines, as it does in Go 1.17 and later. Its expression is
+// returned as a single equivalent "+build" line. Unlike "+build" lines, it
+// does not need to be followed by a blank line.
+//
+// /* */ comments may appear in the block, for example, license headers in C
+// and assembly files. They are skipped; constraints inside them are ignored.
 // Based on go/build.Context.shouldBuild.
-func readTags(path string) ([]string, error) {
-	f, err := os.Open(path)
+func (c *Config) readTags(path string) ([]string, error) {
+	data, err := c.FS.ReadFile(path)
 	if err != nil {
 		return nil, err
 	}
-	defer f.Close()
-	scanner := bufio.NewScanner(f)
+	return readTagsData(path, data)
+}
+
+// readTagsData returns the build tags in "data", the content or the beginning
+// of the file at "path", like readTags.
+func readTagsData(path string, data []byte) ([]string, error) {
+	scanner := bufio.NewScanner(bytes.NewReader(data))
 
 	// Pass 1: Identify leading run of // comments and blank lines,
 	// which must be followed by a blank line.
 	var lines []string
+	var goBuild string
+	haveGoBuild := false
 	end := 0
+	inSlashStar := false
 	for scanner.Scan() {
 		line := strings.TrimSpace(scanner.Text())
+		if inSlashStar || strings.HasPrefix(line, "/*") {
+			if !inSlashStar {
+				line = line[len("/*"):]
+			}
+			i := strings.Index(line, "*/")
+			if i < 0 {
+				inSlashStar = true
+				continue
+			}
+			inSlashStar = false
+			if line = strings.TrimSpace(line[i+len("*/"):]); line == "" {
+				continue
+			}
+			if !strings.HasPrefix(line, "//") {
+				// Code follows the comment on the same line.
+				break
+			}
+		}
 		if line == "" {
 			end = len(lines)
 			continue
 		}
+		if strings.HasPrefix(line, "//go:build ") || strings.HasPrefix(line, "//go:build\t") {
+			if haveGoBuild {
+				return nil, fmt.Errorf("%s: multiple //go:build lines", path)
+			}
+			goBuild, haveGoBuild = line[len("//go:build"):], true
+		}
 		if strings.HasPrefix(line, "//") {
 			lines = append(lines, line[len("//"):])
 			continue
@@ -477,6 +888,13 @@ func readTags(path string) ([]string, error) {
 	if err := scanner.Err(); err != nil {
 		return nil, err
 	}
+	if haveGoBuild {
+		tags, err := parseGoBuild(goBuild)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		return []string{tags}, nil
+	}
 	lines = lines[:end]
 
 	// Pass 2: Process each line in the run.
@@ -519,6 +937,162 @@ func (fi *fileInfo) checkConstraints(tags map[string]bool) bool {
 	return true
 }
 
+// goVersion returns the minor version of the newest Go release the file's
+// build constraints require, for example, 9 for a file that can only be
+// built with the "go1.9" release tag. 0 is returned if no release tag is
+// required.
+func (fi *fileInfo) goVersion() int {
+	max := 0
+	for _, line := range fi.tags {
+		lineMin := -1
+		for _, group := range strings.Fields(line) {
+			groupMin := 0
+			for _, tag := range strings.Split(group, ",") {
+				if v, ok := releaseTagVersion(tag); ok && v > groupMin {
+					groupMin = v
+				}
+			}
+			if lineMin < 0 || groupMin < lineMin {
+				lineMin = groupMin
+			}
+		}
+		if lineMin > max {
+			max = lineMin
+		}
+	}
+	return max
+}
+
+// releaseTagVersion returns the minor version named by a release tag like
+// "go1.9". false is returned for other tags, including negated ones.
+func releaseTagVersion(tag string) (int, bool) {
+	if !strings.HasPrefix(tag, "go1.") {
+		return 0, false
+	}
+	v, err := strconv.Atoi(tag[len("go1."):])
+	if err != nil || v < 0 {
+		return 0, false
+	}
+	return v, true
+}
+
+// ignoreTag is the build tag conventionally used to exclude files from every
+// build, for example, programs run with "go run" by "go generate".
+const ignoreTag = "ignore"
+
+// isIgnored returns whether a file can only be built with the "ignore" tag,
+// because every group in one of its +build lines requires it. This is the
+// case for files with "+build ignore" or "//go:build ignore" comments.
+func (fi *fileInfo) isIgnored() bool {
+	for _, line := range fi.tags {
+		groups := strings.Fields(line)
+		ignored := len(groups) > 0
+		for _, group := range groups {
+			if !groupRequiresTag(group, ignoreTag) {
+				ignored = false
+				break
+			}
+		}
+		if ignored {
+			return true
+		}
+	}
+	return false
+}
+
+// groupRequiresTag returns whether "tag" is set, not negated, in a group of
+// comma-separated tags.
+func groupRequiresTag(group, tag string) bool {
+	for _, t := range strings.Split(group, ",") {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// isImpossible returns whether the constraints of a file can never be
+// satisfied, no matter which platform it is built for and which other tags
+// are set. For example, a file with the constraint "linux,windows" is
+// impossible.
+func (fi *fileInfo) isImpossible() bool {
+	if !fi.hasConstraints() {
+		return false
+	}
+	for goos := range knownOS {
+		if fi.goos != "" && fi.goos != goos {
+			continue
+		}
+		for goarch := range knownArch {
+			if fi.goarch != "" && fi.goarch != goarch {
+				continue
+			}
+			if fi.possibleOn(goos, goarch) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// possibleOn returns whether the +build lines of a file can be satisfied on
+// the platform "goos"/"goarch" for some setting of tags that don't name an
+// operating system or architecture.
+func (fi *fileInfo) possibleOn(goos, goarch string) bool {
+	for _, line := range fi.tags {
+		linePossible := false
+		for _, group := range strings.Fields(line) {
+			if groupPossibleOn(group, goos, goarch) {
+				linePossible = true
+				break
+			}
+		}
+		if !linePossible {
+			return false
+		}
+	}
+	return true
+}
+
+func groupPossibleOn(group, goos, goarch string) bool {
+	free := make(map[string]bool)
+	for _, tag := range strings.Split(group, ",") {
+		if strings.HasPrefix(tag, "!!") {
+			return false
+		}
+		want := !strings.HasPrefix(tag, "!")
+		tag = strings.TrimPrefix(tag, "!")
+		switch {
+		case knownOS[tag]:
+			if (tag == goos) != want {
+				return false
+			}
+		case knownArch[tag]:
+			if (tag == goarch) != want {
+				return false
+			}
+		default:
+			if v, ok := free[tag]; ok && v != want {
+				return false
+			}
+			free[tag] = want
+		}
+	}
+	return true
+}
+
+// constraintString describes the constraints of a file for error messages.
+func (fi *fileInfo) constraintString() string {
+	var parts []string
+	if fi.goos != "" || fi.goarch != "" {
+		parts = append(parts, fmt.Sprintf("file name suffix %q", strings.Trim(fi.goos+"_"+fi.goarch, "_")))
+	}
+	for _, line := range fi.tags {
+		parts = append(parts, fmt.Sprintf("%q", "+build "+line))
+	}
+	return strings.Join(parts, " and ")
+}
+
 // checkTags determines whether the build tags on a given line are satisfied.
 // The line should be a whitespace-separated list of groups of comma-separated
 // tags. The constraints are satisfied for the line if any of the groups are
@@ -0,0 +1,226 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package packages
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// FileSystem provides access to the files in a repository. Walk,
+// FindPackage, and the functions they call read directories and files
+// through Config.FS instead of the os package, so repositories may be read from
+// memory in tests, or overlaid with unsaved changes from an editor. Paths
+// are OS paths, like those passed to Walk.
+type FileSystem interface {
+	// ReadDir returns the entries of the directory "dir", sorted by name,
+	// like ioutil.ReadDir.
+	ReadDir(dir string) ([]os.FileInfo, error)
+
+	// ReadFile returns the contents of the file "path", like
+	// ioutil.ReadFile.
+	ReadFile(path string) ([]byte, error)
+
+	// Stat returns information about the file "path", following symbolic
+	// links, like os.Stat.
+	Stat(path string) (os.FileInfo, error)
+}
+
+// A PrefixFileSystem is a FileSystem that can read the beginning of a file
+// without reading the rest. If Config.FS implements it, only the headers of most
+// .go files are read.
+type PrefixFileSystem interface {
+	FileSystem
+
+	// ReadFilePrefix returns the first "n" bytes of the file "path", or the
+	// whole file if it is shorter.
+	ReadFilePrefix(path string, n int) ([]byte, error)
+}
+
+// readFilePrefix returns at least the first "n" bytes of the file "path",
+// or the whole file if it is shorter. The whole file may be returned if FS
+// is not a PrefixFileSystem.
+func (c *Config) readFilePrefix(path string, n int) ([]byte, error) {
+	if pfs, ok := c.FS.(PrefixFileSystem); ok {
+		return pfs.ReadFilePrefix(path, n)
+	}
+	return c.FS.ReadFile(path)
+}
+
+// OSFileSystem is a FileSystem that reads files with the os package.
+type OSFileSystem struct{}
+
+func (OSFileSystem) ReadDir(dir string) ([]os.FileInfo, error) { return ioutil.ReadDir(dir) }
+func (OSFileSystem) ReadFile(path string) ([]byte, error)      { return ioutil.ReadFile(path) }
+func (OSFileSystem) Stat(path string) (os.FileInfo, error)     { return os.Stat(path) }
+
+func (OSFileSystem) ReadFilePrefix(path string, n int) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	buf := make([]byte, n)
+	m, err := io.ReadFull(f, buf)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		err = nil
+	}
+	return buf[:m], err
+}
+
+// MapFileSystem is an in-memory FileSystem. It maps the paths of files to
+// their contents. Directories are implied by the files in them. Files have
+// no modification times, so they are not stored in Config.FileCache.
+type MapFileSystem map[string]string
+
+func (m MapFileSystem) ReadDir(dir string) ([]os.FileInfo, error) {
+	dir = filepath.Clean(dir)
+	entries := make(map[string]bool)
+	for p := range m {
+		rel, ok := childPath(dir, p)
+		if !ok {
+			continue
+		}
+		if i := strings.IndexRune(rel, filepath.Separator); i >= 0 {
+			entries[rel[:i]] = true
+		} else if !entries[rel] {
+			entries[rel] = false
+		}
+	}
+	if len(entries) == 0 {
+		return nil, &os.PathError{Op: "readdir", Path: dir, Err: os.ErrNotExist}
+	}
+	infos := make([]os.FileInfo, 0, len(entries))
+	for name, isDir := range entries {
+		info := memFileInfo{name: name, isDir: isDir}
+		if !isDir {
+			info.size = int64(len(m[filepath.Join(dir, name)]))
+		}
+		infos = append(infos, info)
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name() < infos[j].Name() })
+	return infos, nil
+}
+
+func (m MapFileSystem) ReadFile(path string) ([]byte, error) {
+	content, ok := m[filepath.Clean(path)]
+	if !ok {
+		return nil, &os.PathError{Op: "open", Path: path, Err: os.ErrNotExist}
+	}
+	return []byte(content), nil
+}
+
+func (m MapFileSystem) Stat(path string) (os.FileInfo, error) {
+	path = filepath.Clean(path)
+	if content, ok := m[path]; ok {
+		return memFileInfo{name: filepath.Base(path), size: int64(len(content))}, nil
+	}
+	for p := range m {
+		if _, ok := childPath(path, p); ok {
+			return memFileInfo{name: filepath.Base(path), isDir: true}, nil
+		}
+	}
+	return nil, &os.PathError{Op: "stat", Path: path, Err: os.ErrNotExist}
+}
+
+// childPath returns the path of "p" relative to "dir" and true if "p" is
+// inside "dir".
+func childPath(dir, p string) (string, bool) {
+	prefix := dir
+	if !strings.HasSuffix(prefix, string(filepath.Separator)) {
+		prefix += string(filepath.Separator)
+	}
+	if !strings.HasPrefix(p, prefix) {
+		return "", false
+	}
+	return p[len(prefix):], true
+}
+
+// Overlay is a FileSystem that reads files from Files, a map from paths to
+// contents, in place of the same files in Base. Files may also be new, for
+// example, unsaved editor buffers, but their directories must exist in Base.
+// Like MapFileSystem, overlaid files are not stored in Config.FileCache.
+type Overlay struct {
+	Base  FileSystem
+	Files map[string][]byte
+}
+
+func (o Overlay) ReadDir(dir string) ([]os.FileInfo, error) {
+	infos, err := o.Base.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	overlaid := make(map[string]os.FileInfo)
+	for p, content := range o.Files {
+		if filepath.Dir(filepath.Clean(p)) == filepath.Clean(dir) {
+			name := filepath.Base(p)
+			overlaid[name] = memFileInfo{name: name, size: int64(len(content))}
+		}
+	}
+	if len(overlaid) == 0 {
+		return infos, nil
+	}
+	for i, info := range infos {
+		if o, ok := overlaid[info.Name()]; ok {
+			infos[i] = o
+			delete(overlaid, info.Name())
+		}
+	}
+	for _, info := range overlaid {
+		infos = append(infos, info)
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name() < infos[j].Name() })
+	return infos, nil
+}
+
+func (o Overlay) ReadFile(path string) ([]byte, error) {
+	if content, ok := o.Files[path]; ok {
+		return content, nil
+	}
+	return o.Base.ReadFile(path)
+}
+
+func (o Overlay) Stat(path string) (os.FileInfo, error) {
+	if content, ok := o.Files[path]; ok {
+		return memFileInfo{name: filepath.Base(path), size: int64(len(content))}, nil
+	}
+	return o.Base.Stat(path)
+}
+
+// memFileInfo describes a file or directory in a MapFileSystem or Overlay.
+type memFileInfo struct {
+	name  string
+	size  int64
+	isDir bool
+}
+
+func (fi memFileInfo) Name() string       { return fi.name }
+func (fi memFileInfo) Size() int64        { return fi.size }
+func (fi memFileInfo) ModTime() time.Time { return time.Time{} }
+func (fi memFileInfo) IsDir() bool        { return fi.isDir }
+func (fi memFileInfo) Sys() interface{}   { return nil }
+
+func (fi memFileInfo) Mode() os.FileMode {
+	if fi.isDir {
+		return os.ModeDir | 0755
+	}
+	return 0644
+}
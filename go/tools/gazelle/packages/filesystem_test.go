@@ -0,0 +1,131 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package packages
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestMapFileSystem(t *testing.T) {
+	root := filepath.FromSlash("/repo")
+	fs := MapFileSystem{
+		filepath.Join(root, "b.go"):        "package b",
+		filepath.Join(root, "a", "a.go"):   "package a",
+		filepath.Join(root, "a", "x", "y"): "",
+	}
+
+	infos, err := fs.ReadDir(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, fi := range infos {
+		name := fi.Name()
+		if fi.IsDir() {
+			name += "/"
+		}
+		got = append(got, name)
+	}
+	if want := []string{"a/", "b.go"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("ReadDir: got %q; want %q", got, want)
+	}
+
+	if fi, err := fs.Stat(filepath.Join(root, "a", "x")); err != nil || !fi.IsDir() {
+		t.Errorf("Stat a/x: got %v, %v; want a directory", fi, err)
+	}
+	if fi, err := fs.Stat(filepath.Join(root, "b.go")); err != nil || fi.IsDir() || fi.Size() != int64(len("package b")) {
+		t.Errorf("Stat b.go: got %v, %v; want a file", fi, err)
+	}
+	if data, err := fs.ReadFile(filepath.Join(root, "a", "a.go")); err != nil || string(data) != "package a" {
+		t.Errorf("ReadFile a/a.go: got %q, %v; want %q", data, err, "package a")
+	}
+
+	for _, p := range []string{"missing", filepath.Join("a", "missing")} {
+		if _, err := fs.Stat(filepath.Join(root, p)); !os.IsNotExist(err) {
+			t.Errorf("Stat %s: got %v; want not exist error", p, err)
+		}
+		if _, err := fs.ReadFile(filepath.Join(root, p)); !os.IsNotExist(err) {
+			t.Errorf("ReadFile %s: got %v; want not exist error", p, err)
+		}
+	}
+}
+
+func TestReadFilePrefix(t *testing.T) {
+	dir, err := ioutil.TempDir(os.Getenv("TEST_TMPDIR"), "prefix")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "a.go")
+	if err := ioutil.WriteFile(path, []byte("package a"), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		n    int
+		want string
+	}{
+		{4, "pack"},
+		{9, "package a"},
+		{100, "package a"},
+	} {
+		if got, err := (OSFileSystem{}).ReadFilePrefix(path, tc.n); err != nil || string(got) != tc.want {
+			t.Errorf("ReadFilePrefix %d: got %q, %v; want %q", tc.n, got, err, tc.want)
+		}
+	}
+	if _, err := (OSFileSystem{}).ReadFilePrefix(filepath.Join(dir, "missing"), 4); !os.IsNotExist(err) {
+		t.Errorf("ReadFilePrefix missing: got %v; want not exist error", err)
+	}
+}
+
+func TestOverlay(t *testing.T) {
+	root := filepath.FromSlash("/repo")
+	fs := Overlay{
+		Base: MapFileSystem{
+			filepath.Join(root, "a.go"): "package a",
+			filepath.Join(root, "c.go"): "package a",
+		},
+		Files: map[string][]byte{
+			filepath.Join(root, "a.go"): []byte("package a // edited"),
+			filepath.Join(root, "b.go"): []byte("package a"),
+		},
+	}
+
+	infos, err := fs.ReadDir(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, fi := range infos {
+		names = append(names, fi.Name())
+	}
+	if want := []string{"a.go", "b.go", "c.go"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("ReadDir: got %q; want %q", names, want)
+	}
+	if infos[0].Size() != int64(len("package a // edited")) {
+		t.Errorf("ReadDir: got size %d for a.go; want size of overlaid content", infos[0].Size())
+	}
+	if data, err := fs.ReadFile(filepath.Join(root, "a.go")); err != nil || string(data) != "package a // edited" {
+		t.Errorf("ReadFile a.go: got %q, %v; want overlaid content", data, err)
+	}
+	if data, err := fs.ReadFile(filepath.Join(root, "c.go")); err != nil || string(data) != "package a" {
+		t.Errorf("ReadFile c.go: got %q, %v; want base content", data, err)
+	}
+}
@@ -0,0 +1,86 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package packages
+
+import (
+	"go/ast"
+	"regexp"
+	"strings"
+)
+
+// GeneratedFileSuffixes maps file name suffixes used by code generators to
+// classes of generated files. Classes may be named in exclude_generated
+// directives. When several suffixes match a file name, the longest one wins.
+// Programs using this package may add their own suffixes before walking.
+var GeneratedFileSuffixes = map[string]string{
+	"_gen.go":   "gen",
+	".gen.go":   "gen",
+	".pb.go":    "protobuf",
+	".pb.gw.go": "grpc_gateway",
+}
+
+// GeneratedHeaderClass is the class of .go files that have no known suffix
+// but start with a standard "// Code generated ... DO NOT EDIT." comment.
+const GeneratedHeaderClass = "generated"
+
+// allGeneratedClasses is recorded by an exclude_generated directive with no
+// arguments. It matches files of any class.
+const allGeneratedClasses = "*"
+
+// GeneratedHeaderPattern matches comments that mark .go files as
+// generated. It is matched against the text of each comment before the
+// package clause, including the comment markers. The default matches the
+// standard "// Code generated ... DO NOT EDIT." convention.
+var GeneratedHeaderPattern = regexp.MustCompile(`^// Code generated .* DO NOT EDIT\.$`)
+
+// generatedClass returns the class of a file with the given name, based on
+// GeneratedFileSuffixes, or "" if the name has no known suffix.
+func generatedClass(name string) string {
+	class, length := "", 0
+	for suffix, c := range GeneratedFileSuffixes {
+		if len(suffix) > length && strings.HasSuffix(name, suffix) {
+			class, length = c, len(suffix)
+		}
+	}
+	return class
+}
+
+// hasGeneratedHeader returns whether a comment in "comments", the text of
+// comments before the package clause of a .go file, matches
+// GeneratedHeaderPattern.
+func hasGeneratedHeader(comments []string) bool {
+	for _, c := range comments {
+		if GeneratedHeaderPattern.MatchString(c) {
+			return true
+		}
+	}
+	return false
+}
+
+// headerComments returns the text of comments before the package clause of
+// f, including the comment markers.
+func headerComments(f *ast.File) []string {
+	var comments []string
+	for _, cg := range f.Comments {
+		if cg.Pos() >= f.Package {
+			break
+		}
+		for _, c := range cg.List {
+			comments = append(comments, c.Text)
+		}
+	}
+	return comments
+}
@@ -0,0 +1,172 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package packages
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// A Manifest lists the files in a repository, with optional hashes of their
+// content. Walk lists directories from Config.Manifest when it is set. Directories are implied by the paths of the files they contain.
+type Manifest struct {
+	// hashes maps slash-separated paths of files, relative to the repository
+	// root, to hashes of their content. Hashes may be empty.
+	hashes map[string]string
+
+	// children maps slash-separated paths of directories, relative to the
+	// repository root, to the names of their entries. Names of directories
+	// map to true. The repository root is "".
+	children map[string]map[string]bool
+}
+
+// NewManifest returns a manifest with the files in "hashes", which maps
+// slash-separated paths relative to the repository root to hashes of their
+// content. Hashes may be empty.
+func NewManifest(hashes map[string]string) (*Manifest, error) {
+	m := &Manifest{
+		hashes:   make(map[string]string),
+		children: map[string]map[string]bool{"": {}},
+	}
+	for p, hash := range hashes {
+		if err := m.add(p, hash); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// ReadManifest reads a manifest with one file per line. Each line has a
+// slash-separated path relative to the repository root, optionally followed
+// by a space and a hash of the file's content. Source file labels printed by
+// "bazel query", like //foo/bar:baz.go, are accepted in place of paths.
+// Blank lines and lines starting with "#" are ignored.
+func ReadManifest(r io.Reader) (*Manifest, error) {
+	hashes := make(map[string]string)
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) > 2 {
+			return nil, fmt.Errorf("manifest line %d: want path and optional hash", line)
+		}
+		p, err := manifestPath(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("manifest line %d: %v", line, err)
+		}
+		hashes[p] = ""
+		if len(fields) == 2 {
+			hashes[p] = fields[1]
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return NewManifest(hashes)
+}
+
+// manifestPath converts a path or source file label in a manifest to a
+// clean slash-separated path.
+func manifestPath(s string) (string, error) {
+	if strings.HasPrefix(s, "//") {
+		i := strings.Index(s, ":")
+		if i < 0 {
+			return "", fmt.Errorf("label %q does not name a file", s)
+		}
+		s = path.Join(s[len("//"):i], s[i+1:])
+	} else if strings.HasPrefix(s, "@") {
+		return "", fmt.Errorf("label %q is in another repository", s)
+	}
+	p := path.Clean(s)
+	if path.IsAbs(p) || p == "." || p == ".." || strings.HasPrefix(p, "../") {
+		return "", fmt.Errorf("path %q must be inside the repository", s)
+	}
+	return p, nil
+}
+
+// add records the file "p" and the directories containing it.
+func (m *Manifest) add(p, hash string) error {
+	if _, ok := m.children[p]; ok {
+		return fmt.Errorf("manifest path %q is both a file and a directory", p)
+	}
+	m.hashes[p] = hash
+	isDir := false
+	for {
+		dir, name := path.Split(p)
+		dir = strings.TrimSuffix(dir, "/")
+		if m.children[dir] == nil {
+			m.children[dir] = make(map[string]bool)
+		}
+		if _, ok := m.hashes[path.Join(dir, name)]; ok && isDir {
+			return fmt.Errorf("manifest path %q is both a file and a directory", path.Join(dir, name))
+		}
+		m.children[dir][name] = isDir
+		if dir == "" {
+			return nil
+		}
+		p, isDir = dir, true
+	}
+}
+
+// Hash returns the hash of the content of the file "rel", a slash-separated
+// path from the repository root, and whether the file is in the manifest.
+func (m *Manifest) Hash(rel string) (string, bool) {
+	hash, ok := m.hashes[rel]
+	return hash, ok
+}
+
+// readDir returns the entries of the directory "rel", sorted by name, like
+// ioutil.ReadDir. Sizes and modification times of entries are zero.
+func (m *Manifest) readDir(rel string) ([]os.FileInfo, error) {
+	children, ok := m.children[rel]
+	if !ok {
+		return nil, &os.PathError{Op: "readdir", Path: rel, Err: os.ErrNotExist}
+	}
+	infos := make([]os.FileInfo, 0, len(children))
+	for name, isDir := range children {
+		infos = append(infos, manifestFileInfo{name: name, isDir: isDir})
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name() < infos[j].Name() })
+	return infos, nil
+}
+
+// manifestFileInfo describes a file or directory in a Manifest.
+type manifestFileInfo struct {
+	name  string
+	isDir bool
+}
+
+func (fi manifestFileInfo) Name() string       { return fi.name }
+func (fi manifestFileInfo) Size() int64        { return 0 }
+func (fi manifestFileInfo) ModTime() time.Time { return time.Time{} }
+func (fi manifestFileInfo) IsDir() bool        { return fi.isDir }
+func (fi manifestFileInfo) Sys() interface{}   { return nil }
+
+func (fi manifestFileInfo) Mode() os.FileMode {
+	if fi.isDir {
+		return os.ModeDir | 0755
+	}
+	return 0644
+}
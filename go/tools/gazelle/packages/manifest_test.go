@@ -0,0 +1,95 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package packages
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestReadManifest(t *testing.T) {
+	m, err := ReadManifest(strings.NewReader(`# comment
+a/a.go 1234
+a/b/b.go
+
+//c:c.go
+//c:data/d.txt abcd
+//:root.go
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		path, hash string
+		ok         bool
+	}{
+		{"a/a.go", "1234", true},
+		{"a/b/b.go", "", true},
+		{"c/c.go", "", true},
+		{"c/data/d.txt", "abcd", true},
+		{"root.go", "", true},
+		{"a/b", "", false},
+	} {
+		if hash, ok := m.Hash(tc.path); hash != tc.hash || ok != tc.ok {
+			t.Errorf("Hash(%q) = %q, %v; want %q, %v", tc.path, hash, ok, tc.hash, tc.ok)
+		}
+	}
+
+	for _, tc := range []struct {
+		dir  string
+		want []string
+	}{
+		{"", []string{"a/", "c/", "root.go"}},
+		{"a", []string{"a.go", "b/"}},
+		{"c/data", []string{"d.txt"}},
+	} {
+		infos, err := m.readDir(tc.dir)
+		if err != nil {
+			t.Errorf("readDir(%q): %v", tc.dir, err)
+			continue
+		}
+		var got []string
+		for _, fi := range infos {
+			name := fi.Name()
+			if fi.IsDir() {
+				name += "/"
+			}
+			got = append(got, name)
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("readDir(%q) = %q; want %q", tc.dir, got, tc.want)
+		}
+	}
+	if _, err := m.readDir("missing"); err == nil {
+		t.Error("readDir(\"missing\"): got success; want error")
+	}
+}
+
+func TestReadManifestErrors(t *testing.T) {
+	for _, content := range []string{
+		"../outside.go\n",
+		"/abs.go\n",
+		"a.go hash extra\n",
+		"//a\n",
+		"@repo//a:a.go\n",
+		"a\na/b.go\n",
+	} {
+		if _, err := ReadManifest(strings.NewReader(content)); err == nil {
+			t.Errorf("%q: got success; want error", content)
+		}
+	}
+}
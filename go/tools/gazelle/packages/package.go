@@ -18,8 +18,11 @@ package packages
 import (
 	"fmt"
 	"go/build"
+	"path"
 	"sort"
 	"strings"
+
+	"github.com/bazelbuild/rules_go/go/tools/gazelle/logging"
 )
 
 // PlatformConstraints is a map from config_setting labels (for example,
@@ -41,6 +44,62 @@ func init() {
 	}
 }
 
+// ParsePlatformConstraints builds a set of platforms from a list of
+// specifications, as given to -platforms. Each specification is either a
+// name like "linux_amd64", which refers to the config_setting of that name in
+// @io_bazel_rules_go//go/platform, or "label=os_arch", which refers to a
+// config_setting defined elsewhere, for example,
+// "//platforms:linux_arm64=linux_arm64". Names must be in
+// DefaultPlatformConstraints, since rules_go only defines config_settings for
+// those. The operating system and architecture must both be known to Go.
+func ParsePlatformConstraints(specs []string) (PlatformConstraints, error) {
+	platforms := make(PlatformConstraints)
+	for _, spec := range specs {
+		label, name := "", spec
+		if i := strings.Index(spec, "="); i >= 0 {
+			label, name = spec[:i], spec[i+1:]
+			if label == "" {
+				return nil, fmt.Errorf("invalid platform %q: empty label", spec)
+			}
+		} else {
+			label = "@io_bazel_rules_go//go/platform:" + name
+			if _, ok := DefaultPlatformConstraints[label]; !ok {
+				return nil, fmt.Errorf("invalid platform %q: @io_bazel_rules_go//go/platform has no config_setting for it; use label=%s with a config_setting defined elsewhere", spec, spec)
+			}
+		}
+		os, arch, ok := SplitPlatform(name)
+		if !ok || os == "" || arch == "" {
+			return nil, fmt.Errorf("invalid platform %q: want os_arch with a known operating system and architecture", spec)
+		}
+		if _, ok := platforms[label]; ok {
+			return nil, fmt.Errorf("platform %s listed more than once", label)
+		}
+		platforms[label] = map[string]bool{os: true, arch: true}
+	}
+	if len(platforms) == 0 {
+		return nil, fmt.Errorf("no platforms listed")
+	}
+	return platforms, nil
+}
+
+// SplitPlatform splits the name of a platform config_setting (for example,
+// "linux_amd64", "linux", or "amd64") into an operating system and an
+// architecture. Either may be empty. ok is false if the name does not
+// describe a known platform.
+func SplitPlatform(name string) (os, arch string, ok bool) {
+	if i := strings.Index(name, "_"); i >= 0 {
+		os, arch = name[:i], name[i+1:]
+		return os, arch, knownOS[os] && knownArch[arch]
+	}
+	if knownOS[name] {
+		return name, "", true
+	}
+	if knownArch[name] {
+		return "", name, true
+	}
+	return "", "", false
+}
+
 // PreprocessTags performs some automatic processing on generic and
 // platform-specific tags before they are used to match files.
 func PreprocessTags(genericTags map[string]bool, platforms PlatformConstraints) {
@@ -67,12 +126,129 @@ type Package struct {
 
 	Protos  []string
 	HasPbGo bool
+
+	// CgoFiles lists the non-test .go files in the package that import "C"
+	// and are built on some platform, sorted by name. These are the sources
+	// of CgoLibrary. C, C++, assembly, and header files are only built with
+	// cgo if this is not empty.
+	CgoFiles []string
+
+	// BinaryOnly is true if a non-test .go file in the package has a
+	// "//go:binary-only-package" comment. Such packages are distributed as
+	// prebuilt archives, and their sources can't be compiled.
+	BinaryOnly bool
+
+	// Swig lists SWIG interface files (.swig and .swigcxx) in the package.
+	// Go rules can't build them yet; see RequiresSwig.
+	Swig []string
+
+	// ToolSrcs lists .go files excluded from every build by "+build ignore"
+	// comments. These are usually programs run by "go generate". They are
+	// not added to any target. A directory whose only .go files are these
+	// is reported as a package with no other sources.
+	ToolSrcs []string
+
+	// HasMain is true if a non-test .go file in the package declares a main
+	// function. Only packages named "main" are checked. A go_binary is only
+	// generated for commands that have one.
+	HasMain bool
+
+	// ProtoPackage is the package declared in the .proto files in Protos,
+	// and ProtoGoPackage is the value of their go_package option, for
+	// example, "example.com/repo/foo;foo_go". Both are empty if the files
+	// don't declare them. All files must declare the same package. If they
+	// disagree on go_package, the first one is used.
+	ProtoPackage, ProtoGoPackage string
+
+	// Vendored is true if the package is in a vendor directory. ImportPath is
+	// the import path of a vendored package, which is its path relative to
+	// the innermost vendor directory. ImportPath is empty for other packages,
+	// since their import paths are derived from the go_prefix, except for
+	// packages under a prefix directive (see PrefixRoot).
+	Vendored   bool
+	ImportPath string
+
+	// PrefixRoot is set for packages in a directory or subdirectory of a
+	// build file with a "# gazelle:prefix" directive. It names that
+	// directory and prefix. ImportPath is set to the package's import path
+	// under the prefix. Vendored packages are not affected.
+	PrefixRoot *ModuleRoot
+
+	// ImportComment is the path in import comments on package clauses, like
+	// `package foo // import "example.com/foo"`, in the package's files. It
+	// is empty if there are none. If files disagree, the first comment is
+	// used.
+	ImportComment string
+
+	// Synopsis is the first sentence of the package doc comment. It is
+	// taken from doc.go if that file has one, otherwise from the first
+	// non-test .go file that does.
+	Synopsis string
+
+	// GoVersion is the minimum Go version the package requires, like "1.18".
+	// It is the newer of the version in the go directive of the go.mod file
+	// of the module containing the package and the newest release tag, like
+	// "go1.18", that the build constraints of every non-test .go file
+	// require. It is empty if neither requires a version. Language features
+	// used in the files are not detected.
+	GoVersion string
+
+	// Testdata lists the files in the package's testdata directory and its
+	// subdirectories, as sorted slash-separated paths relative to the package
+	// directory, like "testdata/golden.txt". Walk doesn't visit testdata
+	// directories, so these files are only reachable as data of tests.
+	// Subdirectories with their own build files are skipped, since their
+	// files belong to other Bazel packages. It is nil if the package has no
+	// tests, or if there is no testdata directory or it has no files.
+	Testdata []string
+
+	// Extra is true for packages reported by Walk in addition to the package
+	// matching their directory name, when EmitAllPackages is set. Rules for
+	// these packages are named after the package instead of using the
+	// default names.
+	Extra bool
+
+	// TestSuites maps tags in Config.TestSuiteTags to the tests that are only built
+	// when that tag is set. It is nil if there are no such tests.
+	TestSuites map[string]*TestSuite
+
+	// BuildTags is a sorted list of tags named in build constraints of files
+	// in the package. These are the tags that may affect which files are
+	// selected for each target. Negated tags are listed without the "!".
+	BuildTags []string
+
+	// SrcsStyle is the style of srcs attributes in rules generated for the
+	// package: SrcsStyleList, SrcsStyleGlob, or "" if no style was set.
+	SrcsStyle string
+}
+
+// TestSuite contains internal and external tests that are only built when
+// a tag in Config.TestSuiteTags is set.
+type TestSuite struct {
+	Test, XTest Target
 }
 
 // Target contains metadata about a buildable Go target in a package.
 type Target struct {
 	Sources, Imports PlatformStrings
 	COpts, CLinkOpts PlatformStrings
+
+	// CxxOpts lists flags from "#cgo CXXFLAGS" directives, which only apply
+	// to C++ sources. COpts has flags from CFLAGS and CPPFLAGS directives.
+	CxxOpts PlatformStrings
+
+	// PkgConfigs lists packages named in "#cgo pkg-config" directives.
+	PkgConfigs PlatformStrings
+
+	// EmbedSrcs lists files matched by //go:embed directives, as
+	// slash-separated paths relative to the package directory.
+	EmbedSrcs PlatformStrings
+
+	// EmbedDirs lists directories matched by //go:embed directives that
+	// contain build files of their own, so their files belong to other Bazel
+	// packages. Paths are slash-separated and relative to the package
+	// directory.
+	EmbedDirs PlatformStrings
 }
 
 // PlatformStrings contains a set of strings associated with a buildable
@@ -87,16 +263,44 @@ type PlatformStrings struct {
 	Platform map[string][]string
 }
 
-// IsCommand returns true if the package name is "main".
+// IsCommand returns true if the package name is "main". See also HasMain.
 func (p *Package) IsCommand() bool {
 	return p.Name == "main"
 }
 
+// IsTestOnly returns true if the package has tests but no library or
+// binary sources, for example, a directory containing only _test.go files.
+// Rules generated for these packages have go_test rules without a library.
+func (p *Package) IsTestOnly() bool {
+	return p.HasGo() && !p.Library.HasGo() && !p.CgoLibrary.HasGo() && !p.Binary.HasGo()
+}
+
+// RequiresSwig returns true if the package has SWIG interface files. The go
+// tool builds these packages with SWIG and cgo, which Go rules don't support
+// yet, so the files are only preserved in a filegroup.
+func (p *Package) RequiresSwig() bool {
+	return len(p.Swig) > 0
+}
+
 // HasGo returns true if at least one target in the package contains a
 // .go source file. If a package does not contain Go code, Gazelle will
 // not generate rules for it.
 func (p *Package) HasGo() bool {
-	return p.Library.HasGo() || p.CgoLibrary.HasGo() || p.Binary.HasGo() || p.Test.HasGo() || p.XTest.HasGo()
+	return p.firstGoFile() != ""
+}
+
+// hasTests returns true if the package has _test.go files in its tests or
+// test suites.
+func (p *Package) hasTests() bool {
+	if p.Test.HasGo() || p.XTest.HasGo() {
+		return true
+	}
+	for _, s := range p.TestSuites {
+		if s.Test.HasGo() || s.XTest.HasGo() {
+			return true
+		}
+	}
+	return false
 }
 
 // firstGoFile returns the name of a .go file if the package contains at least
@@ -114,13 +318,107 @@ func (p *Package) firstGoFile() string {
 	if f := p.Test.firstGoFile(); f != "" {
 		return f
 	}
-	return p.XTest.firstGoFile()
+	if f := p.XTest.firstGoFile(); f != "" {
+		return f
+	}
+	for _, s := range p.TestSuites {
+		if f := s.Test.firstGoFile(); f != "" {
+			return f
+		}
+		if f := s.XTest.firstGoFile(); f != "" {
+			return f
+		}
+	}
+	return ""
+}
+
+// goFileCount returns the number of distinct .go files in the package's
+// targets on any platform.
+func (p *Package) goFileCount() int {
+	files := make(map[string]bool)
+	for _, t := range []*Target{&p.Library, &p.CgoLibrary, &p.Binary, &p.Test, &p.XTest} {
+		for _, f := range t.Sources.Generic {
+			files[f] = true
+		}
+		for _, ss := range t.Sources.Platform {
+			for _, f := range ss {
+				files[f] = true
+			}
+		}
+	}
+	n := 0
+	for f := range files {
+		if strings.HasSuffix(f, ".go") {
+			n++
+		}
+	}
+	return n
+}
+
+// Imports returns the imports of the library, cgo library, and binary in
+// the package. Imports needed on every platform are in Generic; imports
+// only needed on some platforms, because only files built on those platforms
+// import them, are in Platform. Test imports are not included.
+func (p *Package) Imports() PlatformStrings {
+	var imports PlatformStrings
+	for _, t := range []*Target{&p.Library, &p.CgoLibrary, &p.Binary} {
+		imports.addGenericStrings(t.Imports.Generic...)
+		for name, ss := range t.Imports.Platform {
+			imports.addPlatformStrings(name, ss...)
+		}
+	}
+	imports.Clean()
+	return imports
 }
 
 func (t *Target) HasGo() bool {
 	return t.Sources.HasGo()
 }
 
+// HasCxx returns whether the target has C++ sources on any platform. These
+// need a C++ toolchain and the flags in CxxOpts.
+func (t *Target) HasCxx() bool {
+	for _, f := range t.Sources.Generic {
+		if isCxxFile(f) {
+			return true
+		}
+	}
+	for _, fs := range t.Sources.Platform {
+		for _, f := range fs {
+			if isCxxFile(f) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// CgoOpts returns the flags for compiling the target's C and C++ sources
+// with a single list of options: COpts, followed by CxxOpts if the target
+// has C++ sources. Neither is modified.
+func (t *Target) CgoOpts() PlatformStrings {
+	if !t.HasCxx() || t.CxxOpts.IsEmpty() {
+		return t.COpts
+	}
+	var opts PlatformStrings
+	opts.addGenericStrings(t.COpts.Generic...)
+	opts.addGenericStrings(t.CxxOpts.Generic...)
+	for _, ps := range []PlatformStrings{t.COpts, t.CxxOpts} {
+		for name, ss := range ps.Platform {
+			opts.addPlatformStrings(name, ss...)
+		}
+	}
+	return opts
+}
+
+func isCxxFile(name string) bool {
+	switch path.Ext(name) {
+	case ".cc", ".cpp", ".cxx":
+		return true
+	}
+	return false
+}
+
 func (t *Target) firstGoFile() string {
 	return t.Sources.firstGoFile()
 }
@@ -160,49 +458,205 @@ func (ts *PlatformStrings) firstGoFile() string {
 // addFile adds the file described by "info" to a target in the package "p" if
 // the file is buildable.
 //
-// "cgo" tells whether a ".go" file in the package contains cgo code. This
-// affects whether C files are added to targets.
+// "cgo" tells whether a ".go" file in the package imports "C", that is,
+// whether CgoFiles is not empty. This affects whether C files are added to
+// targets. .go files that import "C" are recorded in CgoFiles.
 // "buildTags" is a set of tags that are true on all platforms.
 // "platforms" is a map from platform names (labels referencing config_settings)
 // to sets of tags that are true on those platforms. The tag sets may include
 // "buildTags".
+// "testSuiteTags" is a set of tags that select suites of tests, as in
+// Config.TestSuiteTags.
 //
 // An error is returned if a file is buildable but invalid (for example, a
 // test .go file containing cgo code). Files that are not buildable will not
-// be added to any target (for example, .txt files).
-func (p *Package) addFile(info fileInfo, cgo bool, buildTags map[string]bool, platforms PlatformConstraints) error {
+// be added to any target (for example, .txt files). A file whose import
+// comment disagrees with the one in files added earlier is still added,
+// with a warning; the first import comment is kept.
+func (p *Package) addFile(info fileInfo, cgo bool, buildTags map[string]bool, platforms PlatformConstraints, testSuiteTags map[string]bool) error {
+	if info.importComment != "" && !info.isXTest {
+		if p.ImportComment == "" {
+			p.ImportComment = info.importComment
+		} else if info.importComment != p.ImportComment {
+			logging.Warnf(logging.At{File: info.path}, "%s: import comment %q does not match %q in other files", info.path, info.importComment, p.ImportComment)
+		}
+	}
+
 	switch {
-	case info.isXTest:
-		if info.isCgo {
-			return fmt.Errorf("%s: use of cgo in test not supported", info.path)
+	case (info.isTest || info.isXTest) && info.isCgo:
+		return fmt.Errorf("%s: use of cgo in test not supported", info.path)
+	case info.isTest || info.isXTest:
+		test, xtest := &p.Test, &p.XTest
+		if tag := testSuiteTag(info, testSuiteTags, buildTags, platforms); tag != "" {
+			if p.TestSuites == nil {
+				p.TestSuites = make(map[string]*TestSuite)
+			}
+			if p.TestSuites[tag] == nil {
+				p.TestSuites[tag] = &TestSuite{}
+			}
+			test, xtest = &p.TestSuites[tag].Test, &p.TestSuites[tag].XTest
+			buildTags, platforms = withTag(buildTags, platforms, tag)
 		}
-		p.XTest.addFile(info, buildTags, platforms)
-	case info.isTest:
-		if info.isCgo {
-			return fmt.Errorf("%s: use of cgo in test not supported", info.path)
+		if info.isXTest {
+			xtest.addFile(info, buildTags, platforms)
+		} else {
+			test.addFile(info, buildTags, platforms)
+		}
+	case info.isCgo:
+		p.CgoLibrary.addFile(info, buildTags, platforms)
+		if isBuildable(info, buildTags, platforms) {
+			p.CgoFiles = append(p.CgoFiles, info.name)
 		}
-		p.Test.addFile(info, buildTags, platforms)
-	case info.isCgo || cgo && (info.category == cExt || info.category == hExt || info.category == csExt):
+	case cgo && (info.category == cExt || info.category == cxxExt || info.category == objcExt || info.category == hExt || info.category == csExt):
 		p.CgoLibrary.addFile(info, buildTags, platforms)
-	case info.category == goExt || info.category == sExt || info.category == hExt:
+	case info.category == goExt || info.category == sExt || info.category == hExt || info.category == sysoExt:
 		p.Library.addFile(info, buildTags, platforms)
 	case info.category == protoExt:
+		if err := p.addProtoOptions(info); err != nil {
+			return err
+		}
 		p.Protos = append(p.Protos, info.name)
+	case info.category == swigExt:
+		if isBuildable(info, buildTags, platforms) {
+			p.Swig = append(p.Swig, info.name)
+		}
 	}
 
 	if strings.HasSuffix(info.name, ".pb.go") {
 		p.HasPbGo = true
 	}
+	if info.hasMain && !info.isTest {
+		p.HasMain = true
+	}
+	if info.binaryOnly && !info.isTest {
+		p.BinaryOnly = true
+	}
+	if info.synopsis != "" && !info.isTest && (p.Synopsis == "" || info.name == "doc.go") {
+		p.Synopsis = info.synopsis
+	}
+	p.addBuildTags(info.tags)
 
 	return nil
 }
 
+// isBuildable returns whether the file described by "info" is built with
+// "buildTags" or on any platform in "platforms".
+func isBuildable(info fileInfo, buildTags map[string]bool, platforms PlatformConstraints) bool {
+	if !info.hasConstraints() || info.checkConstraints(buildTags) {
+		return true
+	}
+	for _, tags := range platforms {
+		if info.checkConstraints(tags) {
+			return true
+		}
+	}
+	return false
+}
+
+// addProtoOptions sets ProtoPackage and ProtoGoPackage from the .proto file
+// described by "info". An error is returned if ProtoPackage was set to a
+// different value by a file added earlier. A different go_package is only
+// reported with a warning; the file is still added, and the first
+// go_package is kept.
+func (p *Package) addProtoOptions(info fileInfo) error {
+	if len(p.Protos) == 0 {
+		p.ProtoPackage, p.ProtoGoPackage = info.protoPackage, info.goPackage
+		return nil
+	}
+	if info.protoPackage != p.ProtoPackage {
+		return fmt.Errorf("%s: proto package %q does not match %q declared in other files", info.path, info.protoPackage, p.ProtoPackage)
+	}
+	if info.goPackage != p.ProtoGoPackage {
+		logging.Warnf(logging.At{File: info.path}, "%s: go_package %q does not match %q declared in other files", info.path, info.goPackage, p.ProtoGoPackage)
+	}
+	return nil
+}
+
+// addBuildTags adds tags named in the build constraint lines "lines" to
+// p.BuildTags, keeping the list sorted and free of duplicates.
+func (p *Package) addBuildTags(lines []string) {
+	for _, line := range lines {
+		for _, group := range strings.Fields(line) {
+			for _, tag := range strings.Split(group, ",") {
+				tag = strings.TrimLeft(tag, "!")
+				if tag == "" {
+					continue
+				}
+				i := sort.SearchStrings(p.BuildTags, tag)
+				if i < len(p.BuildTags) && p.BuildTags[i] == tag {
+					continue
+				}
+				p.BuildTags = append(p.BuildTags, "")
+				copy(p.BuildTags[i+1:], p.BuildTags[i:])
+				p.BuildTags[i] = tag
+			}
+		}
+	}
+}
+
+// testSuiteTag returns the tag in "testSuiteTags" that must be set for the
+// test file described by "info" to be built, or "" if the file is built
+// without any of those tags. If several tags would work, the first in sorted
+// order is returned.
+func testSuiteTag(info fileInfo, testSuiteTags, buildTags map[string]bool, platforms PlatformConstraints) string {
+	if len(testSuiteTags) == 0 || !info.hasConstraints() {
+		return ""
+	}
+	if info.checkConstraints(buildTags) {
+		return ""
+	}
+	for _, tags := range platforms {
+		if info.checkConstraints(tags) {
+			return ""
+		}
+	}
+
+	var suites []string
+	for tag := range testSuiteTags {
+		suites = append(suites, tag)
+	}
+	sort.Strings(suites)
+	for _, tag := range suites {
+		tagged, taggedPlatforms := withTag(buildTags, platforms, tag)
+		if info.checkConstraints(tagged) {
+			return tag
+		}
+		for _, tags := range taggedPlatforms {
+			if info.checkConstraints(tags) {
+				return tag
+			}
+		}
+	}
+	return ""
+}
+
+// withTag returns copies of "buildTags" and "platforms" with "tag" added to
+// each set of tags.
+func withTag(buildTags map[string]bool, platforms PlatformConstraints, tag string) (map[string]bool, PlatformConstraints) {
+	addTag := func(tags map[string]bool) map[string]bool {
+		tagged := map[string]bool{tag: true}
+		for t := range tags {
+			tagged[t] = true
+		}
+		return tagged
+	}
+	taggedPlatforms := make(PlatformConstraints)
+	for name, tags := range platforms {
+		taggedPlatforms[name] = addTag(tags)
+	}
+	return addTag(buildTags), taggedPlatforms
+}
+
 func (t *Target) addFile(info fileInfo, buildTags map[string]bool, platforms PlatformConstraints) {
 	if !info.hasConstraints() || info.checkConstraints(buildTags) {
 		t.Sources.addGenericStrings(info.name)
 		t.Imports.addGenericStrings(info.imports...)
 		t.COpts.addGenericOpts(platforms, info.copts)
+		t.CxxOpts.addGenericOpts(platforms, info.cxxopts)
 		t.CLinkOpts.addGenericOpts(platforms, info.clinkopts)
+		t.PkgConfigs.addGenericOpts(platforms, info.pkgConfigs)
+		t.EmbedSrcs.addGenericStrings(info.embedSrcs...)
+		t.EmbedDirs.addGenericStrings(info.embedDirs...)
 		return
 	}
 
@@ -211,7 +665,11 @@ func (t *Target) addFile(info fileInfo, buildTags map[string]bool, platforms Pla
 			t.Sources.addPlatformStrings(name, info.name)
 			t.Imports.addPlatformStrings(name, info.imports...)
 			t.COpts.addTaggedOpts(name, info.copts, tags)
+			t.CxxOpts.addTaggedOpts(name, info.cxxopts, tags)
 			t.CLinkOpts.addTaggedOpts(name, info.clinkopts, tags)
+			t.PkgConfigs.addTaggedOpts(name, info.pkgConfigs, tags)
+			t.EmbedSrcs.addPlatformStrings(name, info.embedSrcs...)
+			t.EmbedDirs.addPlatformStrings(name, info.embedDirs...)
 		}
 	}
 }
@@ -256,6 +714,14 @@ func (ps *PlatformStrings) addTaggedOpts(name string, opts []taggedOpts, tags ma
 	}
 }
 
+// ForPlatform returns the generic strings followed by the strings specific
+// to the platform "name".
+func (ps *PlatformStrings) ForPlatform(name string) []string {
+	var ss []string
+	ss = append(ss, ps.Generic...)
+	return append(ss, ps.Platform[name]...)
+}
+
 // Clean sorts and de-duplicates PlatformStrings. It also removes any
 // strings from platform-specific lists that also appear in the generic list.
 // This is useful for imports.
@@ -64,6 +64,34 @@ func TestCleanPlatformStrings(t *testing.T) {
 	}
 }
 
+func TestParsePlatformConstraints(t *testing.T) {
+	got, err := ParsePlatformConstraints([]string{"linux_amd64", "//platforms:darwin_arm64=darwin_arm64"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := PlatformConstraints{
+		"@io_bazel_rules_go//go/platform:linux_amd64": {"linux": true, "amd64": true},
+		"//platforms:darwin_arm64":                    {"darwin": true, "arm64": true},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v; want %v", got, want)
+	}
+
+	for _, specs := range [][]string{
+		nil,
+		{"linux"},
+		{"linux_foo"},
+		{"darwin_arm64"},
+		{"//platforms:js_wasm=js_wasm"},
+		{"=linux_amd64"},
+		{"linux_amd64", "linux_amd64"},
+	} {
+		if _, err := ParsePlatformConstraints(specs); err == nil {
+			t.Errorf("%q: got success; want error", specs)
+		}
+	}
+}
+
 func TestMapPlatformStrings(t *testing.T) {
 	f := func(s string) (string, error) {
 		if len(s) > 0 && s[0] == 'e' {
@@ -97,3 +125,86 @@ func TestMapPlatformStrings(t *testing.T) {
 		t.Errorf("got errors %#v; want errors %#v", gotErrors, wantErrors)
 	}
 }
+
+func TestPackageImports(t *testing.T) {
+	pkg := Package{
+		Library: Target{
+			Imports: PlatformStrings{
+				Generic: []string{"fmt", "example.com/a"},
+				Platform: map[string][]string{
+					"linux_amd64":   []string{"example.com/unix"},
+					"windows_amd64": []string{"example.com/windows"},
+				},
+			},
+		},
+		CgoLibrary: Target{
+			Imports: PlatformStrings{
+				Platform: map[string][]string{
+					"linux_amd64": []string{"example.com/a", "example.com/cgo"},
+				},
+			},
+		},
+		Test: Target{
+			Imports: PlatformStrings{
+				Generic: []string{"testing"},
+			},
+		},
+	}
+	got := pkg.Imports()
+	want := PlatformStrings{
+		Generic: []string{"example.com/a", "fmt"},
+		Platform: map[string][]string{
+			"linux_amd64":   []string{"example.com/cgo", "example.com/unix"},
+			"windows_amd64": []string{"example.com/windows"},
+		},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %#v; want %#v", got, want)
+	}
+
+	if got, want := got.ForPlatform("linux_amd64"), []string{"example.com/a", "fmt", "example.com/cgo", "example.com/unix"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("ForPlatform: got %#v; want %#v", got, want)
+	}
+	if got, want := got.ForPlatform("darwin_amd64"), []string{"example.com/a", "fmt"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("ForPlatform: got %#v; want %#v", got, want)
+	}
+}
+
+func TestTargetCgoOpts(t *testing.T) {
+	copts := PlatformStrings{
+		Generic:  []string{"-DC"},
+		Platform: map[string][]string{"linux": {"-DLINUX"}},
+	}
+	cxxopts := PlatformStrings{
+		Generic:  []string{"-std=c++11"},
+		Platform: map[string][]string{"darwin": {"-stdlib=libc++"}},
+	}
+	for _, tc := range []struct {
+		desc    string
+		sources PlatformStrings
+		wantCxx bool
+		want    PlatformStrings
+	}{
+		{
+			desc:    "c only",
+			sources: PlatformStrings{Generic: []string{"cgo.go", "foo.c"}},
+			want:    copts,
+		}, {
+			desc:    "c++",
+			sources: PlatformStrings{Generic: []string{"cgo.go", "foo.c"}, Platform: map[string][]string{"darwin": {"bar.cc"}}},
+			wantCxx: true,
+			want: PlatformStrings{
+				Generic:  []string{"-DC", "-std=c++11"},
+				Platform: map[string][]string{"linux": {"-DLINUX"}, "darwin": {"-stdlib=libc++"}},
+			},
+		},
+	} {
+		target := Target{Sources: tc.sources, COpts: copts, CxxOpts: cxxopts}
+		if got := target.HasCxx(); got != tc.wantCxx {
+			t.Errorf("%s: got HasCxx %v; want %v", tc.desc, got, tc.wantCxx)
+		}
+		if got := target.CgoOpts(); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: got %#v; want %#v", tc.desc, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,67 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package packages
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var (
+	protoCommentRegexp   = regexp.MustCompile(`(?s)//[^\n]*|/\*.*?\*/`)
+	protoPackageRegexp   = regexp.MustCompile(`(?m)^\s*package\s+([\w.]+)\s*;`)
+	protoGoPackageRegexp = regexp.MustCompile(`(?m)^\s*option\s+go_package\s*=\s*("(?:[^"\\\n]|\\.)*"|'(?:[^'\\\n]|\\.)*')\s*;`)
+)
+
+// readProtoOptions reads the .proto file described by "info" and sets its
+// protoPackage and goPackage fields from the package statement and the
+// go_package option. The file is not fully parsed; comments are removed and
+// the statements are matched at the start of lines.
+func (c *Config) readProtoOptions(info *fileInfo) error {
+	data, err := c.FS.ReadFile(info.path)
+	if err != nil {
+		return err
+	}
+	content := protoCommentRegexp.ReplaceAll(data, nil)
+
+	if m := protoPackageRegexp.FindAllSubmatch(content, -1); len(m) > 1 {
+		return fmt.Errorf("%s: multiple package statements", info.path)
+	} else if len(m) == 1 {
+		info.protoPackage = string(m[0][1])
+	}
+
+	if m := protoGoPackageRegexp.FindAllSubmatch(content, -1); len(m) > 1 {
+		return fmt.Errorf("%s: multiple go_package options", info.path)
+	} else if len(m) == 1 {
+		goPackage, err := unquoteProtoString(string(m[0][1]))
+		if err != nil {
+			return fmt.Errorf("%s: invalid go_package option %s: %v", info.path, m[0][1], err)
+		}
+		info.goPackage = goPackage
+	}
+	return nil
+}
+
+// unquoteProtoString returns the value of a string literal in a .proto file,
+// which may be quoted with either double or single quotes.
+func unquoteProtoString(s string) (string, error) {
+	if strings.HasPrefix(s, "'") {
+		s = `"` + strings.Replace(strings.Replace(s[1:len(s)-1], `\'`, `'`, -1), `"`, `\"`, -1) + `"`
+	}
+	return strconv.Unquote(s)
+}
@@ -0,0 +1,48 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package packages
+
+import "strings"
+
+// RelocatedImports maps import path prefixes of deprecated or relocated
+// repositories to the prefixes that replace them. A warning is logged for
+// each source file that imports a package under an old prefix. Entries may
+// be added with gazelle's -relocated_imports flag.
+var RelocatedImports = map[string]string{
+	"github.com/Sirupsen/logrus":  "github.com/sirupsen/logrus",
+	"gopkg.in/fsnotify.v1":        "github.com/fsnotify/fsnotify",
+	"code.google.com/p/go.net":    "golang.org/x/net",
+	"code.google.com/p/go.crypto": "golang.org/x/crypto",
+}
+
+// RelocatedImport returns the import path that replaces "importpath" if it
+// is in a relocated repository listed in RelocatedImports. The longest
+// matching prefix is used. false is returned if "importpath" has not moved.
+func RelocatedImport(importpath string) (string, bool) {
+	var oldPrefix string
+	for old := range RelocatedImports {
+		if importpath != old && !strings.HasPrefix(importpath, old+"/") {
+			continue
+		}
+		if len(old) > len(oldPrefix) {
+			oldPrefix = old
+		}
+	}
+	if oldPrefix == "" {
+		return "", false
+	}
+	return RelocatedImports[oldPrefix] + importpath[len(oldPrefix):], true
+}
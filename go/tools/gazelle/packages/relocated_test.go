@@ -0,0 +1,41 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package packages
+
+import "testing"
+
+func TestRelocatedImport(t *testing.T) {
+	defer func(old map[string]string) { RelocatedImports = old }(RelocatedImports)
+	RelocatedImports = map[string]string{
+		"example.com/old":     "example.com/new",
+		"example.com/old/sub": "example.com/sub",
+	}
+	for _, tc := range []struct {
+		importpath, want string
+		ok               bool
+	}{
+		{importpath: "example.com/old", want: "example.com/new", ok: true},
+		{importpath: "example.com/old/pkg", want: "example.com/new/pkg", ok: true},
+		{importpath: "example.com/old/sub/pkg", want: "example.com/sub/pkg", ok: true},
+		{importpath: "example.com/older"},
+		{importpath: "example.com/new"},
+	} {
+		got, ok := RelocatedImport(tc.importpath)
+		if got != tc.want || ok != tc.ok {
+			t.Errorf("RelocatedImport(%q) = %q, %v; want %q, %v", tc.importpath, got, ok, tc.want, tc.ok)
+		}
+	}
+}
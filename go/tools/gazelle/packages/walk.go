@@ -16,52 +16,725 @@ limitations under the License.
 package packages
 
 import (
+	"fmt"
 	"go/build"
-	"io/ioutil"
-	"log"
 	"os"
 	"path"
 	"path/filepath"
+	"sort"
 	"strings"
+
+	"github.com/bazelbuild/rules_go/go/tools/gazelle/logging"
 )
 
 // A WalkFunc is a callback called by Walk for each package.
 type WalkFunc func(pkg *Package)
 
+// A WalkErrFunc is a callback called by WalkWithErrors for each directory
+// where errors occurred.
+type WalkErrFunc func(err *DirError)
+
+// DirError describes errors that occurred while reading a directory, for
+// example, files that could not be parsed or conflicting package names.
+// Packages in the directory may still be reported if the errors were not
+// fatal.
+type DirError struct {
+	// Dir is the path of the directory.
+	Dir string
+
+	// Errs lists the errors in the order they occurred.
+	Errs []error
+}
+
+func (e *DirError) Error() string {
+	msgs := make([]string, len(e.Errs))
+	for i, err := range e.Errs {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "\n")
+}
+
+// ExcludedError is reported in a DirError for a directory with .go files
+// that are all excluded by build constraints, with the build tags and on
+// every platform Walk was called with. No package is reported for the
+// directory, so no rules are generated for it.
+type ExcludedError struct {
+	// Dir is the path of the directory.
+	Dir string
+
+	// Files lists the names of the excluded .go files.
+	Files []string
+
+	// Tags lists the tags named in build constraints of the files, without
+	// negations. Setting some of them may make the files buildable.
+	Tags []string
+}
+
+func (e *ExcludedError) Error() string {
+	msg := fmt.Sprintf("%s: build constraints exclude all Go files on all platforms", e.Dir)
+	if len(e.Tags) > 0 {
+		msg += fmt.Sprintf(" (tags: %s)", strings.Join(e.Tags, ", "))
+	}
+	return msg
+}
+
+// CaseCollisionError is reported in a DirError for a directory with
+// entries whose names differ only in case, like "Foo.go" and "foo.go". Only
+// one of them can exist on a case-insensitive file system, so builds there
+// fail in confusing ways. Rules are still generated for the directory.
+type CaseCollisionError struct {
+	// Dir is the path of the directory.
+	Dir string
+
+	// Names lists the colliding entries, sorted.
+	Names []string
+}
+
+func (e *CaseCollisionError) Error() string {
+	return fmt.Sprintf("%s: names differ only in case and collide on case-insensitive file systems: %s", e.Dir, strings.Join(e.Names, ", "))
+}
+
+// PackageNameError is reported in a DirError for a directory with .go files
+// in several packages when none of them can be selected: no package is
+// named after the directory or in a "# gazelle:package_name" directive, and
+// Config.ChoosePackage is nil or returns nil. No package is reported for the
+// directory unless Config.EmitAllPackages is set.
+type PackageNameError struct {
+	// Dir is the path of the directory.
+	Dir string
+
+	// Packages lists the candidate packages with .go files, sorted by name.
+	Packages []*Package
+}
+
+func (e *PackageNameError) Error() string {
+	descs := make([]string, len(e.Packages))
+	for i, pkg := range e.Packages {
+		descs[i] = fmt.Sprintf("%s (%s)", pkg.Name, pkg.firstGoFile())
+	}
+	return fmt.Sprintf("%s: found packages %s; none matches the directory name", e.Dir, strings.Join(descs, ", "))
+}
+
+// ChooseLargestPackage is a function for Config.ChoosePackage that selects the
+// candidate with the most .go files. Ties are broken by package name.
+func ChooseLargestPackage(err *PackageNameError) *Package {
+	var largest *Package
+	max := 0
+	for _, pkg := range err.Packages {
+		if n := pkg.goFileCount(); largest == nil || n > max {
+			largest, max = pkg, n
+		}
+	}
+	return largest
+}
+
+// excludeDirective is a comment in a build file that names a file or
+// directory, relative to the build file's directory, that Walk should skip.
+// For example,
+//
+//	# gazelle:exclude third_party
+//	# gazelle:exclude gen.go
+const excludeDirective = "# gazelle:exclude"
+
+// excludeGeneratedDirective is a comment in a build file that names classes
+// of generated files in the build file's directory that Walk should skip.
+// Classes come from GeneratedFileSuffixes or are GeneratedHeaderClass.
+// Without arguments, all generated files are skipped. For example,
+//
+//	# gazelle:exclude_generated protobuf grpc_gateway
+const excludeGeneratedDirective = "# gazelle:exclude_generated"
+
+// SrcsStyleDirective is a comment in a build file that sets the style of
+// srcs attributes in rules generated for its directory. For example,
+//
+//	# gazelle:srcs_style glob
+//
+// In the root build file, it sets Config.SrcsStyle for the whole repository.
+const SrcsStyleDirective = "# gazelle:srcs_style"
+
+// prefixDirective is a comment in a build file that sets the import path
+// prefix of its directory and subdirectories, instead of the go_prefix.
+// For example,
+//
+//	# gazelle:prefix example.com/other
+//
+// gives the package in the directory the import path example.com/other, and
+// a package in the subdirectory "sub" the import path example.com/other/sub.
+// Prefix directives and modules listed in go.work may be nested; the
+// innermost one applies.
+const prefixDirective = "# gazelle:prefix"
+
+// packageNameDirective is a comment in a build file that names the package
+// to generate rules for in its directory when it contains .go files in
+// several packages. For example,
+//
+//	# gazelle:package_name foo
+//
+// It takes precedence over the package matching the directory name.
+const packageNameDirective = "# gazelle:package_name"
+
+const (
+	// SrcsStyleList lists sources explicitly in srcs attributes. Existing
+	// glob calls in srcs are replaced with lists when merging.
+	SrcsStyleList = "list"
+
+	// SrcsStyleGlob lists sources that are built on all platforms with a
+	// glob call, excluding other files that match its patterns.
+	SrcsStyleGlob = "glob"
+)
+
+// ParseSrcsStyleDirective returns the style set by "line", a comment in a
+// build file, if it is a SrcsStyleDirective. "ok" is false for other
+// comments. An error is returned if the style is not SrcsStyleList or
+// SrcsStyleGlob.
+func ParseSrcsStyleDirective(line string) (style string, ok bool, err error) {
+	line = strings.TrimSpace(line)
+	if !strings.HasPrefix(line, SrcsStyleDirective+" ") {
+		return "", false, nil
+	}
+	style = strings.TrimSpace(strings.TrimPrefix(line, SrcsStyleDirective))
+	if style != SrcsStyleList && style != SrcsStyleGlob {
+		return "", true, fmt.Errorf("invalid directive %q: want %q or %q", line, SrcsStyleList, SrcsStyleGlob)
+	}
+	return style, true, nil
+}
+
 // Walk walks through directories under "root".
-// It calls back "f" for each package.
+// It calls back "f" for each package. Fields of "c" control which
+// directories and files are read; they are referred to by name below.
 //
 // It is similar to "golang.org/x/tools/go/buildutil".ForEachPackage, but
 // it does not assume the standard Go tree because Bazel rules_go uses
 // go_prefix instead of the standard tree.
 //
-// If a directory contains no buildable Go code, "f" is not called. If a
+// If a directory contains no buildable Go code, "f" is not called, unless
+// the directory has .go files excluded by "+build ignore" comments. Then "f"
+// is called with a package that only has ToolSrcs set. If a
 // directory contains one package with any name, "f" will be called with that
 // package. If a directory contains multiple packages and one of the package
 // names matches the directory name, "f" will be called on that package and the
 // other packages will be silently ignored. If none of the package names match
 // the directory name, or if some other error occurs, an error will be logged,
-// and "f" will not be called.
-func Walk(buildTags map[string]bool, platforms PlatformConstraints, repoRoot, goPrefix, dir string, f WalkFunc) {
-	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			return err
+// and "f" will not be called. If EmitAllPackages is set, "f" is called for
+// each package in the directory instead, starting with the package matching
+// the directory name, if there is one. A "# gazelle:package_name" directive
+// in the directory's build file or ChoosePackage may select a package when
+// none matches; otherwise, a PackageNameError listing the candidates is
+// reported.
+//
+// If a go.work file is present in "repoRoot", each module it lists is
+// treated as a separate prefix root: packages in a module directory are
+// named relative to the module path instead of "goPrefix".
+//
+// Symbolic links to directories are followed if FollowSymlinks is set or
+// if they are listed in FollowedSymlinks. Packages found through a link are
+// named by the path of the link, not its target. Links that point to a
+// directory being visited are skipped to avoid cycles.
+//
+// Unlike the go command, Walk visits directories whose names start with "_",
+// like "_examples", since they may hold code that should be built. Add "_*"
+// to SkipDirs to skip them. Files whose names start with "_" or "." are
+// always ignored.
+//
+// Like Bazel, Walk skips directories listed in a .bazelignore file in
+// "repoRoot". Directories matching a pattern in SkipDirs are also skipped,
+// as are subdirectories of "dir" that are roots of other repositories, with
+// a WORKSPACE or WORKSPACE.bazel file, unless SkipNestedRepos is false.
+// Directories with more files than MaxDirFiles or MaxDirBytes allow are
+// reported with a warning, and skipped if SkipLargeDirs is set; their
+// subdirectories are still visited.
+//
+// If WalkSubdirs is false, only "dir" is visited. Otherwise, subdirectories
+// are visited down to MaxDepth levels below "dir".
+//
+// If Manifest is set, directories are listed from the manifest instead
+// of FS. Symbolic links whose names start with "bazel-", like the
+// convenience links Bazel creates for its output directories, are never
+// followed.
+//
+// Files and directories named by "# gazelle:exclude" directives in build
+// files are skipped. Directives apply to paths relative to the directory
+// containing the build file. Generated files in classes named by
+// "# gazelle:exclude_generated" directives are skipped in the directory
+// containing the build file. If SkipGenerated is set, .go files with a
+// comment matching GeneratedHeaderPattern are skipped everywhere. SrcsStyle
+// is set on each package from the "# gazelle:srcs_style" directive in its
+// directory's build file, if there is one.
+//
+// Errors are logged. Use WalkWithErrors to handle them instead.
+func Walk(c *Config, buildTags map[string]bool, platforms PlatformConstraints, repoRoot, goPrefix, dir string, f WalkFunc) {
+	WalkWithErrors(c, buildTags, platforms, repoRoot, goPrefix, dir, f, func(err *DirError) {
+		for _, e := range err.Errs {
+			logging.Errorf(logging.At{File: err.Dir}, "%v", e)
 		}
-		if !info.IsDir() {
-			return nil
+	})
+}
+
+// WalkWithErrors is like Walk, but instead of logging errors, it calls "errf"
+// once for each directory where errors occurred. Errors in files at the
+// repository root that affect the whole walk, like go.work, are reported
+// for "repoRoot".
+func WalkWithErrors(c *Config, buildTags map[string]bool, platforms PlatformConstraints, repoRoot, goPrefix, dir string, f WalkFunc, errf WalkErrFunc) {
+	var rootErrs []error
+	modules, err := FindWorkspaceModules(c, repoRoot)
+	if err != nil {
+		rootErrs = append(rootErrs, err)
+	}
+	ignored, err := c.readBazelIgnore(repoRoot)
+	if err != nil {
+		rootErrs = append(rootErrs, err)
+	}
+	rootGoVersion, err := c.findGoVersion(repoRoot, dir)
+	if err != nil {
+		rootErrs = append(rootErrs, err)
+	}
+	if len(rootErrs) > 0 {
+		errf(&DirError{Dir: repoRoot, Errs: rootErrs})
+	}
+	excluded := make(map[string]bool)
+
+	var visit func(path string, depth int, ancestors []os.FileInfo, prefixRoots []ModuleRoot, goVersion string)
+	visit = func(path string, depth int, ancestors []os.FileInfo, prefixRoots []ModuleRoot, goVersion string) {
+		if base := filepath.Base(path); base == "" || base[0] == '.' || base == "testdata" {
+			return
 		}
-		if base := info.Name(); base == "" || base[0] == '.' || base == "testdata" {
-			return filepath.SkipDir
+		var errs []error
+		report := func() {
+			if len(errs) > 0 {
+				errf(&DirError{Dir: path, Errs: errs})
+			}
+		}
+		rel, relErr := filepath.Rel(repoRoot, path)
+		if c.Manifest != nil {
+			// Manifests don't have symbolic links, so there can't be cycles.
+			if relErr != nil {
+				errs = append(errs, relErr)
+				report()
+				return
+			}
+		} else {
+			info, err := c.FS.Stat(path)
+			if err != nil {
+				errs = append(errs, err)
+				report()
+				return
+			}
+			for _, a := range ancestors {
+				if os.SameFile(a, info) {
+					logging.Warnf(logging.At{File: path}, "%s: skipping symbolic link cycle", path)
+					return
+				}
+			}
+			ancestors = append(ancestors, info)
+		}
+
+		srcsStyle := c.SrcsStyle
+		var d buildDirectives
+		if relErr == nil {
+			if rel == "." {
+				rel = ""
+			}
+			rel = filepath.ToSlash(rel)
+			var err error
+			d, err = c.readDirectives(path, rel, excluded)
+			if err != nil {
+				errs = append(errs, err)
+			}
+			if d.srcsStyle != "" {
+				srcsStyle = d.srcsStyle
+			}
+			if d.prefix != "" {
+				prefixRoots = append(prefixRoots[:len(prefixRoots):len(prefixRoots)], ModuleRoot{Rel: rel, Path: d.prefix})
+			}
+		}
+
+		prefixRoot, prefix := repoRoot, goPrefix
+		var dirPrefixRoot *ModuleRoot
+		if relErr == nil {
+			if root, isPrefix, ok := FindPrefixRoot(prefixRoots, modules, rel); ok {
+				prefixRoot, prefix = filepath.Join(repoRoot, filepath.FromSlash(root.Rel)), root.Path
+				if isPrefix {
+					dirPrefixRoot = &root
+				}
+			}
 		}
 
-		if pkg := FindPackage(path, buildTags, platforms, repoRoot, goPrefix); pkg != nil {
+		if v, err := ReadGoVersion(c, path); err == nil {
+			goVersion = v
+		} else if !os.IsNotExist(err) {
+			errs = append(errs, err)
+		}
+
+		pr := packageReader{
+			c:         c,
+			buildTags: buildTags,
+			platforms: platforms,
+			repoRoot:  prefixRoot,
+			goPrefix:  prefix,
+			goVersion: goVersion,
+			dir:       path,
+			rel:       rel,
+			excluded:  excluded,
+			manifest:  c.Manifest,
+
+			excludedGenerated: d.excludedGenerated,
+			packageName:       d.packageName,
+		}
+		pkgs := pr.findPackages()
+		errs = append(errs, pr.errs...)
+		for _, pkg := range pkgs {
+			if relErr == nil {
+				pkg.ImportPath, pkg.Vendored = VendoredImportPath(rel)
+				if !pkg.Vendored && dirPrefixRoot != nil {
+					pkg.ImportPath = dirPrefixRoot.ImportPath(rel)
+					pkg.PrefixRoot = dirPrefixRoot
+				}
+			}
+			pkg.SrcsStyle = srcsStyle
 			f(pkg)
 		}
-		return nil
-	})
+
+		if !c.WalkSubdirs || c.MaxDepth > 0 && depth >= c.MaxDepth {
+			report()
+			return
+		}
+		subdirs, nestedRepos, subErrs := c.listSubdirs(path, rel, ignored, excluded)
+		errs = append(errs, subErrs...)
+		for _, sub := range nestedRepos {
+			logging.Infof(logging.At{File: sub}, "%s: skipping nested repository", sub)
+		}
+		report()
+
+		for _, sub := range subdirs {
+			visit(sub, depth+1, ancestors, prefixRoots, goVersion)
+		}
+	}
+	prefixRoots, ok := c.readAncestors(repoRoot, dir, ignored, excluded, errf)
+	if !ok {
+		return
+	}
+	visit(dir, 0, nil, prefixRoots, rootGoVersion)
+}
+
+// readAncestors reads directives from the build files in "repoRoot" and the
+// directories between it and "dir", so a walk starting at "dir" sees the
+// same exclude and prefix directives as a walk starting at "repoRoot". The
+// prefix directives are returned. false is returned if a walk from
+// "repoRoot" would skip "dir" or one of the directories above it. Errors
+// are reported with "errf".
+func (c *Config) readAncestors(repoRoot, dir string, ignored, excluded map[string]bool, errf WalkErrFunc) ([]ModuleRoot, bool) {
+	rel, err := filepath.Rel(repoRoot, dir)
+	if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		// visit reports directories outside the repository.
+		return nil, true
+	}
+	var prefixRoots []ModuleRoot
+	ancestor, ancestorRel := repoRoot, ""
+	for _, name := range strings.Split(filepath.ToSlash(rel), "/") {
+		d, err := c.readDirectives(ancestor, ancestorRel, excluded)
+		if err != nil {
+			errf(&DirError{Dir: ancestor, Errs: []error{err}})
+		}
+		if d.prefix != "" {
+			prefixRoots = append(prefixRoots, ModuleRoot{Rel: ancestorRel, Path: d.prefix})
+		}
+		sub, subRel := filepath.Join(ancestor, name), path.Join(ancestorRel, name)
+		if name[0] == '.' || name == "testdata" || ignored[subRel] || excluded[subRel] || c.skipDir(subRel) {
+			return nil, false
+		}
+		if c.SkipNestedRepos && c.isRepoRoot(sub, subRel) {
+			logging.Infof(logging.At{File: sub}, "%s: skipping nested repository", sub)
+			return nil, false
+		}
+		ancestor, ancestorRel = sub, subRel
+	}
+	return prefixRoots, true
+}
+
+// FindPrefixRoots returns the directories under "repoRoot" whose build files
+// have a "# gazelle:prefix" directive, with the prefixes they set. The
+// directories Walk would skip are skipped, regardless of WalkSubdirs and
+// MaxDepth, and no source files are read. This lets callers compute import
+// paths and resolve imports of directories Walk hasn't visited yet.
+// Errors in subdirectories are ignored; Walk reports them when it visits
+// the directories.
+func FindPrefixRoots(c *Config, repoRoot string) ([]ModuleRoot, error) {
+	ignored, err := c.readBazelIgnore(repoRoot)
+	if err != nil {
+		return nil, err
+	}
+	excluded := make(map[string]bool)
+	var roots []ModuleRoot
+	var visit func(dir, rel string, ancestors []os.FileInfo)
+	visit = func(dir, rel string, ancestors []os.FileInfo) {
+		if c.Manifest == nil {
+			info, err := c.FS.Stat(dir)
+			if err != nil {
+				return
+			}
+			for _, a := range ancestors {
+				if os.SameFile(a, info) {
+					return
+				}
+			}
+			ancestors = append(ancestors, info)
+		}
+		if d, err := c.readDirectives(dir, rel, excluded); err == nil && d.prefix != "" {
+			roots = append(roots, ModuleRoot{Rel: rel, Path: d.prefix})
+		}
+		subdirs, _, _ := c.listSubdirs(dir, rel, ignored, excluded)
+		for _, sub := range subdirs {
+			name := filepath.Base(sub)
+			if name[0] == '.' || name == "testdata" {
+				continue
+			}
+			visit(sub, path.Join(rel, name), ancestors)
+		}
+	}
+	visit(repoRoot, "", nil)
+	return roots, nil
+}
+
+// FindPrefixRoot returns the innermost of the prefix directive roots in
+// "prefixRoots" and the modules in "modules" that contains the directory
+// "rel", a slash-separated path from the repository root. A directive wins
+// over a module in the same directory. "isPrefix" reports whether "root"
+// came from "prefixRoots". false is returned if none contains "rel".
+func FindPrefixRoot(prefixRoots, modules []ModuleRoot, rel string) (root ModuleRoot, isPrefix, ok bool) {
+	pm, pok := FindModule(prefixRoots, rel)
+	mm, mok := FindModule(modules, rel)
+	if pok && (!mok || len(pm.Rel) >= len(mm.Rel)) {
+		return pm, true, true
+	}
+	return mm, false, mok
+}
+
+// listSubdirs returns the subdirectories of "dir", whose slash-separated
+// path from the repository root is "rel", that Walk descends into.
+// Directories in "ignored" or "excluded" or matching SkipDirs are left out,
+// as are symbolic links that shouldn't be followed. If SkipNestedRepos is
+// set, roots of nested repositories are returned in "nestedRepos" instead
+// of "subdirs".
+func (c *Config) listSubdirs(dir, rel string, ignored, excluded map[string]bool) (subdirs, nestedRepos []string, errs []error) {
+	files, err := c.readDir(c.Manifest, dir, rel)
+	if err != nil {
+		return nil, nil, []error{err}
+	}
+	for _, file := range files {
+		sub := filepath.Join(dir, file.Name())
+		subRel := strings.TrimPrefix(rel+"/"+file.Name(), "/")
+		if ignored[subRel] || excluded[subRel] || c.skipDir(subRel) {
+			continue
+		}
+		if file.Mode()&os.ModeSymlink != 0 {
+			if strings.HasPrefix(file.Name(), "bazel-") || !c.shouldFollow(subRel) {
+				continue
+			}
+			if file, err = c.FS.Stat(sub); err != nil {
+				errs = append(errs, err)
+				continue
+			}
+		}
+		if !file.IsDir() {
+			continue
+		}
+		if c.SkipNestedRepos && c.isRepoRoot(sub, subRel) {
+			nestedRepos = append(nestedRepos, sub)
+			continue
+		}
+		subdirs = append(subdirs, sub)
+	}
+	return subdirs, nestedRepos, errs
+}
+
+// skipDir returns whether the directory "rel", a slash-separated path from
+// the repository root, matches a pattern in SkipDirs.
+func (c *Config) skipDir(rel string) bool {
+	for _, pattern := range c.SkipDirs {
+		name := path.Base(rel)
+		if strings.Contains(pattern, "/") {
+			name = rel
+		}
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// isRepoRoot returns whether the directory "dir", whose slash-separated
+// path from the repository root is "rel", contains a file named in
+// WorkspaceFileNames. Files are looked up in Manifest if it is set.
+func (c *Config) isRepoRoot(dir, rel string) bool {
+	for _, name := range c.WorkspaceFileNames {
+		if c.Manifest != nil {
+			if _, ok := c.Manifest.Hash(path.Join(rel, name)); ok {
+				return true
+			}
+			continue
+		}
+		if fi, err := c.FS.Stat(filepath.Join(dir, name)); err == nil && !fi.IsDir() {
+			return true
+		}
+	}
+	return false
+}
+
+// readDir returns the entries of the directory "dir", whose slash-separated
+// path from the repository root is "rel". Entries come from "manifest" if it
+// is not nil.
+func (c *Config) readDir(manifest *Manifest, dir, rel string) ([]os.FileInfo, error) {
+	if manifest != nil {
+		return manifest.readDir(rel)
+	}
+	return c.FS.ReadDir(dir)
+}
+
+// IsDir returns whether "dir", a directory under "repoRoot", exists. It is
+// looked up in the Manifest of "c" if it is set, and in its FS otherwise,
+// like the directories Walk lists.
+func IsDir(c *Config, repoRoot, dir string) bool {
+	if c.Manifest == nil {
+		fi, err := c.FS.Stat(dir)
+		return err == nil && fi.IsDir()
+	}
+	rel, err := filepath.Rel(repoRoot, dir)
 	if err != nil {
-		log.Print(err)
+		return false
+	}
+	if rel = filepath.ToSlash(rel); rel == "." {
+		rel = ""
 	}
+	_, err = c.Manifest.readDir(rel)
+	return err == nil
+}
+
+// shouldFollow returns whether Walk should descend into the symbolic link
+// "rel", a slash-separated path from the repository root.
+func (c *Config) shouldFollow(rel string) bool {
+	return c.FollowSymlinks || c.FollowedSymlinks[rel]
+}
+
+// buildDirectives holds directives read from a build file that apply to
+// its own directory.
+type buildDirectives struct {
+	// srcsStyle is the argument of the last srcs_style directive, or "" if
+	// there is none.
+	srcsStyle string
+
+	// excludedGenerated is the set of generated file classes named in
+	// exclude_generated directives. It is nil if there are none.
+	excludedGenerated map[string]bool
+
+	// prefix is the argument of the last prefix directive, or "" if there
+	// is none.
+	prefix string
+
+	// packageName is the argument of the last package_name directive, or ""
+	// if there is none.
+	packageName string
+}
+
+// readDirectives reads directives from the build file in "dir", if there is
+// one. Paths named by exclude directives are added to "excluded" as
+// slash-separated paths from the repository root. "rel" is the path of "dir"
+// from the repository root. Other directives are returned.
+func (c *Config) readDirectives(dir, rel string, excluded map[string]bool) (buildDirectives, error) {
+	var d buildDirectives
+	for _, name := range c.BuildFileNames {
+		data, err := c.FS.ReadFile(filepath.Join(dir, name))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return d, err
+		}
+		for _, line := range strings.Split(string(data), "\n") {
+			line = strings.TrimSpace(line)
+			if style, ok, err := ParseSrcsStyleDirective(line); err != nil {
+				return d, fmt.Errorf("%s: %v", filepath.Join(dir, name), err)
+			} else if ok {
+				d.srcsStyle = style
+				continue
+			}
+			if strings.HasPrefix(line, prefixDirective+" ") {
+				args := strings.Fields(strings.TrimPrefix(line, prefixDirective))
+				if len(args) != 1 || path.IsAbs(args[0]) || path.Clean(args[0]) != args[0] {
+					return d, fmt.Errorf("%s: invalid directive %q: want one import path prefix", filepath.Join(dir, name), line)
+				}
+				d.prefix = args[0]
+				continue
+			}
+			if strings.HasPrefix(line, packageNameDirective+" ") {
+				args := strings.Fields(strings.TrimPrefix(line, packageNameDirective))
+				if len(args) != 1 {
+					return d, fmt.Errorf("%s: invalid directive %q: want one package name", filepath.Join(dir, name), line)
+				}
+				d.packageName = args[0]
+				continue
+			}
+			if line == excludeGeneratedDirective || strings.HasPrefix(line, excludeGeneratedDirective+" ") {
+				if d.excludedGenerated == nil {
+					d.excludedGenerated = make(map[string]bool)
+				}
+				classes := strings.Fields(strings.TrimPrefix(line, excludeGeneratedDirective))
+				if len(classes) == 0 {
+					classes = []string{allGeneratedClasses}
+				}
+				for _, c := range classes {
+					d.excludedGenerated[c] = true
+				}
+				continue
+			}
+			if !strings.HasPrefix(line, excludeDirective+" ") {
+				continue
+			}
+			p := path.Clean(strings.TrimSpace(strings.TrimPrefix(line, excludeDirective)))
+			if path.IsAbs(p) || p == "." || p == ".." || strings.HasPrefix(p, "../") {
+				return d, fmt.Errorf("%s: invalid directive %q: path must be inside the directory", filepath.Join(dir, name), line)
+			}
+			excluded[path.Join(rel, p)] = true
+		}
+		return d, nil
+	}
+	return d, nil
+}
+
+// readBazelIgnore returns the set of directories listed in the .bazelignore
+// file in "repoRoot". Each line names a directory relative to "repoRoot".
+// Blank lines and lines starting with "#" are skipped. An empty set is
+// returned without error if there is no .bazelignore file.
+func (c *Config) readBazelIgnore(repoRoot string) (map[string]bool, error) {
+	ignored := make(map[string]bool)
+	data, err := c.FS.ReadFile(filepath.Join(repoRoot, ".bazelignore"))
+	if os.IsNotExist(err) {
+		return ignored, nil
+	}
+	if err != nil {
+		return ignored, err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		ignored[path.Clean(filepath.ToSlash(line))] = true
+	}
+	return ignored, nil
+}
+
+// VendoredImportPath returns the import path of a package in the directory
+// "rel", a slash-separated path from the repository root, if "rel" is inside
+// a vendor directory. The import path is relative to the innermost vendor
+// directory. false is returned if "rel" is not in a vendor directory.
+func VendoredImportPath(rel string) (string, bool) {
+	if i := strings.LastIndex(rel, "/vendor/"); i >= 0 {
+		return rel[i+len("/vendor/"):], true
+	}
+	if strings.HasPrefix(rel, "vendor/") {
+		return rel[len("vendor/"):], true
+	}
+	return "", false
 }
 
 // FindPackage reads source files in a given directory and returns a Package
@@ -70,37 +743,111 @@ func Walk(buildTags map[string]bool, platforms PlatformConstraints, repoRoot, go
 // If no buildable .go files are found in the directory, nil will be returned.
 // If the directory contains multiple buildable packages, the package whose
 // name matches the directory base name will be returned. If there is no such
-// package or if an error occurs, an error will be logged, and nil will be
-// returned.
-func FindPackage(dir string, buildTags map[string]bool, platforms PlatformConstraints, repoRoot, goPrefix string) *Package {
+// package, the package selected by the ChoosePackage field of "c" is
+// returned. Otherwise, or if an error occurs, an error will be logged, and nil
+// will be returned. Directives, Manifest, and EmitAllPackages do not affect
+// FindPackage.
+//
+// "repoRoot" is the directory corresponding to "goPrefix". When walking a
+// workspace, this is the root directory of the module containing "dir".
+func FindPackage(c *Config, dir string, buildTags map[string]bool, platforms PlatformConstraints, repoRoot, goPrefix string) *Package {
 	pr := packageReader{
+		c:         c,
 		buildTags: buildTags,
 		platforms: platforms,
 		repoRoot:  repoRoot,
 		goPrefix:  goPrefix,
 		dir:       dir,
 	}
-	return pr.findPackage()
+	var err error
+	if pr.goVersion, err = c.findGoVersion(repoRoot, dir); err != nil {
+		pr.errs = append(pr.errs, err)
+	}
+	pkgs := pr.findPackages()
+	for _, err := range pr.errs {
+		logging.Errorf(logging.At{File: dir}, "%v", err)
+	}
+	if len(pkgs) > 0 && !pkgs[0].Extra && pkgs[0].HasGo() {
+		return pkgs[0]
+	}
+	return nil
 }
 
 // packageReader reads package metadata from a directory.
 type packageReader struct {
+	c                       *Config
 	buildTags               map[string]bool
 	platforms               PlatformConstraints
 	repoRoot, goPrefix, dir string
+
+	// goVersion is the Go version in the go.mod file of the module
+	// containing dir, or "" if there is none.
+	goVersion string
+
+	// errs is a list of errors that occurred while reading the directory.
+	errs []error
+
+	// rel is the slash-separated path from the repository root to dir.
+	// excluded is a set of slash-separated paths from the repository root of
+	// files that should be skipped. Both are only set by Walk.
+	rel      string
+	excluded map[string]bool
+
+	// manifest lists the files in the directory instead of the file
+	// system, if it is not nil. It is only set by Walk.
+	manifest *Manifest
+
+	// excludedGenerated is a set of classes of generated files that should
+	// be skipped. It may contain allGeneratedClasses.
+	excludedGenerated map[string]bool
+
+	// packageName is the package selected by a package_name directive, or
+	// "" if there is none. It is only set by Walk.
+	packageName string
 }
 
-func (pr *packageReader) findPackage() *Package {
+// isExcludedGenerated returns whether "info" describes a generated file
+// in a class that should be skipped, or a file with a generated code comment
+// when SkipGenerated is set.
+func (pr *packageReader) isExcludedGenerated(info fileInfo) bool {
+	if pr.c.SkipGenerated && info.generatedHeader {
+		return true
+	}
+	return info.generated != "" && (pr.excludedGenerated[info.generated] || pr.excludedGenerated[allGeneratedClasses])
+}
+
+// tooLarge returns whether a directory with "count" files of "size" total
+// bytes is over MaxDirFiles or MaxDirBytes, logging a warning if it is.
+func (pr *packageReader) tooLarge(count int, size int64) bool {
+	large := false
+	if pr.c.MaxDirFiles > 0 && count > pr.c.MaxDirFiles {
+		logging.Warnf(logging.At{File: pr.dir}, "%s: directory has %d files, more than the limit of %d", pr.dir, count, pr.c.MaxDirFiles)
+		large = true
+	}
+	if pr.c.MaxDirBytes > 0 && size > pr.c.MaxDirBytes {
+		logging.Warnf(logging.At{File: pr.dir}, "%s: directory has %d bytes of files, more than the limit of %d", pr.dir, size, pr.c.MaxDirBytes)
+		large = true
+	}
+	return large
+}
+
+// findPackages returns the package in the directory selected by
+// selectPackage. If EmitAllPackages is set, other packages with Go files are
+// returned after it, sorted by name, with Extra set. Files other than .go
+// files are only added to the selected package.
+func (pr *packageReader) findPackages() []*Package {
 	var goFiles, otherFiles []string
 
 	// List the files in the directory and split into .go files and other files.
 	// We need to process the Go files first to determine which package we'll
 	// generate rules for if there are multiple packages.
-	files, err := ioutil.ReadDir(pr.dir)
+	files, err := pr.c.readDir(pr.manifest, pr.dir, pr.rel)
 	if err != nil {
-		log.Print(err)
+		pr.errs = append(pr.errs, err)
 		return nil
 	}
+	pr.errs = append(pr.errs, caseCollisions(pr.dir, files)...)
+	var totalBytes int64
 	for _, file := range files {
 		if file.IsDir() {
 			continue
@@ -110,21 +857,46 @@ func (pr *packageReader) findPackage() *Package {
 		if name == "" || name[0] == '.' || name[0] == '_' {
 			continue
 		}
+		if pr.excluded[path.Join(pr.rel, name)] {
+			continue
+		}
 
+		totalBytes += file.Size()
 		if strings.HasSuffix(name, ".go") {
 			goFiles = append(goFiles, name)
 		} else {
 			otherFiles = append(otherFiles, name)
 		}
 	}
+	if pr.tooLarge(len(goFiles)+len(otherFiles), totalBytes) && pr.c.SkipLargeDirs {
+		logging.Warnf(logging.At{File: pr.dir}, "%s: skipping directory", pr.dir)
+		return nil
+	}
 
 	// Process the .go files.
 	packageMap := make(map[string]*Package)
-	cgo := false
+	fileVersions := make(map[string]int)
+	var constrained, toolSrcs []string
+	var toolPackageName string
 	for _, goFile := range goFiles {
 		info, err := pr.goFileInfo(goFile)
 		if err != nil {
-			log.Print(err)
+			pr.errs = append(pr.errs, err)
+			continue
+		}
+		if pr.isExcludedGenerated(info) {
+			continue
+		}
+		if info.isImpossible() {
+			logging.Infof(logging.At{File: info.path}, "%s: skipping file: constraints can never be satisfied: %s", info.path, info.constraintString())
+			continue
+		}
+		if info.isIgnored() {
+			logging.Infof(logging.At{File: info.path}, "%s: skipping file: excluded by %q", info.path, "+build "+ignoreTag)
+			if toolSrcs == nil {
+				toolPackageName = info.packageName
+			}
+			toolSrcs = append(toolSrcs, goFile)
 			continue
 		}
 		if info.packageName == "documentation" {
@@ -132,7 +904,9 @@ func (pr *packageReader) findPackage() *Package {
 			continue
 		}
 
-		cgo = cgo || info.isCgo
+		if !isBuildable(info, pr.buildTags, pr.platforms) && testSuiteTag(info, pr.c.TestSuiteTags, pr.buildTags, pr.platforms) == "" {
+			constrained = append(constrained, goFile)
+		}
 
 		if _, ok := packageMap[info.packageName]; !ok {
 			packageMap[info.packageName] = &Package{
@@ -140,37 +914,226 @@ func (pr *packageReader) findPackage() *Package {
 				Dir:  pr.dir,
 			}
 		}
-		err = packageMap[info.packageName].addFile(info, false, pr.buildTags, pr.platforms)
+		err = packageMap[info.packageName].addFile(info, false, pr.buildTags, pr.platforms, pr.c.TestSuiteTags)
 		if err != nil {
-			log.Print(err)
+			pr.errs = append(pr.errs, err)
+		}
+		if !info.isTest {
+			if v, ok := fileVersions[info.packageName]; !ok || info.goVersion() < v {
+				fileVersions[info.packageName] = info.goVersion()
+			}
 		}
 	}
+	for name, pkg := range packageMap {
+		pkg.GoVersion = pr.packageGoVersion(fileVersions[name])
+	}
 
 	// Select a package to generate rules for.
 	pkg, err := pr.selectPackage(packageMap)
+	var extras []*Package
+	if pr.c.EmitAllPackages {
+		if _, ok := err.(*PackageNameError); ok {
+			err = nil
+		}
+		extras = extraPackages(packageMap, pkg)
+	}
 	if err != nil {
 		if _, ok := err.(*build.NoGoError); !ok {
-			log.Print(err)
+			pr.errs = append(pr.errs, err)
+		} else if len(constrained) > 0 {
+			pr.errs = append(pr.errs, excludedError(pr.dir, constrained, packageMap))
+		} else if len(toolSrcs) > 0 {
+			return []*Package{{
+				Name:     toolPackageName,
+				Dir:      pr.dir,
+				ToolSrcs: toolSrcs,
+			}}
 		}
 		return nil
 	}
+	// testdata is only read if a package has tests, since its files are only
+	// used as data of tests.
+	withTests := extras
+	if pkg != nil {
+		withTests = append([]*Package{pkg}, extras...)
+	}
+	var testdata []string
+	for _, p := range withTests {
+		if !p.hasTests() {
+			continue
+		}
+		if testdata == nil {
+			if testdata, err = pr.c.readTestdata(pr.manifest, pr.dir, pr.rel); err != nil {
+				pr.errs = append(pr.errs, err)
+				break
+			}
+			if testdata == nil {
+				break
+			}
+		}
+		p.Testdata = testdata
+	}
+	if pkg == nil {
+		return extras
+	}
+	pkg.ToolSrcs = toolSrcs
 
 	// Process the other files.
 	for _, file := range otherFiles {
 		info, err := pr.otherFileInfo(file)
 		if err != nil {
-			log.Print(err)
+			pr.errs = append(pr.errs, err)
+			continue
+		}
+		if pr.isExcludedGenerated(info) {
 			continue
 		}
-		err = pkg.addFile(info, cgo, pr.buildTags, pr.platforms)
+		if info.isImpossible() {
+			logging.Infof(logging.At{File: info.path}, "%s: skipping file: constraints can never be satisfied: %s", info.path, info.constraintString())
+			continue
+		}
+		if info.isIgnored() {
+			logging.Infof(logging.At{File: info.path}, "%s: skipping file: excluded by %q", info.path, "+build "+ignoreTag)
+			continue
+		}
+		err = pkg.addFile(info, len(pkg.CgoFiles) > 0, pr.buildTags, pr.platforms, pr.c.TestSuiteTags)
+		if err != nil {
+			pr.errs = append(pr.errs, err)
+		}
+	}
+
+	return append([]*Package{pkg}, extras...)
+}
+
+// caseCollisions returns a CaseCollisionError for each set of entries in
+// "files", listed from "dir", whose names are equal ignoring case. Errors
+// are sorted by the first name in each set.
+func caseCollisions(dir string, files []os.FileInfo) []error {
+	byLower := make(map[string][]string)
+	for _, file := range files {
+		lower := strings.ToLower(file.Name())
+		byLower[lower] = append(byLower[lower], file.Name())
+	}
+	var collisions []*CaseCollisionError
+	for _, names := range byLower {
+		if len(names) > 1 {
+			sort.Strings(names)
+			collisions = append(collisions, &CaseCollisionError{Dir: dir, Names: names})
+		}
+	}
+	sort.Slice(collisions, func(i, j int) bool {
+		return collisions[i].Names[0] < collisions[j].Names[0]
+	})
+	errs := make([]error, len(collisions))
+	for i, c := range collisions {
+		errs[i] = c
+	}
+	return errs
+}
+
+// readTestdata returns the files in the testdata directory in "dir", whose
+// slash-separated path from the repository root is "rel", as sorted
+// slash-separated paths relative to "dir". Subdirectories with build files
+// are skipped. Files are listed from "manifest" if it is not nil. nil is
+// returned if there is no testdata directory.
+func (c *Config) readTestdata(manifest *Manifest, dir, rel string) ([]string, error) {
+	var files []string
+	if manifest != nil {
+		var visit func(sub string)
+		visit = func(sub string) {
+			infos, _ := manifest.readDir(path.Join(rel, sub))
+			for _, fi := range infos {
+				p := path.Join(sub, fi.Name())
+				if !fi.IsDir() {
+					files = append(files, p)
+				} else if !c.isBuildFileDir(manifest, path.Join(rel, p)) {
+					visit(p)
+				}
+			}
+		}
+		visit("testdata")
+		sort.Strings(files)
+		return files, nil
+	}
+
+	root := filepath.Join(dir, "testdata")
+	info, err := c.FS.Stat(root)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, nil
+	}
+	err = c.walkFS(root, info, func(p string, fi os.FileInfo) error {
+		if fi.IsDir() {
+			if p != root && c.hasBuildFile(p) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		rel, err := filepath.Rel(dir, p)
 		if err != nil {
-			log.Print(err)
+			return err
+		}
+		files = append(files, filepath.ToSlash(rel))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// isBuildFileDir returns whether "manifest" has a file named in
+// BuildFileNames in the directory "rel", a slash-separated path from the
+// repository root.
+func (c *Config) isBuildFileDir(manifest *Manifest, rel string) bool {
+	for _, name := range c.BuildFileNames {
+		if _, ok := manifest.Hash(path.Join(rel, name)); ok {
+			return true
 		}
 	}
+	return false
+}
 
-	return pkg
+// excludedError returns an ExcludedError for "dir", where "files" are
+// excluded by build constraints. Tags are collected from the packages in
+// "packageMap", which were read from those files.
+func excludedError(dir string, files []string, packageMap map[string]*Package) *ExcludedError {
+	var tags []string
+	for _, pkg := range packageMap {
+		tags = append(tags, pkg.BuildTags...)
+	}
+	sort.Strings(tags)
+	return &ExcludedError{Dir: dir, Files: files, Tags: uniq(tags)}
 }
 
+// extraPackages returns the packages in "packageMap" with Go files, other
+// than "selected", sorted by name. Extra is set on each returned package.
+// "selected" may be nil.
+func extraPackages(packageMap map[string]*Package, selected *Package) []*Package {
+	var extras []*Package
+	for _, pkg := range packageMap {
+		if pkg != selected && pkg.HasGo() {
+			pkg.Extra = true
+			extras = append(extras, pkg)
+		}
+	}
+	sort.Slice(extras, func(i, j int) bool {
+		return extras[i].Name < extras[j].Name
+	})
+	return extras
+}
+
+// selectPackage returns the package in "packageMap" to generate rules for.
+// If there are several packages with .go files, the one named by a
+// package_name directive is preferred, then the one matching the directory
+// name, then the one chosen by ChoosePackage. A PackageNameError is returned
+// if none is selected.
 func (pr *packageReader) selectPackage(packageMap map[string]*Package) (*Package, error) {
 	packagesWithGo := make(map[string]*Package)
 	for name, pkg := range packageMap {
@@ -189,22 +1152,41 @@ func (pr *packageReader) selectPackage(packageMap map[string]*Package) (*Package
 		}
 	}
 
+	if pkg, ok := packagesWithGo[pr.packageName]; ok {
+		return pkg, nil
+	}
 	if pkg, ok := packagesWithGo[pr.defaultPackageName()]; ok {
 		return pkg, nil
 	}
 
-	err := &build.MultiplePackageError{Dir: pr.dir}
-	for name, pkg := range packagesWithGo {
-		// Add the first file for each package for the error message.
-		// Error() method expects these lists to be the same length. File
-		// lists must be non-empty. These lists are only created by
-		// findPackageFiles for packages with .go files present.
-		err.Packages = append(err.Packages, name)
-		err.Files = append(err.Files, pkg.firstGoFile())
+	err := &PackageNameError{Dir: pr.dir}
+	for _, pkg := range packagesWithGo {
+		err.Packages = append(err.Packages, pkg)
+	}
+	sort.Slice(err.Packages, func(i, j int) bool {
+		return err.Packages[i].Name < err.Packages[j].Name
+	})
+	if pr.c.ChoosePackage != nil {
+		if pkg := pr.c.ChoosePackage(err); pkg != nil {
+			return pkg, nil
+		}
 	}
 	return nil, err
 }
 
+// packageGoVersion returns the Go version a package requires: the newer of
+// the module's version and "minor", the minor version of the newest release
+// every file in the package requires.
+func (pr *packageReader) packageGoVersion(minor int) string {
+	if m, ok := goMinorVersion(pr.goVersion); ok && m >= minor {
+		return pr.goVersion
+	}
+	if minor == 0 {
+		return ""
+	}
+	return fmt.Sprintf("1.%d", minor)
+}
+
 func (pr *packageReader) defaultPackageName() string {
 	if pr.dir != pr.repoRoot {
 		return filepath.Base(pr.dir)
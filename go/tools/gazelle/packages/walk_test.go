@@ -20,6 +20,7 @@ import (
 	"os"
 	"path/filepath"
 	"reflect"
+	"regexp"
 	"strings"
 	"testing"
 
@@ -34,7 +35,7 @@ type fileSpec struct {
 	path, content string
 }
 
-func checkFiles(t *testing.T, files []fileSpec, goPrefix string, want []*packages.Package) {
+func checkFiles(t *testing.T, c *packages.Config, files []fileSpec, goPrefix string, want []*packages.Package) {
 	dir, err := createFiles(files)
 	if err != nil {
 		t.Fatalf("createFiles() failed with %v; want success", err)
@@ -45,7 +46,7 @@ func checkFiles(t *testing.T, files []fileSpec, goPrefix string, want []*package
 		p.Dir = filepath.Join(dir, filepath.FromSlash(p.Dir))
 	}
 
-	got := walkPackages(dir, goPrefix, dir)
+	got := walkPackages(c, dir, goPrefix, dir)
 	checkPackages(t, got, want)
 }
 
@@ -72,9 +73,9 @@ func createFiles(files []fileSpec) (string, error) {
 	return dir, nil
 }
 
-func walkPackages(repoRoot, goPrefix, dir string) []*packages.Package {
+func walkPackages(c *packages.Config, repoRoot, goPrefix, dir string) []*packages.Package {
 	var pkgs []*packages.Package
-	packages.Walk(nil, nil, repoRoot, goPrefix, dir, func(pkg *packages.Package) {
+	packages.Walk(c, nil, nil, repoRoot, goPrefix, dir, func(pkg *packages.Package) {
 		pkgs = append(pkgs, pkg)
 	})
 	return pkgs
@@ -97,15 +98,17 @@ func checkPackage(t *testing.T, got, want *packages.Package) {
 }
 
 func TestWalkEmpty(t *testing.T) {
+	c := packages.NewConfig()
 	files := []fileSpec{
 		{path: "a/foo.c"},
 		{path: "b/"},
 	}
 	want := []*packages.Package{}
-	checkFiles(t, files, "", want)
+	checkFiles(t, c, files, "", want)
 }
 
 func TestWalkSimple(t *testing.T) {
+	c := packages.NewConfig()
 	files := []fileSpec{{path: "lib.go", content: "package lib"}}
 	want := []*packages.Package{
 		{
@@ -117,10 +120,11 @@ func TestWalkSimple(t *testing.T) {
 			},
 		},
 	}
-	checkFiles(t, files, "", want)
+	checkFiles(t, c, files, "", want)
 }
 
 func TestWalkNested(t *testing.T) {
+	c := packages.NewConfig()
 	files := []fileSpec{
 		{path: "a/foo.go", content: "package a"},
 		{path: "b/c/bar.go", content: "package c"},
@@ -155,10 +159,11 @@ func TestWalkNested(t *testing.T) {
 			},
 		},
 	}
-	checkFiles(t, files, "", want)
+	checkFiles(t, c, files, "", want)
 }
 
 func TestMultiplePackagesWithDefault(t *testing.T) {
+	c := packages.NewConfig()
 	files := []fileSpec{
 		{path: "a/a.go", content: "package a"},
 		{path: "a/b.go", content: "package b"},
@@ -174,10 +179,11 @@ func TestMultiplePackagesWithDefault(t *testing.T) {
 			},
 		},
 	}
-	checkFiles(t, files, "", want)
+	checkFiles(t, c, files, "", want)
 }
 
 func TestMultiplePackagesWithoutDefault(t *testing.T) {
+	c := packages.NewConfig()
 	files := []fileSpec{
 		{path: "a/b.go", content: "package b"},
 		{path: "a/c.go", content: "package c"},
@@ -188,13 +194,162 @@ func TestMultiplePackagesWithoutDefault(t *testing.T) {
 	}
 	defer os.RemoveAll(dir)
 
-	got := walkPackages(dir, "", dir)
+	got := walkPackages(c, dir, "", dir)
 	if len(got) > 0 {
 		t.Errorf("got %v; want empty slice", got)
 	}
 }
 
+func TestMultiplePackagesError(t *testing.T) {
+	c := packages.NewConfig()
+	files := []fileSpec{
+		{path: "a/b.go", content: "package b"},
+		{path: "a/c.go", content: "package c"},
+		{path: "a/c_test.go", content: "package c"},
+	}
+	dir, err := createFiles(files)
+	if err != nil {
+		t.Fatalf("createFiles() failed with %v; want success", err)
+	}
+	defer os.RemoveAll(dir)
+
+	var names []string
+	packages.WalkWithErrors(c, nil, nil, dir, "example.com/repo", dir, func(pkg *packages.Package) {
+		t.Errorf("got package %q; want none", pkg.Name)
+	}, func(err *packages.DirError) {
+		for _, e := range err.Errs {
+			nameErr, ok := e.(*packages.PackageNameError)
+			if !ok {
+				t.Errorf("got error %v; want PackageNameError", e)
+				continue
+			}
+			for _, pkg := range nameErr.Packages {
+				names = append(names, pkg.Name)
+			}
+		}
+	})
+	if want := []string{"b", "c"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("got candidates %q; want %q", names, want)
+	}
+}
+
+func TestMultiplePackagesWithDirective(t *testing.T) {
+	c := packages.NewConfig()
+	files := []fileSpec{
+		{path: "a/BUILD", content: "# gazelle:package_name c"},
+		{path: "a/a.go", content: "package a"},
+		{path: "a/c.go", content: "package c"},
+	}
+	want := []*packages.Package{
+		{
+			Name: "c",
+			Dir:  "a",
+			Library: packages.Target{
+				Sources: packages.PlatformStrings{
+					Generic: []string{"c.go"},
+				},
+			},
+		},
+	}
+	checkFiles(t, c, files, "", want)
+}
+
+func TestMultiplePackagesChooseLargest(t *testing.T) {
+	c := packages.NewConfig()
+	c.ChoosePackage = packages.ChooseLargestPackage
+
+	files := []fileSpec{
+		{path: "a/b.go", content: "package b"},
+		{path: "a/c.go", content: "package c"},
+		{path: "a/c_test.go", content: "package c"},
+	}
+	want := []*packages.Package{
+		{
+			Name: "c",
+			Dir:  "a",
+			Library: packages.Target{
+				Sources: packages.PlatformStrings{
+					Generic: []string{"c.go"},
+				},
+			},
+			Test: packages.Target{
+				Sources: packages.PlatformStrings{
+					Generic: []string{"c_test.go"},
+				},
+			},
+		},
+	}
+	checkFiles(t, c, files, "", want)
+}
+
+func TestWalkAllPackages(t *testing.T) {
+	c := packages.NewConfig()
+	c.EmitAllPackages = true
+
+	files := []fileSpec{
+		{path: "a/a.go", content: "package a"},
+		{path: "a/c.go", content: "package c"},
+		{path: "a/b.go", content: "package b"},
+		{path: "a/data.txt"},
+		{path: "d/e.go", content: "package e"},
+		{path: "d/f.go", content: "package f"},
+	}
+	want := []*packages.Package{
+		{
+			Name: "a",
+			Dir:  "a",
+			Library: packages.Target{
+				Sources: packages.PlatformStrings{
+					Generic: []string{"a.go"},
+				},
+			},
+		},
+		{
+			Name:  "b",
+			Dir:   "a",
+			Extra: true,
+			Library: packages.Target{
+				Sources: packages.PlatformStrings{
+					Generic: []string{"b.go"},
+				},
+			},
+		},
+		{
+			Name:  "c",
+			Dir:   "a",
+			Extra: true,
+			Library: packages.Target{
+				Sources: packages.PlatformStrings{
+					Generic: []string{"c.go"},
+				},
+			},
+		},
+		{
+			Name:  "e",
+			Dir:   "d",
+			Extra: true,
+			Library: packages.Target{
+				Sources: packages.PlatformStrings{
+					Generic: []string{"e.go"},
+				},
+			},
+		},
+		{
+			Name:  "f",
+			Dir:   "d",
+			Extra: true,
+			Library: packages.Target{
+				Sources: packages.PlatformStrings{
+					Generic: []string{"f.go"},
+				},
+			},
+		},
+	}
+	checkFiles(t, c, files, "", want)
+}
+
 func TestRootWithPrefix(t *testing.T) {
+	c := packages.NewConfig()
 	files := []fileSpec{
 		{path: "a.go", content: "package a"},
 		{path: "b.go", content: "package b"},
@@ -209,10 +364,11 @@ func TestRootWithPrefix(t *testing.T) {
 			},
 		},
 	}
-	checkFiles(t, files, "github.com/a", want)
+	checkFiles(t, c, files, "github.com/a", want)
 }
 
 func TestRootWithoutPrefix(t *testing.T) {
+	c := packages.NewConfig()
 	files := []fileSpec{
 		{path: "a.go", content: "package a"},
 		{path: "b.go", content: "package b"},
@@ -223,8 +379,1641 @@ func TestRootWithoutPrefix(t *testing.T) {
 	}
 	defer os.RemoveAll(dir)
 
-	got := walkPackages(dir, "", dir)
+	got := walkPackages(c, dir, "", dir)
 	if len(got) > 0 {
 		t.Errorf("got %v; want empty slice", got)
 	}
 }
+
+func TestWalkVendor(t *testing.T) {
+	c := packages.NewConfig()
+	files := []fileSpec{
+		{path: "lib/lib.go", content: "package lib"},
+		{path: "vendor/example.com/dep/dep.go", content: "package dep"},
+		{path: "vendor/example.com/dep/vendor/example.com/inner/inner.go", content: "package inner"},
+	}
+	want := []*packages.Package{
+		{
+			Name: "lib",
+			Dir:  "lib",
+			Library: packages.Target{
+				Sources: packages.PlatformStrings{
+					Generic: []string{"lib.go"},
+				},
+			},
+		},
+		{
+			Name: "dep",
+			Dir:  "vendor/example.com/dep",
+			Library: packages.Target{
+				Sources: packages.PlatformStrings{
+					Generic: []string{"dep.go"},
+				},
+			},
+			Vendored:   true,
+			ImportPath: "example.com/dep",
+		},
+		{
+			Name: "inner",
+			Dir:  "vendor/example.com/dep/vendor/example.com/inner",
+			Library: packages.Target{
+				Sources: packages.PlatformStrings{
+					Generic: []string{"inner.go"},
+				},
+			},
+			Vendored:   true,
+			ImportPath: "example.com/inner",
+		},
+	}
+	checkFiles(t, c, files, "example.com/repo", want)
+}
+
+func TestWalkWorkspaceModules(t *testing.T) {
+	c := packages.NewConfig()
+	files := []fileSpec{
+		{path: "go.work", content: "go 1.18\n\nuse (\n\t./mod\n)\n"},
+		{path: "mod/go.mod", content: "module example.com/foo\n"},
+		{path: "mod/foo.go", content: "package foo"},
+		{path: "mod/bar.go", content: "package bar"},
+	}
+	want := []*packages.Package{
+		{
+			Name: "foo",
+			Dir:  "mod",
+			Library: packages.Target{
+				Sources: packages.PlatformStrings{
+					Generic: []string{"foo.go"},
+				},
+			},
+		},
+	}
+	checkFiles(t, c, files, "example.com/repo", want)
+}
+
+func TestWalkPrefixDirective(t *testing.T) {
+	c := packages.NewConfig()
+	files := []fileSpec{
+		{path: "other/BUILD", content: "# gazelle:prefix example.com/renamed\n"},
+		{path: "other/other.go", content: "package other"},
+		{path: "other/renamed.go", content: "package renamed"},
+		{path: "other/sub/sub.go", content: "package sub"},
+		{path: "plain/plain.go", content: "package plain"},
+	}
+	root := &packages.ModuleRoot{Rel: "other", Path: "example.com/renamed"}
+	want := []*packages.Package{
+		{
+			Name: "renamed",
+			Dir:  "other",
+			Library: packages.Target{
+				Sources: packages.PlatformStrings{
+					Generic: []string{"renamed.go"},
+				},
+			},
+			ImportPath: "example.com/renamed",
+			PrefixRoot: root,
+		},
+		{
+			Name: "sub",
+			Dir:  "other/sub",
+			Library: packages.Target{
+				Sources: packages.PlatformStrings{
+					Generic: []string{"sub.go"},
+				},
+			},
+			ImportPath: "example.com/renamed/sub",
+			PrefixRoot: root,
+		},
+		{
+			Name: "plain",
+			Dir:  "plain",
+			Library: packages.Target{
+				Sources: packages.PlatformStrings{
+					Generic: []string{"plain.go"},
+				},
+			},
+		},
+	}
+	checkFiles(t, c, files, "example.com/repo", want)
+}
+
+func TestFindPrefixRoots(t *testing.T) {
+	c := packages.NewConfig()
+	dir, err := createFiles([]fileSpec{
+		{path: "other/BUILD", content: "# gazelle:prefix example.com/renamed\n"},
+		{path: "other/inner/BUILD", content: "# gazelle:prefix example.com/inner\n"},
+		{path: "other/inner/sub/sub.go", content: "package sub"},
+		{path: "ignored/BUILD", content: "# gazelle:prefix example.com/ignored\n"},
+		{path: "testdata/BUILD", content: "# gazelle:prefix example.com/testdata\n"},
+		{path: ".bazelignore", content: "ignored\n"},
+	})
+	defer os.RemoveAll(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := packages.FindPrefixRoots(c, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []packages.ModuleRoot{
+		{Rel: "other", Path: "example.com/renamed"},
+		{Rel: "other/inner", Path: "example.com/inner"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %#v; want %#v", got, want)
+	}
+}
+
+func TestWalkSymlinks(t *testing.T) {
+	files := []fileSpec{
+		{path: "repo/lib/lib.go", content: "package lib"},
+		{path: "shared/gen/gen.go", content: "package gen"},
+	}
+	dir, err := createFiles(files)
+	if err != nil {
+		t.Fatalf("createFiles() failed with %v; want success", err)
+	}
+	defer os.RemoveAll(dir)
+	repoRoot := filepath.Join(dir, "repo")
+	if err := os.Symlink(filepath.Join(dir, "shared", "gen"), filepath.Join(repoRoot, "gen")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(repoRoot, filepath.Join(repoRoot, "lib", "loop")); err != nil {
+		t.Fatal(err)
+	}
+
+	lib := &packages.Package{
+		Name: "lib",
+		Dir:  filepath.Join(repoRoot, "lib"),
+		Library: packages.Target{
+			Sources: packages.PlatformStrings{
+				Generic: []string{"lib.go"},
+			},
+		},
+	}
+	gen := &packages.Package{
+		Name: "gen",
+		Dir:  filepath.Join(repoRoot, "gen"),
+		Library: packages.Target{
+			Sources: packages.PlatformStrings{
+				Generic: []string{"gen.go"},
+			},
+		},
+	}
+
+	for _, tc := range []struct {
+		desc     string
+		all      bool
+		followed map[string]bool
+		want     []*packages.Package
+	}{
+		{
+			desc: "not followed",
+			want: []*packages.Package{lib},
+		}, {
+			desc:     "allowlisted",
+			followed: map[string]bool{"gen": true},
+			want:     []*packages.Package{gen, lib},
+		}, {
+			desc: "all with cycle",
+			all:  true,
+			want: []*packages.Package{gen, lib},
+		},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			c := packages.NewConfig()
+			c.FollowSymlinks = tc.all
+			c.FollowedSymlinks = tc.followed
+			got := walkPackages(c, repoRoot, "example.com/repo", repoRoot)
+			checkPackages(t, got, tc.want)
+		})
+	}
+}
+
+func TestWalkBuildTags(t *testing.T) {
+	c := packages.NewConfig()
+	files := []fileSpec{
+		{path: "lib/a.go", content: "// +build foo,!bar\n\npackage lib"},
+		{path: "lib/b.go", content: "// +build baz foo\n\npackage lib"},
+		{path: "lib/c.go", content: "package lib"},
+	}
+	want := []*packages.Package{
+		{
+			Name: "lib",
+			Dir:  "lib",
+			Library: packages.Target{
+				Sources: packages.PlatformStrings{
+					Generic: []string{"c.go"},
+				},
+			},
+			BuildTags: []string{"bar", "baz", "foo"},
+		},
+	}
+	checkFiles(t, c, files, "example.com/repo", want)
+}
+
+func TestWalkImportCommentMismatch(t *testing.T) {
+	c := packages.NewConfig()
+	files := []fileSpec{
+		{path: "lib/a.go", content: "package lib // import \"example.com/lib\"\n"},
+		{path: "lib/b.go", content: "package lib // import \"example.com/other\"\n"},
+	}
+	want := []*packages.Package{
+		{
+			Name: "lib",
+			Dir:  "lib",
+			Library: packages.Target{
+				Sources: packages.PlatformStrings{
+					Generic: []string{"a.go", "b.go"},
+				},
+			},
+			ImportComment: "example.com/lib",
+		},
+	}
+	checkFiles(t, c, files, "example.com/repo", want)
+}
+
+func TestWalkProtos(t *testing.T) {
+	c := packages.NewConfig()
+	files := []fileSpec{
+		{path: "foo/foo.pb.go", content: "package foo"},
+		{
+			path: "foo/a.proto",
+			content: `syntax = "proto3";
+
+// package old.foo;
+/* option go_package = "example.com/old"; */
+package example.foo;
+
+option go_package = "example.com/repo/foo;foo";
+`,
+		},
+		{
+			path:    "foo/b.proto",
+			content: "syntax = 'proto3';\npackage example.foo;\noption go_package='example.com/repo/foo;foo';\n",
+		},
+		{path: "bar/bar.go", content: "package bar"},
+		{path: "bar/a.proto", content: "package example.bar;\n"},
+		{path: "bar/b.proto", content: "package example.baz;\n"},
+		{path: "baz/baz.go", content: "package baz"},
+		{path: "baz/a.proto", content: "package example.baz;\noption go_package = \"example.com/repo/baz\";\n"},
+		{path: "baz/b.proto", content: "package example.baz;\noption go_package = \"example.com/other\";\n"},
+	}
+	dir, err := createFiles(files)
+	if err != nil {
+		t.Fatalf("createFiles() failed with %v; want success", err)
+	}
+	defer os.RemoveAll(dir)
+
+	var got []*packages.Package
+	var errs []*packages.DirError
+	packages.WalkWithErrors(c, nil, nil, dir, "example.com/repo", dir, func(pkg *packages.Package) {
+		got = append(got, pkg)
+	}, func(err *packages.DirError) {
+		errs = append(errs, err)
+	})
+	if len(got) != 3 {
+		t.Fatalf("got %d packages; want 3", len(got))
+	}
+
+	bar := got[0]
+	if !reflect.DeepEqual(bar.Protos, []string{"a.proto"}) || bar.ProtoPackage != "example.bar" {
+		t.Errorf("got protos %q with package %q; want [a.proto] with package example.bar", bar.Protos, bar.ProtoPackage)
+	}
+	if len(errs) != 1 || errs[0].Dir != filepath.Join(dir, "bar") || len(errs[0].Errs) != 1 {
+		t.Errorf("got errors %v; want one error for package mismatch in bar", errs)
+	}
+
+	baz := got[1]
+	if !reflect.DeepEqual(baz.Protos, []string{"a.proto", "b.proto"}) || baz.ProtoGoPackage != "example.com/repo/baz" {
+		t.Errorf("got protos %q with go_package %q; want [a.proto b.proto] with go_package example.com/repo/baz", baz.Protos, baz.ProtoGoPackage)
+	}
+
+	foo := got[2]
+	if !reflect.DeepEqual(foo.Protos, []string{"a.proto", "b.proto"}) {
+		t.Errorf("got protos %q; want [a.proto b.proto]", foo.Protos)
+	}
+	if foo.ProtoPackage != "example.foo" {
+		t.Errorf("got proto package %q; want example.foo", foo.ProtoPackage)
+	}
+	if foo.ProtoGoPackage != "example.com/repo/foo;foo" {
+		t.Errorf("got go_package %q; want example.com/repo/foo;foo", foo.ProtoGoPackage)
+	}
+}
+
+func TestWalkAssembly(t *testing.T) {
+	c := packages.NewConfig()
+	files := []fileSpec{
+		{path: "lib/lib.go", content: "package lib"},
+		{path: "lib/asm.s", content: "TEXT ·f(SB),0,$0\n"},
+		{path: "lib/asm_amd64.s", content: "TEXT ·g(SB),0,$0\n"},
+		{path: "lib/asm_linux.s", content: "TEXT ·h(SB),0,$0\n"},
+		{path: "lib/asm_arm.s", content: "TEXT ·g(SB),0,$0\n"},
+		{path: "lib/asm_tag.s", content: "// +build darwin\n\nTEXT ·i(SB),0,$0\n"},
+		{path: "lib/cgo_only.S", content: "nop\n"},
+	}
+	dir, err := createFiles(files)
+	if err != nil {
+		t.Fatalf("createFiles() failed with %v; want success", err)
+	}
+	defer os.RemoveAll(dir)
+
+	var got []*packages.Package
+	packages.Walk(c, nil, packages.DefaultPlatformConstraints, dir, "example.com/repo", dir, func(pkg *packages.Package) {
+		got = append(got, pkg)
+	})
+	if len(got) != 1 {
+		t.Fatalf("got %d packages; want 1", len(got))
+	}
+	// .S files are only built in cgo packages, and there are no default
+	// platforms for arm.
+	want := packages.PlatformStrings{
+		Generic: []string{"lib.go", "asm.s"},
+		Platform: map[string][]string{
+			"@io_bazel_rules_go//go/platform:darwin_amd64": {
+				"asm_amd64.s",
+				"asm_tag.s",
+			},
+			"@io_bazel_rules_go//go/platform:linux_amd64": {
+				"asm_amd64.s",
+				"asm_linux.s",
+			},
+			"@io_bazel_rules_go//go/platform:windows_amd64": {
+				"asm_amd64.s",
+			},
+		},
+	}
+	if !reflect.DeepEqual(got[0].Library.Sources, want) {
+		t.Errorf("got sources %#v; want %#v", got[0].Library.Sources, want)
+	}
+}
+
+func TestWalkPlatformTests(t *testing.T) {
+	c := packages.NewConfig()
+	files := []fileSpec{
+		{path: "lib/lib.go", content: "package lib"},
+		{path: "lib/lib_test.go", content: "package lib"},
+		{path: "lib/lib_linux_test.go", content: "package lib\n\nimport \"example.com/linux\"\n"},
+		{path: "lib/lib_amd64_test.go", content: "package lib"},
+		{path: "lib/lib_windows_amd64_test.go", content: "package lib_test"},
+		{path: "lib/lib_test_linux.go", content: "package lib"},
+	}
+	dir, err := createFiles(files)
+	if err != nil {
+		t.Fatalf("createFiles() failed with %v; want success", err)
+	}
+	defer os.RemoveAll(dir)
+
+	var got []*packages.Package
+	packages.Walk(c, nil, packages.DefaultPlatformConstraints, dir, "example.com/repo", dir, func(pkg *packages.Package) {
+		got = append(got, pkg)
+	})
+	if len(got) != 1 {
+		t.Fatalf("got %d packages; want 1", len(got))
+	}
+	// lib_test_linux.go is not a test file, since its name doesn't end
+	// with _test.go.
+	wantTest := packages.PlatformStrings{
+		Generic: []string{"lib_test.go"},
+		Platform: map[string][]string{
+			"@io_bazel_rules_go//go/platform:darwin_amd64":  {"lib_amd64_test.go"},
+			"@io_bazel_rules_go//go/platform:linux_amd64":   {"lib_amd64_test.go", "lib_linux_test.go"},
+			"@io_bazel_rules_go//go/platform:windows_amd64": {"lib_amd64_test.go"},
+		},
+	}
+	wantXTest := packages.PlatformStrings{
+		Platform: map[string][]string{
+			"@io_bazel_rules_go//go/platform:windows_amd64": {"lib_windows_amd64_test.go"},
+		},
+	}
+	if !reflect.DeepEqual(got[0].Test.Sources, wantTest) {
+		t.Errorf("got test sources %#v; want %#v", got[0].Test.Sources, wantTest)
+	}
+	if want := []string{"example.com/linux"}; !reflect.DeepEqual(got[0].Test.Imports.Platform["@io_bazel_rules_go//go/platform:linux_amd64"], want) || len(got[0].Test.Imports.Generic) > 0 {
+		t.Errorf("got test imports %#v; want %q on linux only", got[0].Test.Imports, want)
+	}
+	if !reflect.DeepEqual(got[0].XTest.Sources, wantXTest) {
+		t.Errorf("got xtest sources %#v; want %#v", got[0].XTest.Sources, wantXTest)
+	}
+	if want := []string{"lib_test_linux.go"}; !reflect.DeepEqual(got[0].Library.Sources.Platform["@io_bazel_rules_go//go/platform:linux_amd64"], want) {
+		t.Errorf("got library sources %#v; want %q on linux", got[0].Library.Sources, want)
+	}
+}
+
+func TestWalkObjC(t *testing.T) {
+	c := packages.NewConfig()
+	files := []fileSpec{
+		{path: "lib/lib.go", content: "package lib\n\nimport \"C\"\n"},
+		{path: "lib/bridge.m", content: "void f() {}\n"},
+		{path: "lib/bridge_amd64.mm", content: "void g() {}\n"},
+		{path: "lib/bridge_linux.m", content: "void h() {}\n"},
+		{path: "nocgo/nocgo.go", content: "package nocgo"},
+		{path: "nocgo/bridge.m", content: "void f() {}\n"},
+	}
+	dir, err := createFiles(files)
+	if err != nil {
+		t.Fatalf("createFiles() failed with %v; want success", err)
+	}
+	defer os.RemoveAll(dir)
+
+	got := make(map[string]*packages.Package)
+	packages.Walk(c, nil, packages.DefaultPlatformConstraints, dir, "example.com/repo", dir, func(pkg *packages.Package) {
+		got[pkg.Name] = pkg
+	})
+	if len(got) != 2 {
+		t.Fatalf("got %d packages; want 2", len(got))
+	}
+	// Objective-C files are only built on darwin. Files with another OS
+	// suffix are ignored, as are files in packages without cgo.
+	want := packages.PlatformStrings{
+		Generic: []string{"lib.go"},
+		Platform: map[string][]string{
+			"@io_bazel_rules_go//go/platform:darwin_amd64": {
+				"bridge.m",
+				"bridge_amd64.mm",
+			},
+		},
+	}
+	if !reflect.DeepEqual(got["lib"].CgoLibrary.Sources, want) {
+		t.Errorf("got sources %#v; want %#v", got["lib"].CgoLibrary.Sources, want)
+	}
+	if want := []string{"nocgo.go"}; !reflect.DeepEqual(got["nocgo"].Library.Sources.Generic, want) || !got["nocgo"].CgoLibrary.Sources.IsEmpty() {
+		t.Errorf("got sources %#v and cgo sources %#v; want %q only", got["nocgo"].Library.Sources, got["nocgo"].CgoLibrary.Sources, want)
+	}
+
+	// Without darwin platforms, no Objective-C files are listed.
+	platforms, err := packages.ParsePlatformConstraints([]string{"linux_amd64", "windows_amd64"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	packages.Walk(c, nil, platforms, dir, "example.com/repo", dir, func(pkg *packages.Package) {
+		got[pkg.Name] = pkg
+	})
+	want = packages.PlatformStrings{Generic: []string{"lib.go"}}
+	if !reflect.DeepEqual(got["lib"].CgoLibrary.Sources, want) {
+		t.Errorf("got sources without darwin %#v; want %#v", got["lib"].CgoLibrary.Sources, want)
+	}
+}
+
+func TestWalkCgoConstrainedSources(t *testing.T) {
+	c := packages.NewConfig()
+	license := "/*\n * Copyright 2017 Example Authors.\n */\n\n"
+	files := []fileSpec{
+		{path: "lib/lib.go", content: "package lib\n\nimport \"C\"\n"},
+		{path: "lib/common.c", content: license + "void f() {}\n"},
+		{path: "lib/epoll.c", content: license + "// +build linux\n\nvoid g() {}\n"},
+		{path: "lib/kqueue.h", content: license + "//go:build darwin\n\nvoid h();\n"},
+	}
+	dir, err := createFiles(files)
+	if err != nil {
+		t.Fatalf("createFiles() failed with %v; want success", err)
+	}
+	defer os.RemoveAll(dir)
+
+	var got *packages.Package
+	packages.Walk(c, nil, packages.DefaultPlatformConstraints, dir, "example.com/repo", dir, func(pkg *packages.Package) {
+		got = pkg
+	})
+	if got == nil {
+		t.Fatal("no package found")
+	}
+	want := packages.PlatformStrings{
+		Generic: []string{"lib.go", "common.c"},
+		Platform: map[string][]string{
+			"@io_bazel_rules_go//go/platform:darwin_amd64": {"kqueue.h"},
+			"@io_bazel_rules_go//go/platform:linux_amd64":  {"epoll.c"},
+		},
+	}
+	if !reflect.DeepEqual(got.CgoLibrary.Sources, want) {
+		t.Errorf("got sources %#v; want %#v", got.CgoLibrary.Sources, want)
+	}
+}
+
+func TestWalkCgoFiles(t *testing.T) {
+	c := packages.NewConfig()
+	files := []fileSpec{
+		{path: "lib/pure.go", content: "package lib\n"},
+		{path: "lib/cgo_linux.go", content: "package lib\n\nimport \"C\"\n"},
+		{path: "lib/cgo_plan9.go", content: "package lib\n\nimport \"C\"\n"},
+		{path: "lib/impl.c", content: "void f() {}\n"},
+		{path: "other/other.go", content: "package other\n"},
+		{path: "other/stub.c", content: "void g() {}\n"},
+	}
+	dir, err := createFiles(files)
+	if err != nil {
+		t.Fatalf("createFiles() failed with %v; want success", err)
+	}
+	defer os.RemoveAll(dir)
+
+	got := make(map[string]*packages.Package)
+	packages.Walk(c, nil, packages.DefaultPlatformConstraints, dir, "example.com/repo", dir, func(pkg *packages.Package) {
+		got[pkg.Name] = pkg
+	})
+	if want := []string{"cgo_linux.go"}; !reflect.DeepEqual(got["lib"].CgoFiles, want) {
+		t.Errorf("got lib cgo files %q; want %q", got["lib"].CgoFiles, want)
+	}
+	if want := []string{"pure.go"}; !reflect.DeepEqual(got["lib"].Library.Sources.Generic, want) {
+		t.Errorf("got lib sources %q; want %q", got["lib"].Library.Sources.Generic, want)
+	}
+	if want := []string{"impl.c"}; !reflect.DeepEqual(got["lib"].CgoLibrary.Sources.Generic, want) {
+		t.Errorf("got lib cgo sources %q; want %q", got["lib"].CgoLibrary.Sources.Generic, want)
+	}
+	if got["other"].CgoFiles != nil || got["other"].CgoLibrary.HasGo() || !got["other"].CgoLibrary.Sources.IsEmpty() {
+		t.Errorf("got cgo files in package without cgo: %#v", got["other"])
+	}
+}
+
+func TestWalkSynopsis(t *testing.T) {
+	c := packages.NewConfig()
+	files := []fileSpec{
+		{path: "a/a.go", content: "// Package a is first.\npackage a\n"},
+		{path: "a/doc.go", content: "// Package a is documented.\npackage a\n"},
+		{path: "a/a_test.go", content: "// Package a is tested.\npackage a\n"},
+		{path: "b/b.go", content: "package b\n"},
+		{path: "b/b_test.go", content: "// Package b is tested.\npackage b\n"},
+		{path: "c/c.go", content: "// Package c is like a.\n// It is not b.\npackage c\n"},
+	}
+	dir, err := createFiles(files)
+	if err != nil {
+		t.Fatalf("createFiles() failed with %v; want success", err)
+	}
+	defer os.RemoveAll(dir)
+
+	got := make(map[string]string)
+	packages.Walk(c, nil, packages.DefaultPlatformConstraints, dir, "example.com/repo", dir, func(pkg *packages.Package) {
+		got[pkg.Name] = pkg.Synopsis
+	})
+	want := map[string]string{
+		"a": "Package a is documented.",
+		"b": "",
+		"c": "Package c is like a.",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got synopses %q; want %q", got, want)
+	}
+}
+
+func TestWalkSyso(t *testing.T) {
+	c := packages.NewConfig()
+	files := []fileSpec{
+		{path: "lib/lib.go", content: "package lib"},
+		// .syso files are binary; they aren't read for build constraints.
+		{path: "lib/blob.syso", content: "// +build ignore\n\n"},
+		{path: "lib/rsrc_windows_amd64.syso", content: "\x00\x01"},
+	}
+	dir, err := createFiles(files)
+	if err != nil {
+		t.Fatalf("createFiles() failed with %v; want success", err)
+	}
+	defer os.RemoveAll(dir)
+
+	var got *packages.Package
+	packages.Walk(c, nil, packages.DefaultPlatformConstraints, dir, "example.com/repo", dir, func(pkg *packages.Package) {
+		got = pkg
+	})
+	if got == nil {
+		t.Fatal("no package found")
+	}
+	want := packages.PlatformStrings{
+		Generic: []string{"lib.go", "blob.syso"},
+		Platform: map[string][]string{
+			"@io_bazel_rules_go//go/platform:windows_amd64": {"rsrc_windows_amd64.syso"},
+		},
+	}
+	if !reflect.DeepEqual(got.Library.Sources, want) {
+		t.Errorf("got sources %#v; want %#v", got.Library.Sources, want)
+	}
+}
+
+func TestWalkMapFileSystem(t *testing.T) {
+	c := packages.NewConfig()
+	root := filepath.FromSlash("/repo")
+	c.FS = packages.MapFileSystem{
+		filepath.Join(root, "lib", "lib.go"):          "package lib\n\nimport \"example.com/repo/lib/deep\"\n",
+		filepath.Join(root, "lib", "lib_linux.go"):    "package lib\n",
+		filepath.Join(root, "lib", "deep", "deep.go"): "package deep\n\n//go:embed data\nvar _ string\n",
+		filepath.Join(root, "lib", "deep", "data"):    "hello\n",
+	}
+
+	got := make(map[string]*packages.Package)
+	packages.Walk(c, nil, packages.DefaultPlatformConstraints, root, "example.com/repo", root, func(pkg *packages.Package) {
+		got[pkg.Name] = pkg
+	})
+	if len(got) != 2 {
+		t.Fatalf("got %d packages; want 2", len(got))
+	}
+	if want := []string{"lib.go"}; !reflect.DeepEqual(got["lib"].Library.Sources.Generic, want) {
+		t.Errorf("got lib sources %#v; want %q", got["lib"].Library.Sources, want)
+	}
+	if want := []string{"lib_linux.go"}; !reflect.DeepEqual(got["lib"].Library.Sources.Platform["@io_bazel_rules_go//go/platform:linux_amd64"], want) {
+		t.Errorf("got lib sources %#v; want %q on linux", got["lib"].Library.Sources, want)
+	}
+	if want := []string{"example.com/repo/lib/deep"}; !reflect.DeepEqual(got["lib"].Library.Imports.Generic, want) {
+		t.Errorf("got lib imports %#v; want %q", got["lib"].Library.Imports, want)
+	}
+	if want := []string{"data"}; !reflect.DeepEqual(got["deep"].Library.EmbedSrcs.Generic, want) {
+		t.Errorf("got deep embedsrcs %#v; want %q", got["deep"].Library.EmbedSrcs, want)
+	}
+}
+
+func TestWalkOverlay(t *testing.T) {
+	c := packages.NewConfig()
+	files := []fileSpec{
+		{path: "lib/lib.go", content: "package lib\n"},
+	}
+	dir, err := createFiles(files)
+	if err != nil {
+		t.Fatalf("createFiles() failed with %v; want success", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// An unsaved edit adds an import, and a new file hasn't been saved yet.
+	c.FS = packages.Overlay{
+		Base: packages.OSFileSystem{},
+		Files: map[string][]byte{
+			filepath.Join(dir, "lib", "lib.go"):      []byte("package lib\n\nimport \"example.com/dep\"\n"),
+			filepath.Join(dir, "lib", "new_test.go"): []byte("package lib\n"),
+		},
+	}
+
+	var got *packages.Package
+	packages.Walk(c, nil, packages.DefaultPlatformConstraints, dir, "example.com/repo", dir, func(pkg *packages.Package) {
+		got = pkg
+	})
+	if got == nil {
+		t.Fatal("no package found")
+	}
+	if want := []string{"example.com/dep"}; !reflect.DeepEqual(got.Library.Imports.Generic, want) {
+		t.Errorf("got imports %#v; want %q", got.Library.Imports, want)
+	}
+	if want := []string{"new_test.go"}; !reflect.DeepEqual(got.Test.Sources.Generic, want) {
+		t.Errorf("got test sources %#v; want %q", got.Test.Sources, want)
+	}
+}
+
+func TestWalkExternalTests(t *testing.T) {
+	c := packages.NewConfig()
+	files := []fileSpec{
+		{path: "lib/lib.go", content: "package lib"},
+		{path: "lib/lib_test.go", content: "package lib\n\nimport \"example.com/internal/helper\"\n"},
+		{path: "lib/lib_external_test.go", content: "package lib_test\n\nimport \"example.com/repo/lib\"\n"},
+		{path: "lib/other_external_test.go", content: "package lib_test\n\nimport \"example.com/external/check\"\n"},
+		{path: "integration/integration_test.go", content: "package integration_test\n\nimport \"example.com/repo/lib\"\n"},
+	}
+	want := []*packages.Package{
+		{
+			Name: "integration",
+			Dir:  "integration",
+			XTest: packages.Target{
+				Sources: packages.PlatformStrings{
+					Generic: []string{"integration_test.go"},
+				},
+				Imports: packages.PlatformStrings{
+					Generic: []string{"example.com/repo/lib"},
+				},
+			},
+		},
+		{
+			Name: "lib",
+			Dir:  "lib",
+			Library: packages.Target{
+				Sources: packages.PlatformStrings{
+					Generic: []string{"lib.go"},
+				},
+			},
+			Test: packages.Target{
+				Sources: packages.PlatformStrings{
+					Generic: []string{"lib_test.go"},
+				},
+				Imports: packages.PlatformStrings{
+					Generic: []string{"example.com/internal/helper"},
+				},
+			},
+			XTest: packages.Target{
+				Sources: packages.PlatformStrings{
+					Generic: []string{"lib_external_test.go", "other_external_test.go"},
+				},
+				Imports: packages.PlatformStrings{
+					Generic: []string{"example.com/repo/lib", "example.com/external/check"},
+				},
+			},
+		},
+	}
+	checkFiles(t, c, files, "example.com/repo", want)
+}
+
+func TestWalkEmbed(t *testing.T) {
+	c := packages.NewConfig()
+	files := []fileSpec{
+		{path: "lib/lib.go", content: "package lib\n\nimport _ \"embed\"\n\n//go:embed version.txt\nvar version string\n"},
+		{path: "lib/assets_linux.go", content: "package lib\n\nimport \"embed\"\n\n//go:embed static\nvar assets embed.FS\n"},
+		{path: "lib/version.txt", content: "1.0"},
+		{path: "lib/static/index.html", content: ""},
+		{path: "lib/static/.hidden", content: ""},
+	}
+	dir, err := createFiles(files)
+	if err != nil {
+		t.Fatalf("createFiles() failed with %v; want success", err)
+	}
+	defer os.RemoveAll(dir)
+
+	var got []*packages.Package
+	packages.Walk(c, nil, packages.DefaultPlatformConstraints, dir, "example.com/repo", dir, func(pkg *packages.Package) {
+		got = append(got, pkg)
+	})
+	if len(got) != 1 {
+		t.Fatalf("got %d packages; want 1", len(got))
+	}
+	if want := []string{"version.txt"}; !reflect.DeepEqual(got[0].Library.EmbedSrcs.Generic, want) {
+		t.Errorf("got generic embedsrcs %q; want %q", got[0].Library.EmbedSrcs.Generic, want)
+	}
+	if want := []string{"static/index.html"}; !reflect.DeepEqual(got[0].Library.EmbedSrcs.Platform["@io_bazel_rules_go//go/platform:linux_amd64"], want) {
+		t.Errorf("got embedsrcs %#v; want %q on linux", got[0].Library.EmbedSrcs, want)
+	}
+}
+
+func TestWalkBazelIgnore(t *testing.T) {
+	c := packages.NewConfig()
+	files := []fileSpec{
+		{path: ".bazelignore", content: "# generated code\nthird_party/gen\n\nnode_modules/\n"},
+		{path: "lib/lib.go", content: "package lib"},
+		{path: "third_party/gen/gen.go", content: "package gen"},
+		{path: "node_modules/x/x.go", content: "package x"},
+		{path: "out/out.go", content: "package out"},
+	}
+	dir, err := createFiles(files)
+	if err != nil {
+		t.Fatalf("createFiles() failed with %v; want success", err)
+	}
+	defer os.RemoveAll(dir)
+	if err := os.Symlink(filepath.Join(dir, "out"), filepath.Join(dir, "bazel-out")); err != nil {
+		t.Fatal(err)
+	}
+	c.FollowSymlinks = true
+
+	want := []*packages.Package{
+		{
+			Name: "lib",
+			Dir:  filepath.Join(dir, "lib"),
+			Library: packages.Target{
+				Sources: packages.PlatformStrings{
+					Generic: []string{"lib.go"},
+				},
+			},
+		},
+		{
+			Name: "out",
+			Dir:  filepath.Join(dir, "out"),
+			Library: packages.Target{
+				Sources: packages.PlatformStrings{
+					Generic: []string{"out.go"},
+				},
+			},
+		},
+	}
+	got := walkPackages(c, dir, "example.com/repo", dir)
+	checkPackages(t, got, want)
+}
+
+func TestWalkTestSuites(t *testing.T) {
+	c := packages.NewConfig()
+	c.TestSuiteTags = map[string]bool{"integration": true}
+
+	files := []fileSpec{
+		{path: "lib/lib.go", content: "package lib"},
+		{path: "lib/unit_test.go", content: "// +build !integration\n\npackage lib\n\nimport \"example.com/unit\""},
+		{path: "lib/slow_test.go", content: "// +build integration\n\npackage lib\n\nimport \"example.com/slow\""},
+		{path: "lib/e2e_test.go", content: "// +build integration\n\npackage lib_test\n\nimport \"example.com/e2e\""},
+	}
+	want := []*packages.Package{
+		{
+			Name: "lib",
+			Dir:  "lib",
+			Library: packages.Target{
+				Sources: packages.PlatformStrings{
+					Generic: []string{"lib.go"},
+				},
+			},
+			Test: packages.Target{
+				Sources: packages.PlatformStrings{
+					Generic: []string{"unit_test.go"},
+				},
+				Imports: packages.PlatformStrings{
+					Generic: []string{"example.com/unit"},
+				},
+			},
+			TestSuites: map[string]*packages.TestSuite{
+				"integration": {
+					Test: packages.Target{
+						Sources: packages.PlatformStrings{
+							Generic: []string{"slow_test.go"},
+						},
+						Imports: packages.PlatformStrings{
+							Generic: []string{"example.com/slow"},
+						},
+					},
+					XTest: packages.Target{
+						Sources: packages.PlatformStrings{
+							Generic: []string{"e2e_test.go"},
+						},
+						Imports: packages.PlatformStrings{
+							Generic: []string{"example.com/e2e"},
+						},
+					},
+				},
+			},
+			BuildTags: []string{"integration"},
+		},
+	}
+	checkFiles(t, c, files, "example.com/repo", want)
+}
+
+func TestWalkExclude(t *testing.T) {
+	c := packages.NewConfig()
+	files := []fileSpec{
+		{path: "BUILD", content: "# gazelle:exclude third_party\n# gazelle:exclude lib/gen.go\n"},
+		{path: "lib/lib.go", content: "package lib"},
+		{path: "lib/gen.go", content: "package lib"},
+		{path: "lib/sub/BUILD.bazel", content: "# gazelle:exclude skip\n"},
+		{path: "lib/sub/skip/skip.go", content: "package skip"},
+		{path: "third_party/dep/dep.go", content: "package dep"},
+	}
+	want := []*packages.Package{
+		{
+			Name: "lib",
+			Dir:  "lib",
+			Library: packages.Target{
+				Sources: packages.PlatformStrings{
+					Generic: []string{"lib.go"},
+				},
+			},
+		},
+	}
+	checkFiles(t, c, files, "example.com/repo", want)
+}
+
+func TestWalkExcludeGenerated(t *testing.T) {
+	c := packages.NewConfig()
+	files := []fileSpec{
+		{path: "a/BUILD", content: "# gazelle:exclude_generated protobuf\n"},
+		{path: "a/a.go", content: "package a"},
+		{path: "a/a.pb.go", content: "package a"},
+		{path: "a/a.pb.gw.go", content: "package a"},
+		{path: "b/BUILD", content: "# gazelle:exclude_generated\n"},
+		{path: "b/b.go", content: "package b"},
+		{path: "b/b_gen.go", content: "package b"},
+		{path: "b/stringer.go", content: "// Code generated by stringer. DO NOT EDIT.\n\npackage b"},
+		{path: "c/c.go", content: "package c"},
+		{path: "c/c.gen.go", content: "package c"},
+	}
+	want := []*packages.Package{
+		{
+			Name: "a",
+			Dir:  "a",
+			Library: packages.Target{
+				Sources: packages.PlatformStrings{
+					Generic: []string{"a.go", "a.pb.gw.go"},
+				},
+			},
+		},
+		{
+			Name: "b",
+			Dir:  "b",
+			Library: packages.Target{
+				Sources: packages.PlatformStrings{
+					Generic: []string{"b.go"},
+				},
+			},
+		},
+		{
+			Name: "c",
+			Dir:  "c",
+			Library: packages.Target{
+				Sources: packages.PlatformStrings{
+					Generic: []string{"c.gen.go", "c.go"},
+				},
+			},
+		},
+	}
+	checkFiles(t, c, files, "example.com/repo", want)
+}
+
+func TestWalkSkipDirs(t *testing.T) {
+	c := packages.NewConfig()
+	files := []fileSpec{
+		{path: "lib/lib.go", content: "package lib"},
+		{path: "node_modules/x/x.go", content: "package x"},
+		{path: "web/node_modules/y/y.go", content: "package y"},
+		{path: "third_party/a/a.go", content: "package a"},
+		{path: "third_party/keep.go", content: "package third_party"},
+		{path: "lib/third_party/b/b.go", content: "package b"},
+	}
+	c.SkipDirs = []string{"node_modules", "third_party/*"}
+
+	want := []*packages.Package{
+		{
+			Name: "lib",
+			Dir:  "lib",
+			Library: packages.Target{
+				Sources: packages.PlatformStrings{
+					Generic: []string{"lib.go"},
+				},
+			},
+		},
+		{
+			Name: "b",
+			Dir:  "lib/third_party/b",
+			Library: packages.Target{
+				Sources: packages.PlatformStrings{
+					Generic: []string{"b.go"},
+				},
+			},
+		},
+		{
+			Name: "third_party",
+			Dir:  "third_party",
+			Library: packages.Target{
+				Sources: packages.PlatformStrings{
+					Generic: []string{"keep.go"},
+				},
+			},
+		},
+	}
+	checkFiles(t, c, files, "example.com/repo", want)
+}
+
+func TestWalkLargeDirs(t *testing.T) {
+	c := packages.NewConfig()
+	files := []fileSpec{
+		{path: "small/small.go", content: "package small"},
+		{path: "big/a.go", content: "package big"},
+		{path: "big/b.go", content: "package big"},
+		{path: "big/c.go", content: "package big"},
+		{path: "big/sub/sub.go", content: "package sub"},
+	}
+	c.MaxDirFiles = 2
+
+	newWant := func() []*packages.Package {
+		return []*packages.Package{
+			{
+				Name: "big",
+				Dir:  "big",
+				Library: packages.Target{
+					Sources: packages.PlatformStrings{
+						Generic: []string{"a.go", "b.go", "c.go"},
+					},
+				},
+			},
+			{
+				Name: "sub",
+				Dir:  "big/sub",
+				Library: packages.Target{
+					Sources: packages.PlatformStrings{
+						Generic: []string{"sub.go"},
+					},
+				},
+			},
+			{
+				Name: "small",
+				Dir:  "small",
+				Library: packages.Target{
+					Sources: packages.PlatformStrings{
+						Generic: []string{"small.go"},
+					},
+				},
+			},
+		}
+	}
+	checkFiles(t, c, files, "example.com/repo", newWant())
+
+	c.SkipLargeDirs = true
+	checkFiles(t, c, files, "example.com/repo", newWant()[1:])
+}
+
+func TestWalkManifest(t *testing.T) {
+	c := packages.NewConfig()
+	files := []fileSpec{
+		{path: "a/a.go", content: "package a"},
+		{path: "a/a_test.go", content: "package a"},
+		{path: "b/b.go", content: "package b"},
+	}
+	dir, err := createFiles(files)
+	if err != nil {
+		t.Fatalf("createFiles() failed with %v; want success", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// a/a_test.go and b are not listed.
+	m, err := packages.ReadManifest(strings.NewReader("a/a.go\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Manifest = m
+
+	want := []*packages.Package{
+		{
+			Name: "a",
+			Dir:  filepath.Join(dir, "a"),
+			Library: packages.Target{
+				Sources: packages.PlatformStrings{
+					Generic: []string{"a.go"},
+				},
+			},
+		},
+	}
+	got := walkPackages(c, dir, "example.com/repo", dir)
+	checkPackages(t, got, want)
+}
+
+func TestWalkSkipGenerated(t *testing.T) {
+	c := packages.NewConfig()
+	files := []fileSpec{
+		{path: "a/a.go", content: "package a"},
+		{path: "a/a.pb.go", content: "// Code generated by protoc-gen-go. DO NOT EDIT.\n\npackage a"},
+		{path: "a/stringer.go", content: "// Code generated by stringer. DO NOT EDIT.\n\npackage a"},
+		{path: "a/custom.go", content: "// @generated by tool\n\npackage a"},
+		{path: "a/late.go", content: "package a\n\n// Code generated by stringer. DO NOT EDIT.\n"},
+	}
+	defer func(re *regexp.Regexp) { packages.GeneratedHeaderPattern = re }(packages.GeneratedHeaderPattern)
+	c.SkipGenerated = true
+
+	want := []*packages.Package{
+		{
+			Name: "a",
+			Dir:  "a",
+			Library: packages.Target{
+				Sources: packages.PlatformStrings{
+					Generic: []string{"a.go", "custom.go", "late.go"},
+				},
+			},
+		},
+	}
+	checkFiles(t, c, files, "example.com/repo", want)
+
+	packages.GeneratedHeaderPattern = regexp.MustCompile(`^// @generated`)
+	want = []*packages.Package{
+		{
+			Name: "a",
+			Dir:  "a",
+			Library: packages.Target{
+				Sources: packages.PlatformStrings{
+					Generic: []string{"a.go", "a.pb.go", "late.go", "stringer.go"},
+				},
+			},
+			HasPbGo: true,
+		},
+	}
+	checkFiles(t, c, files, "example.com/repo", want)
+}
+
+func TestWalkExcludedByConstraints(t *testing.T) {
+	c := packages.NewConfig()
+	files := []fileSpec{
+		{path: "a/a.go", content: "// +build foo\n\npackage a"},
+		{path: "a/a_test.go", content: "// +build bar,!baz\n\npackage a"},
+		{path: "b/b.go", content: "package b"},
+		{path: "b/b_foo.go", content: "// +build foo\n\npackage b"},
+	}
+	dir, err := createFiles(files)
+	if err != nil {
+		t.Fatalf("createFiles() failed with %v; want success", err)
+	}
+	defer os.RemoveAll(dir)
+
+	var got []*packages.Package
+	var errs []*packages.DirError
+	packages.WalkWithErrors(c, nil, nil, dir, "example.com/repo", dir, func(pkg *packages.Package) {
+		got = append(got, pkg)
+	}, func(err *packages.DirError) {
+		errs = append(errs, err)
+	})
+	if len(got) != 1 || got[0].Name != "b" {
+		t.Errorf("got %d packages; want only b", len(got))
+	}
+	if len(errs) != 1 || len(errs[0].Errs) != 1 {
+		t.Fatalf("got errors %v; want one error for a", errs)
+	}
+	want := &packages.ExcludedError{
+		Dir:   filepath.Join(dir, "a"),
+		Files: []string{"a.go", "a_test.go"},
+		Tags:  []string{"bar", "baz", "foo"},
+	}
+	if got, ok := errs[0].Errs[0].(*packages.ExcludedError); !ok || !reflect.DeepEqual(got, want) {
+		t.Errorf("got error %#v; want %#v", errs[0].Errs[0], want)
+	}
+}
+
+func TestWalkSwig(t *testing.T) {
+	c := packages.NewConfig()
+	files := []fileSpec{
+		{path: "a/a.go", content: "package a"},
+		{path: "a/a.swig", content: "%module a\n"},
+		{path: "a/b.swigcxx", content: "%module a\n"},
+		{path: "a/c.swig", content: "// +build ignore\n\n%module a\n"},
+	}
+	want := []*packages.Package{
+		{
+			Name: "a",
+			Dir:  "a",
+			Library: packages.Target{
+				Sources: packages.PlatformStrings{
+					Generic: []string{"a.go"},
+				},
+			},
+			Swig: []string{"a.swig", "b.swigcxx"},
+		},
+	}
+	checkFiles(t, c, files, "example.com/repo", want)
+}
+
+func TestWalkIgnore(t *testing.T) {
+	c := packages.NewConfig()
+	files := []fileSpec{
+		{path: "a/a.go", content: "package a"},
+		{path: "a/gen.go", content: "// +build ignore\n\npackage main\n\nfunc main() {}\n"},
+		{path: "a/gen2.go", content: "//go:build ignore\n\npackage a\n\nimport \"fmt\"\n"},
+		{path: "a/tool.s", content: "// +build ignore\n\nTEXT ·f(SB),0,$0\n"},
+		{path: "b/gen.go", content: "// +build ignore\n\npackage main\n"},
+	}
+	want := []*packages.Package{
+		{
+			Name: "a",
+			Dir:  "a",
+			Library: packages.Target{
+				Sources: packages.PlatformStrings{
+					Generic: []string{"a.go"},
+				},
+			},
+			ToolSrcs: []string{"gen.go", "gen2.go"},
+		},
+		{
+			Name:     "main",
+			Dir:      "b",
+			ToolSrcs: []string{"gen.go"},
+		},
+	}
+	checkFiles(t, c, files, "example.com/repo", want)
+}
+
+func TestWalkMain(t *testing.T) {
+	c := packages.NewConfig()
+	files := []fileSpec{
+		{path: "cmd/cmd.go", content: "package main\n\nfunc main() {}\n"},
+		{path: "cmd/cmd_test.go", content: "package main\n\nimport \"testing\"\n\nfunc TestMain(m *testing.M) {}\n"},
+		{path: "nomain/nomain.go", content: "package main\n\nfunc helper() {}\n"},
+		{path: "nomain/nomain_test.go", content: "package main\n\nfunc main() {}\n"},
+	}
+	want := []*packages.Package{
+		{
+			Name: "main",
+			Dir:  "cmd",
+			Library: packages.Target{
+				Sources: packages.PlatformStrings{
+					Generic: []string{"cmd.go"},
+				},
+			},
+			Test: packages.Target{
+				Sources: packages.PlatformStrings{
+					Generic: []string{"cmd_test.go"},
+				},
+			},
+			HasMain: true,
+		},
+		{
+			Name: "main",
+			Dir:  "nomain",
+			Library: packages.Target{
+				Sources: packages.PlatformStrings{
+					Generic: []string{"nomain.go"},
+				},
+			},
+			Test: packages.Target{
+				Sources: packages.PlatformStrings{
+					Generic: []string{"nomain_test.go"},
+				},
+			},
+		},
+	}
+	checkFiles(t, c, files, "example.com/repo", want)
+}
+
+func TestWalkTestOnly(t *testing.T) {
+	c := packages.NewConfig()
+	files := []fileSpec{
+		{path: "a/a.go", content: "package a"},
+		{path: "a/a_test.go", content: "package a"},
+		{path: "b/b_test.go", content: "package b"},
+		{path: "c/c_test.go", content: "package c_test"},
+	}
+	want := []*packages.Package{
+		{
+			Name: "a",
+			Dir:  "a",
+			Library: packages.Target{
+				Sources: packages.PlatformStrings{
+					Generic: []string{"a.go"},
+				},
+			},
+			Test: packages.Target{
+				Sources: packages.PlatformStrings{
+					Generic: []string{"a_test.go"},
+				},
+			},
+		},
+		{
+			Name: "b",
+			Dir:  "b",
+			Test: packages.Target{
+				Sources: packages.PlatformStrings{
+					Generic: []string{"b_test.go"},
+				},
+			},
+		},
+		{
+			Name: "c",
+			Dir:  "c",
+			XTest: packages.Target{
+				Sources: packages.PlatformStrings{
+					Generic: []string{"c_test.go"},
+				},
+			},
+		},
+	}
+
+	dir, err := createFiles(files)
+	if err != nil {
+		t.Fatalf("createFiles() failed with %v; want success", err)
+	}
+	defer os.RemoveAll(dir)
+	for _, p := range want {
+		p.Dir = filepath.Join(dir, filepath.FromSlash(p.Dir))
+	}
+	got := walkPackages(c, dir, "example.com/repo", dir)
+	checkPackages(t, got, want)
+	for i, wantTestOnly := range []bool{false, true, true} {
+		if got := got[i].IsTestOnly(); got != wantTestOnly {
+			t.Errorf("%s: IsTestOnly() = %v; want %v", want[i].Name, got, wantTestOnly)
+		}
+	}
+}
+
+func TestWalkSrcsStyle(t *testing.T) {
+	c := packages.NewConfig()
+	files := []fileSpec{
+		{path: "a/BUILD", content: "# gazelle:srcs_style glob\n"},
+		{path: "a/a.go", content: "package a"},
+		{path: "a/b/b.go", content: "package b"},
+	}
+	want := []*packages.Package{
+		{
+			Name: "a",
+			Dir:  "a",
+			Library: packages.Target{
+				Sources: packages.PlatformStrings{
+					Generic: []string{"a.go"},
+				},
+			},
+			SrcsStyle: packages.SrcsStyleGlob,
+		},
+		{
+			Name: "b",
+			Dir:  "a/b",
+			Library: packages.Target{
+				Sources: packages.PlatformStrings{
+					Generic: []string{"b.go"},
+				},
+			},
+		},
+	}
+	checkFiles(t, c, files, "example.com/repo", want)
+}
+
+func TestWalkNestedRepos(t *testing.T) {
+	files := []fileSpec{
+		{path: "WORKSPACE"},
+		{path: "lib/lib.go", content: "package lib"},
+		{path: "sub/WORKSPACE"},
+		{path: "sub/sub.go", content: "package sub"},
+		{path: "other/WORKSPACE.bazel"},
+		{path: "other/inner/inner.go", content: "package inner"},
+	}
+	dir, err := createFiles(files)
+	if err != nil {
+		t.Fatalf("createFiles() failed with %v; want success", err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, tc := range []struct {
+		skip bool
+		want []string
+	}{
+		{skip: true, want: []string{"lib"}},
+		{skip: false, want: []string{"lib", "other/inner", "sub"}},
+	} {
+		c := packages.NewConfig()
+		c.SkipNestedRepos = tc.skip
+		var got []string
+		for _, pkg := range walkPackages(c, dir, "example.com/repo", dir) {
+			rel, _ := filepath.Rel(dir, pkg.Dir)
+			got = append(got, filepath.ToSlash(rel))
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("SkipNestedRepos=%v: got %q; want %q", tc.skip, got, tc.want)
+		}
+	}
+}
+
+func TestWalkSubdirs(t *testing.T) {
+	c := packages.NewConfig()
+	c.WalkSubdirs = false
+
+	files := []fileSpec{
+		{path: "a/a.go", content: "package a"},
+		{path: "a/b/b.go", content: "package b"},
+	}
+	dir, err := createFiles(files)
+	if err != nil {
+		t.Fatalf("createFiles() failed with %v; want success", err)
+	}
+	defer os.RemoveAll(dir)
+
+	var got []string
+	for _, pkg := range walkPackages(c, dir, "example.com/repo", filepath.Join(dir, "a")) {
+		got = append(got, pkg.Name)
+	}
+	if want := []string{"a"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q; want %q", got, want)
+	}
+}
+
+func TestWalkSubdirsAncestors(t *testing.T) {
+	c := packages.NewConfig()
+	c.WalkSubdirs = false
+	c.SkipDirs = []string{"skipped"}
+
+	files := []fileSpec{
+		{path: ".bazelignore", content: "ignored\n"},
+		{path: "BUILD", content: "# gazelle:exclude excluded\n"},
+		{path: "other/BUILD", content: "# gazelle:prefix example.com/renamed\n"},
+		{path: "other/sub/sub.go", content: "package sub"},
+		{path: "excluded/x.go", content: "package x"},
+		{path: "ignored/sub/y.go", content: "package y"},
+		{path: "skipped/z.go", content: "package z"},
+	}
+	dir, err := createFiles(files)
+	if err != nil {
+		t.Fatalf("createFiles() failed with %v; want success", err)
+	}
+	defer os.RemoveAll(dir)
+
+	got := walkPackages(c, dir, "example.com/repo", filepath.Join(dir, "other", "sub"))
+	want := []*packages.Package{
+		{
+			Name: "sub",
+			Dir:  filepath.Join(dir, "other", "sub"),
+			Library: packages.Target{
+				Sources: packages.PlatformStrings{
+					Generic: []string{"sub.go"},
+				},
+			},
+			ImportPath: "example.com/renamed/sub",
+			PrefixRoot: &packages.ModuleRoot{Rel: "other", Path: "example.com/renamed"},
+		},
+	}
+	checkPackages(t, got, want)
+
+	for _, sub := range []string{"excluded", "ignored/sub", "skipped"} {
+		if got := walkPackages(c, dir, "example.com/repo", filepath.Join(dir, filepath.FromSlash(sub))); len(got) > 0 {
+			t.Errorf("%s: got %d packages; want 0", sub, len(got))
+		}
+	}
+}
+
+func TestWalkMaxDepth(t *testing.T) {
+	c := packages.NewConfig()
+	c.MaxDepth = 1
+
+	files := []fileSpec{
+		{path: "a/a.go", content: "package a"},
+		{path: "a/b/b.go", content: "package b"},
+		{path: "a/b/c/c.go", content: "package c"},
+	}
+	dir, err := createFiles(files)
+	if err != nil {
+		t.Fatalf("createFiles() failed with %v; want success", err)
+	}
+	defer os.RemoveAll(dir)
+
+	var got []string
+	for _, pkg := range walkPackages(c, dir, "example.com/repo", filepath.Join(dir, "a")) {
+		got = append(got, pkg.Name)
+	}
+	if want := []string{"a", "b"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q; want %q", got, want)
+	}
+}
+
+func TestWalkGoVersion(t *testing.T) {
+	c := packages.NewConfig()
+	files := []fileSpec{
+		{path: "go.mod", content: "module example.com/repo\n\ngo 1.12\n"},
+		{path: "a/a.go", content: "package a"},
+		{path: "b/b.go", content: "//go:build go1.18\n\npackage b"},
+		{path: "b/b_test.go", content: "//go:build go1.20\n\npackage b"},
+		{path: "c/c.go", content: "//go:build go1.18\n\npackage c"},
+		{path: "c/c_old.go", content: "//go:build !go1.18\n\npackage c"},
+		{path: "d/go.mod", content: "module example.com/d\n"},
+		{path: "d/d.go", content: "package d"},
+	}
+	dir, err := createFiles(files)
+	if err != nil {
+		t.Fatalf("createFiles() failed with %v; want success", err)
+	}
+	defer os.RemoveAll(dir)
+
+	got := make(map[string]string)
+	packages.Walk(c, map[string]bool{"go1.18": true, "go1.20": true}, nil, dir, "example.com/repo", dir, func(pkg *packages.Package) {
+		got[pkg.Name] = pkg.GoVersion
+	})
+	want := map[string]string{"a": "1.12", "b": "1.18", "c": "1.12", "d": ""}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v; want %v", got, want)
+	}
+}
+
+func TestWalkCaseCollisions(t *testing.T) {
+	c := packages.NewConfig()
+	files := []fileSpec{
+		{path: "a/Foo.go", content: "package a"},
+		{path: "a/foo.go", content: "package a"},
+		{path: "a/bar.go", content: "package a"},
+		{path: "a/Data/x.txt"},
+		{path: "a/data"},
+	}
+	dir, err := createFiles(files)
+	if err != nil {
+		t.Fatalf("createFiles() failed with %v; want success", err)
+	}
+	defer os.RemoveAll(dir)
+
+	if _, err := os.Stat(filepath.Join(dir, "A", "foo.go")); err == nil {
+		t.Skip("file system is case-insensitive")
+	}
+
+	var pkgs []string
+	var got [][]string
+	packages.WalkWithErrors(c, nil, nil, dir, "example.com/repo", dir, func(pkg *packages.Package) {
+		pkgs = append(pkgs, pkg.Name)
+	}, func(err *packages.DirError) {
+		for _, e := range err.Errs {
+			if c, ok := e.(*packages.CaseCollisionError); ok {
+				got = append(got, c.Names)
+			} else {
+				t.Errorf("unexpected error: %v", e)
+			}
+		}
+	})
+	if want := []string{"a"}; !reflect.DeepEqual(pkgs, want) {
+		t.Errorf("got packages %q; want %q", pkgs, want)
+	}
+	if want := [][]string{{"Data", "data"}, {"Foo.go", "foo.go"}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got collisions %q; want %q", got, want)
+	}
+}
+
+func TestWalkTestdata(t *testing.T) {
+	c := packages.NewConfig()
+	files := []fileSpec{
+		{path: "a/a.go", content: "package a"},
+		{path: "a/a_test.go", content: "package a"},
+		{path: "a/testdata/golden.txt"},
+		{path: "a/testdata/in/input.json"},
+		{path: "a/testdata/pkg/BUILD"},
+		{path: "a/testdata/pkg/data.txt"},
+		{path: "b/b.go", content: "package b"},
+		{path: "b/testdata/unused.txt"},
+	}
+	want := []*packages.Package{
+		{
+			Name: "a",
+			Dir:  "a",
+			Library: packages.Target{
+				Sources: packages.PlatformStrings{
+					Generic: []string{"a.go"},
+				},
+			},
+			Test: packages.Target{
+				Sources: packages.PlatformStrings{
+					Generic: []string{"a_test.go"},
+				},
+			},
+			Testdata: []string{"testdata/golden.txt", "testdata/in/input.json"},
+		},
+		{
+			Name: "b",
+			Dir:  "b",
+			Library: packages.Target{
+				Sources: packages.PlatformStrings{
+					Generic: []string{"b.go"},
+				},
+			},
+		},
+	}
+	checkFiles(t, c, files, "", want)
+}
+
+func TestWalkTestdataManifest(t *testing.T) {
+	c := packages.NewConfig()
+	files := []fileSpec{
+		{path: "a/a_test.go", content: "package a"},
+		{path: "a/testdata/golden.txt"},
+		{path: "a/testdata/unlisted.txt"},
+		{path: "a/testdata/pkg/BUILD"},
+		{path: "a/testdata/pkg/data.txt"},
+		{path: "a/testdata/sub/in.txt"},
+	}
+	dir, err := createFiles(files)
+	if err != nil {
+		t.Fatalf("createFiles() failed with %v; want success", err)
+	}
+	defer os.RemoveAll(dir)
+
+	m, err := packages.ReadManifest(strings.NewReader(`a/a_test.go
+a/testdata/golden.txt
+a/testdata/pkg/BUILD
+a/testdata/pkg/data.txt
+a/testdata/sub/in.txt
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Manifest = m
+
+	want := []*packages.Package{
+		{
+			Name: "a",
+			Dir:  filepath.Join(dir, "a"),
+			Test: packages.Target{
+				Sources: packages.PlatformStrings{
+					Generic: []string{"a_test.go"},
+				},
+			},
+			Testdata: []string{"testdata/golden.txt", "testdata/sub/in.txt"},
+		},
+	}
+	got := walkPackages(c, dir, "example.com/repo", dir)
+	checkPackages(t, got, want)
+}
+
+func TestWalkUnderscoreDirs(t *testing.T) {
+	c := packages.NewConfig()
+	files := []fileSpec{
+		{path: "_examples/ex/ex.go", content: "package ex"},
+		{path: "_examples/ex/_ignored.go", content: "package ignored"},
+	}
+	want := []*packages.Package{
+		{
+			Name: "ex",
+			Dir:  "_examples/ex",
+			Library: packages.Target{
+				Sources: packages.PlatformStrings{
+					Generic: []string{"ex.go"},
+				},
+			},
+		},
+	}
+	checkFiles(t, c, files, "", want)
+
+	c.SkipDirs = []string{"_*"}
+	checkFiles(t, c, files, "", []*packages.Package{})
+}
+
+func TestWalkWithErrors(t *testing.T) {
+	c := packages.NewConfig()
+	files := []fileSpec{
+		{path: "a/b.go", content: "package b"},
+		{path: "a/c.go", content: "package c"},
+		{path: "bad/bad.go", content: "package"},
+		{path: "good/good.go", content: "package good"},
+	}
+	dir, err := createFiles(files)
+	if err != nil {
+		t.Fatalf("createFiles() failed with %v; want success", err)
+	}
+	defer os.RemoveAll(dir)
+
+	var pkgs []string
+	errDirs := make(map[string]int)
+	packages.WalkWithErrors(c, nil, nil, dir, "example.com/repo", dir, func(pkg *packages.Package) {
+		pkgs = append(pkgs, pkg.Name)
+	}, func(err *packages.DirError) {
+		rel, _ := filepath.Rel(dir, err.Dir)
+		errDirs[filepath.ToSlash(rel)] = len(err.Errs)
+	})
+	if want := []string{"good"}; !reflect.DeepEqual(pkgs, want) {
+		t.Errorf("got packages %q; want %q", pkgs, want)
+	}
+	if want := map[string]int{"a": 1, "bad": 1}; !reflect.DeepEqual(errDirs, want) {
+		t.Errorf("got errors %v; want %v", errDirs, want)
+	}
+}
@@ -0,0 +1,273 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package packages
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// ModuleRoot describes a module listed in a go.work file. Packages in the
+// module directory are named relative to the module path instead of the
+// repository's go_prefix.
+type ModuleRoot struct {
+	// Rel is the slash-separated path from the repository root to the module
+	// directory. It is empty if the module is at the repository root.
+	Rel string
+
+	// Path is the module path declared in the module's go.mod file.
+	Path string
+}
+
+// ImportPath returns the import path of the package in the directory "rel",
+// a slash-separated path from the repository root. "rel" must be inside
+// the module directory.
+func (m ModuleRoot) ImportPath(rel string) string {
+	if rel == m.Rel {
+		return m.Path
+	}
+	if m.Rel == "" {
+		return path.Join(m.Path, rel)
+	}
+	return path.Join(m.Path, strings.TrimPrefix(rel, m.Rel+"/"))
+}
+
+// ImportPath returns the import path of the package in the directory "rel",
+// a slash-separated path from the repository root. If "rel" is inside one of
+// "modules", the import path is relative to the module path. Otherwise, it is
+// relative to "goPrefix".
+func ImportPath(modules []ModuleRoot, goPrefix, rel string) string {
+	if m, ok := FindModule(modules, rel); ok {
+		return m.ImportPath(rel)
+	}
+	if rel == "" {
+		return goPrefix
+	}
+	return path.Join(goPrefix, rel)
+}
+
+// FindWorkspaceModules reads the go.work file at the root of the repository
+// and returns the modules listed in its "use" directives. nil is returned
+// without error if there is no go.work file.
+func FindWorkspaceModules(c *Config, repoRoot string) ([]ModuleRoot, error) {
+	workPath := filepath.Join(repoRoot, "go.work")
+	data, err := c.FS.ReadFile(workPath)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	dirs, err := readDirectiveArgs(workPath, data, "use")
+	if err != nil {
+		return nil, err
+	}
+
+	var modules []ModuleRoot
+	for _, dir := range dirs {
+		rel := path.Clean(filepath.ToSlash(dir))
+		if rel == "." {
+			rel = ""
+		}
+		if path.IsAbs(rel) || rel == ".." || strings.HasPrefix(rel, "../") {
+			return nil, fmt.Errorf("%s: module directory %q is outside the repository", workPath, dir)
+		}
+		modPath, err := ReadModulePath(c, filepath.Join(repoRoot, filepath.FromSlash(rel)))
+		if err != nil {
+			return nil, err
+		}
+		modules = append(modules, ModuleRoot{Rel: rel, Path: modPath})
+	}
+	return modules, nil
+}
+
+// ReadModulePath returns the module path declared in the go.mod file in
+// "dir". If there is no go.mod file, the error satisfies os.IsNotExist.
+func ReadModulePath(c *Config, dir string) (string, error) {
+	modPath := filepath.Join(dir, "go.mod")
+	data, err := c.FS.ReadFile(modPath)
+	if err != nil {
+		return "", err
+	}
+	names, err := readDirectiveArgs(modPath, data, "module")
+	if err != nil {
+		return "", err
+	}
+	if len(names) != 1 {
+		return "", fmt.Errorf("%s: expected exactly one module directive", modPath)
+	}
+	return names[0], nil
+}
+
+// ReadGoVersion returns the Go version in the go directive of the go.mod
+// file in "dir", like "1.18", or "" if there is none. If there is no go.mod
+// file, the error satisfies os.IsNotExist.
+func ReadGoVersion(c *Config, dir string) (string, error) {
+	modPath := filepath.Join(dir, "go.mod")
+	data, err := c.FS.ReadFile(modPath)
+	if err != nil {
+		return "", err
+	}
+	versions, err := readDirectiveArgs(modPath, data, "go")
+	if err != nil {
+		return "", err
+	}
+	if len(versions) == 0 {
+		return "", nil
+	}
+	if _, ok := goMinorVersion(versions[0]); !ok {
+		return "", fmt.Errorf("%s: invalid go version %q", modPath, versions[0])
+	}
+	return versions[0], nil
+}
+
+// findGoVersion returns the Go version in the go.mod file of the module
+// containing "dir", searching up to "repoRoot". "" is returned if no go.mod
+// file is found or it has no go directive.
+func (c *Config) findGoVersion(repoRoot, dir string) (string, error) {
+	for {
+		v, err := ReadGoVersion(c, dir)
+		if err == nil {
+			return v, nil
+		}
+		if !os.IsNotExist(err) {
+			return "", err
+		}
+		parent := filepath.Dir(dir)
+		if dir == repoRoot || parent == dir || !strings.HasPrefix(dir, repoRoot) {
+			return "", nil
+		}
+		dir = parent
+	}
+}
+
+// goMinorVersion returns the minor version of a Go 1 version like "1.18",
+// "1.21.0", or "1.21rc1". false is returned if "v" is not a Go 1 version.
+func goMinorVersion(v string) (int, bool) {
+	if !strings.HasPrefix(v, "1.") {
+		return 0, false
+	}
+	v = v[len("1."):]
+	i := 0
+	for i < len(v) && '0' <= v[i] && v[i] <= '9' {
+		i++
+	}
+	n, err := strconv.Atoi(v[:i])
+	if err != nil {
+		return 0, false
+	}
+	return n, true
+}
+
+// FindModule returns the module containing the directory "rel", a
+// slash-separated path from the repository root. If modules are nested,
+// the innermost module is returned. false is returned if no module
+// contains the directory.
+func FindModule(modules []ModuleRoot, rel string) (ModuleRoot, bool) {
+	var found ModuleRoot
+	ok := false
+	for _, m := range modules {
+		if m.Rel != "" && rel != m.Rel && !strings.HasPrefix(rel, m.Rel+"/") {
+			continue
+		}
+		if !ok || len(m.Rel) > len(found.Rel) {
+			found = m
+			ok = true
+		}
+	}
+	return found, ok
+}
+
+// ModLine is a line of a directive in a go.mod or go.work file.
+type ModLine struct {
+	// Line is the number of the line in the file, starting at 1.
+	Line int
+
+	// Args are the fields of the line after the directive's verb, or all
+	// fields of a line in a block. Quoted fields are unquoted.
+	Args []string
+}
+
+// ParseModDirective returns the lines of the directives named "verb" in
+// "data", the content of the go.mod or go.work file at "path". Both the
+// single-line form ("use ./a") and the block form ("use ( ... )") are
+// recognized, and comments are removed. Each line in a block is returned
+// separately.
+func ParseModDirective(path string, data []byte, verb string) ([]ModLine, error) {
+	var lines []ModLine
+	inBlock := false
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := scanner.Text()
+		if i := strings.Index(line, "//"); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		switch {
+		case len(fields) == 0:
+			continue
+		case inBlock && fields[0] == ")":
+			inBlock = false
+			continue
+		case inBlock:
+		case fields[0] == verb && len(fields) == 2 && fields[1] == "(":
+			inBlock = true
+			continue
+		case fields[0] == verb && len(fields) >= 2:
+			fields = fields[1:]
+		default:
+			continue
+		}
+
+		for i, f := range fields {
+			if strings.HasPrefix(f, `"`) || strings.HasPrefix(f, "`") {
+				var err error
+				if fields[i], err = strconv.Unquote(f); err != nil {
+					return nil, fmt.Errorf("%s:%d: %v", path, lineNum, err)
+				}
+			}
+		}
+		lines = append(lines, ModLine{Line: lineNum, Args: fields})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if inBlock {
+		return nil, fmt.Errorf("%s: unterminated %s block", path, verb)
+	}
+	return lines, nil
+}
+
+// readDirectiveArgs returns the first argument on each line of the
+// directives named "verb" in a go.mod or go.work file, as parsed by
+// ParseModDirective.
+func readDirectiveArgs(path string, data []byte, verb string) ([]string, error) {
+	lines, err := ParseModDirective(path, data, verb)
+	if err != nil {
+		return nil, err
+	}
+	args := make([]string, len(lines))
+	for i, l := range lines {
+		args[i] = l.Args[0]
+	}
+	return args, nil
+}
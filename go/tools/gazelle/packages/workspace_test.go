@@ -0,0 +1,149 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package packages
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestReadModulePath(t *testing.T) {
+	dir, err := ioutil.TempDir(os.Getenv("TEST_TMPDIR"), "workspace_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if _, err := ReadModulePath(NewConfig(), dir); !os.IsNotExist(err) {
+		t.Errorf("without go.mod: got error %v; want not exist", err)
+	}
+
+	for _, tc := range []struct {
+		desc, content, want string
+		wantErr             bool
+	}{
+		{
+			desc:    "simple",
+			content: "module example.com/repo\n\ngo 1.20\n",
+			want:    "example.com/repo",
+		}, {
+			desc:    "quoted with comment",
+			content: "// comment\nmodule \"example.com/quoted\" // trailing\n",
+			want:    "example.com/quoted",
+		}, {
+			desc:    "missing module",
+			content: "go 1.20\n",
+			wantErr: true,
+		},
+	} {
+		if err := ioutil.WriteFile(filepath.Join(dir, "go.mod"), []byte(tc.content), 0666); err != nil {
+			t.Fatal(err)
+		}
+		got, err := ReadModulePath(NewConfig(), dir)
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("%s: got %q; want error", tc.desc, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: got error %v; want success", tc.desc, err)
+		} else if got != tc.want {
+			t.Errorf("%s: got %q; want %q", tc.desc, got, tc.want)
+		}
+	}
+}
+
+func TestReadGoVersion(t *testing.T) {
+	dir, err := ioutil.TempDir(os.Getenv("TEST_TMPDIR"), "workspace_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if _, err := ReadGoVersion(NewConfig(), dir); !os.IsNotExist(err) {
+		t.Errorf("without go.mod: got error %v; want not exist", err)
+	}
+
+	for _, tc := range []struct {
+		desc, content, want string
+		wantErr             bool
+	}{
+		{
+			desc:    "simple",
+			content: "module example.com/repo\n\ngo 1.20\n",
+			want:    "1.20",
+		}, {
+			desc:    "patch",
+			content: "module example.com/repo\ngo 1.21.0 // toolchain\n",
+			want:    "1.21.0",
+		}, {
+			desc:    "missing",
+			content: "module example.com/repo\n",
+			want:    "",
+		}, {
+			desc:    "invalid",
+			content: "module example.com/repo\ngo latest\n",
+			wantErr: true,
+		},
+	} {
+		if err := ioutil.WriteFile(filepath.Join(dir, "go.mod"), []byte(tc.content), 0666); err != nil {
+			t.Fatal(err)
+		}
+		got, err := ReadGoVersion(NewConfig(), dir)
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("%s: got %q; want error", tc.desc, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: got error %v; want success", tc.desc, err)
+		} else if got != tc.want {
+			t.Errorf("%s: got %q; want %q", tc.desc, got, tc.want)
+		}
+	}
+}
+
+func TestParseModDirective(t *testing.T) {
+	data := []byte(`module example.com/repo
+
+require example.com/a v1.0.0 // indirect
+require (
+	"example.com/b" v1.2.0
+	example.com/c v0.1.0
+)
+`)
+	got, err := ParseModDirective("go.mod", data, "require")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []ModLine{
+		{Line: 3, Args: []string{"example.com/a", "v1.0.0"}},
+		{Line: 5, Args: []string{"example.com/b", "v1.2.0"}},
+		{Line: 6, Args: []string{"example.com/c", "v0.1.0"}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v; want %v", got, want)
+	}
+
+	if _, err := ParseModDirective("go.mod", []byte("require (\n\texample.com/a v1.0.0\n"), "require"); err == nil {
+		t.Errorf("unterminated block: got success; want error")
+	}
+}
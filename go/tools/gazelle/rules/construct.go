@@ -108,9 +108,10 @@ func newValue(val interface{}) bzl.Expr {
 			globArgs := []bzl.Expr{patternsValue}
 			if len(val.excludes) > 0 {
 				excludesValue := newValue(val.excludes)
-				globArgs = append(globArgs, &bzl.KeyValueExpr{
-					Key:   &bzl.StringExpr{Value: "excludes"},
-					Value: excludesValue,
+				globArgs = append(globArgs, &bzl.BinaryExpr{
+					X:  &bzl.LiteralExpr{Token: "exclude"},
+					Op: "=",
+					Y:  excludesValue,
 				})
 			}
 			return &bzl.CallExpr{
@@ -118,6 +119,13 @@ func newValue(val interface{}) bzl.Expr {
 				List: globArgs,
 			}
 
+		case globSources:
+			glob := newValue(val.glob)
+			if len(val.platform) == 0 {
+				return glob
+			}
+			return &bzl.BinaryExpr{X: glob, Op: "+", Y: newValue(val.platform)}
+
 		case packages.PlatformStrings:
 			gen := newValue(val.Generic)
 			if len(val.Platform) == 0 {
@@ -17,12 +17,13 @@ package rules
 
 import (
 	"fmt"
-	"log"
-	"os"
+	"path"
 	"path/filepath"
+	"sort"
 	"strings"
 
 	bzl "github.com/bazelbuild/buildtools/build"
+	"github.com/bazelbuild/rules_go/go/tools/gazelle/logging"
 	"github.com/bazelbuild/rules_go/go/tools/gazelle/packages"
 )
 
@@ -40,6 +41,12 @@ const (
 	// defaultProtosName is the name of a filegroup created
 	// whenever the library contains .pb.go files
 	defaultProtosName = "go_default_library_protos"
+	// defaultSwigName is the name of the filegroup containing SWIG
+	// interface files.
+	defaultSwigName = "go_default_library_swig"
+	// defaultToolSrcsName is the name of the filegroup containing .go files
+	// excluded by "+build ignore" comments.
+	defaultToolSrcsName = "go_default_library_tool_srcs"
 	// defaultCgoLibName is the name of the default cgo_library rule in a Go package directory.
 	defaultCgoLibName = "cgo_default_library"
 )
@@ -55,6 +62,64 @@ const (
 	Vendored
 )
 
+// Languages for which rules may be generated.
+const (
+	// GoLang covers go_prefix, go_library, cgo_library, go_binary, and
+	// go_test rules.
+	GoLang = "go"
+	// ProtoLang covers filegroups of .proto files.
+	ProtoLang = "proto"
+)
+
+// KnownLanguages lists the languages that may be selected in Languages.
+var KnownLanguages = []string{GoLang, ProtoLang}
+
+// Languages is the set of languages for which rules are generated. Since
+// the merger never removes existing rules, rules for languages not in this
+// set are left untouched in existing build files.
+var Languages = map[string]bool{
+	GoLang:    true,
+	ProtoLang: true,
+}
+
+// CustomKindAttrs maps rule kinds to attributes that are added to every
+// generated rule of that kind, for example, organizational metadata like
+// team = "backend". Values are copied into new rules. Since these attributes
+// are not merged, existing values are owned by the user.
+var CustomKindAttrs = map[string]map[string]bzl.Expr{}
+
+// PkgConfigLabels maps package names from "#cgo pkg-config" directives to
+// labels of cc_library rules that provide them. Generated rules list these
+// labels in cdeps. Packages without a label are reported and skipped.
+var PkgConfigLabels = map[string]string{}
+
+// ResolveRelocatedImports controls whether imports of relocated packages
+// listed in packages.RelocatedImports are resolved to the labels of the
+// packages that replace them.
+var ResolveRelocatedImports = false
+
+// ToolSrcsFilegroup controls whether a filegroup is generated for the .go
+// files in each package excluded by "+build ignore" comments, listed in
+// packages.Package.ToolSrcs.
+var ToolSrcsFilegroup = false
+
+// TestOnly controls whether generated rules are marked testonly, so that
+// only tests and other testonly rules may depend on them. This is set when
+// generating build files for a repository that is only needed by tests.
+// go_test and go_prefix rules are not marked.
+var TestOnly = false
+
+// UseImportComments controls whether the path in a package's import
+// comment (packages.Package.ImportComment) is used as the importpath of its
+// go_library when it differs from the import path computed from the
+// go_prefix. If false, a warning is logged instead.
+var UseImportComments = false
+
+// PackageDocComments controls whether the synopsis of a package's doc
+// comment (packages.Package.Synopsis) is added as a comment above its
+// go_library. Existing rules keep their comments.
+var PackageDocComments = false
+
 // Generator generates Bazel build rules for Go build targets
 type Generator interface {
 	// Generate generates build rules for build targets in a Go package in a
@@ -65,27 +130,52 @@ type Generator interface {
 	// directory is the repository root itself.
 	// "pkg" is a description about the package.
 	Generate(rel string, pkg *packages.Package) []*bzl.Rule
+
+	// AddImportComment records that the package in "rel" has the import
+	// comment "importpath". With UseImportComments, imports of that path
+	// from other packages resolve to the package's library. Comments should
+	// be added before rules are generated for the packages importing them.
+	AddImportComment(rel, importpath string)
 }
 
 // NewGenerator returns an implementation of Generator.
 //
+// "c" is the configuration packages were read with. Files in the repository
+// are read through its FS.
 // "repoRoot" is a path to the root directory of the repository.
 // "goPrefix" is the go_prefix corresponding to the repository root.
 // See also https://github.com/bazelbuild/rules_go#go_prefix.
 // "external" is how external packages should be resolved.
-func NewGenerator(repoRoot string, goPrefix string, external ExternalResolver) Generator {
+func NewGenerator(c *packages.Config, repoRoot string, goPrefix string, external ExternalResolver) Generator {
 	var (
 		// TODO(yugui) Support another resolver to cover the pattern 2 in
 		// https://github.com/bazelbuild/rules_go/issues/16#issuecomment-216010843
 		r = structuredResolver{goPrefix: goPrefix}
 	)
 
+	// Modules listed in go.work and directories with prefix directives are
+	// resolved within the repository, relative to the module directory. All
+	// of them are found up front, so imports of packages that haven't been
+	// generated yet resolve the same way.
+	modules, err := packages.FindWorkspaceModules(c, repoRoot)
+	if err != nil {
+		logging.Errorf(logging.At{File: repoRoot}, "%v", err)
+	}
+	prefixRoots, err := packages.FindPrefixRoots(c, repoRoot)
+	if err != nil {
+		logging.Errorf(logging.At{File: repoRoot}, "%v", err)
+	}
+	w := &workspaceResolver{}
+	for _, m := range append(modules, prefixRoots...) {
+		w.addModule(m)
+	}
+
 	var e labelResolver
 	switch external {
 	case External:
 		e = externalResolver{}
 	case Vendored:
-		e = vendoredResolver{}
+		e = vendoredResolver{repoRoot: repoRoot, fs: c.FS}
 	default:
 		return nil
 	}
@@ -93,8 +183,25 @@ func NewGenerator(repoRoot string, goPrefix string, external ExternalResolver) G
 	return &generator{
 		repoRoot: repoRoot,
 		goPrefix: goPrefix,
+		fs:       c.FS,
+		modules:  modules,
+		w:        w,
 		r: resolverFunc(func(importpath, dir string) (label, error) {
+			if ResolveRelocatedImports {
+				if to, ok := packages.RelocatedImport(importpath); ok {
+					importpath = to
+				}
+			}
+			if l, ok := resolveLocalOverride(importpath); ok {
+				return l, nil
+			}
+			if l, ok := w.resolveModule(importpath, dir); ok {
+				return l, nil
+			}
 			if importpath != goPrefix && !strings.HasPrefix(importpath, goPrefix+"/") && !isRelative(importpath) {
+				if l, ok := resolveKnownImport(importpath); ok {
+					return l, nil
+				}
 				return e.resolve(importpath, dir)
 			}
 			return r.resolve(importpath, dir)
@@ -105,14 +212,74 @@ func NewGenerator(repoRoot string, goPrefix string, external ExternalResolver) G
 type generator struct {
 	repoRoot string
 	goPrefix string
+	fs       packages.FileSystem
+	modules  []packages.ModuleRoot
+	w        *workspaceResolver
 	r        labelResolver
 }
 
+func (g *generator) AddImportComment(rel, importpath string) {
+	if UseImportComments {
+		g.w.addImportPath(importpath, rel)
+	}
+}
+
 func (g *generator) Generate(rel string, pkg *packages.Package) []*bzl.Rule {
 	var rules []*bzl.Rule
-	if rel == "" {
+	if Languages[GoLang] {
+		rules = append(rules, g.generateGo(rel, pkg)...)
+	}
+	if Languages[ProtoLang] {
+		if r := g.filegroup(rel, pkg); r != nil {
+			rules = append(rules, r)
+		}
+	}
+	for _, r := range rules {
+		addCustomKindAttrs(r)
+		if TestOnly {
+			setTestOnly(r)
+		}
+	}
+	return rules
+}
+
+// setTestOnly sets testonly = True on r, unless r is a test or go_prefix
+// rule, or it already has a testonly attribute.
+func setTestOnly(r *bzl.Rule) {
+	switch r.Kind() {
+	case "go_test", "go_prefix":
+		return
+	}
+	if r.Attr("testonly") == nil {
+		r.SetAttr("testonly", &bzl.LiteralExpr{Token: "True"})
+	}
+}
+
+// addCustomKindAttrs sets attributes from CustomKindAttrs on r, unless r
+// already has them. Attributes are added in sorted order.
+func addCustomKindAttrs(r *bzl.Rule) {
+	attrs := CustomKindAttrs[r.Kind()]
+	var keys []string
+	for k := range attrs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if r.Attr(k) == nil {
+			r.SetAttr(k, attrs[k])
+		}
+	}
+}
+
+func (g *generator) generateGo(rel string, pkg *packages.Package) []*bzl.Rule {
+	var rules []*bzl.Rule
+	if rel == "" && !pkg.Extra {
 		rules = append(rules, newRule("go_prefix", []interface{}{g.goPrefix}, nil))
 	}
+	if pkg.BinaryOnly {
+		logging.Warnf(logging.At{File: pkg.Dir}, "%s: skipping binary-only package: its sources can't be compiled", pkg.Dir)
+		return rules
+	}
 
 	cgoLibrary, r := g.generateCgoLib(rel, pkg)
 	if r != nil {
@@ -128,19 +295,36 @@ func (g *generator) Generate(rel string, pkg *packages.Package) []*bzl.Rule {
 		rules = append(rules, r)
 	}
 
-	if r := g.filegroup(rel, pkg); r != nil {
+	hasTestdata := len(pkg.Testdata) > 0
+
+	if r := g.generateTest(rel, pkg, pkg.Test, library, hasTestdata, ""); r != nil {
 		rules = append(rules, r)
 	}
 
-	testdataPath := filepath.Join(g.repoRoot, rel, "testdata")
-	st, err := os.Stat(testdataPath)
-	hasTestdata := err == nil && st.IsDir()
+	if r := g.generateXTest(rel, pkg, pkg.XTest, library, hasTestdata, ""); r != nil {
+		rules = append(rules, r)
+	}
 
-	if r := g.generateTest(rel, pkg, library, hasTestdata); r != nil {
+	var suites []string
+	for tag := range pkg.TestSuites {
+		suites = append(suites, tag)
+	}
+	sort.Strings(suites)
+	for _, tag := range suites {
+		s := pkg.TestSuites[tag]
+		if r := g.generateTest(rel, pkg, s.Test, library, hasTestdata, tag); r != nil {
+			rules = append(rules, r)
+		}
+		if r := g.generateXTest(rel, pkg, s.XTest, library, hasTestdata, tag); r != nil {
+			rules = append(rules, r)
+		}
+	}
+
+	if r := g.swigFilegroup(pkg); r != nil {
 		rules = append(rules, r)
 	}
 
-	if r := g.generateXTest(rel, pkg, library, hasTestdata); r != nil {
+	if r := g.toolSrcsFilegroup(pkg); r != nil {
 		rules = append(rules, r)
 	}
 
@@ -148,12 +332,12 @@ func (g *generator) Generate(rel string, pkg *packages.Package) []*bzl.Rule {
 }
 
 func (g *generator) generateBin(rel string, pkg *packages.Package, library string) *bzl.Rule {
-	if !pkg.IsCommand() || pkg.Binary.Sources.IsEmpty() && library == "" {
+	if !pkg.IsCommand() || !pkg.HasMain || pkg.Binary.Sources.IsEmpty() && library == "" {
 		return nil
 	}
-	name := filepath.Base(pkg.Dir)
+	name := ruleName(pkg, filepath.Base(pkg.Dir))
 	visibility := checkInternalVisibility(rel, "//visibility:public")
-	return g.generateRule(rel, "go_binary", name, visibility, library, false, pkg.Binary)
+	return g.generateRule(rel, pkg, "go_binary", name, visibility, library, false, pkg.Binary)
 }
 
 func (g *generator) generateLib(rel string, pkg *packages.Package, cgoName string) (string, *bzl.Rule) {
@@ -161,30 +345,78 @@ func (g *generator) generateLib(rel string, pkg *packages.Package, cgoName strin
 		return "", nil
 	}
 
-	name := defaultLibName
+	name := ruleName(pkg, defaultLibName)
 	var visibility string
 	if pkg.IsCommand() {
 		// Libraries made for a go_binary should not be exposed to the public.
 		visibility = "//visibility:private"
+	} else if pkg.Vendored {
+		visibility = checkInternalVisibility(rel, vendorVisibility(rel))
 	} else {
 		visibility = checkInternalVisibility(rel, "//visibility:public")
 	}
 
-	rule := g.generateRule(rel, "go_library", name, visibility, cgoName, false, pkg.Library)
+	rule := g.generateRule(rel, pkg, "go_library", name, visibility, cgoName, false, pkg.Library)
+	var importpath string
+	if pkg.Vendored || pkg.PrefixRoot != nil {
+		importpath = pkg.ImportPath
+	} else if importpath = g.moduleImportPath(rel); importpath == "" {
+		importpath = path.Join(g.goPrefix, rel)
+	}
+	// Like the go command, ignore import comments in vendored packages.
+	if pkg.ImportComment != "" && pkg.ImportComment != importpath && !pkg.Vendored {
+		if UseImportComments {
+			importpath = pkg.ImportComment
+		} else {
+			logging.Warnf(logging.At{File: pkg.Dir, Rule: name}, "%s: import comment %q does not match import path %q", pkg.Dir, pkg.ImportComment, importpath)
+		}
+	}
+	if pkg.Vendored || importpath != path.Join(g.goPrefix, rel) {
+		rule.SetAttr("importpath", &bzl.StringExpr{Value: importpath})
+	}
+	if PackageDocComments && pkg.Synopsis != "" {
+		rule.Call.Comments.Before = []bzl.Comment{{Token: "# " + pkg.Synopsis}}
+	}
 	return name, rule
 }
 
+// moduleImportPath returns the import path of the package in "rel" if the
+// package is part of a workspace module and its import path differs from
+// the one implied by go_prefix. Otherwise, "" is returned.
+func (g *generator) moduleImportPath(rel string) string {
+	m, ok := packages.FindModule(g.modules, rel)
+	if !ok {
+		return ""
+	}
+	importpath := m.ImportPath(rel)
+	if importpath == path.Join(g.goPrefix, rel) {
+		return ""
+	}
+	return importpath
+}
+
 func (g *generator) generateCgoLib(rel string, pkg *packages.Package) (string, *bzl.Rule) {
 	if !pkg.CgoLibrary.HasGo() {
 		return "", nil
 	}
 
-	name := defaultCgoLibName
+	name := ruleName(pkg, defaultCgoLibName)
 	visibility := "//visibility:private"
-	rule := g.generateRule(rel, "cgo_library", name, visibility, "", false, pkg.CgoLibrary)
+	rule := g.generateRule(rel, pkg, "cgo_library", name, visibility, "", false, pkg.CgoLibrary)
 	return name, rule
 }
 
+// vendorVisibility returns the visibility of a vendored package in "rel".
+// Like the go tool, this allows the package to be imported from the tree
+// rooted at the parent of the innermost vendor directory.
+func vendorVisibility(rel string) string {
+	parent := ""
+	if i := strings.LastIndex(rel, "/vendor/"); i >= 0 {
+		parent = rel[:i]
+	}
+	return fmt.Sprintf("//%s:__subpackages__", parent)
+}
+
 // checkInternalVisibility overrides the given visibility if the package is
 // internal.
 func checkInternalVisibility(rel, visibility string) string {
@@ -210,50 +442,116 @@ func (g *generator) filegroup(rel string, pkg *packages.Package) *bzl.Rule {
 	})
 }
 
-func (g *generator) generateTest(rel string, pkg *packages.Package, library string, hasTestdata bool) *bzl.Rule {
-	if !pkg.Test.HasGo() {
+// swigFilegroup creates a filegroup for SWIG interface files in "pkg". SWIG
+// isn't supported by Go rules, so the files can't be added to a library,
+// but listing them keeps them visible to the build and to other rules.
+func (g *generator) swigFilegroup(pkg *packages.Package) *bzl.Rule {
+	if !pkg.RequiresSwig() || pkg.Extra {
+		return nil
+	}
+	return newRule("filegroup", nil, []keyvalue{
+		{key: "name", value: defaultSwigName},
+		{key: "srcs", value: pkg.Swig},
+		{key: "visibility", value: []string{"//visibility:public"}},
+	})
+}
+
+// toolSrcsFilegroup creates a filegroup for .go files in "pkg" that are
+// excluded from builds by "+build ignore" comments, if ToolSrcsFilegroup is
+// set. These are usually programs run by "go generate".
+func (g *generator) toolSrcsFilegroup(pkg *packages.Package) *bzl.Rule {
+	if !ToolSrcsFilegroup || len(pkg.ToolSrcs) == 0 || pkg.Extra {
+		return nil
+	}
+	return newRule("filegroup", nil, []keyvalue{
+		{key: "name", value: defaultToolSrcsName},
+		{key: "srcs", value: pkg.ToolSrcs},
+		{key: "visibility", value: []string{"//visibility:public"}},
+	})
+}
+
+// generateTest generates a go_test rule for internal tests. If "suite" is
+// not empty, the test only contains files built with that tag, and its name
+// ends with the tag.
+func (g *generator) generateTest(rel string, pkg *packages.Package, test packages.Target, library string, hasTestdata bool, suite string) *bzl.Rule {
+	if !test.HasGo() {
 		return nil
 	}
 
 	var name string
-	if library == "" || library == defaultLibName {
-		name = defaultTestName
+	if library == "" || library == ruleName(pkg, defaultLibName) {
+		name = ruleName(pkg, defaultTestName)
 	} else {
 		name = library + "_test"
 	}
 
-	return g.generateRule(rel, "go_test", name, "", library, hasTestdata, pkg.Test)
+	return suiteRule(g.generateRule(rel, pkg, "go_test", suiteName(name, suite), "", library, hasTestdata, test), suite)
 }
 
-func (g *generator) generateXTest(rel string, pkg *packages.Package, library string, hasTestdata bool) *bzl.Rule {
-	if !pkg.XTest.HasGo() {
+// generateXTest generates a go_test rule for external tests. "suite" is
+// treated the same way as in generateTest.
+func (g *generator) generateXTest(rel string, pkg *packages.Package, xtest packages.Target, library string, hasTestdata bool, suite string) *bzl.Rule {
+	if !xtest.HasGo() {
 		return nil
 	}
 
 	var name string
-	if library == "" || library == defaultLibName {
-		name = defaultXTestName
+	if library == "" || library == ruleName(pkg, defaultLibName) {
+		name = ruleName(pkg, defaultXTestName)
 	} else {
 		name = library + "_xtest"
 	}
 
-	return g.generateRule(rel, "go_test", name, "", "", hasTestdata, pkg.XTest)
+	return suiteRule(g.generateRule(rel, pkg, "go_test", suiteName(name, suite), "", "", hasTestdata, xtest), suite)
+}
+
+// ruleName returns the name of a rule for "pkg". Rules for extra packages
+// (see packages.Config.EmitAllPackages) are prefixed with the package name, so they
+// don't collide with rules for the default package in the same directory.
+func ruleName(pkg *packages.Package, name string) string {
+	if pkg.Extra {
+		return pkg.Name + "_" + name
+	}
+	return name
+}
+
+// suiteName returns the name of a test rule in the suite selected by "tag".
+func suiteName(name, tag string) string {
+	if tag == "" {
+		return name
+	}
+	return name + "_" + tag
+}
+
+// suiteRule sets attributes on a test rule in the suite selected by
+// "tag". gotags makes the rule compile the files that need the tag, and
+// tags lets the suite be selected with --test_tag_filters.
+func suiteRule(r *bzl.Rule, tag string) *bzl.Rule {
+	if tag == "" {
+		return r
+	}
+	r.SetAttr("gotags", &bzl.ListExpr{List: []bzl.Expr{&bzl.StringExpr{Value: tag}}})
+	r.SetAttr("tags", &bzl.ListExpr{List: []bzl.Expr{&bzl.StringExpr{Value: tag}}})
+	return r
 }
 
-func (g *generator) generateRule(rel, kind, name, visibility, library string, hasTestdata bool, target packages.Target) *bzl.Rule {
+func (g *generator) generateRule(rel string, pkg *packages.Package, kind, name, visibility, library string, hasTestdata bool, target packages.Target) *bzl.Rule {
 	// Construct attrs in the same order that bzl.Rewrite uses. See
 	// namePriority in github.com/bazelbuild/buildtools/build/rewrite.go.
 	attrs := []keyvalue{
 		{"name", name},
 	}
 	if !target.Sources.IsEmpty() {
-		attrs = append(attrs, keyvalue{"srcs", target.Sources})
+		attrs = append(attrs, keyvalue{"srcs", srcsValue(g.fs, pkg, target.Sources)})
+	}
+	if !target.PkgConfigs.IsEmpty() {
+		attrs = append(attrs, keyvalue{"cdeps", pkgConfigDeps(target.PkgConfigs, rel)})
 	}
 	if !target.CLinkOpts.IsEmpty() {
 		attrs = append(attrs, keyvalue{"clinkopts", target.CLinkOpts})
 	}
-	if !target.COpts.IsEmpty() {
-		attrs = append(attrs, keyvalue{"copts", target.COpts})
+	if copts := target.CgoOpts(); !copts.IsEmpty() {
+		attrs = append(attrs, keyvalue{"copts", copts})
 	}
 	if hasTestdata {
 		glob := globvalue{patterns: []string{"testdata/**"}}
@@ -283,7 +581,29 @@ func (g *generator) dependencies(imports packages.PlatformStrings, dir string) p
 
 	deps, errors := imports.Map(resolve)
 	for _, err := range errors {
-		log.Print(err)
+		logging.Warnf(logging.At{File: dir}, "%v", err)
+	}
+	deps.Clean()
+	return deps
+}
+
+// pkgConfigDeps maps pkg-config package names to labels using
+// PkgConfigLabels. Names without a label are logged once and dropped.
+func pkgConfigDeps(names packages.PlatformStrings, dir string) packages.PlatformStrings {
+	lookup := func(name string) (string, error) {
+		if l, ok := PkgConfigLabels[name]; ok {
+			return l, nil
+		}
+		return "", fmt.Errorf("in dir %q, no label for pkg-config package %q; map it with a pkg_config directive", dir, name)
+	}
+
+	deps, errors := names.Map(lookup)
+	reported := make(map[string]bool)
+	for _, err := range errors {
+		if msg := err.Error(); !reported[msg] {
+			reported[msg] = true
+			logging.Warnf(logging.At{File: dir}, "%v", err)
+		}
 	}
 	deps.Clean()
 	return deps
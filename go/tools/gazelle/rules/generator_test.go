@@ -17,7 +17,9 @@ package rules_test
 
 import (
 	"io/ioutil"
+	"os"
 	"path/filepath"
+	"reflect"
 	"testing"
 
 	bzl "github.com/bazelbuild/buildtools/build"
@@ -38,13 +40,13 @@ func packageFromDir(t *testing.T, dir, repoRoot, goPrefix string) *packages.Pack
 	buildTags := map[string]bool{}
 	platforms := packages.DefaultPlatformConstraints
 	packages.PreprocessTags(buildTags, platforms)
-	return packages.FindPackage(dir, buildTags, platforms, repoRoot, goPrefix)
+	return packages.FindPackage(packages.NewConfig(), dir, buildTags, platforms, repoRoot, goPrefix)
 }
 
 func TestGenerator(t *testing.T) {
 	repoRoot := filepath.Join(testdata.Dir(), "repo")
 	goPrefix := "example.com/repo"
-	g := rules.NewGenerator(repoRoot, goPrefix, rules.External)
+	g := rules.NewGenerator(packages.NewConfig(), repoRoot, goPrefix, rules.External)
 	for _, rel := range []string{
 		"allcgolib",
 		"bin",
@@ -78,7 +80,7 @@ func TestGenerator(t *testing.T) {
 func TestGeneratorGoPrefix(t *testing.T) {
 	repoRoot := filepath.Join(testdata.Dir(), "repo")
 	goPrefix := "example.com/repo/lib"
-	g := rules.NewGenerator(repoRoot, goPrefix, rules.External)
+	g := rules.NewGenerator(packages.NewConfig(), repoRoot, goPrefix, rules.External)
 	dir := filepath.Join(repoRoot, "lib")
 	pkg := packageFromDir(t, dir, repoRoot, goPrefix)
 	rules := g.Generate("", pkg)
@@ -93,3 +95,167 @@ func TestGeneratorGoPrefix(t *testing.T) {
 		t.Errorf("r = %q; want %q", got, want)
 	}
 }
+
+func TestGeneratorLanguages(t *testing.T) {
+	defer func(old map[string]bool) { rules.Languages = old }(rules.Languages)
+
+	repoRoot := filepath.Join(testdata.Dir(), "repo")
+	goPrefix := "example.com/repo"
+	g := rules.NewGenerator(packages.NewConfig(), repoRoot, goPrefix, rules.External)
+	pkg := packageFromDir(t, filepath.Join(repoRoot, "lib"), repoRoot, goPrefix)
+	pkg.HasPbGo = true
+	pkg.Protos = []string{"lib.proto"}
+
+	for _, tc := range []struct {
+		desc  string
+		langs map[string]bool
+		kinds []string
+	}{
+		{
+			desc:  "go",
+			langs: map[string]bool{rules.GoLang: true},
+			kinds: []string{"go_prefix", "go_library", "go_test", "go_test"},
+		}, {
+			desc:  "proto",
+			langs: map[string]bool{rules.ProtoLang: true},
+			kinds: []string{"filegroup"},
+		},
+	} {
+		rules.Languages = tc.langs
+		var kinds []string
+		for _, r := range g.Generate("", pkg) {
+			kinds = append(kinds, r.Kind())
+		}
+		if !reflect.DeepEqual(kinds, tc.kinds) {
+			t.Errorf("%s: got kinds %q; want %q", tc.desc, kinds, tc.kinds)
+		}
+	}
+}
+
+func TestGeneratorTestOnly(t *testing.T) {
+	defer func() { rules.TestOnly = false }()
+	rules.TestOnly = true
+
+	repoRoot := filepath.Join(testdata.Dir(), "repo")
+	goPrefix := "example.com/repo"
+	g := rules.NewGenerator(packages.NewConfig(), repoRoot, goPrefix, rules.External)
+	pkg := packageFromDir(t, filepath.Join(repoRoot, "lib"), repoRoot, goPrefix)
+
+	for _, r := range g.Generate("", pkg) {
+		got := r.AttrLiteral("testonly")
+		want := "True"
+		if r.Kind() == "go_test" || r.Kind() == "go_prefix" {
+			want = ""
+		}
+		if got != want {
+			t.Errorf("%s %s: got testonly %q; want %q", r.Kind(), r.Name(), got, want)
+		}
+	}
+}
+
+func TestGeneratorImportComment(t *testing.T) {
+	defer func() { rules.UseImportComments = false }()
+
+	repoRoot, err := ioutil.TempDir(os.Getenv("TEST_TMPDIR"), "import_comment")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(repoRoot)
+	dir := filepath.Join(repoRoot, "foo")
+	if err := os.Mkdir(dir, 0777); err != nil {
+		t.Fatal(err)
+	}
+	src := []byte("package foo // import \"example.com/canonical/foo\"\n")
+	if err := ioutil.WriteFile(filepath.Join(dir, "foo.go"), src, 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	goPrefix := "example.com/repo"
+	for _, tc := range []struct {
+		use  bool
+		want string
+	}{
+		{use: false, want: ""},
+		{use: true, want: "example.com/canonical/foo"},
+	} {
+		rules.UseImportComments = tc.use
+		g := rules.NewGenerator(packages.NewConfig(), repoRoot, goPrefix, rules.External)
+		pkg := packageFromDir(t, dir, repoRoot, goPrefix)
+		if pkg.ImportComment != "example.com/canonical/foo" {
+			t.Fatalf("got import comment %q; want %q", pkg.ImportComment, "example.com/canonical/foo")
+		}
+		for _, r := range g.Generate("foo", pkg) {
+			if r.Kind() != "go_library" {
+				continue
+			}
+			if got := r.AttrString("importpath"); got != tc.want {
+				t.Errorf("UseImportComments=%v: got importpath %q; want %q", tc.use, got, tc.want)
+			}
+		}
+	}
+}
+
+func TestGeneratorPackageDocComments(t *testing.T) {
+	defer func() { rules.PackageDocComments = false }()
+
+	repoRoot, err := ioutil.TempDir(os.Getenv("TEST_TMPDIR"), "package_doc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(repoRoot)
+	dir := filepath.Join(repoRoot, "foo")
+	if err := os.Mkdir(dir, 0777); err != nil {
+		t.Fatal(err)
+	}
+	src := []byte("// Package foo does things.\n// It does them well.\npackage foo\n")
+	if err := ioutil.WriteFile(filepath.Join(dir, "foo.go"), src, 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	goPrefix := "example.com/repo"
+	for _, tc := range []struct {
+		use  bool
+		want []bzl.Comment
+	}{
+		{use: false, want: nil},
+		{use: true, want: []bzl.Comment{{Token: "# Package foo does things."}}},
+	} {
+		rules.PackageDocComments = tc.use
+		g := rules.NewGenerator(packages.NewConfig(), repoRoot, goPrefix, rules.External)
+		pkg := packageFromDir(t, dir, repoRoot, goPrefix)
+		for _, r := range g.Generate("foo", pkg) {
+			if r.Kind() != "go_library" {
+				continue
+			}
+			if got := r.Call.Comments.Before; !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("PackageDocComments=%v: got comments %#v; want %#v", tc.use, got, tc.want)
+			}
+		}
+	}
+}
+
+func TestGeneratorBinaryOnly(t *testing.T) {
+	repoRoot, err := ioutil.TempDir(os.Getenv("TEST_TMPDIR"), "binary_only")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(repoRoot)
+	dir := filepath.Join(repoRoot, "foo")
+	if err := os.Mkdir(dir, 0777); err != nil {
+		t.Fatal(err)
+	}
+	src := []byte("//go:binary-only-package\n\npackage foo\n")
+	if err := ioutil.WriteFile(filepath.Join(dir, "foo.go"), src, 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	goPrefix := "example.com/repo"
+	g := rules.NewGenerator(packages.NewConfig(), repoRoot, goPrefix, rules.External)
+	pkg := packageFromDir(t, dir, repoRoot, goPrefix)
+	if !pkg.BinaryOnly {
+		t.Fatalf("got BinaryOnly false; want true")
+	}
+	if rs := g.Generate("foo", pkg); len(rs) > 0 {
+		t.Errorf("got %d rules; want none", len(rs))
+	}
+}
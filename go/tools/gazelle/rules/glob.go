@@ -0,0 +1,108 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package rules
+
+import (
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/bazelbuild/rules_go/go/tools/gazelle/packages"
+)
+
+// globSources is the value of a srcs attribute in the glob style: a glob
+// call for sources built on all platforms, followed by a select call for
+// platform-specific sources.
+type globSources struct {
+	glob     globvalue
+	platform map[string][]string
+}
+
+// srcsValue returns the value of the srcs attribute for a target with
+// "sources" in "pkg". This is "sources" itself unless the package uses
+// packages.SrcsStyleGlob. The files in the package's directory are listed
+// from "fs".
+func srcsValue(fs packages.FileSystem, pkg *packages.Package, sources packages.PlatformStrings) interface{} {
+	if pkg.SrcsStyle != packages.SrcsStyleGlob || len(sources.Generic) == 0 {
+		return sources
+	}
+	files, err := fs.ReadDir(pkg.Dir)
+	if err != nil {
+		return sources
+	}
+	var names []string
+	for _, f := range files {
+		if !f.IsDir() {
+			names = append(names, f.Name())
+		}
+	}
+	return globSources{
+		glob:     srcsGlob(sources.Generic, names),
+		platform: sources.Platform,
+	}
+}
+
+// srcsGlob returns a glob that matches exactly the files "srcs" among
+// "files", the names of the files in their directory. There is one pattern
+// for each extension in "srcs". Test sources are matched with "*_test.go",
+// and excluded with that pattern from globs for other Go sources. Other
+// files matching the patterns are excluded by name.
+func srcsGlob(srcs, files []string) globvalue {
+	isSrc := make(map[string]bool)
+	hasTests, hasNonTests := false, false
+	for _, src := range srcs {
+		isSrc[src] = true
+		if strings.HasSuffix(src, "_test.go") {
+			hasTests = true
+		} else if filepath.Ext(src) == ".go" {
+			hasNonTests = true
+		}
+	}
+
+	patternSet := make(map[string]bool)
+	for _, src := range srcs {
+		if hasTests && !hasNonTests && strings.HasSuffix(src, "_test.go") {
+			patternSet["*_test.go"] = true
+		} else {
+			patternSet["*"+filepath.Ext(src)] = true
+		}
+	}
+	var g globvalue
+	for p := range patternSet {
+		g.patterns = append(g.patterns, p)
+	}
+	sort.Strings(g.patterns)
+
+	excludeTests := hasNonTests && !hasTests
+	if excludeTests {
+		g.excludes = append(g.excludes, "*_test.go")
+	}
+	var names []string
+	for _, name := range files {
+		if isSrc[name] || excludeTests && strings.HasSuffix(name, "_test.go") {
+			continue
+		}
+		for _, p := range g.patterns {
+			if ok, _ := filepath.Match(p, name); ok {
+				names = append(names, name)
+				break
+			}
+		}
+	}
+	sort.Strings(names)
+	g.excludes = append(g.excludes, names...)
+	return g
+}
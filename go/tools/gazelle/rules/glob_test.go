@@ -0,0 +1,66 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package rules
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSrcsGlob(t *testing.T) {
+	files := []string{
+		"a.go",
+		"a_test.go",
+		"asm_amd64.s",
+		"b_linux.go",
+		"b_test.go",
+		"c.go",
+		"gen.s",
+		"x_test.go",
+	}
+	for _, tc := range []struct {
+		desc string
+		srcs []string
+		want globvalue
+	}{
+		{
+			desc: "library",
+			srcs: []string{"a.go", "c.go", "gen.s"},
+			want: globvalue{
+				patterns: []string{"*.go", "*.s"},
+				excludes: []string{"*_test.go", "asm_amd64.s", "b_linux.go"},
+			},
+		}, {
+			desc: "test",
+			srcs: []string{"a_test.go", "b_test.go"},
+			want: globvalue{
+				patterns: []string{"*_test.go"},
+				excludes: []string{"x_test.go"},
+			},
+		}, {
+			desc: "mixed",
+			srcs: []string{"a.go", "a_test.go", "b_test.go", "c.go", "x_test.go"},
+			want: globvalue{
+				patterns: []string{"*.go"},
+				excludes: []string{"b_linux.go"},
+			},
+		},
+	} {
+		if got := srcsGlob(tc.srcs, files); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: got %#v; want %#v", tc.desc, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,61 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package rules
+
+import (
+	"path"
+	"strings"
+)
+
+// KnownImports maps import path prefixes outside the go_prefix to the
+// repositories or packages that provide them, like "@io_k8s_api" or
+// "//third_party/k8s/api". A value may also name a package in another
+// repository, like "@io_k8s_api//core". Packages under a prefix are
+// resolved to labels below the mapped repository or package instead of
+// guessing repository names from import paths. LocalOverrides take
+// precedence.
+var KnownImports = map[string]string{}
+
+// resolveKnownImport resolves "importpath" with the entry in KnownImports
+// for the longest prefix of "importpath". false is returned if no prefix
+// matches. Prefixes only match whole path components.
+func resolveKnownImport(importpath string) (label, bool) {
+	var prefix, to string
+	for p, t := range KnownImports {
+		if importpath != p && !strings.HasPrefix(importpath, p+"/") {
+			continue
+		}
+		if to == "" || len(p) > len(prefix) {
+			prefix, to = p, t
+		}
+	}
+	if to == "" {
+		return label{}, false
+	}
+
+	var repo, pkg string
+	if strings.HasPrefix(to, "@") {
+		repo = strings.TrimPrefix(to, "@")
+		if i := strings.Index(repo, "//"); i >= 0 {
+			repo, pkg = repo[:i], repo[i:]
+		}
+	} else {
+		pkg = to
+	}
+	rest := strings.TrimPrefix(strings.TrimPrefix(importpath, prefix), "/")
+	pkg = path.Join(strings.TrimPrefix(pkg, "//"), rest)
+	return label{repo: repo, pkg: pkg, name: defaultLibName}, true
+}
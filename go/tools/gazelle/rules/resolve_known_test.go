@@ -0,0 +1,52 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package rules
+
+import "testing"
+
+func TestResolveKnownImport(t *testing.T) {
+	KnownImports = map[string]string{
+		"k8s.io/api":            "@io_k8s_api",
+		"k8s.io/api/core":       "@io_k8s_api//core/v1",
+		"example.com/vendored":  "//third_party/vendored",
+		"example.com/other/lib": "@other",
+	}
+	defer func() { KnownImports = map[string]string{} }()
+
+	for _, spec := range []struct {
+		importpath string
+		want       string
+		ok         bool
+	}{
+		{importpath: "k8s.io/api", want: "@io_k8s_api//:go_default_library", ok: true},
+		{importpath: "k8s.io/api/apps/v1", want: "@io_k8s_api//apps/v1:go_default_library", ok: true},
+		{importpath: "k8s.io/api/core", want: "@io_k8s_api//core/v1:go_default_library", ok: true},
+		{importpath: "k8s.io/api/core/x", want: "@io_k8s_api//core/v1/x:go_default_library", ok: true},
+		{importpath: "example.com/vendored/a", want: "//third_party/vendored/a:go_default_library", ok: true},
+		{importpath: "example.com/other/lib", want: "@other//:go_default_library", ok: true},
+		{importpath: "k8s.io/apimachinery"},
+		{importpath: "example.com/other"},
+	} {
+		l, ok := resolveKnownImport(spec.importpath)
+		if ok != spec.ok {
+			t.Errorf("resolveKnownImport(%q) ok = %v; want %v", spec.importpath, ok, spec.ok)
+			continue
+		}
+		if ok && l.String() != spec.want {
+			t.Errorf("resolveKnownImport(%q) = %s; want %s", spec.importpath, l, spec.want)
+		}
+	}
+}
@@ -0,0 +1,52 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package rules
+
+import "strings"
+
+// LocalOverrides maps import path prefixes to the names of repositories that
+// provide them, overriding the usual resolution. This is meant for working
+// on a fork of a dependency: the user declares a local_repository pointing
+// at the local checkout, and imports under the prefix are resolved to
+// labels in that repository.
+var LocalOverrides = map[string]string{}
+
+// resolveLocalOverride resolves "importpath" into a label in the repository
+// named in LocalOverrides for the longest prefix of "importpath". false is
+// returned if no prefix matches.
+func resolveLocalOverride(importpath string) (label, bool) {
+	prefix, repo, ok := FindLocalOverride(importpath)
+	if !ok {
+		return label{}, false
+	}
+	pkg := strings.TrimPrefix(strings.TrimPrefix(importpath, prefix), "/")
+	return label{repo: repo, pkg: pkg, name: defaultLibName}, true
+}
+
+// FindLocalOverride returns the longest prefix of "importpath" in
+// LocalOverrides and the name of the repository it maps to. Prefixes only
+// match whole path components.
+func FindLocalOverride(importpath string) (prefix, repo string, ok bool) {
+	for p, r := range LocalOverrides {
+		if importpath != p && !strings.HasPrefix(importpath, p+"/") {
+			continue
+		}
+		if !ok || len(p) > len(prefix) {
+			prefix, repo, ok = p, r, true
+		}
+	}
+	return prefix, repo, ok
+}
@@ -0,0 +1,47 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package rules
+
+import "testing"
+
+func TestResolveLocalOverride(t *testing.T) {
+	LocalOverrides = map[string]string{
+		"github.com/foo/bar":     "bar_fork",
+		"github.com/foo/bar/sub": "sub_fork",
+	}
+	defer func() { LocalOverrides = map[string]string{} }()
+
+	for _, spec := range []struct {
+		importpath string
+		want       string
+		ok         bool
+	}{
+		{importpath: "github.com/foo/bar", want: "@bar_fork//:go_default_library", ok: true},
+		{importpath: "github.com/foo/bar/baz", want: "@bar_fork//baz:go_default_library", ok: true},
+		{importpath: "github.com/foo/bar/sub/x", want: "@sub_fork//x:go_default_library", ok: true},
+		{importpath: "github.com/foo/barn"},
+		{importpath: "github.com/foo"},
+	} {
+		l, ok := resolveLocalOverride(spec.importpath)
+		if ok != spec.ok {
+			t.Errorf("resolveLocalOverride(%q) ok = %v; want %v", spec.importpath, ok, spec.ok)
+			continue
+		}
+		if ok && l.String() != spec.want {
+			t.Errorf("resolveLocalOverride(%q) = %s; want %s", spec.importpath, l, spec.want)
+		}
+	}
+}
@@ -19,6 +19,8 @@ import (
 	"fmt"
 	"path"
 	"strings"
+
+	"github.com/bazelbuild/rules_go/go/tools/gazelle/packages"
 )
 
 // structuredResolver resolves go_library labels within the same repository as
@@ -48,3 +50,68 @@ func (r structuredResolver) resolve(importpath, dir string) (label, error) {
 
 	return label{}, fmt.Errorf("importpath %q does not start with goPrefix %q", importpath, r.goPrefix)
 }
+
+// workspaceResolver resolves importpaths in modules listed in a go.work file
+// or in directories with prefix directives into labels within the current
+// repository.
+type workspaceResolver struct {
+	modules []packages.ModuleRoot
+
+	// importPaths maps the import comments of packages in the repository to
+	// the directories of the packages. See addImportPath.
+	importPaths map[string]string
+}
+
+// addImportPath records that the package in the directory "rel" has the
+// import comment "importpath", so imports of exactly that path resolve to
+// the package.
+func (r *workspaceResolver) addImportPath(importpath, rel string) {
+	if r.importPaths == nil {
+		r.importPaths = make(map[string]string)
+	}
+	r.importPaths[importpath] = rel
+}
+
+// addModule adds "m" to the modules r resolves, if it is not there yet.
+func (r *workspaceResolver) addModule(m packages.ModuleRoot) {
+	for _, old := range r.modules {
+		if old == m {
+			return
+		}
+	}
+	r.modules = append(r.modules, m)
+}
+
+// resolveModule resolves "importpath" if it is the import comment of a
+// package added with addImportPath or belongs to one of the workspace
+// modules. If more than one module path is a prefix of "importpath", the
+// longest one is used. false is returned if nothing matches.
+func (r workspaceResolver) resolveModule(importpath, dir string) (label, bool) {
+	if pkg, ok := r.importPaths[importpath]; ok {
+		if pkg == dir {
+			return label{name: defaultLibName, relative: true}, true
+		}
+		return label{pkg: pkg, name: defaultLibName}, true
+	}
+
+	var found packages.ModuleRoot
+	ok := false
+	for _, m := range r.modules {
+		if importpath != m.Path && !strings.HasPrefix(importpath, m.Path+"/") {
+			continue
+		}
+		if !ok || len(m.Path) > len(found.Path) {
+			found = m
+			ok = true
+		}
+	}
+	if !ok {
+		return label{}, false
+	}
+
+	pkg := path.Join(found.Rel, strings.TrimPrefix(strings.TrimPrefix(importpath, found.Path), "/"))
+	if pkg == dir {
+		return label{name: defaultLibName, relative: true}, true
+	}
+	return label{pkg: pkg, name: defaultLibName}, true
+}
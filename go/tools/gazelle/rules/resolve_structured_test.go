@@ -18,6 +18,8 @@ package rules
 import (
 	"reflect"
 	"testing"
+
+	"github.com/bazelbuild/rules_go/go/tools/gazelle/packages"
 )
 
 func TestStructuredResolver(t *testing.T) {
@@ -89,3 +91,85 @@ func TestStructuredResolverError(t *testing.T) {
 		}
 	}
 }
+
+func TestWorkspaceResolver(t *testing.T) {
+	r := workspaceResolver{modules: []packages.ModuleRoot{
+		{Rel: "a", Path: "example.com/a"},
+		{Rel: "b", Path: "example.com/b"},
+		{Rel: "b/nested", Path: "example.com/b/nested"},
+	}}
+	for _, spec := range []struct {
+		importpath string
+		curPkg     string
+		want       label
+		ok         bool
+	}{
+		{
+			importpath: "example.com/a",
+			curPkg:     "b",
+			want:       label{pkg: "a", name: defaultLibName},
+			ok:         true,
+		},
+		{
+			importpath: "example.com/a/sub",
+			curPkg:     "a/sub",
+			want:       label{name: defaultLibName, relative: true},
+			ok:         true,
+		},
+		{
+			importpath: "example.com/b/nested/x",
+			curPkg:     "a",
+			want:       label{pkg: "b/nested/x", name: defaultLibName},
+			ok:         true,
+		},
+		{
+			importpath: "example.com/another",
+			curPkg:     "a",
+		},
+	} {
+		l, ok := r.resolveModule(spec.importpath, spec.curPkg)
+		if ok != spec.ok {
+			t.Errorf("r.resolveModule(%q) returned ok = %v; want %v", spec.importpath, ok, spec.ok)
+			continue
+		}
+		if got, want := l, spec.want; !reflect.DeepEqual(got, want) {
+			t.Errorf("r.resolveModule(%q) = %s; want %s", spec.importpath, got, want)
+		}
+	}
+}
+
+func TestWorkspaceResolverAddModule(t *testing.T) {
+	r := &workspaceResolver{}
+	if _, ok := r.resolveModule("example.com/renamed/sub", "a"); ok {
+		t.Fatalf("r.resolveModule succeeded before addModule; want failure")
+	}
+	m := packages.ModuleRoot{Rel: "other", Path: "example.com/renamed"}
+	r.addModule(m)
+	r.addModule(m)
+	if len(r.modules) != 1 {
+		t.Errorf("got %d modules after adding the same module twice; want 1", len(r.modules))
+	}
+	want := label{pkg: "other/sub", name: defaultLibName}
+	if got, ok := r.resolveModule("example.com/renamed/sub", "a"); !ok || !reflect.DeepEqual(got, want) {
+		t.Errorf("r.resolveModule = %s, %v; want %s, true", got, ok, want)
+	}
+}
+
+func TestWorkspaceResolverAddImportPath(t *testing.T) {
+	r := &workspaceResolver{}
+	r.addImportPath("example.com/canonical/foo", "foo")
+	for _, spec := range []struct {
+		importpath, curPkg string
+		want               label
+		ok                 bool
+	}{
+		{"example.com/canonical/foo", "a", label{pkg: "foo", name: defaultLibName}, true},
+		{"example.com/canonical/foo", "foo", label{name: defaultLibName, relative: true}, true},
+		{"example.com/canonical/foo/sub", "a", label{}, false},
+	} {
+		got, ok := r.resolveModule(spec.importpath, spec.curPkg)
+		if ok != spec.ok || !reflect.DeepEqual(got, spec.want) {
+			t.Errorf("r.resolveModule(%q, %q) = %s, %v; want %s, %v", spec.importpath, spec.curPkg, got, ok, spec.want, spec.ok)
+		}
+	}
+}
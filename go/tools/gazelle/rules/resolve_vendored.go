@@ -1,9 +1,34 @@
 package rules
 
+import (
+	"path"
+	"path/filepath"
+
+	"github.com/bazelbuild/rules_go/go/tools/gazelle/packages"
+)
+
 // vendoredResolver resolves external packages as packages in vendor/.
-type vendoredResolver struct{}
+// Like the go command, it looks for the package in the vendor directory of
+// the importing package's directory and of each directory above it, and
+// uses the innermost one where the package exists. If there is none, the
+// package is resolved in vendor/ at the repository root. Vendor
+// directories are looked up in "fs".
+type vendoredResolver struct {
+	repoRoot string
+	fs       packages.FileSystem
+}
 
 func (v vendoredResolver) resolve(importpath, dir string) (label, error) {
+	for d := dir; d != "" && d != "."; d = path.Dir(d) {
+		if path.Base(d) == "vendor" {
+			// Vendor directories don't have vendor directories of their own.
+			continue
+		}
+		pkg := path.Join(d, "vendor", importpath)
+		if fi, err := v.fs.Stat(filepath.Join(v.repoRoot, filepath.FromSlash(pkg))); err == nil && fi.IsDir() {
+			return label{pkg: pkg, name: defaultLibName}, nil
+		}
+	}
 	return label{
 		pkg:  "vendor/" + importpath,
 		name: defaultLibName,
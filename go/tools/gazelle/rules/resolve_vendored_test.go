@@ -0,0 +1,57 @@
+/* Copyright 2017 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package rules
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/bazelbuild/rules_go/go/tools/gazelle/packages"
+)
+
+func TestVendoredResolver(t *testing.T) {
+	repoRoot := filepath.FromSlash("/repo")
+	fs := packages.MapFileSystem{
+		filepath.Join(repoRoot, "vendor", "example.com", "a", "a.go"):                    "package a",
+		filepath.Join(repoRoot, "vendor", "example.com", "b", "b.go"):                    "package b",
+		filepath.Join(repoRoot, "cmd", "vendor", "example.com", "a", "a.go"):             "package a",
+		filepath.Join(repoRoot, "vendor", "example.com", "b", "vendor", "c", "c.go"):     "package c",
+		filepath.Join(repoRoot, "cmd", "tool", "vendor", "example.com", "d", "d.go"):     "package d",
+		filepath.Join(repoRoot, "cmd", "tool", "vendor", "example.com", "d", "sub", "x"): "",
+	}
+
+	r := vendoredResolver{repoRoot: repoRoot, fs: fs}
+	for _, tc := range []struct {
+		importpath, dir, want string
+	}{
+		{"example.com/a", "lib", "//vendor/example.com/a:go_default_library"},
+		{"example.com/a", "cmd/tool", "//cmd/vendor/example.com/a:go_default_library"},
+		{"example.com/d", "cmd/tool", "//cmd/tool/vendor/example.com/d:go_default_library"},
+		{"example.com/d", "cmd", "//vendor/example.com/d:go_default_library"},
+		{"c", "vendor/example.com/b", "//vendor/example.com/b/vendor/c:go_default_library"},
+		{"example.com/a", "vendor/example.com/b", "//vendor/example.com/a:go_default_library"},
+		{"example.com/missing", "cmd/tool", "//vendor/example.com/missing:go_default_library"},
+	} {
+		l, err := r.resolve(tc.importpath, tc.dir)
+		if err != nil {
+			t.Errorf("resolve(%q, %q) failed with %v; want success", tc.importpath, tc.dir, err)
+			continue
+		}
+		if got := l.String(); got != tc.want {
+			t.Errorf("resolve(%q, %q) = %s; want %s", tc.importpath, tc.dir, got, tc.want)
+		}
+	}
+}
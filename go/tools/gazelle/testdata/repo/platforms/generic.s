@@ -0,0 +1,4 @@
+#include "textflag.h"
+
+TEXT ·genericAsm(SB),NOSPLIT,$0
+	RET
@@ -0,0 +1,4 @@
+#include "textflag.h"
+
+TEXT ·linuxAsm(SB),NOSPLIT,$0
+	RET
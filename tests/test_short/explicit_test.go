@@ -0,0 +1,20 @@
+package test_short
+
+import (
+	"flag"
+	"testing"
+	"time"
+)
+
+func TestShort(t *testing.T) {
+	if !testing.Short() {
+		t.Error(`got -test.short=false; want true with short = "true"`)
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	timeout := flag.Lookup("test.timeout").Value.(flag.Getter).Get().(time.Duration)
+	if want := 42 * time.Second; timeout != want {
+		t.Errorf("got -test.timeout=%v; want %v", timeout, want)
+	}
+}
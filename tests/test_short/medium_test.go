@@ -0,0 +1,9 @@
+package test_short
+
+import "testing"
+
+func TestShort(t *testing.T) {
+	if testing.Short() {
+		t.Error("got -test.short=true; want false for a medium test")
+	}
+}
@@ -0,0 +1,20 @@
+package test_short
+
+import (
+	"flag"
+	"testing"
+	"time"
+)
+
+func TestShort(t *testing.T) {
+	if !testing.Short() {
+		t.Error("got -test.short=false; want true for a small test")
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	timeout := flag.Lookup("test.timeout").Value.(flag.Getter).Get().(time.Duration)
+	if timeout <= 0 || timeout >= time.Minute {
+		t.Errorf("got -test.timeout=%v; want less than the small test timeout", timeout)
+	}
+}